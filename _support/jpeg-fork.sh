@@ -0,0 +1,37 @@
+#!/bin/sh
+
+# Our copy of image/jpeg in cmd/gitlab-resize-image/jpeg must differ from
+# the image/jpeg of the Go toolchain only by the changes in stdlib.patch.
+# "check" fails if it does not, for example because a Go release changed
+# image/jpeg. "update" records our changes in stdlib.patch after we synced
+# the copy. See cmd/gitlab-resize-image/jpeg/README.md.
+
+set -e
+
+FORK=cmd/gitlab-resize-image/jpeg
+UPSTREAM="$(go env GOROOT)/src/image/jpeg"
+FILES="reader.go scan.go huffman.go dct.go writer.go"
+
+changes() {
+  for file in ${FILES}; do
+    diff -u --label "a/${file}" --label "b/${file}" "${UPSTREAM}/${file}" "${FORK}/${file}" || true
+  done
+}
+
+case "$1" in
+check)
+  if ! changes | cmp -s - "${FORK}/stdlib.patch"; then
+    echo >&2 "${FORK} is out of sync with image/jpeg of $(go version)"
+    echo >&2 "See ${FORK}/README.md for how to sync it"
+    changes | diff -u "${FORK}/stdlib.patch" - >&2 || true
+    exit 1
+  fi
+  ;;
+update)
+  changes > "${FORK}/stdlib.patch"
+  ;;
+*)
+  echo >&2 "usage: $0 check|update"
+  exit 2
+  ;;
+esac
@@ -0,0 +1,18 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns the commit the binary was built from, which Go 1.18
+// and later record when building in a git checkout
+func vcsRevision(info *debug.BuildInfo) string {
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+
+	return ""
+}
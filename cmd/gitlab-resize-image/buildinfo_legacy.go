@@ -0,0 +1,12 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns "" because Go versions before 1.18 do not record the
+// commit the binary was built from
+func vcsRevision(info *debug.BuildInfo) string {
+	return ""
+}
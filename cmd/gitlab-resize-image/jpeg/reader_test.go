@@ -0,0 +1,152 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const jpegFixture = "../../../testdata/image.jpg"
+
+// fixtures are JPEGs with one and three components, in 4:4:4 and 4:2:0
+func fixtures(t *testing.T) map[string][]byte {
+	photo, err := ioutil.ReadFile(jpegFixture)
+	require.NoError(t, err)
+
+	gradient := image.NewRGBA(image.Rect(0, 0, 203, 77))
+	gray := image.NewGray(gradient.Bounds())
+	for y := 0; y < 77; y++ {
+		for x := 0; x < 203; x++ {
+			gradient.Set(x, y, color.RGBA{R: uint8(x), G: uint8(3 * y), B: uint8(x ^ y), A: 0xff})
+			gray.SetGray(x, y, color.Gray{Y: uint8(x + y)})
+		}
+	}
+
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, stdjpeg.Encode(&buf, img, &stdjpeg.Options{Quality: 90}))
+		return buf.Bytes()
+	}
+
+	return map[string][]byte{
+		"photo 4:4:4": photo,
+		"color 4:2:0": encode(gradient),
+		"gray":        encode(gray),
+	}
+}
+
+func TestDecodeMatchesStandardLibrary(t *testing.T) {
+	for desc, data := range fixtures(t) {
+		t.Run(desc, func(t *testing.T) {
+			expected, err := stdjpeg.Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+
+			img, err := Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, expected.Bounds(), img.Bounds())
+			require.Equal(t, expected.ColorModel(), img.ColorModel())
+
+			// The inverse DCT of the standard library has changed between Go
+			// versions, so we allow for rounding differences
+			bounds := img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					requireSimilar(t, expected.At(x, y), img.At(x, y), 4)
+				}
+			}
+
+			cfg, err := DecodeConfig(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, bounds.Dx(), cfg.Width)
+			require.Equal(t, bounds.Dy(), cfg.Height)
+		})
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	for desc, data := range fixtures(t) {
+		full, err := Decode(bytes.NewReader(data))
+		require.NoError(t, err)
+		bounds := full.Bounds()
+
+		for _, n := range []int{1, 2, 4, 8} {
+			var seen image.Config
+			img, err := DecodeScaled(bytes.NewReader(data), func(cfg image.Config) int {
+				seen = cfg
+				return n
+			})
+			require.NoError(t, err, "%s at 1/%d", desc, n)
+
+			require.Equal(t, bounds.Dx(), seen.Width, desc)
+			require.Equal(t, bounds.Dy(), seen.Height, desc)
+			require.Equal(t, full.ColorModel(), seen.ColorModel, desc)
+
+			expectedBounds := image.Rect(0, 0, (bounds.Dx()+n-1)/n, (bounds.Dy()+n-1)/n)
+			require.Equal(t, expectedBounds, img.Bounds(), "%s at 1/%d", desc, n)
+
+			// Each scaled pixel is the average of the n×n pixels it covers.
+			// At 1/8, it is derived from the DC coefficient instead, which
+			// differs where pixels of the block were clipped.
+			tolerance := 0
+			if n == 8 {
+				tolerance = 3
+			}
+
+			switch full := full.(type) {
+			case *image.Gray:
+				scaled := img.(*image.Gray)
+				requireAverages(t, full.Pix, full.Stride, scaled.Pix, scaled.Stride, expectedBounds, n, tolerance)
+			case *image.YCbCr:
+				scaled := img.(*image.YCbCr)
+				require.Equal(t, full.SubsampleRatio, scaled.SubsampleRatio)
+				requireAverages(t, full.Y, full.YStride, scaled.Y, scaled.YStride, expectedBounds, n, tolerance)
+			default:
+				t.Fatalf("unexpected image type %T", full)
+			}
+		}
+	}
+}
+
+func TestDecodeScaledRejectsOtherDenominators(t *testing.T) {
+	photo, err := ioutil.ReadFile(jpegFixture)
+	require.NoError(t, err)
+
+	for _, n := range []int{0, 3, 16} {
+		_, err := DecodeScaled(bytes.NewReader(photo), func(image.Config) int { return n })
+		require.Error(t, err, "1/%d", n)
+	}
+}
+
+func requireSimilar(t *testing.T, expected, actual color.Color, tolerance int) {
+	er, eg, eb, ea := expected.RGBA()
+	ar, ag, ab, aa := actual.RGBA()
+
+	for _, c := range [][2]uint32{{er, ar}, {eg, ag}, {eb, ab}, {ea, aa}} {
+		diff := int(c[0]>>8) - int(c[1]>>8)
+		if diff < -tolerance || diff > tolerance {
+			require.Equal(t, expected, actual)
+		}
+	}
+}
+
+func requireAverages(t *testing.T, full []byte, fullStride int, scaled []byte, scaledStride int, bounds image.Rectangle, n int, tolerance int) {
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			sum := 0
+			for yy := y * n; yy < (y+1)*n; yy++ {
+				for xx := x * n; xx < (x+1)*n; xx++ {
+					sum += int(full[yy*fullStride+xx])
+				}
+			}
+
+			expected := (sum + n*n/2) / (n * n)
+			actual := int(scaled[y*scaledStride+x])
+			require.InDelta(t, expected, actual, float64(tolerance), "pixel %d,%d at 1/%d", x, y, n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package jpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeProgressive(t *testing.T) {
+	images := map[string]image.Image{}
+	for desc, data := range fixtures(t) {
+		img, err := stdjpeg.Decode(bytes.NewReader(data))
+		require.NoError(t, err)
+		images[desc] = img
+	}
+
+	// The sizes are no multiples of the MCU size, so that the scans of the
+	// color components have different numbers of blocks
+	rgba := image.NewRGBA(image.Rect(0, 0, 37, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			rgba.Set(x, y, color.RGBA{R: uint8(7 * x), G: uint8(11 * y), B: uint8(x * y), A: 0xff})
+		}
+	}
+	images["rgba"] = rgba
+
+	for desc, img := range images {
+		t.Run(desc, func(t *testing.T) {
+			var baseline, progressive bytes.Buffer
+			require.NoError(t, Encode(&baseline, img, &Options{Quality: 90}))
+			require.NoError(t, Encode(&progressive, img, &Options{Quality: 90, Progressive: true}))
+
+			require.Equal(t, byte(sof0Marker), frameMarker(t, baseline.Bytes()))
+			require.Equal(t, byte(sof2Marker), frameMarker(t, progressive.Bytes()))
+
+			// Both code the same coefficients, so they decode to the same
+			// pixels
+			expected, err := stdjpeg.Decode(&baseline)
+			require.NoError(t, err)
+			actual, err := stdjpeg.Decode(&progressive)
+			require.NoError(t, err)
+			bounds := img.Bounds()
+			require.Equal(t, bounds, actual.Bounds())
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					require.Equal(t, expected.At(x, y), actual.At(x, y), "pixel %d,%d", x, y)
+				}
+			}
+		})
+	}
+}
+
+// frameMarker returns the SOFn marker of a JPEG, which tells baseline from
+// progressive images
+func frameMarker(t *testing.T, data []byte) byte {
+	for pos := 2; pos+4 <= len(data); {
+		require.Equal(t, byte(0xff), data[pos], "marker expected at %d", pos)
+		marker := data[pos+1]
+		if marker >= sof0Marker && marker <= sof2Marker {
+			return marker
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+
+	t.Fatal("no SOF marker")
+	return 0
+}
@@ -0,0 +1,131 @@
+// Package log is the leveled logger of gitlab-resize-image. It writes to
+// stderr, because stdout carries the resized image. The level is read from
+// GL_RESIZE_IMAGE_LOG_LEVEL, and defaults to info.
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+const LevelEnv = "GL_RESIZE_IMAGE_LOG_LEVEL"
+
+var levelNames = map[Level]string{
+	LevelError: "error",
+	LevelWarn:  "warn",
+	LevelInfo:  "info",
+	LevelDebug: "debug",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	prefix string
+}
+
+// New returns a logger that writes messages of level and more severe
+// levels to w. Every line starts with prefix.
+func New(w io.Writer, level Level, prefix string) *Logger {
+	return &Logger{w: w, level: level, prefix: prefix}
+}
+
+// Enabled tells whether messages of level are written. Use it to skip
+// preparing expensive messages.
+func (l *Logger) Enabled(level Level) bool {
+	return level <= l.level
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, LevelError.String(), format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, LevelWarn.String(), format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, LevelInfo.String(), format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, LevelDebug.String(), format, args...)
+}
+
+func (l *Logger) logf(level Level, label string, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s: %s: %s\n", l.prefix, label, fmt.Sprintf(format, args...))
+}
+
+var std = New(os.Stderr, levelFromEnv(os.Getenv), os.Args[0])
+
+func levelFromEnv(getenv func(string) string) Level {
+	name := getenv(LevelEnv)
+	if name == "" {
+		// DEBUG=1 used to be the only way to get debug output
+		if getenv("DEBUG") == "1" {
+			return LevelDebug
+		}
+		return LevelInfo
+	}
+
+	level, err := ParseLevel(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v, using %s\n", LevelEnv, err, level)
+	}
+
+	return level
+}
+
+// SetDefault makes the package-level functions write to l, and returns the
+// logger they wrote to before, so that tests can capture messages
+func SetDefault(l *Logger) *Logger {
+	old := std
+	std = l
+	return old
+}
+
+func Enabled(level Level) bool { return std.Enabled(level) }
+
+func Errorf(format string, args ...interface{}) { std.Errorf(format, args...) }
+func Warnf(format string, args ...interface{})  { std.Warnf(format, args...) }
+func Infof(format string, args ...interface{})  { std.Infof(format, args...) }
+func Debugf(format string, args ...interface{}) { std.Debugf(format, args...) }
+
+// Fatalf logs an error and exits with status 1
+func Fatalf(format string, args ...interface{}) {
+	std.logf(LevelError, "fatal", format, args...)
+	os.Exit(1)
+}
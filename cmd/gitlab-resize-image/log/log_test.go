@@ -0,0 +1,55 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevels(t *testing.T) {
+	testCases := []struct {
+		level    Level
+		expected string
+	}{
+		{level: LevelError, expected: "test: error: e\n"},
+		{level: LevelWarn, expected: "test: error: e\ntest: warn: w\n"},
+		{level: LevelInfo, expected: "test: error: e\ntest: warn: w\ntest: info: i\n"},
+		{level: LevelDebug, expected: "test: error: e\ntest: warn: w\ntest: info: i\ntest: debug: d\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.level.String(), func(t *testing.T) {
+			var stderr bytes.Buffer
+			l := New(&stderr, tc.level, "test")
+
+			l.Errorf("%s", "e")
+			l.Warnf("%s", "w")
+			l.Infof("%s", "i")
+			l.Debugf("%s", "d")
+
+			require.Equal(t, tc.expected, stderr.String())
+		})
+	}
+}
+
+func TestLevelFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		env      map[string]string
+		expected Level
+	}{
+		{desc: "default", env: map[string]string{}, expected: LevelInfo},
+		{desc: "warn", env: map[string]string{LevelEnv: "warn"}, expected: LevelWarn},
+		{desc: "case insensitive", env: map[string]string{LevelEnv: "DEBUG"}, expected: LevelDebug},
+		{desc: "legacy DEBUG", env: map[string]string{"DEBUG": "1"}, expected: LevelDebug},
+		{desc: "level wins over DEBUG", env: map[string]string{"DEBUG": "1", LevelEnv: "error"}, expected: LevelError},
+		{desc: "unknown level", env: map[string]string{LevelEnv: "verbose"}, expected: LevelInfo},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, levelFromEnv(func(k string) string { return tc.env[k] }))
+		})
+	}
+}
@@ -1,44 +1,526 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"image"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/disintegration/imaging"
-
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/log"
 	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/png"
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/resize"
+)
+
+const progName = "gitlab-resize-image"
+
+var Version = "unknown"
+
+var (
+	printVersion = flag.Bool("version", false, "Print version and supported formats and exit")
+	inPath       = flag.String("in", "", "Read the image from this file instead of stdin")
+	outPath      = flag.String("out", "", "Write the resized image to this file instead of stdout")
 )
 
+// envFlags are the command line flags. Each of them overrides an
+// environment variable, which is how Workhorse passes options.
+var envFlags = []struct {
+	name  string
+	env   string
+	usage string
+}{
+	{name: "width", env: "GL_RESIZE_IMAGE_WIDTH", usage: "Width of the resized image"},
+	{name: "height", env: "GL_RESIZE_IMAGE_HEIGHT", usage: "Height of the resized image"},
+	{name: "widths", env: "GL_RESIZE_IMAGE_WIDTHS", usage: "Comma-separated widths to resize to instead of width, like 16,32,64"},
+	{name: "outPattern", env: "GL_RESIZE_IMAGE_OUT_PATTERN", usage: "Files to write the widths to, with " + widthPlaceholder + " in place of the width"},
+	{name: "quality", env: "GL_RESIZE_IMAGE_QUALITY", usage: "JPEG quality, from 1 to 100"},
+	{name: "format", env: "GL_RESIZE_IMAGE_FORMAT", usage: "Format to encode the resized image in"},
+	{name: "fallbackFormat", env: "GL_RESIZE_IMAGE_FALLBACK_FORMAT", usage: "Format to encode in if the format is unknown"},
+	{name: "crop", env: "GL_RESIZE_IMAGE_CROP", usage: "Crop mode: cover or contain"},
+	{name: "filter", env: "GL_RESIZE_IMAGE_FILTER", usage: "Resampling filter: lanczos, catmullrom, linear, box or nearest"},
+	{name: "adaptiveFilterThreshold", env: "GL_RESIZE_IMAGE_ADAPTIVE_FILTER_THRESHOLD", usage: "Use the linear filter for downscales by at least this factor, like 0.9"},
+	{name: "pngCompression", env: "GL_RESIZE_IMAGE_PNG_COMPRESSION", usage: "PNG compression: default, none, speed or best"},
+	{name: "jpegProgressive", env: "GL_RESIZE_IMAGE_JPEG_PROGRESSIVE", usage: "Set to 1 to encode progressive JPEGs"},
+}
+
 func main() {
-	if err := _main(); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: fatal: %v\n", os.Args[0], err)
-		os.Exit(1)
+	getenv, err := parseFlags(flag.CommandLine, os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if err := resizeFiles(getenv, *inPath, *outPath); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit codes that tell the caller why resizing failed, without having to
+// parse our error messages. 2 is taken by the flag package. They are
+// documented in doc/operations/configuration.md; do not renumber them.
+const (
+	exitFailure           = 1
+	exitUnsupportedFormat = 3
+	exitDecode            = 4
+	exitTooLarge          = 5
+	exitTimeout           = 6
+	exitNotAnImage        = 7
+)
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, resize.ErrTimeout):
+		// Timeouts come first: a decoder that cannot read on also fails
+		return exitTimeout
+	case errors.Is(err, resize.ErrUnsupportedFormat):
+		return exitUnsupportedFormat
+	case errors.Is(err, resize.ErrTooLarge):
+		return exitTooLarge
+	case errors.Is(err, resize.ErrDecode):
+		return exitDecode
+	case errors.Is(err, resize.ErrNotAnImage):
+		return exitNotAnImage
+	default:
+		return exitFailure
 	}
 }
 
-func _main() error {
-	widthParam := os.Getenv("GL_RESIZE_IMAGE_WIDTH")
-	requestedWidth, err := strconv.Atoi(widthParam)
+// parseFlags parses args with fs, after adding envFlags to it. It returns
+// a function like getenv that returns the values of the flags that were
+// given instead of the environment variables they override.
+func parseFlags(fs *flag.FlagSet, args []string, getenv func(string) string) (func(string) string, error) {
+	for _, f := range envFlags {
+		fs.String(f.name, "", fmt.Sprintf("%s (overrides %s)", f.usage, f.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	overrides := make(map[string]string)
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range envFlags {
+			if f.name == fl.Name {
+				overrides[f.env] = fl.Value.String()
+			}
+		}
+	})
+
+	return func(key string) string {
+		if value, ok := overrides[key]; ok {
+			return value
+		}
+		return getenv(key)
+	}, nil
+}
+
+// resizeFiles runs _main on the files at inPath and outPath, or on stdin
+// and stdout if they are empty. If _main fails, we remove the output file
+// rather than leave a partial image behind.
+func resizeFiles(getenv func(string) string, inPath, outPath string) error {
+	in := os.Stdin
+	if inPath != "" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if outPath == "" {
+		return _main(getenv, in, os.Stdout)
+	}
+
+	out, err := os.Create(outPath)
 	if err != nil {
-		return fmt.Errorf("GL_RESIZE_IMAGE_WIDTH: %w", err)
+		return err
 	}
 
-	pngReader, err := png.NewReader(os.Stdin)
+	err = _main(getenv, in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("construct PNG reader: %w", err)
+		os.Remove(outPath)
 	}
 
-	src, formatName, err := image.Decode(pngReader)
+	return err
+}
+
+func _main(getenv func(string) string, stdin io.Reader, stdout io.Writer) error {
+	// To resize another format, register it here
+	registry := resize.NewRegistry(resize.DefaultFormats...)
+
+	if *printVersion || getenv("GL_RESIZE_IMAGE_PRINT_VERSION") == "1" {
+		return writeVersion(stdout, registry)
+	}
+
+	// In validation mode we only check that stdin is a well-formed PNG
+	if getenv("GL_RESIZE_IMAGE_VALIDATE") == "1" {
+		return png.Validate(stdin, png.Options{})
+	}
+
+	var (
+		opts  resize.Options
+		input = stdin
+		err   error
+	)
+	if getenv("GL_RESIZE_IMAGE_OPTIONS_FROM_STDIN") == "1" {
+		opts, input, err = optionsFromHeader(stdin, getenv)
+	} else {
+		opts, err = optionsFromEnv(getenv)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts.Registry = registry
+	if path := getenv("GL_RESIZE_IMAGE_MIME_OUT"); path != "" {
+		opts.OnContentType = writeContentType(path)
+	}
+	if path := getenv("GL_RESIZE_IMAGE_BLURHASH_OUT"); path != "" {
+		opts.OnBlurhash = writeBlurhash(path)
+	}
+
+	// Decoding is the expensive part of resizing, so we do it once for all
+	// widths
+	if widths := getenv("GL_RESIZE_IMAGE_WIDTHS"); widths != "" {
+		if getenv("GL_RESIZE_IMAGE_DIGEST_OUT") != "" {
+			return errors.New("GL_RESIZE_IMAGE_DIGEST_OUT cannot be combined with GL_RESIZE_IMAGE_WIDTHS")
+		}
+		return resizeVariants(input, opts, widths, getenv("GL_RESIZE_IMAGE_OUT_PATTERN"))
+	}
+
+	// The digest lets the caller deduplicate identical thumbnails. We hash
+	// the output as we write it, so that we do not need a second pass.
+	digestPath := getenv("GL_RESIZE_IMAGE_DIGEST_OUT")
+	if digestPath == "" {
+		return resize.Process(input, stdout, opts)
+	}
+
+	digest := sha256.New()
+	if err := resize.Process(input, io.MultiWriter(stdout, digest), opts); err != nil {
+		return err
+	}
+
+	return writeDigest(digestPath, digest)
+}
+
+// widthPlaceholder is replaced by the width of each variant in
+// GL_RESIZE_IMAGE_OUT_PATTERN
+const widthPlaceholder = "{width}"
+
+// resizeVariants resizes the image read from r to each of the
+// comma-separated widths, and writes each variant to the file named by
+// pattern with widthPlaceholder replaced by its width. If resizing fails,
+// we remove all of these files rather than leave partial images behind.
+func resizeVariants(r io.Reader, opts resize.Options, widths string, pattern string) error {
+	if !strings.Contains(pattern, widthPlaceholder) {
+		return fmt.Errorf("GL_RESIZE_IMAGE_OUT_PATTERN: %q does not contain %s", pattern, widthPlaceholder)
+	}
+	// The height would be the same for all widths, which distorts all but
+	// one of them
+	if opts.Height > 0 {
+		return errors.New("GL_RESIZE_IMAGE_HEIGHT cannot be combined with GL_RESIZE_IMAGE_WIDTHS")
+	}
+
+	parsed, err := parseWidths(widths)
 	if err != nil {
-		return fmt.Errorf("decode: %w", err)
+		return fmt.Errorf("GL_RESIZE_IMAGE_WIDTHS: %w", err)
+	}
+
+	var (
+		files    []*os.File
+		variants []resize.Variant
+	)
+	for _, width := range parsed {
+		f, err := os.Create(strings.Replace(pattern, widthPlaceholder, strconv.Itoa(width), -1))
+		if err != nil {
+			break
+		}
+		files = append(files, f)
+		variants = append(variants, resize.Variant{Width: width, Writer: f})
+	}
+
+	if len(files) == len(parsed) {
+		err = resize.ProcessVariants(r, opts, variants)
+	}
+	for _, f := range files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	imagingFormat, err := imaging.FormatFromExtension(formatName)
 	if err != nil {
-		return fmt.Errorf("find imaging format: %w", err)
+		for _, f := range files {
+			os.Remove(f.Name())
+		}
 	}
 
-	image := imaging.Resize(src, requestedWidth, 0, imaging.Lanczos)
-	return imaging.Encode(os.Stdout, image, imagingFormat)
+	return err
+}
+
+// parseWidths parses a comma-separated list of distinct, positive widths
+func parseWidths(widths string) ([]int, error) {
+	var parsed []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(widths, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if width <= 0 {
+			return nil, fmt.Errorf("width %d is not positive", width)
+		}
+		if seen[width] {
+			return nil, fmt.Errorf("width %d is given twice", width)
+		}
+		seen[width] = true
+		parsed = append(parsed, width)
+	}
+
+	return parsed, nil
+}
+
+// writeDigest writes the hex digest of h to the file at path
+func writeDigest(path string, h hash.Hash) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(h.Sum(nil))), 0600)
+}
+
+// writeContentType returns a resize.Options.OnContentType function that
+// writes the MIME type of the resized image to the file at path, so that
+// the caller can set the Content-Type of the response
+func writeContentType(path string) func(string) error {
+	return func(contentType string) error {
+		return ioutil.WriteFile(path, []byte(contentType), 0600)
+	}
+}
+
+// writeBlurhash returns a resize.Options.OnBlurhash function that writes
+// the blurhash of the image to the file at path
+func writeBlurhash(path string) func(string) error {
+	return func(hash string) error {
+		return ioutil.WriteFile(path, []byte(hash), 0600)
+	}
+}
+
+// writeVersion writes our version, the revision we were built from and the
+// formats in registry to w. It fails if there are no formats.
+func writeVersion(w io.Writer, registry *resize.Registry) error {
+	formats := registry.Names()
+	if len(formats) == 0 {
+		return errors.New("no image formats registered")
+	}
+
+	revision := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if rev := vcsRevision(info); rev != "" {
+			revision = rev
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s\nrevision: %s\ngo: %s\nformats: %s\n",
+		progName, Version, revision, runtime.Version(), strings.Join(formats, " "))
+	return err
+}
+
+// optionsFromEnv reads the resize options from GL_RESIZE_IMAGE_*
+// environment variables. Only the width is required.
+func optionsFromEnv(getenv func(string) string) (resize.Options, error) {
+	opts, err := limitsFromEnv(getenv)
+	if err != nil {
+		return opts, err
+	}
+
+	// GL_RESIZE_IMAGE_WIDTHS replaces the width, see resizeVariants
+	if getenv("GL_RESIZE_IMAGE_WIDTHS") == "" {
+		opts.Width, err = strconv.Atoi(getenv("GL_RESIZE_IMAGE_WIDTH"))
+		if err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_WIDTH: %w", err)
+		}
+	}
+
+	for name, dst := range map[string]*int{
+		"GL_RESIZE_IMAGE_HEIGHT":  &opts.Height,
+		"GL_RESIZE_IMAGE_QUALITY": &opts.Quality,
+	} {
+		param := getenv(name)
+		if param == "" {
+			continue
+		}
+
+		if *dst, err = strconv.Atoi(param); err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	opts.Format = getenv("GL_RESIZE_IMAGE_FORMAT")
+	opts.FallbackFormat = getenv("GL_RESIZE_IMAGE_FALLBACK_FORMAT")
+	opts.Crop = resize.CropMode(getenv("GL_RESIZE_IMAGE_CROP"))
+	opts.Filter = getenv("GL_RESIZE_IMAGE_FILTER")
+	if param := getenv("GL_RESIZE_IMAGE_ADAPTIVE_FILTER_THRESHOLD"); param != "" {
+		if opts.AdaptiveFilterThreshold, err = strconv.ParseFloat(param, 64); err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_ADAPTIVE_FILTER_THRESHOLD: %w", err)
+		}
+	}
+	opts.PNGCompression = getenv("GL_RESIZE_IMAGE_PNG_COMPRESSION")
+	opts.JPEGProgressive = getenv("GL_RESIZE_IMAGE_JPEG_PROGRESSIVE") == "1"
+
+	return opts, nil
+}
+
+// limitsFromEnv reads the options that are about what input we accept,
+// rather than what output we produce. They always come from the
+// environment.
+func limitsFromEnv(getenv func(string) string) (resize.Options, error) {
+	var opts resize.Options
+
+	if param := getenv("GL_RESIZE_IMAGE_MAX_PIXELS"); param != "" {
+		var err error
+		if opts.MaxPixels, err = strconv.Atoi(param); err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_MAX_PIXELS: %w", err)
+		}
+	}
+
+	for name, dst := range map[string]*int{
+		"GL_RESIZE_IMAGE_MAX_WIDTH":            &opts.MaxWidth,
+		"GL_RESIZE_IMAGE_MAX_HEIGHT":           &opts.MaxHeight,
+		"GL_RESIZE_IMAGE_MAX_ANIMATION_PIXELS": &opts.MaxAnimationPixels,
+	} {
+		param := getenv(name)
+		if param == "" {
+			continue
+		}
+
+		var err error
+		if *dst, err = strconv.Atoi(param); err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if param := getenv("GL_RESIZE_IMAGE_EXPECTED_BYTES"); param != "" {
+		var err error
+		if opts.ExpectedBytes, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_EXPECTED_BYTES: %w", err)
+		}
+	}
+
+	// Unset, we skip what png.NewReader skips
+	if param := getenv("GL_RESIZE_IMAGE_SKIP_CHUNKS"); param != "" {
+		var err error
+		if opts.SkipChunks, err = png.ParseChunkTypes(param); err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_SKIP_CHUNKS: %w", err)
+		}
+	}
+
+	opts.RejectMultiPage = getenv("GL_RESIZE_IMAGE_REJECT_MULTIPAGE") == "1"
+	opts.ScaledDecode = getenv("GL_RESIZE_IMAGE_SCALED_DECODE") == "1"
+	opts.KeepAnimation = getenv("GL_RESIZE_IMAGE_KEEP_ANIMATION") == "1"
+	opts.KeepPalette = getenv("GL_RESIZE_IMAGE_KEEP_PALETTE") == "1"
+	opts.PreserveDepth = getenv("GL_RESIZE_IMAGE_PRESERVE_DEPTH") == "1"
+	opts.FallbackOriginal = getenv("GL_RESIZE_IMAGE_FALLBACK_ORIGINAL") == "1"
+
+	if param := getenv("GL_RESIZE_IMAGE_TIMEOUT"); param != "" {
+		var err error
+		if opts.Timeout, err = time.ParseDuration(param); err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_TIMEOUT: %w", err)
+		}
+	}
+
+	// Workhorse passes the deadline of the request, in nanoseconds since
+	// the Unix epoch, so that we do not outlive the client
+	if param := getenv("GL_RESIZE_IMAGE_DEADLINE"); param != "" {
+		nanos, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_DEADLINE: %w", err)
+		}
+
+		remaining := time.Until(time.Unix(0, nanos))
+		if remaining <= 0 {
+			return opts, fmt.Errorf("GL_RESIZE_IMAGE_DEADLINE: %w", resize.ErrTimeout)
+		}
+		if opts.Timeout <= 0 || remaining < opts.Timeout {
+			opts.Timeout = remaining
+		}
+	}
+
+	return opts, nil
+}
+
+// headerOptions are the options that can be passed in the header line
+type headerOptions struct {
+	Width                   int     `json:"width"`
+	Height                  int     `json:"height"`
+	Quality                 int     `json:"quality"`
+	Format                  string  `json:"format"`
+	FallbackFormat          string  `json:"fallback_format"`
+	Filter                  string  `json:"filter"`
+	AdaptiveFilterThreshold float64 `json:"adaptive_filter_threshold"`
+	Crop                    string  `json:"crop"`
+	PNGCompression          string  `json:"png_compression"`
+	JPEGProgressive         bool    `json:"jpeg_progressive"`
+}
+
+// maxHeaderLen is the longest header line we accept, including the newline
+const maxHeaderLen = 4096
+
+// optionsFromHeader reads the resize options from the first line of r,
+// which must be a JSON object terminated by a newline, and returns them
+// with the reader for the image that follows the line. Limits still come
+// from the environment.
+func optionsFromHeader(r io.Reader, getenv func(string) string) (resize.Options, io.Reader, error) {
+	opts, err := limitsFromEnv(getenv)
+	if err != nil {
+		return opts, nil, err
+	}
+
+	br := bufio.NewReaderSize(r, maxHeaderLen)
+	line, err := br.ReadSlice('\n')
+	switch err {
+	case nil:
+	case bufio.ErrBufferFull:
+		return opts, nil, fmt.Errorf("options header: longer than %d bytes", maxHeaderLen)
+	case io.EOF:
+		return opts, nil, errors.New("options header: no newline before end of input")
+	default:
+		return opts, nil, fmt.Errorf("options header: %w", err)
+	}
+
+	var header headerOptions
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&header); err != nil {
+		return opts, nil, fmt.Errorf("options header: %w", err)
+	}
+	if dec.More() {
+		return opts, nil, errors.New("options header: unexpected data after JSON object")
+	}
+
+	opts.Width = header.Width
+	opts.Height = header.Height
+	opts.Quality = header.Quality
+	opts.Format = header.Format
+	opts.FallbackFormat = header.FallbackFormat
+	opts.Filter = header.Filter
+	opts.AdaptiveFilterThreshold = header.AdaptiveFilterThreshold
+	opts.Crop = resize.CropMode(header.Crop)
+	opts.PNGCompression = header.PNGCompression
+	opts.JPEGProgressive = header.JPEGProgressive
+
+	return opts, br, nil
 }
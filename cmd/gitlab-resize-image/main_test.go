@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/resize"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		env       map[string]string
+		expected  resize.Options
+		expectErr bool
+	}{
+		{
+			desc:     "width only",
+			env:      map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64"},
+			expected: resize.Options{Width: 64},
+		},
+		{
+			desc: "all options",
+			env: map[string]string{
+				"GL_RESIZE_IMAGE_WIDTH":                     "64",
+				"GL_RESIZE_IMAGE_HEIGHT":                    "32",
+				"GL_RESIZE_IMAGE_QUALITY":                   "80",
+				"GL_RESIZE_IMAGE_FORMAT":                    "jpg",
+				"GL_RESIZE_IMAGE_FALLBACK_FORMAT":           "png",
+				"GL_RESIZE_IMAGE_CROP":                      "cover",
+				"GL_RESIZE_IMAGE_FILTER":                    "box",
+				"GL_RESIZE_IMAGE_ADAPTIVE_FILTER_THRESHOLD": "0.9",
+				"GL_RESIZE_IMAGE_PNG_COMPRESSION":           "best",
+				"GL_RESIZE_IMAGE_JPEG_PROGRESSIVE":          "1",
+				"GL_RESIZE_IMAGE_MAX_PIXELS":                "1000000",
+				"GL_RESIZE_IMAGE_MAX_WIDTH":                 "2000",
+				"GL_RESIZE_IMAGE_MAX_HEIGHT":                "1000",
+				"GL_RESIZE_IMAGE_REJECT_MULTIPAGE":          "1",
+				"GL_RESIZE_IMAGE_SCALED_DECODE":             "1",
+				"GL_RESIZE_IMAGE_KEEP_ANIMATION":            "1",
+				"GL_RESIZE_IMAGE_MAX_ANIMATION_PIXELS":      "500000",
+				"GL_RESIZE_IMAGE_KEEP_PALETTE":              "1",
+				"GL_RESIZE_IMAGE_PRESERVE_DEPTH":            "1",
+				"GL_RESIZE_IMAGE_FALLBACK_ORIGINAL":         "1",
+				"GL_RESIZE_IMAGE_TIMEOUT":                   "5s",
+				"GL_RESIZE_IMAGE_EXPECTED_BYTES":            "123456",
+				"GL_RESIZE_IMAGE_SKIP_CHUNKS":               "iCCP, sRGB,tEXt",
+			},
+			expected: resize.Options{Width: 64, Height: 32, Quality: 80, Format: "jpg", FallbackFormat: "png", Crop: resize.CropCover, Filter: "box", AdaptiveFilterThreshold: 0.9, PNGCompression: "best", JPEGProgressive: true, MaxPixels: 1000000, MaxWidth: 2000, MaxHeight: 1000, RejectMultiPage: true, ScaledDecode: true, KeepAnimation: true, MaxAnimationPixels: 500000, KeepPalette: true, PreserveDepth: true, FallbackOriginal: true, SkipChunks: []string{"iCCP", "sRGB", "tEXt"}, ExpectedBytes: 123456, Timeout: 5 * time.Second},
+		},
+		{desc: "widths instead of width", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16,32"}, expected: resize.Options{}},
+		{desc: "missing width", env: map[string]string{}, expectErr: true},
+		{desc: "invalid height", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_HEIGHT": "tall"}, expectErr: true},
+		{desc: "invalid adaptive filter threshold", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_ADAPTIVE_FILTER_THRESHOLD": "slight"}, expectErr: true},
+		{desc: "invalid max width", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_MAX_WIDTH": "wide"}, expectErr: true},
+		{desc: "invalid expected bytes", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_EXPECTED_BYTES": "lots"}, expectErr: true},
+		{desc: "invalid chunk type", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_SKIP_CHUNKS": "iCCP,tEX"}, expectErr: true},
+		{desc: "critical chunk type", env: map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_SKIP_CHUNKS": "IDAT"}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts, err := optionsFromEnv(func(k string) string { return tc.env[k] })
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, opts)
+		})
+	}
+}
+
+func TestOptionsFromEnvDeadline(t *testing.T) {
+	deadline := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixNano(), 10)
+	}
+
+	testCases := []struct {
+		desc string
+		env  map[string]string
+		// maxTimeout is the upper bound of the timeout, which depends on
+		// how long the test takes to get there
+		maxTimeout  time.Duration
+		expectedErr error
+	}{
+		{desc: "future deadline", env: map[string]string{"GL_RESIZE_IMAGE_DEADLINE": deadline(time.Hour)}, maxTimeout: time.Hour},
+		{desc: "deadline before timeout", env: map[string]string{"GL_RESIZE_IMAGE_DEADLINE": deadline(time.Minute), "GL_RESIZE_IMAGE_TIMEOUT": "1h"}, maxTimeout: time.Minute},
+		{desc: "past deadline", env: map[string]string{"GL_RESIZE_IMAGE_DEADLINE": deadline(-time.Second)}, expectedErr: resize.ErrTimeout},
+		{desc: "invalid deadline", env: map[string]string{"GL_RESIZE_IMAGE_DEADLINE": "soon"}, expectedErr: strconv.ErrSyntax},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.env["GL_RESIZE_IMAGE_WIDTH"] = "64"
+			opts, err := optionsFromEnv(func(k string) string { return tc.env[k] })
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "unexpected error: %v", err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.True(t, opts.Timeout > tc.maxTimeout-time.Minute/2 && opts.Timeout <= tc.maxTimeout, "unexpected timeout %v", opts.Timeout)
+		})
+	}
+
+	t.Run("timeout before deadline", func(t *testing.T) {
+		env := map[string]string{"GL_RESIZE_IMAGE_WIDTH": "64", "GL_RESIZE_IMAGE_DEADLINE": deadline(time.Hour), "GL_RESIZE_IMAGE_TIMEOUT": "5s"}
+		opts, err := optionsFromEnv(func(k string) string { return env[k] })
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Second, opts.Timeout)
+	})
+}
+
+func TestPastDeadlineExitsWithTimeout(t *testing.T) {
+	env := map[string]string{
+		"GL_RESIZE_IMAGE_WIDTH":    "64",
+		"GL_RESIZE_IMAGE_DEADLINE": strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10),
+	}
+
+	image, err := os.Open("../../testdata/image.png")
+	require.NoError(t, err)
+	defer image.Close()
+
+	err = _main(func(k string) string { return env[k] }, image, ioutil.Discard)
+	require.Equal(t, exitTimeout, exitCode(err), "unexpected error: %v", err)
+}
+
+func TestOptionsFromHeader(t *testing.T) {
+	const image = "\x89PNG\r\n\x1a\n{not JSON}\n"
+
+	testCases := []struct {
+		desc      string
+		input     string
+		env       map[string]string
+		expected  resize.Options
+		expectErr bool
+	}{
+		{
+			desc:     "all options",
+			input:    `{"width":64,"height":32,"quality":80,"format":"jpg","fallback_format":"png","filter":"box","adaptive_filter_threshold":0.9,"crop":"cover","png_compression":"best","jpeg_progressive":true}` + "\n" + image,
+			expected: resize.Options{Width: 64, Height: 32, Quality: 80, Format: "jpg", FallbackFormat: "png", Filter: "box", AdaptiveFilterThreshold: 0.9, Crop: resize.CropCover, PNGCompression: "best", JPEGProgressive: true},
+		},
+		{
+			desc:     "limits from environment",
+			input:    `{"width":64}` + "\n" + image,
+			env:      map[string]string{"GL_RESIZE_IMAGE_MAX_PIXELS": "1000", "GL_RESIZE_IMAGE_WIDTH": "128"},
+			expected: resize.Options{Width: 64, MaxPixels: 1000},
+		},
+		{desc: "malformed JSON", input: `{"width":64` + "\n" + image, expectErr: true},
+		{desc: "unknown option", input: `{"width":64,"colour":"red"}` + "\n" + image, expectErr: true},
+		{desc: "wrong type", input: `{"width":"64"}` + "\n" + image, expectErr: true},
+		{desc: "two objects", input: `{"width":64} {"width":32}` + "\n" + image, expectErr: true},
+		{desc: "no newline", input: `{"width":64}`, expectErr: true},
+		{desc: "header too long", input: `{"format":"` + strings.Repeat("x", maxHeaderLen) + `"}` + "\n" + image, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts, r, err := optionsFromHeader(strings.NewReader(tc.input), func(k string) string { return tc.env[k] })
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, opts)
+
+			rest, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, image, string(rest), "the image must follow the header unchanged")
+		})
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	var out strings.Builder
+	require.NoError(t, writeVersion(&out, resize.NewRegistry(resize.DefaultFormats...)))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, "gitlab-resize-image "+Version, lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "revision: "), lines[1])
+	require.True(t, strings.HasPrefix(lines[2], "go: go"), lines[2])
+
+	formats := strings.Fields(strings.TrimPrefix(lines[3], "formats: "))
+	require.Contains(t, formats, "png")
+	require.Contains(t, formats, "jpeg")
+}
+
+func TestWriteVersionWithoutFormats(t *testing.T) {
+	require.Error(t, writeVersion(ioutil.Discard, resize.NewRegistry()))
+}
+
+func TestWriteContentType(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Open("../../testdata/image.png")
+	require.NoError(t, err)
+	defer f.Close()
+
+	path := filepath.Join(tmp, "mime")
+	opts := resize.Options{Width: 10, Format: "jpeg", OnContentType: writeContentType(path)}
+	require.NoError(t, resize.Process(f, ioutil.Discard, opts))
+
+	contentType, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "image/jpeg", string(contentType))
+}
+
+func TestBlurhashOut(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Open("../../testdata/image.png")
+	require.NoError(t, err)
+	defer f.Close()
+
+	path := filepath.Join(tmp, "blurhash")
+	env := map[string]string{"GL_RESIZE_IMAGE_WIDTH": "10", "GL_RESIZE_IMAGE_BLURHASH_OUT": path}
+	require.NoError(t, _main(func(k string) string { return env[k] }, f, ioutil.Discard))
+
+	hash, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, hash, 28)
+}
+
+func TestDigestOut(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Open("../../testdata/image.png")
+	require.NoError(t, err)
+	defer f.Close()
+
+	path := filepath.Join(tmp, "digest")
+	env := map[string]string{"GL_RESIZE_IMAGE_WIDTH": "10", "GL_RESIZE_IMAGE_DIGEST_OUT": path}
+	var out bytes.Buffer
+	require.NoError(t, _main(func(k string) string { return env[k] }, f, &out))
+	require.NotZero(t, out.Len())
+
+	digest, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	expected := sha256.Sum256(out.Bytes())
+	require.Equal(t, hex.EncodeToString(expected[:]), string(digest))
+}
+
+func TestDigestOutNotWrittenOnFailure(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "digest")
+	env := map[string]string{"GL_RESIZE_IMAGE_WIDTH": "10", "GL_RESIZE_IMAGE_DIGEST_OUT": path}
+	err = _main(func(k string) string { return env[k] }, strings.NewReader("<html>"), ioutil.Discard)
+	require.Error(t, err)
+
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "digest must not be written for failed resizes")
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      error
+		expected int
+	}{
+		{desc: "other error", err: errors.New("width or height must be set"), expected: exitFailure},
+		{desc: "unsupported format", err: resize.ErrMultiPageTIFF, expected: exitUnsupportedFormat},
+		{desc: "decode failure", err: fmt.Errorf("wrapped: %w", resize.ErrDecode), expected: exitDecode},
+		{desc: "too large", err: resize.ErrTooManyPixels, expected: exitTooLarge},
+		{desc: "timeout", err: resize.ErrTimeout, expected: exitTimeout},
+		{desc: "not an image", err: fmt.Errorf("%w: detected text/html", resize.ErrNotAnImage), expected: exitNotAnImage},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, exitCode(tc.err))
+		})
+	}
+}
+
+func TestResizeFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	getenv := func(key string) string {
+		return map[string]string{"GL_RESIZE_IMAGE_WIDTH": "20"}[key]
+	}
+
+	out := filepath.Join(tmp, "resized.png")
+	require.NoError(t, resizeFiles(getenv, "../../testdata/image.png", out))
+
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	require.NoError(t, err)
+	require.Equal(t, 20, cfg.Width)
+}
+
+func TestResizeFilesRemovesOutputOnFailure(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	getenv := func(key string) string {
+		return map[string]string{"GL_RESIZE_IMAGE_WIDTH": "20"}[key]
+	}
+
+	in := filepath.Join(tmp, "page.html")
+	require.NoError(t, ioutil.WriteFile(in, []byte("<html>not an image</html>"), 0600))
+	out := filepath.Join(tmp, "resized.png")
+
+	err = resizeFiles(getenv, in, out)
+	require.True(t, errors.Is(err, resize.ErrNotAnImage), "unexpected error: %v", err)
+	_, err = os.Stat(out)
+	require.True(t, os.IsNotExist(err), "output must be removed: %v", err)
+
+	err = resizeFiles(getenv, filepath.Join(tmp, "missing.png"), out)
+	require.True(t, os.IsNotExist(err), "unexpected error: %v", err)
+}
+
+func TestResizeVariants(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Open("../../testdata/image.png")
+	require.NoError(t, err)
+	defer f.Close()
+
+	env := map[string]string{
+		"GL_RESIZE_IMAGE_WIDTHS":      "16, 128,32,64",
+		"GL_RESIZE_IMAGE_OUT_PATTERN": filepath.Join(tmp, "avatar-{width}.png"),
+	}
+	var out bytes.Buffer
+	require.NoError(t, _main(func(k string) string { return env[k] }, f, &out))
+	require.Zero(t, out.Len(), "variants must not be written to stdout")
+
+	for _, width := range []int{16, 32, 64, 128} {
+		f, err := os.Open(filepath.Join(tmp, fmt.Sprintf("avatar-%d.png", width)))
+		require.NoError(t, err)
+		defer f.Close()
+
+		cfg, err := png.DecodeConfig(f)
+		require.NoError(t, err)
+		require.Equal(t, width, cfg.Width)
+	}
+}
+
+func TestResizeVariantsErrors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	pattern := filepath.Join(tmp, "avatar-{width}.png")
+	testCases := []struct {
+		desc  string
+		env   map[string]string
+		input string
+	}{
+		{desc: "no placeholder", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16", "GL_RESIZE_IMAGE_OUT_PATTERN": filepath.Join(tmp, "avatar.png")}},
+		{desc: "invalid width", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16,big", "GL_RESIZE_IMAGE_OUT_PATTERN": pattern}},
+		{desc: "duplicate width", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16,16", "GL_RESIZE_IMAGE_OUT_PATTERN": pattern}},
+		{desc: "with height", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16", "GL_RESIZE_IMAGE_HEIGHT": "16", "GL_RESIZE_IMAGE_OUT_PATTERN": pattern}},
+		{desc: "with digest", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16", "GL_RESIZE_IMAGE_DIGEST_OUT": filepath.Join(tmp, "digest"), "GL_RESIZE_IMAGE_OUT_PATTERN": pattern}},
+		{desc: "not an image", env: map[string]string{"GL_RESIZE_IMAGE_WIDTHS": "16,32", "GL_RESIZE_IMAGE_OUT_PATTERN": pattern}, input: "<html>"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := _main(func(k string) string { return tc.env[k] }, strings.NewReader(tc.input), ioutil.Discard)
+			require.Error(t, err)
+
+			files, err := ioutil.ReadDir(tmp)
+			require.NoError(t, err)
+			require.Empty(t, files, "no output may be left behind")
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	env := map[string]string{
+		"GL_RESIZE_IMAGE_WIDTH":      "128",
+		"GL_RESIZE_IMAGE_QUALITY":    "50",
+		"GL_RESIZE_IMAGE_MAX_PIXELS": "1000",
+	}
+
+	testCases := []struct {
+		desc      string
+		args      []string
+		expected  resize.Options
+		expectErr bool
+	}{
+		{desc: "no flags", expected: resize.Options{Width: 128, Quality: 50, MaxPixels: 1000}},
+		{desc: "flags override environment", args: []string{"-width=64", "-quality", "80"}, expected: resize.Options{Width: 64, Quality: 80, MaxPixels: 1000}},
+		{desc: "flags only", args: []string{"-height=32", "-format=jpg", "-crop=cover", "-filter=box"}, expected: resize.Options{Width: 128, Height: 32, Quality: 50, Format: "jpg", Crop: resize.CropCover, Filter: "box", MaxPixels: 1000}},
+		{desc: "unknown flag", args: []string{"-colour=red"}, expectErr: true},
+		{desc: "positional argument", args: []string{"-width=64", "image.png"}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+
+			getenv, err := parseFlags(fs, tc.args, func(k string) string { return env[k] })
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			opts, err := optionsFromEnv(getenv)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, opts)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package png
+
+import (
+	"io"
+	"time"
+)
+
+type readDeadliner interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// deadlineReader sets a read deadline on r before each read from it.
+// Inputs like regular files have SetReadDeadline, but fail to set
+// deadlines, after which we stop trying.
+type deadlineReader struct {
+	r           readDeadliner
+	timeout     time.Duration
+	unsupported bool
+}
+
+// withReadTimeout returns r, wrapped in a deadlineReader if timeout is set
+// and r supports read deadlines. See Options.ReadTimeout.
+func withReadTimeout(r io.Reader, timeout time.Duration) io.Reader {
+	if timeout <= 0 {
+		return r
+	}
+
+	if d, ok := r.(readDeadliner); ok {
+		return &deadlineReader{r: d, timeout: timeout}
+	}
+
+	return r
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if !d.unsupported {
+		if err := d.r.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+			d.unsupported = true
+		}
+	}
+
+	return d.r.Read(p)
+}
@@ -0,0 +1,73 @@
+package png
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderReadTimeout(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc  string
+		pause time.Duration
+		stall bool
+	}{
+		// The timeout applies to each read, so a slow upload is fine as
+		// long as it keeps going
+		{desc: "slow but steady", pause: 5 * time.Millisecond},
+		{desc: "stalled", stall: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				for pos := 0; pos < len(original); pos += 1024 {
+					end := pos + 1024
+					if end > len(original) {
+						end = len(original)
+					}
+					if _, err := client.Write(original[pos:end]); err != nil {
+						return
+					}
+					if tc.stall && pos > 0 {
+						// Keep the connection open without sending more
+						return
+					}
+					time.Sleep(tc.pause)
+				}
+				client.Close()
+			}()
+
+			r, err := NewReader(server, Options{ReadTimeout: 50 * time.Millisecond})
+			require.NoError(t, err)
+			out, err := ioutil.ReadAll(r)
+
+			if !tc.stall {
+				require.NoError(t, err)
+				require.Equal(t, original, out)
+				return
+			}
+
+			var netErr net.Error
+			require.True(t, errors.As(err, &netErr) && netErr.Timeout(), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestReaderReadTimeoutWithoutDeadlines(t *testing.T) {
+	// Regular files do not support read deadlines
+	r, err := NewReader(rawImageReader(t, goodPNG), Options{ReadTimeout: time.Nanosecond})
+	require.NoError(t, err)
+	requireStreamUnchanged(t, r, rawImageReader(t, goodPNG))
+}
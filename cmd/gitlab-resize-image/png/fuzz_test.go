@@ -0,0 +1,46 @@
+//go:build go1.18
+// +build go1.18
+
+package png
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Run with: go test -fuzz=FuzzReader ./cmd/gitlab-resize-image/png
+func FuzzReader(f *testing.F) {
+	for _, path := range []string{goodPNG, badPNG, strippedPNG, jpg} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(pngMagic + "\xff\xff\xff\xf0iCCP"))
+	f.Add([]byte(pngMagic + "\x7f\xff\xff\xffIDAT"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, newReader := range []func(io.Reader, Options) (*Reader, error){NewReader, NewStrippingReader, NewStrictReader, NewReaderCriticalOnly, NewReaderPreserveValidICCP, NewReaderReplaceICCP} {
+			r, err := newReader(bytes.NewReader(data), Options{})
+			if err != nil {
+				continue
+			}
+
+			// The reader only ever drops bytes, so whatever the chunk lengths
+			// claim, its output must not be larger than its input. The sRGB
+			// chunk we may insert replaces an iCCP chunk of at least a
+			// header and a CRC.
+			limit := len(data)
+			if r.replaceICCP {
+				limit += len(srgbChunk) - headerLen - crcLen
+			}
+			out, _ := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+			if len(out) > limit {
+				t.Fatalf("read %d bytes from %d bytes of input", len(out), len(data))
+			}
+		}
+	})
+}
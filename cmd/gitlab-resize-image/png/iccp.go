@@ -0,0 +1,61 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// maxICCPLength is the largest iCCP chunk we check rather than drop.
+	// RGB and grayscale profiles are much smaller.
+	maxICCPLength = 1 << 20
+	// maxProfileLength is the largest decompressed profile we accept, so
+	// that a small chunk cannot make us inflate gigabytes
+	maxProfileLength = 4 << 20
+	// iccHeaderLen is the length of the header of an ICC profile
+	iccHeaderLen = 128
+)
+
+// validICCP checks that data, the data of an iCCP chunk, holds a profile
+// that decoders can parse: a profile name, zlib compression, and an ICC
+// profile whose header has the right size and signature. It does not
+// check the tags of the profile.
+func validICCP(data []byte) error {
+	nameLen := bytes.IndexByte(data, 0)
+	if nameLen < 1 || nameLen > 79 {
+		return errors.New("invalid profile name")
+	}
+
+	if len(data) < nameLen+2 || data[nameLen+1] != 0 {
+		return errors.New("unknown compression method")
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data[nameLen+2:]))
+	if err != nil {
+		return fmt.Errorf("decompress profile: %v", err)
+	}
+	profile, err := ioutil.ReadAll(io.LimitReader(zr, maxProfileLength+1))
+	if err != nil {
+		return fmt.Errorf("decompress profile: %v", err)
+	}
+	if len(profile) > maxProfileLength {
+		return fmt.Errorf("profile larger than %d bytes", maxProfileLength)
+	}
+
+	if len(profile) < iccHeaderLen {
+		return fmt.Errorf("profile of %d bytes", len(profile))
+	}
+	if size := binary.BigEndian.Uint32(profile[:4]); int64(size) != int64(len(profile)) {
+		return fmt.Errorf("profile of %d bytes claims to have %d", len(profile), size)
+	}
+	if string(profile[36:40]) != "acsp" {
+		return errors.New("missing profile signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderPreserveValidICCP(t *testing.T) {
+	r, err := NewReaderPreserveValidICCP(rawImageReader(t, badPNG), Options{})
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	// The fixture has a broken profile followed by a valid one
+	profiles := iccpChunks(t, out)
+	require.Len(t, profiles, 1)
+	require.NoError(t, validICCP(profiles[0]))
+	require.Equal(t, "kCGColorSpaceGenericRGB", string(profiles[0][:bytes.IndexByte(profiles[0], 0)]))
+	require.Equal(t, []SkippedChunk{{Type: "iCCP", Length: 207}}, r.SkippedChunks())
+
+	requireValidImage(t, bytes.NewReader(out), "png")
+}
+
+func TestReaderPreserveValidICCPKeepsOnlyOneProfile(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	profile := iccpChunk(validProfileData(t))
+	withProfiles := insertChunk(t, insertChunk(t, original, profile), profile)
+
+	r, err := NewReaderPreserveValidICCP(bytes.NewReader(withProfiles), Options{})
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	require.Len(t, iccpChunks(t, out), 1)
+	require.Len(t, r.SkippedChunks(), 1)
+	require.Equal(t, len(withProfiles)-len(profile), len(out))
+}
+
+func TestReaderPreserveValidICCPSkipsCorruptChunk(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	profile := iccpChunk(validProfileData(t))
+	profile[headerLen] ^= 0xff // breaks the CRC
+
+	r, err := NewReaderPreserveValidICCP(bytes.NewReader(insertChunk(t, original, profile)), Options{})
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	require.Empty(t, iccpChunks(t, out))
+	requireStreamUnchanged(t, bytes.NewReader(out), bytes.NewReader(original))
+}
+
+func TestValidICCP(t *testing.T) {
+	valid := validProfileData(t)
+	nul := bytes.IndexByte(valid, 0)
+
+	var wrongSize bytes.Buffer
+	profile := make([]byte, iccHeaderLen)
+	binary.BigEndian.PutUint32(profile, iccHeaderLen+1)
+	copy(profile[36:], "acsp")
+	zw := zlib.NewWriter(&wrongSize)
+	zw.Write(profile)
+	zw.Close()
+
+	testCases := []struct {
+		desc  string
+		data  []byte
+		valid bool
+	}{
+		{desc: "valid", data: valid, valid: true},
+		{desc: "no name", data: valid[nul:]},
+		{desc: "no compression method", data: valid[:nul+1]},
+		{desc: "unknown compression method", data: append(append([]byte{}, valid[:nul+1]...), append([]byte{1}, valid[nul+2:]...)...)},
+		{desc: "truncated profile", data: valid[:len(valid)-10]},
+		{desc: "not zlib", data: append(append([]byte{}, valid[:nul+2]...), "not zlib"...)},
+		{desc: "wrong profile size", data: append([]byte("name\x00\x00"), wrongSize.Bytes()...)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := validICCP(tc.data)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+// validProfileData returns the data of the valid iCCP chunk of badPNG
+func validProfileData(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+
+	profiles := iccpChunks(t, data)
+	require.Len(t, profiles, 2)
+	return profiles[1]
+}
+
+// iccpChunks returns the data of all iCCP chunks of a PNG
+func iccpChunks(t *testing.T, png []byte) [][]byte {
+	var found [][]byte
+	for pos := pngMagicLen; pos < len(png); {
+		require.True(t, pos+headerLen <= len(png), "truncated chunk header")
+		length := int(binary.BigEndian.Uint32(png[pos:]))
+		if string(png[pos+4:pos+headerLen]) == "iCCP" {
+			found = append(found, png[pos+headerLen:pos+headerLen+length])
+		}
+		pos += headerLen + length + crcLen
+	}
+	return found
+}
+
+func iccpChunk(data []byte) []byte {
+	chunk := make([]byte, headerLen, headerLen+len(data)+crcLen)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], "iCCP")
+	chunk = append(chunk, data...)
+
+	var crc [crcLen]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc[:]...)
+}
+
+// insertChunk adds chunk right after IHDR
+func insertChunk(t *testing.T, png []byte, chunk []byte) []byte {
+	const ihdrEnd = pngMagicLen + headerLen + ihdrLen + crcLen
+	require.Equal(t, "IHDR", string(png[pngMagicLen+4:pngMagicLen+8]))
+
+	var out bytes.Buffer
+	out.Write(png[:ihdrEnd])
+	out.Write(chunk)
+	out.Write(png[ihdrEnd:])
+	return out.Bytes()
+}
@@ -0,0 +1,86 @@
+package png
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrChunkOrder = errors.New("png: chunks out of order")
+
+var (
+	// beforePLTE are chunks that must come before PLTE and IDAT
+	beforePLTE = map[string]bool{"iCCP": true, "sRGB": true, "gAMA": true, "cHRM": true, "sBIT": true}
+	// afterPLTE are chunks that must come after PLTE, if there is one,
+	// and before IDAT
+	afterPLTE = map[string]bool{"tRNS": true, "bKGD": true, "hIST": true}
+	// beforeIDAT are chunks that must come before IDAT
+	beforeIDAT = map[string]bool{"PLTE": true, "pHYs": true, "sPLT": true}
+)
+
+// chunkOrder checks the order of chunks against these rules of the PNG
+// specification:
+//
+//   - IHDR comes first and IEND last, and there is one of each
+//   - iCCP, sRGB, gAMA, cHRM and sBIT come before PLTE and IDAT
+//   - There is at most one PLTE, and it comes before IDAT
+//   - tRNS, bKGD and hIST come after PLTE, if there is one, and before IDAT
+//   - pHYs and sPLT come before IDAT
+//   - IDAT chunks are consecutive
+//
+// The order of other chunks is not checked.
+type chunkOrder struct {
+	count          int
+	seenPLTE       bool
+	seenAfterPLTE  bool
+	seenIDAT       bool
+	imageDataEnded bool
+	seenIEND       bool
+}
+
+func (o *chunkOrder) check(chunkType string) error {
+	defer func() { o.count++ }()
+
+	switch {
+	case o.seenIEND:
+		return o.errorf("%s chunk after IEND", chunkType)
+	case o.count == 0 && chunkType != "IHDR":
+		return o.errorf("first chunk is %s, not IHDR", chunkType)
+	case o.count > 0 && chunkType == "IHDR":
+		return o.errorf("more than one IHDR chunk")
+	}
+
+	if o.seenIDAT && chunkType != "IDAT" {
+		o.imageDataEnded = true
+	}
+
+	switch {
+	case chunkType == "IDAT":
+		if o.imageDataEnded {
+			return o.errorf("IDAT chunks are not consecutive")
+		}
+		o.seenIDAT = true
+	case chunkType == "IEND":
+		o.seenIEND = true
+	case beforePLTE[chunkType] && (o.seenPLTE || o.seenIDAT):
+		return o.errorf("%s chunk after PLTE or IDAT", chunkType)
+	case chunkType == "PLTE" && o.seenPLTE:
+		return o.errorf("more than one PLTE chunk")
+	case chunkType == "PLTE" && o.seenAfterPLTE:
+		return o.errorf("PLTE chunk after tRNS, bKGD or hIST")
+	case (afterPLTE[chunkType] || beforeIDAT[chunkType]) && o.seenIDAT:
+		return o.errorf("%s chunk after IDAT", chunkType)
+	}
+
+	switch {
+	case chunkType == "PLTE":
+		o.seenPLTE = true
+	case afterPLTE[chunkType]:
+		o.seenAfterPLTE = true
+	}
+
+	return nil
+}
+
+func (o *chunkOrder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrChunkOrder, fmt.Sprintf(format, args...))
+}
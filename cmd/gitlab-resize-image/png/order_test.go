@@ -0,0 +1,86 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkOrder(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		chunks string
+		valid  bool
+	}{
+		{desc: "minimal", chunks: "IHDR IDAT IEND", valid: true},
+		{desc: "palette", chunks: "IHDR iCCP gAMA PLTE tRNS bKGD pHYs IDAT IDAT tEXt IEND", valid: true},
+		{desc: "ancillary chunks without palette", chunks: "IHDR tRNS sRGB IDAT IEND", valid: true},
+		{desc: "iCCP after PLTE", chunks: "IHDR PLTE iCCP IDAT IEND"},
+		{desc: "iCCP after IDAT", chunks: "IHDR IDAT iCCP IEND"},
+		{desc: "PLTE after IDAT", chunks: "IHDR IDAT PLTE IEND"},
+		{desc: "PLTE after tRNS", chunks: "IHDR tRNS PLTE IDAT IEND"},
+		{desc: "two PLTE chunks", chunks: "IHDR PLTE PLTE IDAT IEND"},
+		{desc: "bKGD after IDAT", chunks: "IHDR PLTE IDAT bKGD IEND"},
+		{desc: "pHYs after IDAT", chunks: "IHDR IDAT pHYs IEND"},
+		{desc: "IDAT chunks not consecutive", chunks: "IHDR IDAT tEXt IDAT IEND"},
+		{desc: "IHDR not first", chunks: "gAMA IHDR IDAT IEND"},
+		{desc: "two IHDR chunks", chunks: "IHDR IHDR IDAT IEND"},
+		{desc: "chunk after IEND", chunks: "IHDR IDAT IEND tEXt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var order chunkOrder
+			var err error
+			for _, chunkType := range strings.Fields(tc.chunks) {
+				if err = order.check(chunkType); err != nil {
+					break
+				}
+			}
+
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, ErrChunkOrder), "unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStrictReaderRejectsICCPAfterPLTE(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	misordered := insertEmptyChunks(t, insertEmptyChunks(t, original, "iCCP", 1), "PLTE", 1)
+
+	r, err := NewStrictReader(bytes.NewReader(misordered), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.True(t, errors.Is(err, ErrChunkOrder), "unexpected error: %v", err)
+
+	// The default reader does not check the order, and skips the iCCP chunk
+	r, err = NewReader(bytes.NewReader(misordered), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	err = Validate(bytes.NewReader(misordered), Options{})
+	require.True(t, errors.Is(err, ErrInvalidPNG), "unexpected error: %v", err)
+}
+
+func TestStrictReaderReadsWellOrderedImages(t *testing.T) {
+	for _, path := range []string{goodPNG, strippedPNG} {
+		t.Run(path, func(t *testing.T) {
+			r, err := NewStrictReader(rawImageReader(t, path), Options{})
+			require.NoError(t, err)
+			requireValidImage(t, r, "png")
+		})
+	}
+
+	r, err := NewStrictReader(rawImageReader(t, jpg), Options{})
+	require.NoError(t, err)
+	requireStreamUnchanged(t, r, rawImageReader(t, jpg))
+}
@@ -1,17 +1,96 @@
 package png
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/log"
 )
 
 const (
 	pngMagicLen = 8
 	pngMagic    = "\x89PNG\r\n\x1a\n"
+
+	// maxSpecChunkLength is the largest chunk length the PNG specification allows
+	maxSpecChunkLength = 1<<31 - 1
+
+	// Every chunk starts with its length and type, and ends with a CRC
+	headerLen = 8
+	crcLen    = 4
+)
+
+const (
+	// DefaultMaxChunkLength is the default of Options.MaxChunkLength
+	DefaultMaxChunkLength = 64 << 20
+	// DefaultMaxChunksBeforeImageData is the default of
+	// Options.MaxChunksBeforeImageData
+	DefaultMaxChunksBeforeImageData = 1024
+)
+
+// Options are the limits of a Reader on its input. The zero value has the
+// defaults.
+type Options struct {
+	// MaxChunkLength is the largest chunk a Reader accepts. Chunk lengths
+	// come straight from the input, so we do not want to trust arbitrarily
+	// large ones. It is capped at the limit of the PNG specification. 0
+	// means DefaultMaxChunkLength.
+	MaxChunkLength int64
+	// MaxChunksBeforeImageData is how many chunks a Reader accepts before
+	// the first IDAT chunk. Without a limit, an image made of many tiny
+	// chunks would keep us busy for a long time. 0 means
+	// DefaultMaxChunksBeforeImageData.
+	MaxChunksBeforeImageData int
+	// ReadTimeout is how long a Reader waits for each read from its input,
+	// if the input supports read deadlines like a net.Conn does. Without
+	// it, an upload that trickles in a byte now and then keeps us busy
+	// forever. 0 means no timeout.
+	ReadTimeout time.Duration
+}
+
+func (o Options) maxChunkLength() int64 {
+	switch {
+	case o.MaxChunkLength == 0:
+		return DefaultMaxChunkLength
+	case o.MaxChunkLength > maxSpecChunkLength:
+		return maxSpecChunkLength
+	default:
+		return o.MaxChunkLength
+	}
+}
+
+func (o Options) maxChunksBeforeImageData() int {
+	if o.MaxChunksBeforeImageData == 0 {
+		return DefaultMaxChunksBeforeImageData
+	}
+	return o.MaxChunksBeforeImageData
+}
+
+// pngInputs and otherInputs count the inputs that Readers were created
+// for. Readers pass other input through unchanged, and long-running users
+// of this package may want to know how often that happens.
+var pngInputs, otherInputs int64
+
+// InputCounts returns how many Readers were created for PNGs, and how many
+// for other input, since the process started. Input too short to tell is
+// not counted.
+func InputCounts() (pngs, others int64) {
+	return atomic.LoadInt64(&pngInputs), atomic.LoadInt64(&otherInputs)
+}
+
+var (
+	ErrChunkTooLarge = errors.New("png: chunk too large")
+	ErrTooManyChunks = errors.New("png: too many chunks before image data")
+	// ErrBadIHDR means that the first chunk of a PNG is not an IHDR chunk
+	// of the right length. Image decoders fail in confusing ways on these.
+	ErrBadIHDR = errors.New("png: missing or malformed IHDR chunk")
 )
 
 // Reader is an io.Reader decorator that skips certain PNG chunks known to cause problems.
@@ -19,59 +98,516 @@ const (
 // reader.
 // See also https://gitlab.com/gitlab-org/gitlab/-/issues/287614
 type Reader struct {
-	underlying     io.Reader
-	chunk          io.Reader
+	// source is the reader we were created with, underlying reads from it
+	// with buffering if necessary
+	source     io.Reader
+	underlying io.Reader
+	// raw is the reader that underlying buffers, if we had to buffer our
+	// input. WriteTo reads from it directly, past our small buffer.
+	raw   io.Reader
+	magic []byte
+	// header is the header of the chunk we are forwarding, of which the
+	// last headerLeft bytes have not been read yet. The rest of the chunk
+	// is read straight from underlying.
+	header         [headerLen]byte
+	headerLeft     int
 	bytesRemaining int64
+	maxChunkLength int64
+	// chunksLeft is how many more chunks we accept before image data
+	chunksLeft    int
+	seenHeader    bool
+	seenImageData bool
+	skip          func(chunkType string) bool
+	skipped       []SkippedChunk
+	// skippedBytes is how many bytes of the stream we dropped, counting
+	// the headers and CRCs of skipped chunks
+	skippedBytes int64
+	// strip makes us parse the entire stream, because metadata chunks may
+	// also come after the image data
+	strip bool
+	// order is set in strict mode, which also needs the entire stream
+	order *chunkOrder
+	// checkICCP makes us forward the first valid iCCP chunk, and skip all
+	// others. pending is the chunk we are forwarding, which we had to read
+	// in full to check it.
+	checkICCP bool
+	seenICCP  bool
+	pending   []byte
+	// replaceICCP makes us forward an sRGB chunk in place of the first
+	// iCCP chunk we skip, unless the image has an sRGB chunk already.
+	// insertedSRGB is set once we did, after which we skip sRGB chunks,
+	// because there may be only one.
+	replaceICCP  bool
+	seenSRGB     bool
+	insertedSRGB bool
+	// hasICCP and hasSRGB are set once the input had chunks of these types,
+	// see ConflictingColorSpaces
+	hasICCP bool
+	hasSRGB bool
+	// passthrough is set once there is nothing left for us to skip
+	passthrough bool
+}
+
+// SkippedChunk describes a chunk that was dropped from the stream
+type SkippedChunk struct {
+	Type string
+	// Length is the length of the chunk data, without the chunk header and CRC
+	Length int64
+}
+
+var (
+	// iCCP chunks must come before the first IDAT chunk, so we can forward
+	// the rest of the stream unchanged as soon as we see it
+	problemChunks = map[string]bool{"iCCP": true}
+
+	// metadataChunks are ancillary chunks that do not affect how an image
+	// looks. Text chunks and timestamps may come after the image data.
+	metadataChunks = map[string]bool{
+		"iCCP": true,
+		"tEXt": true,
+		"zTXt": true,
+		"iTXt": true,
+		"tIME": true,
+		"eXIf": true,
+	}
+)
+
+// NewReader returns a Reader that skips iCCP chunks. opts limit what input
+// it accepts.
+func NewReader(r io.Reader, opts Options) (*Reader, error) {
+	return newReader(r, inSet(problemChunks), false, false, opts)
+}
+
+// NewStrippingReader is like NewReader, but it also skips metadata chunks,
+// wherever in the stream they are.
+func NewStrippingReader(r io.Reader, opts Options) (*Reader, error) {
+	return newReader(r, inSet(metadataChunks), true, false, opts)
+}
+
+// NewReaderCriticalOnly is like NewReader, but it skips all ancillary
+// chunks, and forwards only the critical ones: IHDR, PLTE, IDAT and IEND.
+// Besides metadata this drops chunks like tRNS and gAMA, so images may
+// look different.
+func NewReaderCriticalOnly(r io.Reader, opts Options) (*Reader, error) {
+	return newReader(r, isAncillary, true, false, opts)
+}
+
+// NewStrictReader is like NewReader, but reading fails with ErrChunkOrder
+// if the chunks of the image are not in the order that the PNG
+// specification requires. See chunkOrder for the rules we enforce.
+func NewStrictReader(r io.Reader, opts Options) (*Reader, error) {
+	return newReader(r, inSet(problemChunks), false, true, opts)
+}
+
+// NewReaderPreserveValidICCP is like NewReader, but it only skips iCCP
+// chunks if their profile is broken, so that color profiles survive
+// resizing. See validICCP for what we check. Of several valid iCCP chunks
+// we keep the first, because there may be only one.
+func NewReaderPreserveValidICCP(r io.Reader, opts Options) (*Reader, error) {
+	reader, err := newReader(r, inSet(nil), false, false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.checkICCP = true
+	return reader, nil
+}
+
+// NewReaderReplaceICCP is like NewReader, but it puts an sRGB chunk in
+// place of the iCCP chunks it skips. Most broken profiles are meant to
+// describe the sRGB color space anyway, so viewers still apply sensible
+// color management instead of none. The chunks it inserts do not count
+// towards SkippedBytes.
+func NewReaderReplaceICCP(r io.Reader, opts Options) (*Reader, error) {
+	reader, err := newReader(r, inSet(problemChunks), false, false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.replaceICCP = true
+	return reader, nil
+}
+
+// NewReaderSkipping is like NewReader, but it skips chunks of the given
+// types instead of iCCP chunks, see ParseChunkTypes. If any of them may
+// come after the image data, it parses the entire stream.
+func NewReaderSkipping(r io.Reader, chunkTypes []string, opts Options) (*Reader, error) {
+	skip := make(map[string]bool)
+	strip := false
+	for _, chunkType := range chunkTypes {
+		if err := checkSkippable(chunkType); err != nil {
+			return nil, err
+		}
+
+		skip[chunkType] = true
+		if !beforePLTE[chunkType] && !afterPLTE[chunkType] && !beforeIDAT[chunkType] {
+			strip = true
+		}
+	}
+
+	return newReader(r, inSet(skip), strip, false, opts)
+}
+
+// ParseChunkTypes parses a comma-separated list of chunk types for
+// NewReaderSkipping, like "iCCP,sRGB,tEXt". Chunk types are four ASCII
+// letters. Critical chunks cannot be skipped, because images are broken
+// without them.
+func ParseChunkTypes(list string) ([]string, error) {
+	var chunkTypes []string
+	for _, chunkType := range strings.Split(list, ",") {
+		chunkType = strings.TrimSpace(chunkType)
+		if err := checkSkippable(chunkType); err != nil {
+			return nil, err
+		}
+
+		chunkTypes = append(chunkTypes, chunkType)
+	}
+
+	return chunkTypes, nil
+}
+
+func checkSkippable(chunkType string) error {
+	if len(chunkType) != 4 {
+		return fmt.Errorf("png: invalid chunk type %q", chunkType)
+	}
+
+	for i := 0; i < len(chunkType); i++ {
+		if c := chunkType[i] | 0x20; c < 'a' || c > 'z' {
+			return fmt.Errorf("png: invalid chunk type %q", chunkType)
+		}
+	}
+
+	if !isAncillary(chunkType) {
+		return fmt.Errorf("png: cannot skip critical chunk %q", chunkType)
+	}
+
+	return nil
+}
+
+func inSet(chunkTypes map[string]bool) func(string) bool {
+	return func(chunkType string) bool { return chunkTypes[chunkType] }
 }
 
-func NewReader(r io.Reader) (io.Reader, error) {
+// isAncillary tells whether chunks of a type may be dropped. The PNG
+// specification marks ancillary chunks with bit 5 of the first type byte,
+// which makes the first letter lowercase.
+func isAncillary(chunkType string) bool {
+	return chunkType[0]&0x20 != 0
+}
+
+func newReader(source io.Reader, skip func(string) bool, strip bool, strict bool, opts Options) (*Reader, error) {
+	raw := withReadTimeout(source, opts.ReadTimeout)
+	r := buffered(raw)
+	if _, ok := raw.(io.ByteReader); ok {
+		raw = nil
+	}
+
 	magicBytes, err := readMagic(r)
 	if err != nil {
 		return nil, err
 	}
 
 	if string(magicBytes) != pngMagic {
-		debug("Not a PNG - read file unchanged")
-		return io.MultiReader(bytes.NewReader(magicBytes), r), nil
+		atomic.AddInt64(&otherInputs, 1)
+		log.Debugf("Not a PNG - read file unchanged")
+		return &Reader{source: source, underlying: r, raw: raw, magic: magicBytes, passthrough: true}, nil
 	}
 
-	return io.MultiReader(bytes.NewReader(magicBytes), &Reader{underlying: r}), nil
+	atomic.AddInt64(&pngInputs, 1)
+	reader := &Reader{
+		source:         source,
+		underlying:     r,
+		raw:            raw,
+		magic:          magicBytes,
+		skip:           skip,
+		strip:          strip,
+		maxChunkLength: opts.maxChunkLength(),
+		chunksLeft:     opts.maxChunksBeforeImageData(),
+	}
+	if strict {
+		reader.order = &chunkOrder{}
+	}
+
+	return reader, nil
+}
+
+// buffered wraps r in a bufio.Reader, unless it already is buffered or in
+// memory. We read chunk headers 8 bytes at a time, which would otherwise
+// mean a syscall each when reading from a file or socket.
+func buffered(r io.Reader) io.Reader {
+	if _, ok := r.(io.ByteReader); ok {
+		return r
+	}
+
+	return bufio.NewReader(r)
+}
+
+// SkippedChunks returns the chunks that were dropped from the stream so
+// far, in the order they appeared in
+func (r *Reader) SkippedChunks() []SkippedChunk {
+	return r.skipped
+}
+
+// SkippedBytes returns how many bytes were dropped from the stream so far.
+// Unlike the lengths of SkippedChunks, it includes the chunk headers and
+// CRCs, so it is how much shorter than the input the output is, unless
+// the Reader inserts chunks. See NewReaderReplaceICCP.
+func (r *Reader) SkippedBytes() int64 {
+	return r.skippedBytes
+}
+
+// ConflictingColorSpaces tells whether the stream so far had both an iCCP
+// and an sRGB chunk. The PNG specification forbids this, so it is a sign
+// of a broken encoder. We only log it, and read such images like others.
+func (r *Reader) ConflictingColorSpaces() bool {
+	return r.hasICCP && r.hasSRGB
+}
+
+// noteColorSpace records a chunk that says which color space the image is
+// in, and warns the first time the image turns out to have both kinds
+func (r *Reader) noteColorSpace(chunkType string) {
+	conflicting := r.ConflictingColorSpaces()
+	switch chunkType {
+	case "iCCP":
+		r.hasICCP = true
+	case "sRGB":
+		r.hasSRGB = true
+	}
+
+	if !conflicting && r.ConflictingColorSpaces() {
+		log.Warnf("PNG has both iCCP and sRGB chunks, which is not allowed; the encoder may be broken")
+	}
+}
+
+// skipChunk records that we dropped a chunk, which we read in full
+func (r *Reader) skipChunk(chunkType string, chunkLen int64) {
+	r.skipped = append(r.skipped, SkippedChunk{Type: chunkType, Length: chunkLen})
+	r.skippedBytes += headerLen + chunkLen + crcLen
+}
+
+// Close closes the underlying reader if it is an io.Closer
+func (r *Reader) Close() error {
+	if c, ok := r.source.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
 }
 
 func (r *Reader) Read(p []byte) (int, error) {
-	for r.bytesRemaining == 0 {
-		const (
-			headerLen = 8
-			crcLen    = 4
-		)
-		var header [headerLen]byte
-		_, err := io.ReadFull(r.underlying, header[:])
+	// The magic bytes were consumed to detect the format; hand them out first
+	if len(r.magic) > 0 {
+		n := copy(p, r.magic)
+		r.magic = r.magic[n:]
+		return n, nil
+	}
+
+	for r.bytesRemaining == 0 && len(r.pending) == 0 {
+		if r.passthrough {
+			return r.underlying.Read(p)
+		}
+
+		header, chunkLen, chunkType, err := readChunkHeader(r.underlying, r.maxChunkLength)
 		if err != nil {
 			return 0, err
 		}
 
-		chunkLen := int64(binary.BigEndian.Uint32(header[:4]))
-		if chunkType := string(header[4:]); chunkType == "iCCP" {
-			debug("!! iCCP chunk found; skipping")
+		if !r.seenHeader {
+			if err := checkIHDR(chunkType, chunkLen); err != nil {
+				return 0, err
+			}
+			r.seenHeader = true
+		}
+
+		if chunkType == "IDAT" {
+			r.seenImageData = true
+		} else if !r.seenImageData {
+			if r.chunksLeft <= 0 {
+				return 0, ErrTooManyChunks
+			}
+			r.chunksLeft--
+		}
+
+		if r.order != nil {
+			if err := r.order.check(chunkType); err != nil {
+				return 0, err
+			}
+		}
+
+		r.noteColorSpace(chunkType)
+
+		if r.checkICCP && chunkType == "iCCP" {
+			chunk, err := r.readICCP(header, chunkLen)
+			if err != nil {
+				return 0, err
+			}
+			if chunk == nil {
+				r.skipChunk(chunkType, chunkLen)
+			}
+			r.pending = chunk
+			continue
+		}
+
+		if r.replaceICCP && chunkType == "sRGB" && !r.insertedSRGB {
+			r.seenSRGB = true
+		}
+
+		if r.skip(chunkType) || (chunkType == "sRGB" && r.insertedSRGB) {
+			log.Debugf("!! %s chunk found; skipping", chunkType)
 			if _, err := io.CopyN(ioutil.Discard, r.underlying, chunkLen+crcLen); err != nil {
 				return 0, err
 			}
+			r.skipChunk(chunkType, chunkLen)
+
+			if r.replaceICCP && chunkType == "iCCP" && !r.seenSRGB {
+				log.Debugf("!! inserting sRGB chunk in place of iCCP chunk")
+				r.pending = srgbChunk
+				r.seenSRGB = true
+				r.insertedSRGB = true
+			}
 			continue
 		}
 
+		if chunkType == "IDAT" && !r.strip && r.order == nil {
+			r.passthrough = true
+		}
+
+		r.header = header
+		r.headerLeft = headerLen
 		r.bytesRemaining = headerLen + chunkLen + crcLen
-		r.chunk = io.MultiReader(bytes.NewReader(header[:]), io.LimitReader(r.underlying, r.bytesRemaining-headerLen))
 	}
 
-	n, err := r.chunk.Read(p)
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	if r.headerLeft > 0 {
+		n := copy(p, r.header[headerLen-r.headerLeft:])
+		r.headerLeft -= n
+		r.bytesRemaining -= int64(n)
+		return n, nil
+	}
+
+	if int64(len(p)) > r.bytesRemaining {
+		p = p[:r.bytesRemaining]
+	}
+	n, err := r.underlying.Read(p)
 	r.bytesRemaining -= int64(n)
 	return n, err
 }
 
-func debug(args ...interface{}) {
-	if os.Getenv("DEBUG") == "1" {
-		fmt.Fprintln(os.Stderr, args...)
+// WriteTo implements io.WriterTo, which io.Copy prefers over Read. Once
+// there is nothing left for us to skip, it hands the rest of the stream,
+// which is mostly image data, to the underlying reader in one go instead
+// of copying it through a small buffer. Until then, and for readers that
+// parse the entire stream, it forwards what Read returns.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var buf []byte
+	for !r.passthrough || len(r.magic) > 0 || r.bytesRemaining > 0 || len(r.pending) > 0 {
+		if buf == nil {
+			buf = make([]byte, 32<<10)
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	br, ok := r.underlying.(*bufio.Reader)
+	if !ok || r.raw == nil {
+		n, err := io.Copy(w, r.underlying)
+		return written + n, err
+	}
+
+	// Copying from the buffer would mean writes of its size, so we only
+	// write out what it holds and copy the rest from raw. That lets
+	// io.Copy use large reads, or splice from sockets and files.
+	head, _ := br.Peek(br.Buffered())
+	m, err := w.Write(head)
+	written += int64(m)
+	br.Discard(m)
+	if err != nil {
+		return written, err
+	}
+	if m < len(head) {
+		return written, io.ErrShortWrite
 	}
+
+	n, err := io.Copy(w, r.raw)
+	return written + n, err
+}
+
+// readICCP reads the rest of an iCCP chunk whose header was just read. It
+// returns the entire chunk if we forward it, and nil if we skip it.
+func (r *Reader) readICCP(header [headerLen]byte, chunkLen int64) ([]byte, error) {
+	if r.seenICCP || chunkLen > maxICCPLength {
+		log.Debugf("!! iCCP chunk found; skipping")
+		_, err := io.CopyN(ioutil.Discard, r.underlying, chunkLen+crcLen)
+		return nil, err
+	}
+
+	chunk := make([]byte, headerLen+chunkLen+crcLen)
+	copy(chunk, header[:])
+	if _, err := io.ReadFull(r.underlying, chunk[headerLen:]); err != nil {
+		return nil, err
+	}
+
+	data, crc := chunk[headerLen:headerLen+chunkLen], chunk[headerLen+chunkLen:]
+	if binary.BigEndian.Uint32(crc) != crc32.ChecksumIEEE(chunk[4:headerLen+chunkLen]) {
+		log.Debugf("!! iCCP chunk with CRC mismatch found; skipping")
+		return nil, nil
+	}
+	if err := validICCP(data); err != nil {
+		log.Debugf("!! invalid iCCP chunk found (%v); skipping", err)
+		return nil, nil
+	}
+
+	r.seenICCP = true
+	return chunk, nil
+}
+
+// checkIHDR checks the type and length of the first chunk
+func checkIHDR(chunkType string, chunkLen int64) error {
+	if chunkType != "IHDR" {
+		return fmt.Errorf("%w: first chunk is %q", ErrBadIHDR, chunkType)
+	}
+	if chunkLen != ihdrLen {
+		return fmt.Errorf("%w: IHDR chunk of %d bytes", ErrBadIHDR, chunkLen)
+	}
+
+	return nil
+}
+
+// readChunkHeader reads the length and type of the next chunk
+func readChunkHeader(r io.Reader, maxChunkLength int64) (header [headerLen]byte, chunkLen int64, chunkType string, err error) {
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return header, 0, "", err
+	}
+
+	chunkLen = int64(binary.BigEndian.Uint32(header[:4]))
+	chunkType = string(header[4:])
+	if chunkLen > maxChunkLength {
+		return header, 0, "", fmt.Errorf("%q chunk of %d bytes: %w", chunkType, chunkLen, ErrChunkTooLarge)
+	}
+
+	return header, chunkLen, chunkType, nil
 }
 
 // Consume PNG magic and proceed to reading the IHDR chunk.
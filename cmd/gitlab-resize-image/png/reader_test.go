@@ -2,12 +2,16 @@ package png
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"hash/crc64"
 	"image"
 	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"testing/iotest"
 
 	_ "image/jpeg" // registers JPEG format for image.Decode
 	"image/png"    // registers PNG format for image.Decode
@@ -66,8 +70,733 @@ func TestReadPNGWithBadICCPChunkDecodesAndReEncodesSuccessfully(t *testing.T) {
 	requireStreamUnchanged(t, buf1, buf2)
 }
 
+func TestInputCounts(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		imagePath      string
+		expectedPNGs   int64
+		expectedOthers int64
+	}{
+		{desc: "PNG", imagePath: goodPNG, expectedPNGs: 1},
+		{desc: "JPEG", imagePath: jpg, expectedOthers: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pngs, others := InputCounts()
+			_, err := NewReader(rawImageReader(t, tc.imagePath), Options{})
+			require.NoError(t, err)
+
+			newPNGs, newOthers := InputCounts()
+			require.Equal(t, tc.expectedPNGs, newPNGs-pngs)
+			require.Equal(t, tc.expectedOthers, newOthers-others)
+		})
+	}
+
+	pngs, others := InputCounts()
+	_, err := NewReader(bytes.NewReader([]byte("GIF")), Options{})
+	require.Error(t, err)
+	newPNGs, newOthers := InputCounts()
+	require.Equal(t, pngs, newPNGs, "input too short to tell must not be counted")
+	require.Equal(t, others, newOthers, "input too short to tell must not be counted")
+}
+
+func TestSkippedChunks(t *testing.T) {
+	r, err := NewReader(rawImageReader(t, badPNG), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	skipped := r.SkippedChunks()
+	require.NotEmpty(t, skipped)
+	for _, chunk := range skipped {
+		require.Equal(t, "iCCP", chunk.Type)
+		require.NotZero(t, chunk.Length)
+	}
+
+	r, err = NewReader(rawImageReader(t, goodPNG), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Empty(t, r.SkippedChunks())
+}
+
+func TestSkippedBytes(t *testing.T) {
+	bad, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+	iccpBytes := chunkBytes(t, bad, "iCCP")
+	require.NotZero(t, iccpBytes)
+
+	r, err := NewReader(iotest.OneByteReader(bytes.NewReader(bad)), Options{})
+	require.NoError(t, err)
+	require.Zero(t, r.SkippedBytes())
+
+	// Reading one byte at a time makes us return in the middle of the
+	// chunks around the iCCP chunk
+	out, err := ioutil.ReadAll(iotest.OneByteReader(r))
+	require.NoError(t, err)
+
+	var chunkLen int64
+	for _, chunk := range r.SkippedChunks() {
+		chunkLen += headerLen + chunk.Length + crcLen
+	}
+	require.Equal(t, chunkLen, r.SkippedBytes())
+	require.Equal(t, iccpBytes, r.SkippedBytes())
+	require.Equal(t, int64(len(bad)-len(out)), r.SkippedBytes())
+
+	r, err = NewReader(rawImageReader(t, goodPNG), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Zero(t, r.SkippedBytes())
+}
+
+func TestReaderRejectsTooManyChunks(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	existing := chunksBeforeImageData(t, original)
+
+	testCases := []struct {
+		desc        string
+		opts        Options
+		chunks      int
+		expectedErr error
+	}{
+		{desc: "at the limit", chunks: DefaultMaxChunksBeforeImageData - existing},
+		{desc: "over the limit", chunks: DefaultMaxChunksBeforeImageData - existing + 1, expectedErr: ErrTooManyChunks},
+		{desc: "far over the limit", chunks: 100000, expectedErr: ErrTooManyChunks},
+		{desc: "at a lower limit", opts: Options{MaxChunksBeforeImageData: 16}, chunks: 16 - existing},
+		{desc: "over a lower limit", opts: Options{MaxChunksBeforeImageData: 16}, chunks: 16 - existing + 1, expectedErr: ErrTooManyChunks},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			data := insertEmptyChunks(t, original, "tIME", tc.chunks)
+
+			for _, newReader := range []func(io.Reader, Options) (*Reader, error){NewReader, NewStrippingReader, NewStrictReader, NewReaderCriticalOnly, NewReaderPreserveValidICCP} {
+				r, err := newReader(bytes.NewReader(data), tc.opts)
+				require.NoError(t, err)
+
+				_, err = ioutil.ReadAll(r)
+				if tc.expectedErr == nil {
+					require.NoError(t, err)
+				} else {
+					require.Equal(t, tc.expectedErr, err)
+				}
+			}
+
+			err := Validate(bytes.NewReader(data), tc.opts)
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, ErrInvalidPNG), "unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReaderRejectsBadIHDR(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	const ihdrEnd = pngMagicLen + headerLen + ihdrLen + crcLen
+	require.Equal(t, "IHDR", string(original[pngMagicLen+4:pngMagicLen+8]))
+
+	testCases := []struct {
+		desc string
+		data []byte
+	}{
+		{desc: "missing IHDR", data: append([]byte(pngMagic), original[ihdrEnd:]...)},
+		{desc: "empty IHDR", data: append(append([]byte(pngMagic), emptyChunk("IHDR")...), original[ihdrEnd:]...)},
+		{desc: "IHDR not first", data: append(append([]byte(pngMagic), emptyChunk("tIME")...), original[pngMagicLen:]...)},
+		{desc: "only IEND", data: append([]byte(pngMagic), emptyChunk("IEND")...)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, newReader := range []func(io.Reader, Options) (*Reader, error){NewReader, NewStrippingReader, NewStrictReader, NewReaderCriticalOnly, NewReaderPreserveValidICCP} {
+				r, err := newReader(bytes.NewReader(tc.data), Options{})
+				require.NoError(t, err)
+
+				_, err = ioutil.ReadAll(r)
+				require.True(t, errors.Is(err, ErrBadIHDR), "unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func chunksBeforeImageData(t *testing.T, png []byte) int {
+	n := 0
+	for pos := pngMagicLen; pos+headerLen <= len(png); n++ {
+		if string(png[pos+4:pos+8]) == "IDAT" {
+			return n
+		}
+		pos += headerLen + int(binary.BigEndian.Uint32(png[pos:])) + crcLen
+	}
+
+	require.Fail(t, "no IDAT chunk")
+	return 0
+}
+
+// insertEmptyChunks adds n zero-length chunks of the given type right after IHDR
+func insertEmptyChunks(t *testing.T, png []byte, chunkType string, n int) []byte {
+	const ihdrEnd = pngMagicLen + headerLen + ihdrLen + crcLen
+	require.Equal(t, "IHDR", string(png[pngMagicLen+4:pngMagicLen+8]))
+
+	chunk := emptyChunk(chunkType)
+
+	var out bytes.Buffer
+	out.Write(png[:ihdrEnd])
+	for i := 0; i < n; i++ {
+		out.Write(chunk)
+	}
+	out.Write(png[ihdrEnd:])
+	return out.Bytes()
+}
+
+func emptyChunk(chunkType string) []byte {
+	chunk := make([]byte, headerLen, headerLen+crcLen)
+	copy(chunk[4:], chunkType)
+	var crc [crcLen]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE([]byte(chunkType)))
+	return append(chunk, crc[:]...)
+}
+
+// readCounter counts how often it is read from. Like a file or socket, it
+// is no io.ByteReader, so Reader buffers it.
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// byteReadCounter pretends to be buffered already
+type byteReadCounter struct {
+	*readCounter
+}
+
+func (byteReadCounter) ReadByte() (byte, error) {
+	panic("not implemented")
+}
+
+func TestReaderBuffersSmallReads(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	withText := insertTextChunks(t, original)
+
+	for _, newReader := range []func(io.Reader, Options) (*Reader, error){NewReader, NewStrippingReader, NewStrictReader, NewReaderCriticalOnly, NewReaderPreserveValidICCP} {
+		unbuffered := &readCounter{r: bytes.NewReader(withText)}
+		r, err := newReader(unbuffered, Options{})
+		require.NoError(t, err)
+		bufferedOut, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		alreadyBuffered := byteReadCounter{&readCounter{r: bytes.NewReader(withText)}}
+		r, err = newReader(alreadyBuffered, Options{})
+		require.NoError(t, err)
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+
+		require.Equal(t, out, bufferedOut, "buffering must not change the output")
+		require.Less(t, unbuffered.reads, alreadyBuffered.reads)
+	}
+}
+
+func TestReaderBuffersNonPNGs(t *testing.T) {
+	unbuffered := &readCounter{r: rawImageReader(t, jpg)}
+	r, err := NewReader(unbuffered, Options{})
+	require.NoError(t, err)
+
+	requireStreamUnchanged(t, r, rawImageReader(t, jpg))
+}
+
+func BenchmarkReaderReads(b *testing.B) {
+	data, err := ioutil.ReadFile(goodPNG)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name string
+		wrap func(*readCounter) io.Reader
+	}{
+		{name: "unbuffered", wrap: func(c *readCounter) io.Reader { return byteReadCounter{c} }},
+		{name: "buffered", wrap: func(c *readCounter) io.Reader { return c }},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				c := &readCounter{r: bytes.NewReader(data)}
+				r, err := NewStrippingReader(bm.wrap(c), Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				reads += c.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkReaderForwardsChunks(b *testing.B) {
+	const (
+		chunks   = 64
+		chunkLen = 64 << 10
+	)
+
+	data := idatHeavyImage(chunks, chunkLen)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The stripping reader forwards every chunk itself instead of
+		// passing the image data through
+		r, err := NewStrippingReader(bytes.NewReader(data), Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// idatHeavyImage returns a PNG-like stream of many large IDAT chunks. The
+// reader does not check CRCs, so the chunks can be all zeroes.
+func idatHeavyImage(chunks, chunkLen int) []byte {
+	var image bytes.Buffer
+	image.WriteString(pngMagic)
+	image.Write(make([]byte, headerLen+ihdrLen+crcLen))
+	copy(image.Bytes()[pngMagicLen:], "\x00\x00\x00\x0dIHDR")
+	for i := 0; i < chunks; i++ {
+		chunk := make([]byte, headerLen+chunkLen+crcLen)
+		binary.BigEndian.PutUint32(chunk, uint32(chunkLen))
+		copy(chunk[4:], "IDAT")
+		image.Write(chunk)
+	}
+	image.Write(emptyChunk("IEND"))
+	return image.Bytes()
+}
+
+// writeOnly hides the io.ReaderFrom of a writer, so that io.Copy into it
+// depends on the io.WriterTo of the source
+type writeOnly struct{ w io.Writer }
+
+func (w writeOnly) Write(p []byte) (int, error) { return w.w.Write(p) }
+
+func TestReaderWriteTo(t *testing.T) {
+	original, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+	withText := insertTextChunks(t, original)
+	jpgData, err := ioutil.ReadFile(jpg)
+	require.NoError(t, err)
+
+	readers := []struct {
+		desc      string
+		newReader func(io.Reader, Options) (*Reader, error)
+	}{
+		{desc: "default", newReader: NewReader},
+		{desc: "stripping", newReader: NewStrippingReader},
+		{desc: "critical only", newReader: NewReaderCriticalOnly},
+		{desc: "preserve valid iCCP", newReader: NewReaderPreserveValidICCP},
+		{desc: "replace iCCP", newReader: NewReaderReplaceICCP},
+	}
+	inputs := []struct {
+		desc string
+		data []byte
+	}{
+		{desc: "png", data: withText},
+		{desc: "idat heavy", data: idatHeavyImage(4, 100000)},
+		{desc: "jpeg", data: jpgData},
+	}
+
+	for _, rd := range readers {
+		for _, in := range inputs {
+			t.Run(rd.desc+"/"+in.desc, func(t *testing.T) {
+				r, err := rd.newReader(bytes.NewReader(in.data), Options{})
+				require.NoError(t, err)
+				expected, err := ioutil.ReadAll(struct{ io.Reader }{r})
+				require.NoError(t, err)
+
+				r, err = rd.newReader(bytes.NewReader(in.data), Options{})
+				require.NoError(t, err)
+				var out bytes.Buffer
+				n, err := r.WriteTo(writeOnly{&out})
+				require.NoError(t, err)
+
+				require.Equal(t, int64(len(expected)), n)
+				require.Equal(t, expected, out.Bytes())
+			})
+		}
+	}
+}
+
+// readFromRecorder records the readers it reads from
+type readFromRecorder struct {
+	bytes.Buffer
+	from []io.Reader
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.from = append(w.from, r)
+	return w.Buffer.ReadFrom(r)
+}
+
+// largestWrite records the size of the largest write to it
+type largestWrite struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *largestWrite) Write(p []byte) (int, error) {
+	if len(p) > w.largest {
+		w.largest = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestReaderWriteToPassesImageDataThrough(t *testing.T) {
+	data := idatHeavyImage(4, 100000)
+
+	t.Run("buffered input", func(t *testing.T) {
+		c := &readCounter{r: bytes.NewReader(data)}
+		r, err := NewReader(c, Options{})
+		require.NoError(t, err)
+
+		var out readFromRecorder
+		_, err = io.Copy(&out, r)
+		require.NoError(t, err)
+		require.Equal(t, data, out.Bytes())
+		// Past our buffer, so that writers like sockets can splice
+		require.Equal(t, []io.Reader{c}, out.from, "image data must be read from the input directly")
+	})
+
+	t.Run("input in memory", func(t *testing.T) {
+		r, err := NewReader(bytes.NewReader(data), Options{})
+		require.NoError(t, err)
+
+		var out largestWrite
+		_, err = io.Copy(writeOnly{&out}, r)
+		require.NoError(t, err)
+		require.Equal(t, data, out.Bytes())
+		// Read forwards the first IDAT chunk, and the rest is one write
+		require.GreaterOrEqual(t, out.largest, 3*100000)
+	})
+}
+
+// BenchmarkReaderWriteTo compares copying an image with mostly image data
+// through Read to copying it with WriteTo
+func BenchmarkReaderWriteTo(b *testing.B) {
+	data := idatHeavyImage(64, 64<<10)
+
+	benchmarks := []struct {
+		name string
+		wrap func(*Reader) io.Reader
+	}{
+		{name: "read", wrap: func(r *Reader) io.Reader { return struct{ io.Reader }{r} }},
+		{name: "writeTo", wrap: func(r *Reader) io.Reader { return r }},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r, err := NewReader(bytes.NewReader(data), Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(writeOnly{ioutil.Discard}, bm.wrap(r)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReaderClosesUnderlyingReader(t *testing.T) {
+	for _, path := range []string{goodPNG, jpg} {
+		t.Run(path, func(t *testing.T) {
+			underlying := &closeRecorder{Reader: rawImageReader(t, path)}
+
+			r, err := NewReader(underlying, Options{})
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, 1, underlying.closed)
+		})
+	}
+
+	r, err := NewReader(bytes.NewReader([]byte(pngMagic)), Options{})
+	require.NoError(t, err)
+	require.NoError(t, r.Close(), "closing a reader that is not an io.Closer is a no-op")
+}
+
+func TestStrippingReaderSkipsMetadataAfterImageData(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	withText := insertTextChunks(t, original)
+
+	// The default reader forwards everything after IDAT unchanged
+	r, err := NewReader(bytes.NewReader(withText), Options{})
+	require.NoError(t, err)
+	defaultOut, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tEXt", "tEXt"}, findChunks(t, defaultOut, "tEXt"))
+
+	r, err = NewStrippingReader(bytes.NewReader(withText), Options{})
+	require.NoError(t, err)
+	strippedOut, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Empty(t, findChunks(t, strippedOut, "tEXt"))
+	require.Equal(t, []SkippedChunk{
+		{Type: "tEXt", Length: int64(len("Comment\x00before IDAT"))},
+		{Type: "tEXt", Length: int64(len("Comment\x00after IDAT"))},
+	}, r.SkippedChunks())
+	require.Equal(t, []string{"IEND"}, findChunks(t, strippedOut, "IEND"))
+
+	requireValidImage(t, bytes.NewReader(strippedOut), "png")
+	requireStreamUnchanged(t, bytes.NewReader(strippedOut), bytes.NewReader(original))
+}
+
+func TestReaderCriticalOnly(t *testing.T) {
+	original, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+	withMetadata := insertTextChunks(t, original)
+
+	r, err := NewReaderCriticalOnly(bytes.NewReader(withMetadata), Options{})
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	require.Less(t, len(out), len(withMetadata))
+	require.Equal(t, []string{"IHDR", "IDAT", "IEND"}, uniqueChunkTypes(t, out))
+
+	var skipped []string
+	for _, c := range r.SkippedChunks() {
+		skipped = append(skipped, c.Type)
+	}
+	require.Contains(t, skipped, "iCCP")
+	require.Contains(t, skipped, "tEXt")
+	require.Equal(t, "tEXt", skipped[len(skipped)-1], "ancillary chunks after IDAT must be skipped too")
+
+	requireValidImage(t, bytes.NewReader(out), "png")
+}
+
+func TestParseChunkTypes(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		list      string
+		expected  []string
+		expectErr string
+	}{
+		{desc: "one", list: "iCCP", expected: []string{"iCCP"}},
+		{desc: "several", list: "iCCP, sRGB,tEXt", expected: []string{"iCCP", "sRGB", "tEXt"}},
+		{desc: "private chunk", list: "prVt", expected: []string{"prVt"}},
+		{desc: "empty entry", list: "iCCP,,tEXt", expectErr: `png: invalid chunk type ""`},
+		{desc: "too short", list: "iCC", expectErr: `png: invalid chunk type "iCC"`},
+		{desc: "too long", list: "iCCPs", expectErr: `png: invalid chunk type "iCCPs"`},
+		{desc: "not a letter", list: "tEX1", expectErr: `png: invalid chunk type "tEX1"`},
+		{desc: "critical chunk", list: "iCCP,IDAT", expectErr: `png: cannot skip critical chunk "IDAT"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			chunkTypes, err := ParseChunkTypes(tc.list)
+			if tc.expectErr != "" {
+				require.EqualError(t, err, tc.expectErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, chunkTypes)
+		})
+	}
+}
+
+func TestReaderSkipping(t *testing.T) {
+	original, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+	withText := insertTextChunks(t, original)
+
+	iccp := len(findChunks(t, withText, "iCCP"))
+	require.NotZero(t, iccp)
+
+	testCases := []struct {
+		desc         string
+		list         string
+		expectedICCP int
+		expectedText int
+	}{
+		{desc: "iCCP", list: "iCCP", expectedICCP: 0, expectedText: 2},
+		{desc: "text only", list: "tEXt", expectedICCP: iccp, expectedText: 0},
+		{desc: "iCCP and text", list: "iCCP,sRGB,tEXt", expectedICCP: 0, expectedText: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			chunkTypes, err := ParseChunkTypes(tc.list)
+			require.NoError(t, err)
+
+			r, err := NewReaderSkipping(bytes.NewReader(withText), chunkTypes, Options{})
+			require.NoError(t, err)
+			out, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+
+			require.Len(t, findChunks(t, out, "iCCP"), tc.expectedICCP)
+			require.Len(t, findChunks(t, out, "tEXt"), tc.expectedText, "text after the image data counts too")
+			require.Equal(t, int64(len(withText)-len(out)), r.SkippedBytes())
+			// The profile of badPNG is broken, so it only decodes without
+			if tc.expectedICCP == 0 {
+				requireValidImage(t, bytes.NewReader(out), "png")
+			}
+		})
+	}
+
+	_, err = NewReaderSkipping(bytes.NewReader(withText), []string{"IEND"}, Options{})
+	require.EqualError(t, err, `png: cannot skip critical chunk "IEND"`)
+}
+
+func TestIsAncillary(t *testing.T) {
+	for _, chunkType := range []string{"IHDR", "PLTE", "IDAT", "IEND"} {
+		require.False(t, isAncillary(chunkType), chunkType)
+	}
+	for _, chunkType := range []string{"iCCP", "tEXt", "tRNS", "gAMA", "pHYs", "eXIf", "prVt"} {
+		require.True(t, isAncillary(chunkType), chunkType)
+	}
+}
+
+func TestStrippingReaderLeavesOtherFormatsUnchanged(t *testing.T) {
+	r, err := NewStrippingReader(rawImageReader(t, jpg), Options{})
+	require.NoError(t, err)
+	requireStreamUnchanged(t, r, rawImageReader(t, jpg))
+}
+
+func TestReaderRejectsHugeChunks(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		chunk string
+	}{
+		{desc: "skipped chunk", chunk: "\xff\xff\xff\xf0iCCP"},
+		{desc: "forwarded chunk", chunk: "\xff\xff\xff\xf0IDAT"},
+		{desc: "beyond the PNG specification", chunk: "\x80\x00\x00\x00IHDR"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader([]byte(pngMagic+tc.chunk)), Options{})
+			require.NoError(t, err)
+
+			_, err = ioutil.ReadAll(r)
+			require.True(t, errors.Is(err, ErrChunkTooLarge), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestReaderRespectsMaxChunkLength(t *testing.T) {
+	r, err := NewReader(rawImageReader(t, goodPNG), Options{MaxChunkLength: 12})
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(r)
+	require.True(t, errors.Is(err, ErrChunkTooLarge), "unexpected error: %v", err)
+}
+
+// insertTextChunks adds a tEXt chunk right after IHDR, and one right before
+// IEND, after the image data
+func insertTextChunks(t *testing.T, png []byte) []byte {
+	const ihdrEnd = pngMagicLen + 8 + 13 + 4
+	require.Equal(t, "IHDR", string(png[pngMagicLen+4:pngMagicLen+8]))
+
+	iendStart := len(png) - 12
+	require.Equal(t, "IEND", string(png[iendStart+4:iendStart+8]))
+
+	var out bytes.Buffer
+	out.Write(png[:ihdrEnd])
+	out.Write(textChunk("Comment", "before IDAT"))
+	out.Write(png[ihdrEnd:iendStart])
+	out.Write(textChunk("Comment", "after IDAT"))
+	out.Write(png[iendStart:])
+	return out.Bytes()
+}
+
+func textChunk(keyword, text string) []byte {
+	data := []byte("tEXt" + keyword + "\x00" + text)
+
+	chunk := make([]byte, 4, 4+len(data)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)-4))
+	chunk = append(chunk, data...)
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(data))
+	return append(chunk, crc[:]...)
+}
+
+// findChunks returns the types of all chunks of the given type in a PNG
+func findChunks(t *testing.T, png []byte, chunkType string) []string {
+	var found []string
+	for pos := pngMagicLen; pos < len(png); {
+		require.True(t, pos+8 <= len(png), "truncated chunk header")
+		length := int(binary.BigEndian.Uint32(png[pos:]))
+		if typ := string(png[pos+4 : pos+8]); typ == chunkType {
+			found = append(found, typ)
+		}
+		pos += 8 + length + 4
+	}
+	return found
+}
+
+// chunkBytes returns how many bytes the chunks of the given type take up
+// in a PNG, including their headers and CRCs
+func chunkBytes(t *testing.T, png []byte, chunkType string) int64 {
+	var total int64
+	for pos := pngMagicLen; pos < len(png); {
+		require.True(t, pos+8 <= len(png), "truncated chunk header")
+		length := int(binary.BigEndian.Uint32(png[pos:]))
+		if string(png[pos+4:pos+8]) == chunkType {
+			total += int64(8 + length + 4)
+		}
+		pos += 8 + length + 4
+	}
+	return total
+}
+
+// uniqueChunkTypes returns the types of the chunks in a PNG, in the order
+// they first appear in
+func uniqueChunkTypes(t *testing.T, png []byte) []string {
+	var types []string
+	seen := make(map[string]bool)
+	for pos := pngMagicLen; pos < len(png); {
+		require.True(t, pos+8 <= len(png), "truncated chunk header")
+		length := int(binary.BigEndian.Uint32(png[pos:]))
+		if typ := string(png[pos+4 : pos+8]); !seen[typ] {
+			seen[typ] = true
+			types = append(types, typ)
+		}
+		pos += 8 + length + 4
+	}
+	return types
+}
+
 func pngReader(t *testing.T, path string) io.Reader {
-	r, err := NewReader(rawImageReader(t, path))
+	r, err := NewReader(rawImageReader(t, path), Options{})
 	require.NoError(t, err)
 	return r
 }
@@ -0,0 +1,26 @@
+package png
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// srgbPerceptual is the rendering intent of the sRGB chunks we insert. It
+// is what PNG encoders write for photographs.
+const srgbPerceptual = 0
+
+// srgbChunk is an sRGB chunk, which tells viewers that the image is in the
+// sRGB color space. We put it in place of iCCP chunks we drop, when
+// replacing them is enabled. Like iCCP, sRGB has to come before PLTE and
+// IDAT, so chunk order stays valid.
+var srgbChunk = newSRGBChunk()
+
+func newSRGBChunk() []byte {
+	chunk := make([]byte, headerLen+1+crcLen)
+	binary.BigEndian.PutUint32(chunk, 1)
+	copy(chunk[4:], "sRGB")
+	chunk[headerLen] = srgbPerceptual
+	binary.BigEndian.PutUint32(chunk[headerLen+1:], crc32.ChecksumIEEE(chunk[4:headerLen+1]))
+
+	return chunk
+}
@@ -0,0 +1,129 @@
+package png
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/log"
+)
+
+func TestReaderReplaceICCP(t *testing.T) {
+	original, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+
+	r, err := NewReaderReplaceICCP(bytes.NewReader(original), Options{})
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	// The fixture has two iCCP chunks, which make room for one sRGB chunk,
+	// in place of the first
+	require.Empty(t, iccpChunks(t, out))
+	require.Equal(t, []string{"sRGB"}, findChunks(t, out, "sRGB"))
+	require.Len(t, r.SkippedChunks(), 2)
+	require.Equal(t, int64(len(original)-len(out)+len(srgbChunk)), r.SkippedBytes())
+
+	require.NoError(t, Validate(bytes.NewReader(out), Options{}))
+	requireValidImage(t, bytes.NewReader(out), "png")
+
+	strict, err := NewStrictReader(bytes.NewReader(out), Options{})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(strict)
+	require.NoError(t, err, "sRGB chunk must be in a valid place")
+}
+
+func TestReaderReplaceICCPKeepsExistingSRGB(t *testing.T) {
+	// The good fixture has an sRGB chunk, and the bad one has none
+	good, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	bad, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc    string
+		input   []byte
+		skipped []string
+	}{
+		{
+			desc:    "sRGB before iCCP",
+			input:   insertChunk(t, bad, srgbChunk),
+			skipped: []string{"iCCP", "iCCP"},
+		},
+		{
+			desc:    "sRGB after iCCP",
+			input:   insertChunk(t, good, iccpChunk(validProfileData(t))),
+			skipped: []string{"iCCP", "sRGB"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r, err := NewReaderReplaceICCP(bytes.NewReader(tc.input), Options{})
+			require.NoError(t, err)
+			out, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+
+			require.Empty(t, iccpChunks(t, out))
+			require.Equal(t, []string{"sRGB"}, findChunks(t, out, "sRGB"))
+			var skipped []string
+			for _, c := range r.SkippedChunks() {
+				skipped = append(skipped, c.Type)
+			}
+			require.Equal(t, tc.skipped, skipped)
+			requireValidImage(t, bytes.NewReader(out), "png")
+		})
+	}
+}
+
+func TestReaderReplaceICCPWithoutICCP(t *testing.T) {
+	r, err := NewReaderReplaceICCP(rawImageReader(t, goodPNG), Options{})
+	require.NoError(t, err)
+	requireStreamUnchanged(t, r, rawImageReader(t, goodPNG))
+	require.Empty(t, r.SkippedChunks())
+}
+
+func TestReaderWarnsAboutConflictingColorSpaces(t *testing.T) {
+	good, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	bad, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+	// The good fixture has an sRGB chunk
+	both := insertChunk(t, good, iccpChunk(validProfileData(t)))
+
+	testCases := []struct {
+		desc      string
+		input     []byte
+		newReader func(io.Reader, Options) (*Reader, error)
+		warned    bool
+	}{
+		{desc: "both", input: both, newReader: NewReader, warned: true},
+		{desc: "both, preserving valid iCCP", input: both, newReader: NewReaderPreserveValidICCP, warned: true},
+		{desc: "both, replacing iCCP", input: both, newReader: NewReaderReplaceICCP, warned: true},
+		{desc: "sRGB only", input: good, newReader: NewReader},
+		{desc: "iCCP only", input: bad, newReader: NewReader},
+		{desc: "inserted sRGB", input: bad, newReader: NewReaderReplaceICCP},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var stderr bytes.Buffer
+			defer log.SetDefault(log.SetDefault(log.New(&stderr, log.LevelWarn, "test")))
+
+			r, err := tc.newReader(bytes.NewReader(tc.input), Options{})
+			require.NoError(t, err)
+			_, err = ioutil.ReadAll(r)
+			require.NoError(t, err, "the conflict is not fatal")
+
+			require.Equal(t, tc.warned, r.ConflictingColorSpaces())
+			if tc.warned {
+				require.Equal(t, "test: warn: PNG has both iCCP and sRGB chunks, which is not allowed; the encoder may be broken\n", stderr.String())
+			} else {
+				require.Empty(t, stderr.String())
+			}
+		})
+	}
+}
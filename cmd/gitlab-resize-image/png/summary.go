@@ -0,0 +1,81 @@
+package png
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Summary describes the chunks of a PNG
+type Summary struct {
+	// Chunks has an entry for each chunk type, in the order in which the
+	// types first appear
+	Chunks []ChunkSummary
+	// Bytes is the length of the PNG up to the end of its IEND chunk,
+	// including the magic
+	Bytes int64
+}
+
+// ChunkSummary describes the chunks of one type
+type ChunkSummary struct {
+	Type  string
+	Count int
+	// Length is the total length of the chunk data, without the chunk
+	// headers and CRCs
+	Length int64
+}
+
+// Summarize reads the PNG from r up to its IEND chunk, and returns which
+// chunks it has, including those after the image data. It is meant for
+// analyzing uploaded images, so unlike Validate it does not check the
+// order or the CRCs of the chunks. Returned errors wrap ErrInvalidPNG, or
+// are read errors. Of opts, only MaxChunkLength applies.
+func Summarize(r io.Reader, opts Options) (*Summary, error) {
+	r = buffered(r)
+
+	magicBytes, err := readMagic(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidPNG)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(magicBytes) != pngMagic {
+		return nil, fmt.Errorf("%w: not a PNG", ErrInvalidPNG)
+	}
+
+	summary := &Summary{Bytes: pngMagicLen}
+	index := make(map[string]int)
+	maxLen := opts.maxChunkLength()
+	for {
+		_, chunkLen, chunkType, err := readChunkHeader(r, maxLen)
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: missing IEND chunk", ErrInvalidPNG)
+		}
+		if errors.Is(err, ErrChunkTooLarge) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPNG, err)
+		}
+		if err != nil {
+			return nil, truncated(err)
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, r, chunkLen+crcLen); err != nil {
+			return nil, truncated(err)
+		}
+
+		i, ok := index[chunkType]
+		if !ok {
+			i = len(summary.Chunks)
+			index[chunkType] = i
+			summary.Chunks = append(summary.Chunks, ChunkSummary{Type: chunkType})
+		}
+		summary.Chunks[i].Count++
+		summary.Chunks[i].Length += chunkLen
+		summary.Bytes += headerLen + chunkLen + crcLen
+
+		if chunkType == "IEND" {
+			return summary, nil
+		}
+	}
+}
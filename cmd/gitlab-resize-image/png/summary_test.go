@@ -0,0 +1,74 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	bad, err := ioutil.ReadFile(badPNG)
+	require.NoError(t, err)
+
+	summary, err := Summarize(bytes.NewReader(bad), Options{})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(bad)), summary.Bytes)
+
+	var types []string
+	counts := make(map[string]int)
+	for _, c := range summary.Chunks {
+		types = append(types, c.Type)
+		counts[c.Type] = c.Count
+		require.Equal(t, chunkBytes(t, bad, c.Type), c.Length+int64(c.Count)*(headerLen+crcLen), c.Type)
+	}
+	require.Equal(t, uniqueChunkTypes(t, bad), types)
+	require.Equal(t, 2, counts["iCCP"])
+	require.Equal(t, 1, counts["IEND"])
+}
+
+func TestSummarizeChunksAfterImageData(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	withText := insertTextChunks(t, original)
+
+	summary, err := Summarize(bytes.NewReader(withText), Options{})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(withText)), summary.Bytes)
+
+	var text *ChunkSummary
+	for i := range summary.Chunks {
+		if summary.Chunks[i].Type == "tEXt" {
+			text = &summary.Chunks[i]
+		}
+	}
+	require.NotNil(t, text)
+	require.Equal(t, 2, text.Count)
+	require.Equal(t, int64(len("Comment\x00before IDAT")+len("Comment\x00after IDAT")), text.Length)
+}
+
+func TestSummarizeErrors(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	jpeg, err := ioutil.ReadFile(jpg)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc string
+		data []byte
+	}{
+		{desc: "not a PNG", data: jpeg},
+		{desc: "too short", data: []byte(pngMagic[:4])},
+		{desc: "truncated", data: original[:len(original)/2]},
+		{desc: "missing IEND", data: original[:len(original)-(headerLen+crcLen)]},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := Summarize(bytes.NewReader(tc.data), Options{})
+			require.True(t, errors.Is(err, ErrInvalidPNG), "unexpected error: %v", err)
+		})
+	}
+}
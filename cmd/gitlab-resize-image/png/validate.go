@@ -0,0 +1,110 @@
+package png
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var ErrInvalidPNG = errors.New("invalid PNG")
+
+// ihdrLen is the data length of the IHDR chunk
+const ihdrLen = 13
+
+// Validate checks that r is a structurally valid PNG without decoding its
+// pixels: it must start with the PNG magic and an IHDR chunk, contain
+// image data, end with an IEND chunk, its chunks must be in the order
+// NewStrictReader enforces, and the CRCs of all chunks must match.
+// opts limit the input like those of a Reader, except for the read timeout.
+// Returned errors wrap ErrInvalidPNG, or are read errors.
+func Validate(r io.Reader, opts Options) error {
+	r = buffered(r)
+
+	magicBytes, err := readMagic(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: too short", ErrInvalidPNG)
+	}
+	if err != nil {
+		return err
+	}
+	if string(magicBytes) != pngMagic {
+		return fmt.Errorf("%w: not a PNG", ErrInvalidPNG)
+	}
+
+	maxLen, maxChunks := opts.maxChunkLength(), opts.maxChunksBeforeImageData()
+	var order chunkOrder
+	seenIDAT := false
+	for i := 0; ; i++ {
+		header, chunkLen, chunkType, err := readChunkHeader(r, maxLen)
+		if err == io.EOF {
+			return fmt.Errorf("%w: missing IEND chunk", ErrInvalidPNG)
+		}
+		if errors.Is(err, ErrChunkTooLarge) {
+			return fmt.Errorf("%w: %v", ErrInvalidPNG, err)
+		}
+		if err != nil {
+			return truncated(err)
+		}
+
+		if err := order.check(chunkType); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPNG, err)
+		}
+		if chunkType == "IHDR" && chunkLen != ihdrLen {
+			return fmt.Errorf("%w: IHDR chunk of %d bytes", ErrInvalidPNG, chunkLen)
+		}
+		if !seenIDAT && chunkType != "IDAT" && i >= maxChunks {
+			return fmt.Errorf("%w: %v", ErrInvalidPNG, ErrTooManyChunks)
+		}
+
+		if err := checkCRC(r, header, chunkLen, chunkType); err != nil {
+			return err
+		}
+
+		switch chunkType {
+		case "IDAT":
+			seenIDAT = true
+		case "IEND":
+			if !seenIDAT {
+				return fmt.Errorf("%w: no IDAT chunk", ErrInvalidPNG)
+			}
+
+			var trailing [1]byte
+			if n, _ := io.ReadFull(r, trailing[:]); n > 0 {
+				return fmt.Errorf("%w: data after IEND chunk", ErrInvalidPNG)
+			}
+
+			return nil
+		}
+	}
+}
+
+// checkCRC reads the data and CRC of a chunk whose header was just read.
+// The CRC covers the chunk type and data.
+func checkCRC(r io.Reader, header [headerLen]byte, chunkLen int64, chunkType string) error {
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	if _, err := io.CopyN(crc, r, chunkLen); err != nil {
+		return truncated(err)
+	}
+
+	var expected [crcLen]byte
+	if _, err := io.ReadFull(r, expected[:]); err != nil {
+		return truncated(err)
+	}
+
+	if binary.BigEndian.Uint32(expected[:]) != crc.Sum32() {
+		return fmt.Errorf("%w: CRC mismatch in %q chunk", ErrInvalidPNG, chunkType)
+	}
+
+	return nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated chunk", ErrInvalidPNG)
+	}
+
+	return err
+}
@@ -0,0 +1,63 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	original, err := ioutil.ReadFile(goodPNG)
+	require.NoError(t, err)
+	jpeg, err := ioutil.ReadFile(jpg)
+	require.NoError(t, err)
+
+	const ihdrEnd = pngMagicLen + headerLen + ihdrLen + crcLen
+	iendStart := len(original) - (headerLen + crcLen)
+
+	badCRC := append([]byte{}, original...)
+	badCRC[ihdrEnd+headerLen] ^= 0xff // first data byte of the chunk after IHDR
+
+	ihdrNotFirst := append(append(append([]byte{}, original[:pngMagicLen]...), textChunk("Comment", "too early")...), original[pngMagicLen:]...)
+
+	testCases := []struct {
+		desc  string
+		data  []byte
+		valid bool
+	}{
+		{desc: "valid", data: original, valid: true},
+		{desc: "valid with metadata", data: insertTextChunks(t, original), valid: true},
+		{desc: "valid without iCCP chunk", data: mustReadFile(t, strippedPNG), valid: true},
+		// The iCCP chunk of this fixture is what makes it bad
+		{desc: "bad iCCP chunk", data: mustReadFile(t, badPNG)},
+		{desc: "missing IEND", data: original[:iendStart]},
+		{desc: "bad CRC", data: badCRC},
+		{desc: "truncated", data: original[:len(original)/2]},
+		{desc: "IHDR not first", data: ihdrNotFirst},
+		{desc: "no IDAT", data: append(append([]byte{}, original[:ihdrEnd]...), original[iendStart:]...)},
+		{desc: "data after IEND", data: append(append([]byte{}, original...), 0)},
+		{desc: "not a PNG", data: jpeg},
+		{desc: "too short", data: []byte(pngMagic[:4])},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := Validate(bytes.NewReader(tc.data), Options{})
+			if tc.valid {
+				require.NoError(t, err)
+				return
+			}
+
+			require.True(t, errors.Is(err, ErrInvalidPNG), "unexpected error: %v", err)
+		})
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,128 @@
+//go:build avif
+// +build avif
+
+package resize
+
+/*
+#cgo pkg-config: libavif
+#include <stdlib.h>
+#include <avif/avif.h>
+
+// gl_avif_decode reads the dimensions of the first image in data and, if
+// rgba is not NULL, decodes it into 8-bit RGBA pixels that the caller must
+// free.
+static avifResult gl_avif_decode(const uint8_t *data, size_t size, uint32_t *width, uint32_t *height, uint8_t **rgba) {
+	avifDecoder *decoder = avifDecoderCreate();
+	if (!decoder) {
+		return AVIF_RESULT_UNKNOWN_ERROR;
+	}
+
+	avifResult result = avifDecoderSetIOMemory(decoder, data, size);
+	if (result == AVIF_RESULT_OK) {
+		result = avifDecoderParse(decoder);
+	}
+	if (result == AVIF_RESULT_OK) {
+		*width = decoder->image->width;
+		*height = decoder->image->height;
+	}
+
+	if (result == AVIF_RESULT_OK && rgba) {
+		result = avifDecoderNextImage(decoder);
+	}
+	if (result == AVIF_RESULT_OK && rgba) {
+		avifRGBImage rgb;
+		avifRGBImageSetDefaults(&rgb, decoder->image);
+		rgb.format = AVIF_RGB_FORMAT_RGBA;
+		rgb.depth = 8;
+		rgb.rowBytes = rgb.width * 4;
+		rgb.pixels = malloc((size_t)rgb.rowBytes * rgb.height);
+
+		if (!rgb.pixels) {
+			result = AVIF_RESULT_UNKNOWN_ERROR;
+		} else if ((result = avifImageYUVToRGB(decoder->image, &rgb)) == AVIF_RESULT_OK) {
+			*rgba = rgb.pixels;
+		} else {
+			free(rgb.pixels);
+		}
+	}
+
+	avifDecoderDestroy(decoder);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"unsafe"
+
+	"github.com/disintegration/imaging"
+)
+
+// AVIF decodes the first image of AVIF files with libavif. imaging cannot
+// encode AVIF, so we transcode them to PNG.
+var AVIF = Format{
+	Name:         "avif",
+	Magic:        avifMagic,
+	Decode:       decodeAVIF,
+	DecodeConfig: decodeAVIFConfig,
+	Output:       imaging.PNG,
+}
+
+func init() {
+	DefaultFormats = append(DefaultFormats, AVIF)
+}
+
+func decodeAVIF(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("avif: empty input")
+	}
+
+	var (
+		width, height C.uint32_t
+		rgba          *C.uint8_t
+	)
+	result := C.gl_avif_decode((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &width, &height, &rgba)
+	if result != C.AVIF_RESULT_OK {
+		return nil, avifError(result)
+	}
+	defer C.free(unsafe.Pointer(rgba))
+
+	stride := 4 * int(width)
+	return &image.NRGBA{
+		Pix:    C.GoBytes(unsafe.Pointer(rgba), C.int(stride*int(height))),
+		Stride: stride,
+		Rect:   image.Rect(0, 0, int(width), int(height)),
+	}, nil
+}
+
+func decodeAVIFConfig(r io.Reader) (image.Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if len(data) == 0 {
+		return image.Config{}, errors.New("avif: empty input")
+	}
+
+	var width, height C.uint32_t
+	result := C.gl_avif_decode((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &width, &height, nil)
+	if result != C.AVIF_RESULT_OK {
+		return image.Config{}, avifError(result)
+	}
+
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+func avifError(result C.avifResult) error {
+	return fmt.Errorf("avif: %s", C.GoString(C.avifResultToString(result)))
+}
@@ -0,0 +1,25 @@
+//go:build avif
+// +build avif
+
+package resize
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAVIFIsRegistered(t *testing.T) {
+	format, ok := (*Registry)(nil).match([]byte(avifHeader))
+	require.True(t, ok)
+	require.Equal(t, "avif", format.Name)
+
+	// A bare ftyp box is no image, but libavif must be the one to say so
+	err := Process(strings.NewReader(avifHeader), ioutil.Discard, Options{Width: 10})
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrUnsupportedFormat), "unexpected error: %v", err)
+	require.Contains(t, err.Error(), "decode avif: avif: ")
+}
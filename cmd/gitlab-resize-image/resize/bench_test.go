@@ -0,0 +1,126 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memProfileEnv names a directory to write a heap profile to after each
+// case of BenchmarkProcess, named after the case. Allocations are counted
+// from the start of the process, so run one case at a time to attribute
+// them, for example to png.Reader or imaging:
+//
+//	GL_RESIZE_IMAGE_BENCH_MEMPROFILE=/tmp go test -run XXX -bench 'Process/png/large' ./resize
+//	go tool pprof -sample_index=alloc_space /tmp/BenchmarkProcess_png_large.pprof
+const memProfileEnv = "GL_RESIZE_IMAGE_BENCH_MEMPROFILE"
+
+// benchSizes are the dimensions of the images that BenchmarkProcess scales
+// down to benchWidth: a thumbnail, a screenshot and a photo
+var benchSizes = []struct {
+	desc          string
+	width, height int
+}{
+	{desc: "small", width: 320, height: 240},
+	{desc: "medium", width: 1280, height: 960},
+	{desc: "large", width: 4000, height: 3000},
+}
+
+const benchWidth = 200
+
+// BenchmarkProcess measures all of Process, from sniffing and skipping
+// chunks to decoding, scaling and encoding
+func BenchmarkProcess(b *testing.B) {
+	dir := os.Getenv(memProfileEnv)
+	if dir != "" {
+		defer func(old int) { runtime.MemProfileRate = old }(runtime.MemProfileRate)
+		runtime.MemProfileRate = 1
+	}
+
+	formats := []struct {
+		desc   string
+		encode func(*bytes.Buffer, image.Image) error
+	}{
+		{desc: "png", encode: func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) }},
+		{desc: "jpeg", encode: func(w *bytes.Buffer, img image.Image) error { return stdjpeg.Encode(w, img, nil) }},
+	}
+
+	for _, f := range formats {
+		for _, size := range benchSizes {
+			f, size := f, size
+			b.Run(f.desc+"/"+size.desc, func(b *testing.B) {
+				var data bytes.Buffer
+				require.NoError(b, f.encode(&data, benchImage(size.width, size.height)))
+				opts := Options{Width: benchWidth}
+
+				b.SetBytes(int64(data.Len()))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := Process(bytes.NewReader(data.Bytes()), ioutil.Discard, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				if dir != "" {
+					require.NoError(b, writeMemProfile(dir, b.Name()))
+				}
+			})
+		}
+	}
+}
+
+// benchImage returns an opaque image with smooth gradients, which both
+// PNG and JPEG compress about as well as photos
+func benchImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8((x + y) / 16), A: 0xff})
+		}
+	}
+	return img
+}
+
+// writeMemProfile writes a heap profile to dir, in a file named after the
+// benchmark
+func writeMemProfile(dir, benchmark string) error {
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(benchmark) + ".pprof"
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Profiles only include allocations up to the last garbage collection
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func TestWriteMemProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memprofile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, writeMemProfile(dir, "BenchmarkProcess/png/small"))
+
+	info, err := os.Stat(filepath.Join(dir, "BenchmarkProcess_png_small.pprof"))
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+}
@@ -0,0 +1,142 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// See https://github.com/woltapp/blurhash/blob/master/Algorithm.md for how
+// blurhashes are computed
+
+const (
+	// blurhashXComponents and blurhashYComponents are how much detail a
+	// blurhash has, horizontally and vertically. 4x3 is what the reference
+	// implementation suggests.
+	blurhashXComponents = 4
+	blurhashYComponents = 3
+
+	// blurhashSize is the width and height we scale larger images down to
+	// before computing their blurhash. Its few components do not need
+	// more pixels, and it keeps the cost independent of the image size.
+	blurhashSize = 32
+
+	blurhashDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurhash returns the blurhash of img, a short string that clients can
+// decode into a blurred placeholder while they load the image
+func blurhash(img image.Image) string {
+	bounds := img.Bounds()
+	if bounds.Dx() > blurhashSize || bounds.Dy() > blurhashSize {
+		img = imaging.Fit(img, blurhashSize, blurhashSize, imaging.Box)
+		bounds = img.Bounds()
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	linear := make([][3]float64, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			linear = append(linear, [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)})
+		}
+	}
+
+	var factors [][3]float64
+	for j := 0; j < blurhashYComponents; j++ {
+		for i := 0; i < blurhashXComponents; i++ {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					pixel := linear[y*width+x]
+					for c := range factor {
+						factor[c] += basis * pixel[c]
+					}
+				}
+			}
+
+			scale := normalization / float64(width*height)
+			for c := range factor {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	writeBase83(&hash, (blurhashXComponents-1)+(blurhashYComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	actualMax := 0.0
+	for _, factor := range ac {
+		for _, v := range factor {
+			actualMax = math.Max(actualMax, math.Abs(v))
+		}
+	}
+	quantizedMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+	maxValue := float64(quantizedMax+1) / 166
+	writeBase83(&hash, quantizedMax, 1)
+
+	writeBase83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		value := 0
+		for _, v := range factor {
+			quantized := clampInt(int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+			value = value*19 + quantized
+		}
+		writeBase83(&hash, value, 2)
+	}
+
+	return hash.String()
+}
+
+// writeBase83 writes value as a base 83 number of length digits
+func writeBase83(b *strings.Builder, value int, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+
+	for ; divisor > 0; divisor /= 83 {
+		b.WriteByte(blurhashDigits[value/divisor%83])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
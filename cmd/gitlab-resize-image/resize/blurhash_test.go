@@ -0,0 +1,55 @@
+package resize
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlurhashSolidColor(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 200, G: 100, B: 50, A: 0xff}), image.Point{}, draw.Src)
+
+	// The basis functions are sampled at the left and top edges of the
+	// pixels, so the AC components are small but not zero even for solid
+	// colors. The first character says there are 4x3 components, and the
+	// DC component after the next one is the color.
+	hash := blurhash(img)
+	require.Len(t, hash, 28)
+	require.Equal(t, "L", hash[:1])
+	require.Equal(t, "M|T9", hash[2:6])
+}
+
+func TestBlurhashStable(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 12))
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 16), G: uint8(y * 20), B: uint8(255 - x*y), A: 0xff})
+		}
+	}
+
+	require.Equal(t, "LvGuVb2|w$o$qrR%jre?g4fhfPfk", blurhash(img))
+}
+
+func TestProcessBlurhash(t *testing.T) {
+	var hashes []string
+	opts := Options{Width: 10, OnBlurhash: func(hash string) error {
+		hashes = append(hashes, hash)
+		return nil
+	}}
+	require.NoError(t, Process(openFixture(t, pngFixture), ioutil.Discard, opts))
+
+	require.Len(t, hashes, 1)
+	// The fixture is scaled down before we compute its hash
+	require.Len(t, hashes[0], 28, "4x3 components take 28 characters")
+
+	errFailed := errors.New("failed")
+	opts.OnBlurhash = func(string) error { return errFailed }
+	err := Process(openFixture(t, pngFixture), ioutil.Discard, opts)
+	require.True(t, errors.Is(err, errFailed), "unexpected error: %v", err)
+}
@@ -0,0 +1,100 @@
+package resize
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// ihdrBitDepthOffset is where the bit depth is in a PNG that starts
+	// with its IHDR chunk, right before the color type
+	ihdrBitDepthOffset = ihdrColorTypeOffset - 1
+)
+
+// pngBitDepth returns the bits per sample of the PNG that head is the start
+// of, or 0 if head does not start with an IHDR chunk
+func pngBitDepth(head []byte) int {
+	if len(head) <= ihdrBitDepthOffset || string(head[12:16]) != "IHDR" {
+		return 0
+	}
+	return int(head[ihdrBitDepthOffset])
+}
+
+// depthFilters are the interpolators of scaleImage16 for the filters of
+// scaleImage. x/image/draw has no lanczos or box filter, so we use the
+// closest one it has.
+var depthFilters = map[string]draw.Interpolator{
+	"":           draw.CatmullRom,
+	"lanczos":    draw.CatmullRom,
+	"catmullrom": draw.CatmullRom,
+	"linear":     draw.BiLinear,
+	"box":        draw.BiLinear,
+	"nearest":    draw.NearestNeighbor,
+}
+
+// scaleImage16 is like scaleImage, but keeps 16 bits per channel. imaging
+// only scales into 8-bit images.
+func scaleImage16(src image.Image, opts Options) image.Image {
+	sr, width, height := scaleGeometry(src.Bounds(), opts)
+
+	var dst draw.Image
+	if _, ok := src.(*image.Gray16); ok {
+		dst = image.NewGray16(image.Rect(0, 0, width, height))
+	} else {
+		dst = image.NewNRGBA64(image.Rect(0, 0, width, height))
+	}
+
+	filter, ok := depthFilters[opts.Filter]
+	if !ok {
+		filter = draw.CatmullRom
+	}
+	filter.Scale(dst, dst.Bounds(), src, sr, draw.Src, nil)
+
+	return dst
+}
+
+// scaleGeometry returns the part of src that scaleImage keeps, and the
+// dimensions it scales that part to
+func scaleGeometry(src image.Rectangle, opts Options) (image.Rectangle, int, int) {
+	srcW, srcH := src.Dx(), src.Dy()
+	aspect := float64(srcW) / float64(srcH)
+
+	switch {
+	case opts.Crop == CropCover:
+		// Cut off what sticks out of the box on either side
+		crop := src
+		if box := float64(opts.Width) / float64(opts.Height); aspect > box {
+			w := roundDimension(float64(srcH) * box)
+			crop.Min.X += (srcW - w) / 2
+			crop.Max.X = crop.Min.X + w
+		} else {
+			h := roundDimension(float64(srcW) / box)
+			crop.Min.Y += (srcH - h) / 2
+			crop.Max.Y = crop.Min.Y + h
+		}
+		return crop, opts.Width, opts.Height
+	case opts.Crop == CropContain && opts.Width > 0 && opts.Height > 0:
+		if srcW <= opts.Width && srcH <= opts.Height {
+			return src, srcW, srcH
+		}
+		if aspect > float64(opts.Width)/float64(opts.Height) {
+			return src, opts.Width, roundDimension(float64(opts.Width) / aspect)
+		}
+		return src, roundDimension(float64(opts.Height) * aspect), opts.Height
+	default:
+		width, height := opts.Width, opts.Height
+		if width == 0 {
+			width = roundDimension(float64(height) * aspect)
+		}
+		if height == 0 {
+			height = roundDimension(float64(width) / aspect)
+		}
+		return src, width, height
+	}
+}
+
+func roundDimension(v float64) int {
+	return int(math.Max(1, math.Floor(v+0.5)))
+}
@@ -0,0 +1,63 @@
+package resize
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// These are the classes of errors that Process fails with. Use errors.Is
+// to tell them apart; the more specific errors below belong to them.
+var (
+	// ErrUnsupportedFormat means that the input is an image, but we cannot
+	// decode its format
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrDecode means that the input is broken
+	ErrDecode = errors.New("cannot decode image")
+	// ErrTooLarge means that the input exceeds one of the limits in Options
+	ErrTooLarge = errors.New("image too large")
+	// ErrTimeout means that Options.Timeout passed, or that reading the
+	// input timed out
+	ErrTimeout = errors.New("resizing timed out")
+)
+
+// classError is err, which also belongs to class
+type classError struct {
+	class error
+	err   error
+}
+
+func classify(class error, err error) error {
+	return &classError{class: class, err: err}
+}
+
+func (e *classError) Error() string { return e.err.Error() }
+
+func (e *classError) Unwrap() error { return e.err }
+
+func (e *classError) Is(target error) bool { return target == e.class }
+
+// timeoutReader fails with ErrTimeout once deadline has passed, unless it
+// is zero. Read errors that are timeouts, like those of network
+// connections, become ErrTimeout as well.
+type timeoutReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if t.expired() {
+		return 0, ErrTimeout
+	}
+
+	n, err := t.r.Read(p)
+	if te, ok := err.(interface{ Timeout() bool }); ok && te.Timeout() {
+		err = classify(ErrTimeout, err)
+	}
+
+	return n, err
+}
+
+func (t *timeoutReader) expired() bool {
+	return !t.deadline.IsZero() && time.Now().After(t.deadline)
+}
@@ -0,0 +1,120 @@
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessErrorClasses(t *testing.T) {
+	data, err := ioutil.ReadFile(pngFixture)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		input    io.Reader
+		opts     Options
+		expected []error
+	}{
+		{
+			desc:     "known format that is not registered",
+			input:    strings.NewReader(avifHeader),
+			opts:     Options{Registry: NewRegistry(PNG)},
+			expected: []error{ErrUnsupportedFormat},
+		},
+		{
+			desc:     "unknown image format",
+			input:    strings.NewReader("RIFF\x00\x00\x00\x00WEBPVP8 "),
+			expected: []error{ErrUnsupportedFormat, image.ErrFormat},
+		},
+		{
+			desc:     "multi-page TIFF",
+			input:    openFixture(t, "../../../testdata/image_multipage.tiff"),
+			opts:     Options{RejectMultiPage: true},
+			expected: []error{ErrUnsupportedFormat, ErrMultiPageTIFF},
+		},
+		{
+			desc:     "truncated image",
+			input:    bytes.NewReader(data[:len(data)/2]),
+			expected: []error{ErrDecode},
+		},
+		{
+			desc:     "truncated image with limits",
+			input:    bytes.NewReader(data[:100]),
+			opts:     Options{MaxPixels: 1000},
+			expected: []error{ErrDecode},
+		},
+		{
+			desc:     "too many pixels",
+			input:    bytes.NewReader(data),
+			opts:     Options{MaxPixels: 1000},
+			expected: []error{ErrTooLarge, ErrTooManyPixels},
+		},
+		{
+			desc:     "larger than expected",
+			input:    bytes.NewReader(data),
+			opts:     Options{ExpectedBytes: 100},
+			expected: []error{ErrTooLarge, ErrLargerThanExpected},
+		},
+		{
+			desc:     "timeout",
+			input:    &slowReader{r: bytes.NewReader(data), delay: 10 * time.Millisecond},
+			opts:     Options{Timeout: time.Millisecond},
+			expected: []error{ErrTimeout},
+		},
+		{
+			desc:     "read timeout",
+			input:    io.MultiReader(bytes.NewReader(data[:100]), &errReader{err: timeoutError{}}),
+			expected: []error{ErrTimeout},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.opts.Width = 10
+			err := Process(tc.input, ioutil.Discard, tc.opts)
+			require.Error(t, err)
+
+			for _, expected := range tc.expected {
+				require.True(t, errors.Is(err, expected), "expected %v, got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestClassifyKeepsMessage(t *testing.T) {
+	err := classify(ErrDecode, errors.New("decode png: unexpected EOF"))
+	require.Equal(t, "decode png: unexpected EOF", err.Error())
+	require.True(t, errors.Is(err, ErrDecode))
+	require.False(t, errors.Is(err, ErrTooLarge))
+}
+
+// slowReader waits for delay before each read
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// timeoutError is like the errors of network connections whose deadline
+// has passed
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+
+func (timeoutError) Timeout() bool { return true }
@@ -0,0 +1,133 @@
+package resize
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+)
+
+// animationPalette is used for all frames of resized animations. Frames
+// are composited before we resize them, so their pixels may come from
+// several of the original palettes. The last entry is transparent.
+var animationPalette = append(append(color.Palette{}, palette.WebSafe...), color.Transparent)
+
+// defaultMaxAnimationPixels is Options.MaxAnimationPixels if that is 0,
+// which is 100 frames of 500x500 pixels
+const defaultMaxAnimationPixels = 100 * 500 * 500
+
+var errGIFTruncated = errors.New("truncated GIF")
+
+// animationPixels returns the number of frames of the GIF in data times
+// its width and height. We decode and resize every frame as a whole image,
+// so this is what an animation costs us. It walks the blocks of the GIF
+// without decoding any of them.
+func animationPixels(data []byte) (int, error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, errGIFTruncated
+	}
+	width := int(data[6]) | int(data[7])<<8
+	height := int(data[8]) | int(data[9])<<8
+	pos := 13 + colorTableSize(data[10])
+
+	frames := 0
+	for {
+		if pos >= len(data) {
+			return 0, errGIFTruncated
+		}
+
+		switch data[pos] {
+		case 0x21: // Extension introducer, followed by the label
+			pos += 2
+		case 0x2c: // Image descriptor
+			if pos+10 > len(data) {
+				return 0, errGIFTruncated
+			}
+			// The descriptor, the local color table and the LZW code size
+			pos += 10 + colorTableSize(data[pos+9]) + 1
+			frames++
+		case 0x3b: // Trailer
+			return frames * width * height, nil
+		default:
+			return 0, fmt.Errorf("unknown GIF block 0x%02x", data[pos])
+		}
+
+		// Extensions and image data are sub-blocks up to an empty one
+		for {
+			if pos >= len(data) {
+				return 0, errGIFTruncated
+			}
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// colorTableSize returns the size of the color table that the flags of a
+// logical screen or image descriptor announce
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << (flags&0x07 + 1)
+}
+
+// resizeAnimation resizes every frame of g with scale. Frames of a GIF
+// may only cover part of the image and build on the frames before them,
+// so we resize what the animation looks like at each frame rather than
+// the frames themselves. The resized frames each cover the whole image.
+func resizeAnimation(g *gif.GIF, scale func(image.Image) *image.NRGBA) *gif.GIF {
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, len(g.Image)),
+		Delay:     g.Delay,
+		Disposal:  make([]byte, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	var previous *image.NRGBA
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = imageCopy(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		resized := scale(canvas)
+		paletted := image.NewPaletted(resized.Bounds(), animationPalette)
+		draw.FloydSteinberg.Draw(paletted, resized.Bounds(), resized, resized.Bounds().Min)
+		out.Image[i] = paletted
+		// Each resized frame replaces the one before it entirely
+		out.Disposal[i] = gif.DisposalBackground
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	bounds := out.Image[0].Bounds()
+	out.Config = image.Config{ColorModel: animationPalette, Width: bounds.Dx(), Height: bounds.Dy()}
+
+	return out
+}
+
+func imageCopy(img *image.NRGBA) *image.NRGBA {
+	c := image.NewNRGBA(img.Bounds())
+	copy(c.Pix, img.Pix)
+	return c
+}
@@ -0,0 +1,41 @@
+package resize
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnimationPixels(t *testing.T) {
+	static, err := ioutil.ReadFile("../../../testdata/image.gif")
+	require.NoError(t, err)
+	animated, err := ioutil.ReadFile("../../../testdata/image_animated.gif")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc        string
+		data        []byte
+		expected    int
+		expectedErr bool
+	}{
+		{desc: "static", data: static, expected: 16 * 16},
+		{desc: "animated", data: animated, expected: 3 * 16 * 16},
+		{desc: "truncated", data: animated[:len(animated)/2], expectedErr: true},
+		{desc: "header only", data: animated[:10], expectedErr: true},
+		{desc: "unknown block", data: append(append([]byte{}, animated[:13]...), 0x42), expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pixels, err := animationPixels(tc.data)
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, pixels)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	// ihdrColorTypeOffset is where the color type is in a PNG that starts
+	// with its IHDR chunk: after the magic, the chunk header, the width and
+	// height, and the bit depth
+	ihdrColorTypeOffset = 8 + 8 + 4 + 4 + 1
+	// colorTypeIndexed is the PNG color type of palette images
+	colorTypeIndexed = 3
+)
+
+// isIndexedPNG tells whether head is the start of a PNG with a palette
+func isIndexedPNG(head []byte) bool {
+	return len(head) > ihdrColorTypeOffset &&
+		string(head[12:16]) == "IHDR" &&
+		head[ihdrColorTypeOffset] == colorTypeIndexed
+}
+
+// quantize maps every pixel of img to the closest color of p. It does not
+// dither: p is the palette of the original image rather than a generic
+// one, and dithering would make the image compress worse.
+func quantize(img image.Image, p color.Palette) *image.Paletted {
+	paletted := image.NewPaletted(img.Bounds(), p)
+	draw.Draw(paletted, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	return paletted
+}
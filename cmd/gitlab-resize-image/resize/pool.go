@@ -0,0 +1,67 @@
+package resize
+
+import (
+	"io"
+	"sync"
+)
+
+// Job is an image for a Pool to resize
+type Job struct {
+	Reader  io.Reader
+	Writer  io.Writer
+	Options Options
+	// Done receives the result of Process for this job, if set. The worker
+	// blocks until it is received, so use a buffered channel if you do not
+	// wait for it.
+	Done chan<- error
+}
+
+// Pool resizes images with a fixed number of goroutines. Each of them
+// keeps its own scratch buffers across jobs, which saves allocations when
+// resizing many images. Nothing else is shared between jobs; every job
+// gets its own png.Reader.
+type Pool struct {
+	jobs chan Job
+	wg   sync.WaitGroup
+}
+
+// NewPool starts a pool of n workers. Close it to stop them.
+func NewPool(n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+
+	p := &Pool{jobs: make(chan Job)}
+
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Jobs returns the channel to send jobs to. It blocks while all workers are
+// busy. Do not send to it after calling Close.
+func (p *Pool) Jobs() chan<- Job {
+	return p.jobs
+}
+
+// Close waits for the workers to finish the jobs they are processing, and
+// stops them
+func (p *Pool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	var buf buffers
+	for job := range p.jobs {
+		err := process(job.Reader, job.Writer, job.Options, &buf)
+		if job.Done != nil {
+			job.Done <- err
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	data, err := ioutil.ReadFile(pngFixture)
+	require.NoError(t, err)
+
+	pool := NewPool(4)
+	defer pool.Close()
+
+	const jobs = 20
+	outputs := make([]bytes.Buffer, jobs)
+	results := make([]chan error, jobs)
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
+
+	go func() {
+		for i := range outputs {
+			pool.Jobs() <- Job{
+				Reader:  bytes.NewReader(data),
+				Writer:  &outputs[i],
+				Options: Options{Width: 10 + i, MaxPixels: 555 * 512},
+				Done:    results[i],
+			}
+		}
+	}()
+
+	for i := range outputs {
+		require.NoError(t, <-results[i])
+
+		cfg, format, err := image.DecodeConfig(&outputs[i])
+		require.NoError(t, err)
+		require.Equal(t, "png", format)
+		require.Equal(t, 10+i, cfg.Width, "job %d", i)
+	}
+}
+
+func TestPoolReportsErrorsPerJob(t *testing.T) {
+	pool := NewPool(2)
+	defer pool.Close()
+
+	bad := make(chan error, 1)
+	good := make(chan error, 1)
+
+	pool.Jobs() <- Job{Reader: strings.NewReader("<html>not an image</html>"), Writer: ioutil.Discard, Options: Options{Width: 8}, Done: bad}
+	pool.Jobs() <- Job{Reader: openFixture(t, pngFixture), Writer: ioutil.Discard, Options: Options{Width: 8}, Done: good}
+
+	require.True(t, errors.Is(<-bad, ErrNotAnImage))
+	require.NoError(t, <-good)
+}
+
+func TestPoolCloseWaitsForJobs(t *testing.T) {
+	pool := NewPool(2)
+
+	var out bytes.Buffer
+	pool.Jobs() <- Job{Reader: openFixture(t, pngFixture), Writer: &out, Options: Options{Width: 8}}
+	pool.Close()
+
+	_, _, err := image.DecodeConfig(&out)
+	require.NoError(t, err, "job must be done when Close returns")
+}
+
+func BenchmarkPool(b *testing.B) {
+	data, err := ioutil.ReadFile(pngFixture)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := Options{Width: 64, MaxPixels: 555 * 512}
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := Process(bytes.NewReader(data), ioutil.Discard, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool := NewPool(runtime.GOMAXPROCS(0))
+		defer pool.Close()
+
+		results := make(chan error, b.N)
+		go func() {
+			for i := 0; i < b.N; i++ {
+				pool.Jobs() <- Job{Reader: bytes.NewReader(data), Writer: ioutil.Discard, Options: opts, Done: results}
+			}
+		}()
+
+		for i := 0; i < b.N; i++ {
+			if err := <-results; err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
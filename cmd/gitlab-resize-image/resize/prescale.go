@@ -0,0 +1,101 @@
+package resize
+
+import (
+	"image"
+	"io"
+	"math"
+)
+
+// denominators are the fractions of their size that Format.DecodeScaled can
+// decode images at, smallest first
+var denominators = []int{8, 4, 2}
+
+// decodeScaled decodes the image read from r with format.DecodeScaled, at
+// the smallest fraction of its size that is still at least as large as the
+// largest of the resized images, whose options are targets. Resizing the
+// rest of the way from there looks the same as resizing the full image,
+// but takes a fraction of the memory and time.
+//
+// The dimensions of the returned options are those of the resized images,
+// derived from the full image. Deriving them from the smaller one could
+// round them differently.
+func decodeScaled(format Format, r io.Reader, targets []Options) (image.Image, []Options, error) {
+	scaled := append([]Options(nil), targets...)
+	src, err := format.DecodeScaled(r, func(cfg image.Config) int {
+		n := 0
+		for _, opts := range targets {
+			if d := decodeDenominator(cfg, opts); n == 0 || d < n {
+				n = d
+			}
+		}
+
+		for i, opts := range targets {
+			if n > 1 && opts.Crop != CropCover {
+				scaled[i].Width, scaled[i].Height = targetSize(cfg.Width, cfg.Height, opts)
+				scaled[i].Crop = CropNone
+			}
+		}
+		return n
+	})
+
+	return src, scaled, err
+}
+
+// decodeDenominator returns the largest n for which an image of cfg decoded
+// at 1/n of its size is at least as large as the resized image
+func decodeDenominator(cfg image.Config, opts Options) int {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return 1
+	}
+
+	width, height := targetSize(cfg.Width, cfg.Height, opts)
+	for _, n := range denominators {
+		if ceilDiv(cfg.Width, n) >= width && ceilDiv(cfg.Height, n) >= height {
+			return n
+		}
+	}
+
+	return 1
+}
+
+// targetSize returns the dimensions that scaleImage resizes an image of
+// srcW x srcH to, before cropping it. It rounds like imaging does.
+func targetSize(srcW, srcH int, opts Options) (int, int) {
+	width, height := opts.Width, opts.Height
+
+	switch {
+	case opts.Crop == CropCover:
+		// imaging.Fill scales the image to cover the box, and one of the
+		// dimensions follows from the other
+		if srcW*height > srcH*width {
+			width = 0
+		} else {
+			height = 0
+		}
+	case opts.Crop == CropContain && width > 0 && height > 0:
+		if srcW <= width && srcH <= height {
+			return srcW, srcH
+		}
+
+		// This is what imaging.Fit does
+		srcAspect := float64(srcW) / float64(srcH)
+		if srcAspect > float64(width)/float64(height) {
+			height = int(float64(width) / srcAspect)
+		} else {
+			width = int(float64(height) * srcAspect)
+		}
+	}
+
+	if width <= 0 {
+		width = int(math.Max(1, math.Floor(float64(height)*float64(srcW)/float64(srcH)+0.5)))
+	}
+	if height <= 0 {
+		height = int(math.Max(1, math.Floor(float64(width)*float64(srcH)/float64(srcW)+0.5)))
+	}
+
+	return width, height
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,132 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const jpegFixture = "../../../testdata/image.jpg"
+
+func TestDecodeDenominator(t *testing.T) {
+	// The dimensions of jpegFixture
+	cfg := image.Config{Width: 1200, Height: 1145}
+
+	testCases := []struct {
+		desc     string
+		opts     Options
+		expected int
+	}{
+		{desc: "width at 1/8", opts: Options{Width: 150}, expected: 8},
+		{desc: "width just above 1/8", opts: Options{Width: 151}, expected: 4},
+		{desc: "width at 1/2", opts: Options{Width: 600}, expected: 2},
+		{desc: "width above 1/2", opts: Options{Width: 601}, expected: 1},
+		{desc: "height", opts: Options{Height: 300}, expected: 2},
+		{desc: "enlarging", opts: Options{Width: 2400}, expected: 1},
+		{desc: "both dimensions", opts: Options{Width: 100, Height: 500}, expected: 2},
+		{desc: "cover", opts: Options{Width: 300, Height: 100, Crop: CropCover}, expected: 4},
+		{desc: "contain", opts: Options{Width: 1200, Height: 10, Crop: CropContain}, expected: 8},
+		{desc: "contain without resizing", opts: Options{Width: 2000, Height: 2000, Crop: CropContain}, expected: 1},
+		{desc: "empty image", opts: Options{Width: 100}, expected: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := cfg
+			if tc.desc == "empty image" {
+				cfg = image.Config{}
+			}
+
+			require.Equal(t, tc.expected, decodeDenominator(cfg, tc.opts))
+		})
+	}
+}
+
+func TestProcessScaledJPEGKeepsDimensions(t *testing.T) {
+	testCases := []struct {
+		desc string
+		opts Options
+	}{
+		{desc: "width", opts: Options{Width: 97}},
+		{desc: "height", opts: Options{Height: 143}},
+		{desc: "both dimensions", opts: Options{Width: 101, Height: 333}},
+		{desc: "cover", opts: Options{Width: 151, Height: 37, Crop: CropCover}},
+		{desc: "contain wide", opts: Options{Width: 299, Height: 53, Crop: CropContain}},
+		{desc: "contain tall", opts: Options{Width: 71, Height: 299, Crop: CropContain}},
+		{desc: "full size", opts: Options{Width: 700}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var scaled, full bytes.Buffer
+			scaledOpts := tc.opts
+			scaledOpts.ScaledDecode = true
+			require.NoError(t, Process(openFixture(t, jpegFixture), &scaled, scaledOpts))
+			require.NoError(t, Process(openFixture(t, jpegFixture), &full, tc.opts))
+
+			scaledCfg, err := jpeg.DecodeConfig(&scaled)
+			require.NoError(t, err)
+			fullCfg, err := jpeg.DecodeConfig(&full)
+			require.NoError(t, err)
+
+			require.Equal(t, fullCfg.Width, scaledCfg.Width)
+			require.Equal(t, fullCfg.Height, scaledCfg.Height)
+			if tc.opts.Width > 0 && tc.opts.Crop != CropContain {
+				require.Equal(t, tc.opts.Width, scaledCfg.Width)
+			}
+		})
+	}
+}
+
+func BenchmarkProcessJPEG(b *testing.B) {
+	photo := image.NewRGBA(image.Rect(0, 0, 3000, 2000))
+	for y := 0; y < 2000; y++ {
+		for x := 0; x < 3000; x++ {
+			photo.SetRGBA(x, y, color.RGBA{R: uint8(x / 12), G: uint8(y / 8), B: uint8((x + y) / 20), A: 0xff})
+		}
+	}
+	var data bytes.Buffer
+	if err := jpeg.Encode(&data, photo, nil); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		desc   string
+		scaled bool
+	}{
+		{desc: "full decode", scaled: false},
+		{desc: "scaled decode", scaled: true},
+	} {
+		b.Run(bc.desc, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				opts := Options{Width: 320, ScaledDecode: bc.scaled}
+				if err := Process(bytes.NewReader(data.Bytes()), ioutil.Discard, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDecodesJPEGWithStandardLibraryByDefault(t *testing.T) {
+	scaledDecodes := 0
+	countingJPEG := JPEG
+	countingJPEG.DecodeScaled = func(r io.Reader, denominator func(image.Config) int) (image.Image, error) {
+		scaledDecodes++
+		return JPEG.DecodeScaled(r, denominator)
+	}
+	registry := NewRegistry(countingJPEG)
+
+	require.NoError(t, Process(openFixture(t, jpegFixture), ioutil.Discard, Options{Width: 97, Registry: registry}))
+	require.Equal(t, 0, scaledDecodes)
+
+	require.NoError(t, Process(openFixture(t, jpegFixture), ioutil.Discard, Options{Width: 97, Registry: registry, ScaledDecode: true}))
+	require.Equal(t, 1, scaledDecodes)
+}
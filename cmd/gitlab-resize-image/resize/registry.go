@@ -0,0 +1,183 @@
+package resize
+
+import (
+	"image"
+	"image/gif"
+	stdjpeg "image/jpeg"
+	stdpng "image/png"
+	"io"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/bmp"
+	xtiff "golang.org/x/image/tiff"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/jpeg"
+)
+
+// Format is an image format that Process can resize
+type Format struct {
+	// Name is how Options.Format and error messages refer to the format
+	Name string
+	// Magic are the strings that images of this format start with. A "?"
+	// matches any byte, like in image.RegisterFormat.
+	Magic []string
+	// Decode and DecodeConfig are the decoder of the format
+	Decode       func(io.Reader) (image.Image, error)
+	DecodeConfig func(io.Reader) (image.Config, error)
+	// DecodeScaled, if set, decodes images at 1/n of their width and
+	// height, where n is 1, 2, 4 or 8 and returned by denominator, which
+	// it calls with the configuration of the image. If Options.ScaledDecode
+	// is set, Process uses it instead of Decode so that it does not need to
+	// decode all pixels of images it scales down a lot.
+	DecodeScaled func(r io.Reader, denominator func(image.Config) int) (image.Image, error)
+	// Output is the format we encode resized images in, unless
+	// Options.Format says otherwise
+	Output imaging.Format
+}
+
+var (
+	PNG = Format{
+		Name:         "png",
+		Magic:        []string{"\x89PNG\r\n\x1a\n"},
+		Decode:       stdpng.Decode,
+		DecodeConfig: stdpng.DecodeConfig,
+		Output:       imaging.PNG,
+	}
+	JPEG = Format{
+		Name:         "jpeg",
+		Magic:        []string{"\xff\xd8"},
+		Decode:       stdjpeg.Decode,
+		DecodeConfig: stdjpeg.DecodeConfig,
+		DecodeScaled: jpeg.DecodeScaled,
+		Output:       imaging.JPEG,
+	}
+	// GIF decodes only the first frame. See Options.KeepAnimation.
+	GIF = Format{
+		Name:         "gif",
+		Magic:        []string{"GIF87a", "GIF89a"},
+		Decode:       gif.Decode,
+		DecodeConfig: gif.DecodeConfig,
+		Output:       imaging.GIF,
+	}
+	// BMP is transcoded to PNG, because uncompressed BMPs are much larger
+	// than the equivalent PNGs
+	BMP = Format{
+		Name:         "bmp",
+		Magic:        []string{"BM????\x00\x00\x00\x00"},
+		Decode:       bmp.Decode,
+		DecodeConfig: bmp.DecodeConfig,
+		Output:       imaging.PNG,
+	}
+	// TIFF decodes only the first page. See Options.RejectMultiPage.
+	TIFF = Format{
+		Name:         "tiff",
+		Magic:        []string{"II\x2a\x00", "MM\x00\x2a"},
+		Decode:       xtiff.Decode,
+		DecodeConfig: xtiff.DecodeConfig,
+		Output:       imaging.TIFF,
+	}
+
+	// DefaultFormats are the formats of a nil Registry. Building with the
+	// avif tag adds AVIF.
+	DefaultFormats = []Format{PNG, JPEG, GIF, BMP, TIFF}
+
+	// knownFormats are formats we recognize even if they are not
+	// registered, so that we can say which format we do not support
+	knownFormats = []Format{{Name: "avif", Magic: avifMagic}}
+
+	// avifMagic matches AVIF images and image sequences. They are ISO base
+	// media files, which start with the size of the ftyp box.
+	avifMagic = []string{"????ftypavif", "????ftypavis"}
+)
+
+// Registry is the set of formats that Process decodes. Register formats
+// before resizing images with it; it is not safe to register formats while
+// resizing.
+type Registry struct {
+	formats []Format
+}
+
+// NewRegistry returns a registry with the given formats
+func NewRegistry(formats ...Format) *Registry {
+	r := &Registry{}
+	for _, f := range formats {
+		r.Register(f)
+	}
+
+	return r
+}
+
+// Register adds a format to the registry. It replaces a format of the same
+// name, if there is one.
+func (r *Registry) Register(f Format) {
+	for i := range r.formats {
+		if r.formats[i].Name == f.Name {
+			r.formats[i] = f
+			return
+		}
+	}
+
+	r.formats = append(r.formats, f)
+}
+
+// Names returns the names of the formats in the registry, in the order
+// they were registered
+func (r *Registry) Names() []string {
+	var names []string
+	for _, f := range r.formats {
+		names = append(names, f.Name)
+	}
+
+	return names
+}
+
+// lookup returns the format of the given name
+func (r *Registry) lookup(name string) (Format, bool) {
+	formats := DefaultFormats
+	if r != nil {
+		formats = r.formats
+	}
+
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+
+	return Format{}, false
+}
+
+// match returns the format whose magic head starts with
+func (r *Registry) match(head []byte) (Format, bool) {
+	if r == nil {
+		return matchFormats(DefaultFormats, head)
+	}
+
+	return matchFormats(r.formats, head)
+}
+
+func matchFormats(formats []Format, head []byte) (Format, bool) {
+	for _, f := range formats {
+		for _, magic := range f.Magic {
+			if matchMagic(magic, head) {
+				return f, true
+			}
+		}
+	}
+
+	return Format{}, false
+}
+
+func matchMagic(magic string, head []byte) bool {
+	if len(head) < len(magic) {
+		return false
+	}
+
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != head[i] && magic[i] != '?' {
+			return false
+		}
+	}
+
+	return true
+}
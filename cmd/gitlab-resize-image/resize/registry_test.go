@@ -0,0 +1,139 @@
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFormat decodes anything that starts with its magic as a 20x10 image
+var fakeFormat = Format{
+	Name:  "fake",
+	Magic: []string{"FAKE?"},
+	Decode: func(r io.Reader) (image.Image, error) {
+		return image.NewNRGBA(image.Rect(0, 0, 20, 10)), nil
+	},
+	DecodeConfig: func(r io.Reader) (image.Config, error) {
+		return image.Config{Width: 20, Height: 10}, nil
+	},
+	Output: imaging.PNG,
+}
+
+func TestRegistryFakeFormat(t *testing.T) {
+	input := "FAKE1 this is no real image format"
+
+	err := Process(strings.NewReader(input), ioutil.Discard, Options{Width: 10})
+	require.True(t, errors.Is(err, ErrNotAnImage), "fake format must not be registered by default: %v", err)
+
+	registry := NewRegistry(DefaultFormats...)
+	registry.Register(fakeFormat)
+
+	var out bytes.Buffer
+	require.NoError(t, Process(strings.NewReader(input), &out, Options{Width: 10, MaxPixels: 200, Registry: registry}))
+
+	cfg, err := png.DecodeConfig(&out)
+	require.NoError(t, err)
+	require.Equal(t, 10, cfg.Width)
+	require.Equal(t, 5, cfg.Height)
+
+	err = Process(strings.NewReader(input), ioutil.Discard, Options{Width: 10, MaxPixels: 199, Registry: registry})
+	require.True(t, errors.Is(err, ErrTooManyPixels), "unexpected error: %v", err)
+}
+
+func TestProcessOutputFormatNames(t *testing.T) {
+	registry := NewRegistry(DefaultFormats...)
+	registry.Register(fakeFormat)
+
+	testCases := []struct {
+		desc     string
+		opts     Options
+		expected string
+	}{
+		{desc: "extension", opts: Options{Format: "jpg"}, expected: "jpeg"},
+		{desc: "format name that is no extension", opts: Options{Format: "fake"}, expected: "png"},
+		{desc: "fallback", opts: Options{Format: "webp", FallbackFormat: "gif"}, expected: "gif"},
+		{desc: "fallback not needed", opts: Options{Format: "jpg", FallbackFormat: "gif"}, expected: "jpeg"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := tc.opts
+			opts.Width = 10
+			opts.Registry = registry
+
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, pngFixture), &out, opts))
+
+			_, format, err := image.DecodeConfig(&out)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, format)
+		})
+	}
+
+	err := Process(openFixture(t, pngFixture), ioutil.Discard, Options{Width: 10, Format: "webp"})
+	require.True(t, errors.Is(err, imaging.ErrUnsupportedFormat), "unexpected error: %v", err)
+
+	err = Process(openFixture(t, pngFixture), ioutil.Discard, Options{Width: 10, Format: "webp", FallbackFormat: "heic"})
+	require.EqualError(t, err, `unknown fallback format "heic"`)
+}
+
+func TestRegistryRegisterReplacesFormat(t *testing.T) {
+	registry := NewRegistry(DefaultFormats...)
+
+	jpegAsGIF := JPEG
+	jpegAsGIF.Output = imaging.GIF
+	registry.Register(jpegAsGIF)
+
+	var out bytes.Buffer
+	require.NoError(t, Process(openFixture(t, "../../../testdata/image.jpg"), &out, Options{Width: 10, Registry: registry}))
+
+	_, format, err := image.DecodeConfig(&out)
+	require.NoError(t, err)
+	require.Equal(t, "gif", format)
+}
+
+func TestRegistryWithoutFormat(t *testing.T) {
+	registry := NewRegistry(JPEG)
+
+	err := Process(openFixture(t, pngFixture), ioutil.Discard, Options{Width: 10, Registry: registry})
+	require.True(t, errors.Is(err, image.ErrFormat), "unexpected error: %v", err)
+}
+
+func TestMatchMagic(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		magic string
+		head  string
+		match bool
+	}{
+		{desc: "exact", magic: "GIF89a", head: "GIF89a", match: true},
+		{desc: "prefix", magic: "GIF89a", head: "GIF89a\x10\x00", match: true},
+		{desc: "wildcard", magic: "BM??\x00", head: "BMxy\x00", match: true},
+		{desc: "mismatch", magic: "GIF89a", head: "GIF87a"},
+		{desc: "head too short", magic: "GIF89a", head: "GIF"},
+		{desc: "wildcard does not match missing byte", magic: "BM?", head: "BM"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.match, matchMagic(tc.magic, []byte(tc.head)))
+		})
+	}
+}
+
+// avifHeader is the ftyp box that AVIF images start with
+const avifHeader = "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"
+
+func TestUnsupportedFormat(t *testing.T) {
+	err := Process(strings.NewReader(avifHeader), ioutil.Discard, Options{Width: 10, Registry: NewRegistry(PNG)})
+	require.True(t, errors.Is(err, ErrUnsupportedFormat), "unexpected error: %v", err)
+	require.Equal(t, "unsupported format: avif", err.Error())
+}
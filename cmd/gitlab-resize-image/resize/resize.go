@@ -0,0 +1,742 @@
+// Package resize scales images. It is what the gitlab-resize-image command
+// runs, and it can be used in-process as well.
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	stdpng "image/png"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/jpeg"
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/png"
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/tiff"
+)
+
+var (
+	ErrMultiPageTIFF = classify(ErrUnsupportedFormat, errors.New("multi-page TIFF images are not supported"))
+	ErrTooManyPixels = classify(ErrTooLarge, errors.New("image has too many pixels"))
+	ErrNotAnImage    = errors.New("not an image")
+	// ErrLargerThanExpected means the input is longer than
+	// Options.ExpectedBytes
+	ErrLargerThanExpected = classify(ErrTooLarge, errors.New("image is larger than expected"))
+)
+
+const (
+	// sniffLen is how many bytes http.DetectContentType looks at
+	sniffLen = 512
+	// preflightLen is how much of the image we look at to check its
+	// dimensions before we read the rest. PNG, GIF and BMP headers are
+	// much smaller, but JPEGs may have large metadata segments first.
+	preflightLen = 64 << 10
+	// maxPreallocation caps how much memory we allocate up front because of
+	// Options.ExpectedBytes, which is only a hint
+	maxPreallocation = 32 << 20
+)
+
+// CropMode determines how an image is fitted into a box of the requested
+// width and height
+type CropMode string
+
+const (
+	// CropNone scales the image to exactly the requested dimensions
+	CropNone CropMode = ""
+	// CropCover scales the image to cover the box entirely and crops what
+	// sticks out, keeping the center of the image
+	CropCover CropMode = "cover"
+	// CropContain scales the image to fit into the box, preserving its
+	// aspect ratio. The result may be smaller than the box. Images that are
+	// already small enough are not enlarged.
+	CropContain CropMode = "contain"
+)
+
+// filters are the resampling filters that can be chosen by name. Lanczos
+// gives the best results, but box and nearest neighbor are much faster.
+var filters = map[string]imaging.ResampleFilter{
+	"":           imaging.Lanczos,
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// pngCompressionLevels are the PNG compression levels that can be chosen by
+// name. best makes smaller thumbnails at the cost of CPU time.
+var pngCompressionLevels = map[string]stdpng.CompressionLevel{
+	"":        stdpng.DefaultCompression,
+	"default": stdpng.DefaultCompression,
+	"none":    stdpng.NoCompression,
+	"speed":   stdpng.BestSpeed,
+	"best":    stdpng.BestCompression,
+}
+
+type Options struct {
+	// Width and Height are the dimensions of the resized image. If one of
+	// them is 0, it is derived from the other one so that the aspect ratio
+	// is preserved.
+	Width  int
+	Height int
+	// Quality is the JPEG quality, ranging from 1 to 100. If 0, we use the
+	// default of the imaging package.
+	Quality int
+	// Format is the name of the format to encode the resized image in, as
+	// understood by imaging.FormatFromExtension, or the Name of a format in
+	// Registry, which stands for its Output. If empty, we use the Output of
+	// the format of the original image.
+	Format string
+	// FallbackFormat is the format we encode in if we do not know Format,
+	// instead of failing. It must be known to imaging.FormatFromExtension.
+	FallbackFormat string
+	// MaxPixels is the largest number of pixels an image may have for us to
+	// decode it. 0 means no limit.
+	MaxPixels int
+	// MaxWidth and MaxHeight cap Width and Height, so that a bogus request
+	// cannot make us upscale a small image to a huge one. They do not cap
+	// a dimension we derive from the aspect ratio. 0 means no limit.
+	MaxWidth  int
+	MaxHeight int
+	// Crop determines how the image is fitted into Width x Height. CropCover
+	// needs both dimensions.
+	Crop CropMode
+	// Filter is the name of the resampling filter: lanczos, catmullrom,
+	// linear, box or nearest. If empty, we use lanczos.
+	Filter string
+	// AdaptiveFilterThreshold makes us use the cheaper linear filter instead
+	// of lanczos if the image is scaled down by a factor of at least this
+	// much, say 0.9, where differences between filters barely show. It has
+	// no effect if Filter is set. 0 means we always use lanczos.
+	AdaptiveFilterThreshold float64
+	// PNGCompression is the name of the compression level of PNG output:
+	// default, none, speed or best. If empty, we use default.
+	PNGCompression string
+	// JPEGProgressive makes us encode progressive JPEGs, which browsers
+	// can show before they received all of them. It does not affect other
+	// formats.
+	JPEGProgressive bool
+	// ScaledDecode makes us decode images that we scale down with the
+	// DecodeScaled of their Format, if it has one. For JPEG, that is our
+	// copy of image/jpeg, which gets fixes of the standard library only
+	// when we update it, so we decode with image/jpeg unless this is set.
+	ScaledDecode bool
+	// RejectMultiPage makes multi-page TIFF images an error. Otherwise we
+	// only resize their first page.
+	RejectMultiPage bool
+	// KeepAnimation makes us resize all frames of animated GIFs, if the
+	// output is a GIF as well. Otherwise we only resize the first frame.
+	KeepAnimation bool
+	// MaxAnimationPixels is the largest number of frames times pixels an
+	// animation may have for KeepAnimation to resize all frames. Beyond it,
+	// we only resize the first frame. 0 means defaultMaxAnimationPixels.
+	MaxAnimationPixels int
+	// KeepPalette makes us map resized palette PNGs back to their palette,
+	// if the output is a PNG as well. Otherwise they become truecolor
+	// images, which are several times as large.
+	KeepPalette bool
+	// FallbackOriginal makes us write PNGs that we fail to decode, but
+	// which png.Validate accepts, unchanged instead of failing. They then
+	// keep their dimensions and format, and lose only the chunks that
+	// png.Reader skips. Corrupt PNGs still fail.
+	FallbackOriginal bool
+	// PreserveDepth makes us keep the 16 bits per channel of 16-bit PNGs,
+	// if the output is a PNG as well. Otherwise we reduce them to 8 bits,
+	// which may shift their colors slightly, and log that we did.
+	PreserveDepth bool
+	// SkipChunks are the types of the PNG chunks we drop from the input
+	// before decoding it, see png.NewReaderSkipping. If nil, we drop iCCP
+	// chunks, like png.NewReader.
+	SkipChunks []string
+	// Registry has the formats we decode. If nil, we decode DefaultFormats.
+	Registry *Registry
+	// ExpectedBytes is how long the caller expects the input to be, for
+	// example from a Content-Length header. If it is set, we size our
+	// buffers for it and fail with ErrLargerThanExpected as soon as the
+	// input turns out to be longer. Shorter input is fine.
+	ExpectedBytes int64
+	// Timeout is how long Process may take. We cannot interrupt decoding
+	// or scaling an image, so we only check it while reading the input and
+	// between these steps. 0 means no timeout.
+	Timeout time.Duration
+	// OnContentType, if set, is called with the MIME type of the resized
+	// image before we write it. It tells callers which Content-Type to
+	// send if we transcode the image. Its error aborts Process.
+	OnContentType func(contentType string) error
+	// OnBlurhash, if set, is called with the blurhash of the image once we
+	// decoded it, which clients can show as a placeholder while they load
+	// the resized image. Its error aborts Process.
+	OnBlurhash func(hash string) error
+}
+
+// contentTypes are the MIME types of the formats we encode
+var contentTypes = map[imaging.Format]string{
+	imaging.JPEG: "image/jpeg",
+	imaging.PNG:  "image/png",
+	imaging.GIF:  "image/gif",
+	imaging.TIFF: "image/tiff",
+	imaging.BMP:  "image/bmp",
+}
+
+// ContentType returns the MIME type of images encoded in f
+func ContentType(f imaging.Format) string {
+	if contentType, ok := contentTypes[f]; ok {
+		return contentType
+	}
+
+	return "application/octet-stream"
+}
+
+// buffers are the scratch space of process. They can be reused by
+// consecutive calls, but not shared by concurrent ones.
+type buffers struct {
+	sniff *bufio.Reader
+	data  bytes.Buffer
+}
+
+// Process resizes the image read from r and writes the result to w
+func Process(r io.Reader, w io.Writer, opts Options) error {
+	return process(r, w, opts, &buffers{})
+}
+
+// Variant is one of the sizes that ProcessVariants resizes an image to
+type Variant struct {
+	// Width and Height replace those of Options for this variant
+	Width  int
+	Height int
+	Writer io.Writer
+}
+
+// ProcessVariants is like Process, but it resizes the image to several
+// sizes, so that it only needs to decode it once. It writes the largest
+// variant first. Each variant is scaled from the decoded image rather than
+// from a larger variant, so it looks the same as if we resized it on its
+// own. opts.OnContentType is called once, because all variants have the
+// same format.
+func ProcessVariants(r io.Reader, opts Options, variants []Variant) error {
+	return processVariants(r, opts, variants, &buffers{})
+}
+
+func process(r io.Reader, w io.Writer, opts Options, buf *buffers) error {
+	return processVariants(r, opts, []Variant{{Width: opts.Width, Height: opts.Height, Writer: w}}, buf)
+}
+
+func processVariants(r io.Reader, opts Options, variants []Variant, buf *buffers) error {
+	if len(variants) == 0 {
+		return errors.New("no variants to resize to")
+	}
+
+	variants = append([]Variant(nil), variants...)
+	sort.SliceStable(variants, func(i, j int) bool {
+		if variants[i].Width != variants[j].Width {
+			return variants[i].Width > variants[j].Width
+		}
+		return variants[i].Height > variants[j].Height
+	})
+
+	// targets are the options of each variant
+	targets := make([]Options, len(variants))
+	writers := make([]io.Writer, len(variants))
+	for i, v := range variants {
+		if v.Width <= 0 && v.Height <= 0 {
+			return errors.New("width or height must be set")
+		}
+		targets[i] = opts
+		targets[i].Width = clampDimension("width", v.Width, opts.MaxWidth)
+		targets[i].Height = clampDimension("height", v.Height, opts.MaxHeight)
+		writers[i] = v.Writer
+	}
+	// If we write the original image instead, every variant gets it
+	w := io.MultiWriter(writers...)
+
+	filter, ok := filters[opts.Filter]
+	if !ok {
+		return fmt.Errorf("unknown filter %q", opts.Filter)
+	}
+
+	if opts.AdaptiveFilterThreshold < 0 || opts.AdaptiveFilterThreshold > 1 {
+		return fmt.Errorf("adaptive filter threshold %v is not between 0 and 1", opts.AdaptiveFilterThreshold)
+	}
+
+	pngCompression, ok := pngCompressionLevels[opts.PNGCompression]
+	if !ok {
+		return fmt.Errorf("unknown PNG compression %q", opts.PNGCompression)
+	}
+
+	if opts.FallbackFormat != "" {
+		if _, err := imaging.FormatFromExtension(opts.FallbackFormat); err != nil {
+			return fmt.Errorf("unknown fallback format %q", opts.FallbackFormat)
+		}
+	}
+
+	switch opts.Crop {
+	case CropNone, CropContain:
+	case CropCover:
+		for _, target := range targets {
+			if target.Width <= 0 || target.Height <= 0 {
+				return errors.New("crop mode cover needs both width and height")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown crop mode %q", opts.Crop)
+	}
+
+	tr := &timeoutReader{r: r}
+	if opts.Timeout > 0 {
+		tr.deadline = time.Now().Add(opts.Timeout)
+	}
+	r = tr
+
+	if opts.ExpectedBytes > 0 {
+		r = &expectedSizeReader{r: r, remaining: opts.ExpectedBytes}
+	}
+
+	var pngReader *png.Reader
+	var err error
+	if opts.SkipChunks != nil {
+		pngReader, err = png.NewReaderSkipping(r, opts.SkipChunks, png.Options{})
+	} else {
+		pngReader, err = png.NewReader(r, png.Options{})
+	}
+	if err != nil {
+		return fmt.Errorf("construct PNG reader: %w", err)
+	}
+
+	// Fail early and clearly if we got, say, an HTML error page instead of
+	// an image. Peeking leaves the sniffed bytes in the stream for the decoder.
+	if buf.sniff == nil {
+		buf.sniff = bufio.NewReaderSize(pngReader, preflightLen)
+	} else {
+		buf.sniff.Reset(pngReader)
+	}
+	buffered := buf.sniff
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("sniff content type: %w", err)
+	}
+	format, err := sniffImage(head, opts.Registry)
+	if err != nil {
+		return err
+	}
+	// head is only valid until we read on
+	indexed := format.Name == PNG.Name && isIndexedPNG(head)
+	deep := format.Name == PNG.Name && pngBitDepth(head) == 16
+
+	// If the dimensions are in the first bytes of the image, we can reject
+	// images with too many pixels before we read, let alone decode, all
+	// of them
+	preflighted := false
+	if opts.MaxPixels > 0 {
+		if preflighted, err = preflight(buffered, format, opts); err != nil {
+			return err
+		}
+	}
+
+	input := io.Reader(buffered)
+	var data []byte
+	if (opts.MaxPixels > 0 && !preflighted) || opts.RejectMultiPage || opts.KeepAnimation || opts.FallbackOriginal {
+		// These need random access to the image, or to write it unchanged,
+		// so we read all of it into memory first
+		buf.data.Reset()
+		if opts.ExpectedBytes > 0 {
+			// ReadFrom wants room for bytes.MinRead more bytes before it
+			// sees the end of the input
+			buf.data.Grow(int(min64(opts.ExpectedBytes, maxPreallocation)) + bytes.MinRead)
+		}
+		if _, err := buf.data.ReadFrom(buffered); err != nil {
+			return fmt.Errorf("read image: %w", err)
+		}
+		data = buf.data.Bytes()
+
+		if err := checkImage(data, format, opts); err != nil {
+			return fallBackToOriginal(w, data, format, opts, err)
+		}
+
+		input = bytes.NewReader(data)
+	}
+
+	// For animated GIFs, this is the first frame
+	var src image.Image
+	if format.DecodeScaled != nil && opts.ScaledDecode {
+		src, targets, err = decodeScaled(format, input, targets)
+	} else {
+		src, err = format.Decode(input)
+	}
+	if err != nil {
+		return fallBackToOriginal(w, data, format, opts, classify(ErrDecode, fmt.Errorf("decode %s: %w", format.Name, err)))
+	}
+	if tr.expired() {
+		return ErrTimeout
+	}
+
+	imagingFormat := format.Output
+	if opts.Format != "" {
+		if imagingFormat, err = outputFormat(opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.OnContentType != nil {
+		if err := opts.OnContentType(ContentType(imagingFormat)); err != nil {
+			return fmt.Errorf("report content type: %w", err)
+		}
+	}
+
+	if opts.OnBlurhash != nil {
+		if err := opts.OnBlurhash(blurhash(src)); err != nil {
+			return fmt.Errorf("report blurhash: %w", err)
+		}
+	}
+
+	// For animations, this is all of their frames
+	var animation *gif.GIF
+	if opts.KeepAnimation && format.Name == GIF.Name && imagingFormat == imaging.GIF {
+		// Before we decode all frames, we make sure that they will not take
+		// all our memory and time
+		pixels, err := animationPixels(data)
+		if err != nil {
+			return classify(ErrDecode, fmt.Errorf("count GIF frames: %w", err))
+		}
+
+		maxPixels := opts.MaxAnimationPixels
+		if maxPixels == 0 {
+			maxPixels = defaultMaxAnimationPixels
+		}
+
+		if pixels > maxPixels {
+			log.Infof("animation has %d pixels in all frames, more than %d: resizing only its first frame", pixels, maxPixels)
+		} else {
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				return classify(ErrDecode, fmt.Errorf("decode GIF frames: %w", err))
+			}
+
+			if len(g.Image) > 1 {
+				animation = g
+			}
+		}
+	}
+
+	encodeOpts := []imaging.EncodeOption{imaging.PNGCompressionLevel(pngCompression)}
+	if opts.Quality > 0 {
+		encodeOpts = append(encodeOpts, imaging.JPEGQuality(opts.Quality))
+	}
+
+	// imaging scales into 8-bit images, so we scale 16-bit PNGs ourselves
+	// if we are to keep their depth
+	keepDepth := deep && opts.PreserveDepth && imagingFormat == imaging.PNG
+	if deep && !keepDepth {
+		log.Infof("reducing 16-bit PNG to 8 bits per channel")
+	}
+
+	resizeTo := func(w io.Writer, opts Options) error {
+		scale := func(src image.Image) *image.NRGBA {
+			if adaptiveFilter(src.Bounds(), opts) {
+				return scaleImage(src, opts, imaging.Linear)
+			}
+			return scaleImage(src, opts, filter)
+		}
+
+		if animation != nil {
+			resized := resizeAnimation(animation, scale)
+			if tr.expired() {
+				return ErrTimeout
+			}
+			return gif.EncodeAll(w, resized)
+		}
+
+		var resized image.Image
+		if keepDepth {
+			resized = scaleImage16(src, opts)
+		} else {
+			resized = scale(src)
+		}
+		if tr.expired() {
+			return ErrTimeout
+		}
+		if paletted, ok := src.(*image.Paletted); ok && opts.KeepPalette && indexed && imagingFormat == imaging.PNG {
+			resized = quantize(resized, paletted.Palette)
+		}
+
+		if opts.JPEGProgressive && imagingFormat == imaging.JPEG {
+			return encodeProgressiveJPEG(w, resized, opts.Quality)
+		}
+
+		return imaging.Encode(w, resized, imagingFormat, encodeOpts...)
+	}
+
+	for i, target := range targets {
+		if err := resizeTo(writers[i], target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// outputFormat returns the format that opts.Format names
+func outputFormat(opts Options) (imaging.Format, error) {
+	f, err := imaging.FormatFromExtension(opts.Format)
+	if err == nil {
+		return f, nil
+	}
+
+	// Format names need not be extensions that imaging knows
+	if format, ok := opts.Registry.lookup(opts.Format); ok {
+		return format.Output, nil
+	}
+
+	if opts.FallbackFormat == "" {
+		return f, fmt.Errorf("find imaging format: %w", err)
+	}
+
+	log.Infof("unknown output format %q; using %s", opts.Format, opts.FallbackFormat)
+	// process validated FallbackFormat
+	return imaging.FormatFromExtension(opts.FallbackFormat)
+}
+
+// defaultJPEGQuality is the JPEG quality that imaging.Encode uses by default
+const defaultJPEGQuality = 95
+
+// encodeProgressiveJPEG is like imaging.Encode for JPEGs, whose encoder
+// cannot write progressive ones
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	if quality <= 0 {
+		quality = defaultJPEGQuality
+	}
+
+	// Like imaging, we let the encoder take the fast path for RGBA images
+	// if we can
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Opaque() {
+		img = &image.RGBA{Pix: nrgba.Pix, Stride: nrgba.Stride, Rect: nrgba.Rect}
+	}
+
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality, Progressive: true})
+}
+
+// expectedSizeReader fails with ErrLargerThanExpected once r returns more
+// than remaining bytes. It reads one byte past the limit so that input of
+// exactly the expected length is no error.
+type expectedSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *expectedSizeReader) Read(p []byte) (int, error) {
+	if e.remaining < 0 {
+		return 0, ErrLargerThanExpected
+	}
+
+	if int64(len(p)) > e.remaining+1 {
+		p = p[:e.remaining+1]
+	}
+
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if e.remaining < 0 {
+		return n - 1, ErrLargerThanExpected
+	}
+
+	return n, err
+}
+
+// clampDimension returns the requested dimension, capped at max unless max
+// is 0
+func clampDimension(name string, requested, max int) int {
+	if max <= 0 || requested <= max {
+		return requested
+	}
+
+	log.Infof("requested %s %d exceeds maximum of %d; clamping", name, requested, max)
+	return max
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// scaleImage fits src into the dimensions given by opts
+func scaleImage(src image.Image, opts Options, filter imaging.ResampleFilter) *image.NRGBA {
+	switch {
+	case opts.Crop == CropCover:
+		return imaging.Fill(src, opts.Width, opts.Height, imaging.Center, filter)
+	case opts.Crop == CropContain && opts.Width > 0 && opts.Height > 0:
+		return imaging.Fit(src, opts.Width, opts.Height, filter)
+	default:
+		// With only one dimension, containing the image in the box is the
+		// same as resizing it with its aspect ratio preserved
+		return resizeImage(src, opts.Width, opts.Height, filter)
+	}
+}
+
+// adaptiveFilter returns whether we scale src down so slightly that the
+// linear filter does as well as lanczos, see Options.AdaptiveFilterThreshold
+func adaptiveFilter(src image.Rectangle, opts Options) bool {
+	if opts.Filter != "" || opts.AdaptiveFilterThreshold <= 0 || src.Empty() {
+		return false
+	}
+
+	ratio := scaleRatio(src, opts)
+	return ratio >= opts.AdaptiveFilterThreshold && ratio <= 1
+}
+
+// scaleRatio returns the factor by which scaleImage scales src. If it scales
+// the dimensions by different factors, this is the smaller one.
+func scaleRatio(src image.Rectangle, opts Options) float64 {
+	x := float64(opts.Width) / float64(src.Dx())
+	y := float64(opts.Height) / float64(src.Dy())
+
+	switch {
+	case opts.Width <= 0:
+		return y
+	case opts.Height <= 0:
+		return x
+	case opts.Crop == CropCover:
+		return math.Max(x, y)
+	default:
+		return math.Min(x, y)
+	}
+}
+
+// sniffImage returns the format of the image that starts with head
+func sniffImage(head []byte, registry *Registry) (Format, error) {
+	if format, ok := registry.match(head); ok {
+		return format, nil
+	}
+	if format, ok := matchFormats(knownFormats, head); ok {
+		return Format{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, format.Name)
+	}
+	// SVGs may contain scripts, so callers must be able to tell them from
+	// other XML and reject them explicitly
+	if isSVG(head) {
+		return Format{}, fmt.Errorf("%w: svg", ErrUnsupportedFormat)
+	}
+
+	contentType := http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, "image/") {
+		return Format{}, fmt.Errorf("%w: detected %s", ErrNotAnImage, contentType)
+	}
+
+	return Format{}, classify(ErrUnsupportedFormat, fmt.Errorf("decode %s: %w", contentType, image.ErrFormat))
+}
+
+// isSVG tells whether head is the start of an XML document whose root
+// element is svg. Only the XML declaration, comments, processing
+// instructions and a document type declaration may come before it.
+func isSVG(head []byte) bool {
+	s := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	for {
+		s = bytes.TrimLeft(s, " \t\r\n")
+
+		end := ""
+		switch {
+		case bytes.HasPrefix(s, []byte("<?")):
+			end = "?>"
+		case bytes.HasPrefix(s, []byte("<!--")):
+			end = "-->"
+		case bytes.HasPrefix(s, []byte("<!")):
+			end = ">"
+		default:
+			return len(s) > 4 && string(s[:4]) == "<svg" && strings.IndexByte(" \t\r\n/>", s[4]) >= 0
+		}
+
+		i := bytes.Index(s, []byte(end))
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(end):]
+	}
+}
+
+// preflight checks the dimensions of the image against opts.MaxPixels,
+// using only the bytes that r has buffered or can buffer. It returns
+// false if these are not enough to tell, for example because the image
+// has a lot of metadata or is a TIFF, whose header may be anywhere. Read
+// errors are left for the caller to run into.
+func preflight(r *bufio.Reader, format Format, opts Options) (bool, error) {
+	head, _ := r.Peek(preflightLen)
+	cfg, err := format.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return false, nil
+	}
+
+	return true, checkPixels(cfg, opts)
+}
+
+// checkPixels checks the dimensions of an image against opts.MaxPixels
+func checkPixels(cfg image.Config, opts Options) error {
+	if opts.MaxPixels > 0 && cfg.Width*cfg.Height > opts.MaxPixels {
+		return fmt.Errorf("%w: %dx%d exceeds %d", ErrTooManyPixels, cfg.Width, cfg.Height, opts.MaxPixels)
+	}
+
+	return nil
+}
+
+func checkImage(data []byte, format Format, opts Options) error {
+	cfg, err := format.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return classify(ErrDecode, fmt.Errorf("decode config: %w", err))
+	}
+
+	if err := checkPixels(cfg, opts); err != nil {
+		return err
+	}
+
+	if opts.RejectMultiPage && format.Name == TIFF.Name {
+		multiPage, err := tiff.IsMultiPage(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("count TIFF pages: %w", err)
+		}
+		if multiPage {
+			return ErrMultiPageTIFF
+		}
+	}
+
+	return nil
+}
+
+// fallBackToOriginal writes data, the image as we read it, to w instead of
+// failing with err, if opts.FallbackOriginal is set and err is about a PNG
+// that we cannot decode but that is structurally valid
+func fallBackToOriginal(w io.Writer, data []byte, format Format, opts Options, err error) error {
+	if !opts.FallbackOriginal || format.Name != PNG.Name || !errors.Is(err, ErrDecode) {
+		return err
+	}
+	if png.Validate(bytes.NewReader(data), png.Options{}) != nil {
+		return err
+	}
+
+	if opts.OnContentType != nil {
+		if err := opts.OnContentType(ContentType(imaging.PNG)); err != nil {
+			return fmt.Errorf("report content type: %w", err)
+		}
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("write original image: %w", err)
+	}
+
+	return nil
+}
+
+// resizeImage scales src to the given dimensions. imaging weighs every
+// sample by its alpha value before resampling and divides the result by
+// the accumulated alpha afterwards, which is equivalent to resampling
+// premultiplied colors. Transparent pixels hence do not bleed their
+// (usually black) color into opaque edges.
+func resizeImage(src image.Image, width, height int, filter imaging.ResampleFilter) *image.NRGBA {
+	return imaging.Resize(src, width, height, filter)
+}
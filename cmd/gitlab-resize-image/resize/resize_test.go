@@ -0,0 +1,987 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/log"
+)
+
+const pngFixture = "../../../testdata/image.png"
+
+var (
+	opaqueWhite      = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	transparentBlack = color.NRGBA{}
+)
+
+func TestResizeImageHasNoDarkFringes(t *testing.T) {
+	src := hardEdgedImage(64, 3)
+	width := src.Bounds().Dx() / 2
+
+	// Sanity check: the fixture must produce fringes when alpha is ignored
+	require.NotZero(t, countDarkFringes(naiveDownscale(src)), "naive downscale should produce dark fringes")
+
+	dst := resizeImage(src, width, 0, imaging.Lanczos)
+	require.Equal(t, width, dst.Bounds().Dx())
+	require.Zero(t, countDarkFringes(dst), "resized image should not have dark fringes")
+}
+
+func TestProcessTIFF(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		fixture         string
+		rejectMultiPage bool
+		expectedErr     error
+	}{
+		{desc: "single page", fixture: "../../../testdata/image.tiff"},
+		{desc: "single page, multi-page rejected", fixture: "../../../testdata/image.tiff", rejectMultiPage: true},
+		{desc: "multiple pages", fixture: "../../../testdata/image_multipage.tiff"},
+		{desc: "multiple pages, multi-page rejected", fixture: "../../../testdata/image_multipage.tiff", rejectMultiPage: true, expectedErr: ErrMultiPageTIFF},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := os.Open(tc.fixture)
+			require.NoError(t, err)
+			defer f.Close()
+
+			var out bytes.Buffer
+			err = Process(f, &out, Options{Width: 8, RejectMultiPage: tc.rejectMultiPage})
+			if tc.expectedErr != nil {
+				require.Equal(t, tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+
+			resized, err := tiff.Decode(&out)
+			require.NoError(t, err, "output should be a TIFF image")
+			require.Equal(t, image.Rect(0, 0, 8, 8), resized.Bounds())
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		opts           Options
+		expectedFormat string
+		expectedBounds image.Rectangle
+	}{
+		{desc: "width", opts: Options{Width: 100}, expectedFormat: "png", expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "height", opts: Options{Height: 64}, expectedFormat: "png", expectedBounds: image.Rect(0, 0, 69, 64)},
+		{desc: "width and height", opts: Options{Width: 100, Height: 50}, expectedFormat: "png", expectedBounds: image.Rect(0, 0, 100, 50)},
+		{desc: "format", opts: Options{Width: 100, Format: "jpg"}, expectedFormat: "jpeg", expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "quality", opts: Options{Width: 100, Format: "jpg", Quality: 10}, expectedFormat: "jpeg", expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "filter", opts: Options{Width: 100, Filter: "box"}, expectedFormat: "png", expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "below max pixels", opts: Options{Width: 100, MaxPixels: 555 * 512}, expectedFormat: "png", expectedBounds: image.Rect(0, 0, 100, 92)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, pngFixture), &out, tc.opts))
+
+			resized, format, err := image.Decode(&out)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedFormat, format)
+			require.Equal(t, tc.expectedBounds, resized.Bounds())
+		})
+	}
+}
+
+func TestProcessReportsContentType(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		fixture  string
+		format   string
+		expected string
+	}{
+		{desc: "png", fixture: pngFixture, expected: "image/png"},
+		{desc: "png to jpeg", fixture: pngFixture, format: "jpg", expected: "image/jpeg"},
+		{desc: "jpeg to gif", fixture: "../../../testdata/image.jpg", format: "gif", expected: "image/gif"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var reported []string
+			opts := Options{Width: 10, Format: tc.format, OnContentType: func(contentType string) error {
+				reported = append(reported, contentType)
+				return nil
+			}}
+
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, tc.fixture), &out, opts))
+			require.Equal(t, []string{tc.expected}, reported)
+			require.Equal(t, tc.expected, http.DetectContentType(out.Bytes()))
+		})
+	}
+}
+
+func TestProcessFailsIfContentTypeCannotBeReported(t *testing.T) {
+	failure := errors.New("disk full")
+	opts := Options{Width: 10, OnContentType: func(string) error { return failure }}
+
+	var out bytes.Buffer
+	err := Process(openFixture(t, pngFixture), &out, opts)
+	require.True(t, errors.Is(err, failure), "unexpected error: %v", err)
+	require.Zero(t, out.Len(), "nothing must be written if the content type was not reported")
+}
+
+func TestProcessCrop(t *testing.T) {
+	// The fixture is 555x512 pixels
+	testCases := []struct {
+		desc           string
+		opts           Options
+		expectedBounds image.Rectangle
+	}{
+		{desc: "no crop", opts: Options{Width: 64, Height: 64}, expectedBounds: image.Rect(0, 0, 64, 64)},
+		{desc: "cover", opts: Options{Width: 64, Height: 64, Crop: CropCover}, expectedBounds: image.Rect(0, 0, 64, 64)},
+		{desc: "cover wide box", opts: Options{Width: 100, Height: 20, Crop: CropCover}, expectedBounds: image.Rect(0, 0, 100, 20)},
+		{desc: "contain", opts: Options{Width: 64, Height: 64, Crop: CropContain}, expectedBounds: image.Rect(0, 0, 64, 59)},
+		{desc: "contain wide box", opts: Options{Width: 100, Height: 20, Crop: CropContain}, expectedBounds: image.Rect(0, 0, 21, 20)},
+		{desc: "contain width only", opts: Options{Width: 100, Crop: CropContain}, expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "contain larger box", opts: Options{Width: 1000, Height: 1000, Crop: CropContain}, expectedBounds: image.Rect(0, 0, 555, 512)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, pngFixture), &out, tc.opts))
+
+			resized, _, err := image.Decode(&out)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedBounds, resized.Bounds())
+		})
+	}
+}
+
+func TestProcessMaxDimensions(t *testing.T) {
+	// The fixture is 555x512 pixels
+	testCases := []struct {
+		desc           string
+		opts           Options
+		expectedBounds image.Rectangle
+	}{
+		{desc: "width below max", opts: Options{Width: 100, MaxWidth: 200}, expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "width clamped", opts: Options{Width: 100000, MaxWidth: 200}, expectedBounds: image.Rect(0, 0, 200, 185)},
+		{desc: "height clamped", opts: Options{Height: 100000, MaxHeight: 64}, expectedBounds: image.Rect(0, 0, 69, 64)},
+		{desc: "both clamped", opts: Options{Width: 5000, Height: 5000, MaxWidth: 100, MaxHeight: 50}, expectedBounds: image.Rect(0, 0, 100, 50)},
+		{desc: "derived height not clamped", opts: Options{Width: 100, MaxHeight: 50}, expectedBounds: image.Rect(0, 0, 100, 92)},
+		{desc: "cover clamped", opts: Options{Width: 5000, Height: 64, Crop: CropCover, MaxWidth: 64}, expectedBounds: image.Rect(0, 0, 64, 64)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, pngFixture), &out, tc.opts))
+
+			resized, _, err := image.Decode(&out)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedBounds, resized.Bounds())
+		})
+	}
+}
+
+func TestProcessJPEGQuality(t *testing.T) {
+	sizes := make(map[int]int)
+	for _, quality := range []int{10, 90} {
+		var out bytes.Buffer
+		require.NoError(t, Process(openFixture(t, pngFixture), &out, Options{Width: 200, Format: "jpg", Quality: quality}))
+		sizes[quality] = out.Len()
+	}
+
+	require.Less(t, sizes[10], sizes[90], "lower quality should result in a smaller image")
+}
+
+func TestProcessBMP(t *testing.T) {
+	const bmpFixture = "../../../testdata/image.bmp"
+
+	testCases := []struct {
+		desc           string
+		opts           Options
+		expectedFormat string
+		expectedErr    error
+	}{
+		{desc: "transcoded to PNG", opts: Options{Width: 8}, expectedFormat: "png"},
+		{desc: "explicit format", opts: Options{Width: 8, Format: "bmp"}, expectedFormat: "bmp"},
+		{desc: "too many pixels", opts: Options{Width: 8, MaxPixels: 16*16 - 1}, expectedErr: ErrTooManyPixels},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Process(openFixture(t, bmpFixture), &out, tc.opts)
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+
+			resized, format, err := image.Decode(&out)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedFormat, format)
+			require.Equal(t, image.Rect(0, 0, 8, 8), resized.Bounds())
+		})
+	}
+}
+
+func TestProcessGIF(t *testing.T) {
+	const (
+		staticGIF   = "../../../testdata/image.gif"
+		animatedGIF = "../../../testdata/image_animated.gif"
+	)
+
+	testCases := []struct {
+		desc           string
+		fixture        string
+		opts           Options
+		expectedFrames int
+		expectedErr    error
+	}{
+		{desc: "static", fixture: staticGIF, opts: Options{Width: 8}, expectedFrames: 1},
+		{desc: "static, keep animation", fixture: staticGIF, opts: Options{Width: 8, KeepAnimation: true}, expectedFrames: 1},
+		{desc: "animated", fixture: animatedGIF, opts: Options{Width: 8}, expectedFrames: 1},
+		{desc: "animated, keep animation", fixture: animatedGIF, opts: Options{Width: 8, KeepAnimation: true}, expectedFrames: 3},
+		{desc: "animated, as many pixels as allowed", fixture: animatedGIF, opts: Options{Width: 8, KeepAnimation: true, MaxAnimationPixels: 3 * 16 * 16}, expectedFrames: 3},
+		{desc: "animated, too many pixels to keep animation", fixture: animatedGIF, opts: Options{Width: 8, KeepAnimation: true, MaxAnimationPixels: 3*16*16 - 1}, expectedFrames: 1},
+		{desc: "too many pixels", fixture: animatedGIF, opts: Options{Width: 8, MaxPixels: 16*16 - 1}, expectedErr: ErrTooManyPixels},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Process(openFixture(t, tc.fixture), &out, tc.opts)
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+
+			resized, err := gif.DecodeAll(&out)
+			require.NoError(t, err, "output should be a GIF image")
+			require.Len(t, resized.Image, tc.expectedFrames)
+			for _, frame := range resized.Image {
+				require.Equal(t, image.Rect(0, 0, 8, 8), frame.Bounds())
+			}
+		})
+	}
+}
+
+func TestProcessAnimatedGIFCompositesFrames(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, Process(openFixture(t, "../../../testdata/image_animated.gif"), &out, Options{Width: 8, Filter: "nearest", KeepAnimation: true}))
+
+	resized, err := gif.DecodeAll(&out)
+	require.NoError(t, err)
+
+	// The second frame of the fixture paints the top left quarter blue on
+	// top of the red first frame
+	second := resized.Image[1]
+	requireColor(t, color.RGBA{B: 0xff, A: 0xff}, second.At(1, 1))
+	requireColor(t, color.RGBA{R: 0xff, A: 0xff}, second.At(6, 6))
+}
+
+func TestProcessAnimatedGIFToOtherFormat(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, Process(openFixture(t, "../../../testdata/image_animated.gif"), &out, Options{Width: 8, Format: "png", KeepAnimation: true}))
+
+	_, format, err := image.Decode(&out)
+	require.NoError(t, err)
+	require.Equal(t, "png", format)
+}
+
+func TestProcessKeepPalette(t *testing.T) {
+	indexed := palettedPNG(t)
+	require.True(t, isIndexedPNG(indexed))
+
+	sizes := make(map[bool]int)
+	for _, keepPalette := range []bool{false, true} {
+		var out bytes.Buffer
+		require.NoError(t, Process(bytes.NewReader(indexed), &out, Options{Width: 100, KeepPalette: keepPalette}))
+		sizes[keepPalette] = out.Len()
+
+		resized, err := png.Decode(bytes.NewReader(out.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 100, 100), resized.Bounds())
+
+		_, paletted := resized.(*image.Paletted)
+		require.Equal(t, keepPalette, paletted)
+		require.Equal(t, keepPalette, isIndexedPNG(out.Bytes()))
+	}
+
+	require.Less(t, sizes[true], sizes[false], "palette images should be smaller")
+}
+
+func TestProcessKeepPaletteOnlyForPNGOutput(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, Process(bytes.NewReader(palettedPNG(t)), &out, Options{Width: 100, KeepPalette: true, Format: "jpg"}))
+
+	_, format, err := image.Decode(&out)
+	require.NoError(t, err)
+	require.Equal(t, "jpeg", format)
+}
+
+func TestProcessPreserveDepth(t *testing.T) {
+	deep := deepPNG(t)
+	require.Equal(t, 16, pngBitDepth(deep))
+
+	testCases := []struct {
+		desc          string
+		opts          Options
+		expectedDepth int
+	}{
+		{desc: "reduced", opts: Options{Width: 100}, expectedDepth: 8},
+		{desc: "preserved", opts: Options{Width: 100, PreserveDepth: true}, expectedDepth: 16},
+		{desc: "preserved with cover", opts: Options{Width: 50, Height: 50, Crop: CropCover, PreserveDepth: true}, expectedDepth: 16},
+		{desc: "preserved with nearest", opts: Options{Width: 100, Filter: "nearest", PreserveDepth: true}, expectedDepth: 16},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var stderr bytes.Buffer
+			defer log.SetDefault(log.SetDefault(log.New(&stderr, log.LevelInfo, "test")))
+
+			var out bytes.Buffer
+			require.NoError(t, Process(bytes.NewReader(deep), &out, tc.opts))
+			require.Equal(t, tc.expectedDepth, pngBitDepth(out.Bytes()))
+			require.Equal(t, tc.expectedDepth == 8, strings.Contains(stderr.String(), "reducing 16-bit PNG to 8 bits per channel"), stderr.String())
+
+			resized, err := png.Decode(&out)
+			require.NoError(t, err)
+			width, height := tc.opts.Width, tc.opts.Height
+			if height == 0 {
+				height = width / 2
+			}
+			require.Equal(t, image.Rect(0, 0, width, height), resized.Bounds())
+
+			// The gradient has shades between the ones 8 bits can tell apart
+			fine := false
+			bounds := resized.Bounds()
+			for x := bounds.Min.X; x < bounds.Max.X && !fine; x++ {
+				r, _, _, _ := resized.At(x, bounds.Min.Y).RGBA()
+				fine = r%0x101 != 0
+			}
+			require.Equal(t, tc.expectedDepth == 16, fine)
+		})
+	}
+}
+
+func TestProcessPreserveDepthOnlyForPNGOutput(t *testing.T) {
+	var stderr bytes.Buffer
+	defer log.SetDefault(log.SetDefault(log.New(&stderr, log.LevelInfo, "test")))
+
+	var out bytes.Buffer
+	require.NoError(t, Process(bytes.NewReader(deepPNG(t)), &out, Options{Width: 100, PreserveDepth: true, Format: "jpg"}))
+	require.Contains(t, stderr.String(), "reducing 16-bit PNG to 8 bits per channel")
+
+	_, format, err := image.Decode(&out)
+	require.NoError(t, err)
+	require.Equal(t, "jpeg", format)
+}
+
+func TestScaleGeometry(t *testing.T) {
+	src := image.Rect(0, 0, 200, 100)
+
+	testCases := []struct {
+		desc           string
+		opts           Options
+		expectedCrop   image.Rectangle
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{desc: "width", opts: Options{Width: 50}, expectedCrop: src, expectedWidth: 50, expectedHeight: 25},
+		{desc: "height", opts: Options{Height: 50}, expectedCrop: src, expectedWidth: 100, expectedHeight: 50},
+		{desc: "both", opts: Options{Width: 30, Height: 40}, expectedCrop: src, expectedWidth: 30, expectedHeight: 40},
+		{desc: "contain", opts: Options{Width: 50, Height: 50, Crop: CropContain}, expectedCrop: src, expectedWidth: 50, expectedHeight: 25},
+		{desc: "contain small", opts: Options{Width: 400, Height: 400, Crop: CropContain}, expectedCrop: src, expectedWidth: 200, expectedHeight: 100},
+		{desc: "cover wide", opts: Options{Width: 50, Height: 50, Crop: CropCover}, expectedCrop: image.Rect(50, 0, 150, 100), expectedWidth: 50, expectedHeight: 50},
+		{desc: "cover tall", opts: Options{Width: 400, Height: 100, Crop: CropCover}, expectedCrop: image.Rect(0, 25, 200, 75), expectedWidth: 400, expectedHeight: 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			crop, width, height := scaleGeometry(src, tc.opts)
+			require.Equal(t, tc.expectedCrop, crop)
+			require.Equal(t, tc.expectedWidth, width)
+			require.Equal(t, tc.expectedHeight, height)
+		})
+	}
+}
+
+func TestProcessPNGCompression(t *testing.T) {
+	sizes := make(map[string]int)
+	for _, level := range []string{"", "best"} {
+		var out bytes.Buffer
+		require.NoError(t, Process(openFixture(t, pngFixture), &out, Options{Width: 100, PNGCompression: level}))
+		sizes[level] = out.Len()
+
+		resized, err := png.Decode(&out)
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 100, 92), resized.Bounds())
+	}
+
+	require.LessOrEqual(t, sizes["best"], sizes[""], "best compression should not be larger than the default")
+}
+
+func TestProcessJPEGProgressive(t *testing.T) {
+	for _, fixture := range []string{pngFixture, "../../../testdata/image.jpg"} {
+		for _, progressive := range []bool{false, true} {
+			var out bytes.Buffer
+			require.NoError(t, Process(openFixture(t, fixture), &out, Options{Width: 100, Format: "jpg", JPEGProgressive: progressive}))
+			require.Equal(t, progressive, isProgressiveJPEG(t, out.Bytes()), fixture)
+
+			resized, format, err := image.Decode(&out)
+			require.NoError(t, err)
+			require.Equal(t, "jpeg", format)
+			require.Equal(t, 100, resized.Bounds().Dx())
+		}
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, Process(openFixture(t, pngFixture), &out, Options{Width: 100, JPEGProgressive: true}))
+	_, format, err := image.DecodeConfig(&out)
+	require.NoError(t, err)
+	require.Equal(t, "png", format, "other formats must ignore JPEGProgressive")
+}
+
+// isProgressiveJPEG tells whether the SOF marker of a JPEG is the one of
+// progressive images
+func isProgressiveJPEG(t *testing.T, data []byte) bool {
+	for pos := 2; pos+4 <= len(data); {
+		require.Equal(t, byte(0xff), data[pos], "marker expected at %d", pos)
+		if marker := data[pos+1]; marker >= 0xc0 && marker <= 0xc2 {
+			return marker == 0xc2
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+
+	t.Fatal("no SOF marker")
+	return false
+}
+
+// palettedPNG returns a 200x200 palette PNG of randomly colored cells
+func palettedPNG(t *testing.T) []byte {
+	p := color.Palette{
+		color.NRGBA{A: 0xff},
+		color.NRGBA{R: 0xff, A: 0xff},
+		color.NRGBA{G: 0xff, A: 0xff},
+		color.NRGBA{B: 0xff, A: 0xff},
+		color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		color.NRGBA{},
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewPaletted(image.Rect(0, 0, 200, 200), p)
+	for y := 0; y < 200; y += 10 {
+		for x := 0; x < 200; x += 10 {
+			cell := image.Rect(x, y, x+10, y+10)
+			draw.Draw(img, cell, image.NewUniform(p[rnd.Intn(len(p))]), image.Point{}, draw.Src)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// deepPNG returns a 16-bit PNG with a horizontal gradient, most shades of
+// which do not survive a round trip through 8 bits
+func deepPNG(t *testing.T) []byte {
+	img := image.NewNRGBA64(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			v := uint16(0x4000 + x*7)
+			img.SetNRGBA64(x, y, color.NRGBA64{R: v, G: v, B: v, A: 0xffff})
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func requireColor(t *testing.T, expected color.Color, actual color.Color) {
+	er, eg, eb, ea := expected.RGBA()
+	ar, ag, ab, aa := actual.RGBA()
+	require.Equal(t, []uint32{er, eg, eb, ea}, []uint32{ar, ag, ab, aa})
+}
+
+func TestProcessErrors(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		opts        Options
+		expectedErr error
+	}{
+		{desc: "no dimensions", opts: Options{}},
+		{desc: "too many pixels", opts: Options{Width: 100, MaxPixels: 555*512 - 1}, expectedErr: ErrTooManyPixels},
+		{desc: "unknown format", opts: Options{Width: 100, Format: "foo"}},
+		{desc: "cover without height", opts: Options{Width: 100, Crop: CropCover}},
+		{desc: "cover without width", opts: Options{Height: 100, Crop: CropCover}},
+		{desc: "unknown crop mode", opts: Options{Width: 100, Height: 100, Crop: "stretch"}},
+		{desc: "unknown filter", opts: Options{Width: 100, Filter: "bicubic"}},
+		{desc: "unknown PNG compression", opts: Options{Width: 100, PNGCompression: "max"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := Process(openFixture(t, pngFixture), ioutil.Discard, tc.opts)
+			require.Error(t, err)
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "expected %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestProcessRejectsTooManyPixelsBeforeReadingImage(t *testing.T) {
+	// A PNG header of a 100000x100000 RGB image, whose image data never
+	// ends
+	ihdr := make([]byte, 4+4+13)
+	binary.BigEndian.PutUint32(ihdr, 13)
+	copy(ihdr[4:], "IHDR")
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	binary.BigEndian.PutUint32(ihdr[12:], 100000)
+	ihdr[16] = 8 // bit depth
+	ihdr[17] = 2 // RGB
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(ihdr[4:]))
+
+	head := "\x89PNG\r\n\x1a\n" + string(ihdr) + string(crc[:]) + "\x03\x00\x00\x00IDAT"
+	zeros := &countingReader{r: io.LimitReader(zeroReader{}, 16<<20)}
+	r := io.MultiReader(strings.NewReader(head), zeros)
+
+	registry := NewRegistry(PNG)
+	registry.Register(Format{
+		Name:         PNG.Name,
+		Magic:        PNG.Magic,
+		DecodeConfig: PNG.DecodeConfig,
+		Decode: func(io.Reader) (image.Image, error) {
+			t.Fatal("image must not be decoded")
+			return nil, nil
+		},
+		Output: PNG.Output,
+	})
+
+	err := Process(r, ioutil.Discard, Options{Width: 100, MaxPixels: 1000 * 1000, Registry: registry})
+	require.True(t, errors.Is(err, ErrTooManyPixels), "unexpected error: %v", err)
+	require.Less(t, zeros.n, int64(1<<20), "only the head of the image must be read")
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestProcessExpectedBytes(t *testing.T) {
+	data, err := ioutil.ReadFile(pngFixture)
+	require.NoError(t, err)
+	size := int64(len(data))
+
+	testCases := []struct {
+		desc          string
+		expectedBytes int64
+		expectedErr   error
+	}{
+		{desc: "no hint"},
+		{desc: "exact length", expectedBytes: size},
+		{desc: "stream shorter than hint", expectedBytes: 2 * size},
+		{desc: "huge hint", expectedBytes: 1 << 40},
+		{desc: "stream longer than hint", expectedBytes: size - 1, expectedErr: ErrLargerThanExpected},
+		{desc: "stream much longer than hint", expectedBytes: size / 2, expectedErr: ErrLargerThanExpected},
+		{desc: "stream longer than sniffed head", expectedBytes: 100, expectedErr: ErrLargerThanExpected},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, maxPixels := range []int{0, 555 * 512} {
+				// Without a pixel limit we stream the image into the decoder,
+				// otherwise we read all of it into memory first
+				opts := Options{Width: 64, MaxPixels: maxPixels, ExpectedBytes: tc.expectedBytes}
+				err := Process(bytes.NewReader(data), ioutil.Discard, opts)
+				if tc.expectedErr == nil {
+					require.NoError(t, err, "max pixels %d", maxPixels)
+				} else {
+					require.True(t, errors.Is(err, tc.expectedErr), "max pixels %d: unexpected error: %v", maxPixels, err)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFallbackOriginal(t *testing.T) {
+	data, err := ioutil.ReadFile(pngFixture)
+	require.NoError(t, err)
+
+	// A bit depth of 4 is not allowed for RGB images, so the decoder
+	// rejects the image even though all its chunks are intact
+	unsupported := withIHDRByte(data, 8, 4, true)
+	corrupt := withIHDRByte(data, 8, 4, false)
+
+	testCases := []struct {
+		desc        string
+		input       []byte
+		fallback    bool
+		maxPixels   int
+		expectedErr error
+	}{
+		{desc: "unsupported PNG", input: unsupported, fallback: true},
+		{desc: "unsupported PNG with pixel limit", input: unsupported, fallback: true, maxPixels: 555 * 512},
+		{desc: "unsupported PNG without fallback", input: unsupported, expectedErr: ErrDecode},
+		{desc: "CRC mismatch", input: corrupt, fallback: true, expectedErr: ErrDecode},
+		{desc: "truncated PNG", input: unsupported[:len(unsupported)/2], fallback: true, expectedErr: ErrDecode},
+		{desc: "corrupt JPEG", input: []byte("\xff\xd8\xff\xe0 broken"), fallback: true, expectedErr: ErrDecode},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var contentType string
+			opts := Options{
+				Width:            64,
+				Format:           "jpg",
+				MaxPixels:        tc.maxPixels,
+				FallbackOriginal: tc.fallback,
+				OnContentType:    func(ct string) error { contentType = ct; return nil },
+			}
+
+			var out bytes.Buffer
+			err := Process(bytes.NewReader(tc.input), &out, opts)
+			if tc.expectedErr != nil {
+				require.True(t, errors.Is(err, tc.expectedErr), "unexpected error: %v", err)
+				require.Zero(t, out.Len())
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.input, out.Bytes())
+			require.Equal(t, "image/png", contentType)
+		})
+	}
+}
+
+// withIHDRByte returns a copy of a PNG with the byte at offset i of the IHDR
+// chunk data set to b. If fixCRC is false, the CRC of the chunk no longer
+// matches.
+func withIHDRByte(data []byte, i int, b byte, fixCRC bool) []byte {
+	const ihdrStart = 8 + 8 // after the PNG magic and the chunk header
+
+	data = append([]byte(nil), data...)
+	data[ihdrStart+i] = b
+	if fixCRC {
+		binary.BigEndian.PutUint32(data[ihdrStart+13:], crc32.ChecksumIEEE(data[ihdrStart-4:ihdrStart+13]))
+	}
+
+	return data
+}
+
+func TestProcessVariants(t *testing.T) {
+	for _, fixture := range []string{pngFixture, jpegFixture} {
+		t.Run(fixture, func(t *testing.T) {
+			data, err := ioutil.ReadFile(fixture)
+			require.NoError(t, err)
+
+			decodes := 0
+			registry := NewRegistry(DefaultFormats...)
+			for _, format := range DefaultFormats {
+				format := format
+				decode, decodeScaled := format.Decode, format.DecodeScaled
+				format.Decode = func(r io.Reader) (image.Image, error) {
+					decodes++
+					return decode(r)
+				}
+				if decodeScaled != nil {
+					format.DecodeScaled = func(r io.Reader, denominator func(image.Config) int) (image.Image, error) {
+						decodes++
+						return decodeScaled(r, denominator)
+					}
+				}
+				registry.Register(format)
+			}
+
+			var order []int
+			widths := []int{32, 128, 16, 64}
+			outputs := make([]*orderedWriter, len(widths))
+			var variants []Variant
+			for i, width := range widths {
+				outputs[i] = &orderedWriter{id: width, order: &order}
+				variants = append(variants, Variant{Width: width, Writer: outputs[i]})
+			}
+
+			require.NoError(t, ProcessVariants(bytes.NewReader(data), Options{Registry: registry}, variants))
+			require.Equal(t, 1, decodes, "the image must be decoded once")
+			require.Equal(t, []int{128, 64, 32, 16}, order, "the largest variant must come first")
+
+			for i, width := range widths {
+				// Each variant is the same as if we resized the image to it
+				// on its own, rather than from a larger variant
+				var expected bytes.Buffer
+				require.NoError(t, Process(bytes.NewReader(data), &expected, Options{Width: width}))
+				require.Equal(t, expected.Bytes(), outputs[i].buf.Bytes(), "width %d", width)
+			}
+		})
+	}
+}
+
+func TestProcessVariantsValidatesEachVariant(t *testing.T) {
+	variants := []Variant{{Width: 32, Height: 32, Writer: ioutil.Discard}, {Width: 16, Writer: ioutil.Discard}}
+	err := ProcessVariants(openFixture(t, pngFixture), Options{Crop: CropCover}, variants)
+	require.EqualError(t, err, "crop mode cover needs both width and height")
+
+	err = ProcessVariants(openFixture(t, pngFixture), Options{}, nil)
+	require.Error(t, err)
+}
+
+// orderedWriter records its id in order when it is first written to
+type orderedWriter struct {
+	buf   bytes.Buffer
+	id    int
+	order *[]int
+}
+
+func (w *orderedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() == 0 {
+		*w.order = append(*w.order, w.id)
+	}
+	return w.buf.Write(p)
+}
+
+func TestExpectedSizeReader(t *testing.T) {
+	r := &expectedSizeReader{r: strings.NewReader("0123456789"), remaining: 4}
+
+	buf := make([]byte, 3)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	n, err = r.Read(buf)
+	require.Equal(t, ErrLargerThanExpected, err)
+	require.Equal(t, 1, n, "bytes up to the limit must be returned")
+
+	n, err = r.Read(buf)
+	require.Equal(t, ErrLargerThanExpected, err)
+	require.Equal(t, 0, n)
+}
+
+func TestProcessRejectsNonImages(t *testing.T) {
+	garbage := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(garbage)
+
+	testCases := []struct {
+		desc  string
+		input []byte
+	}{
+		{desc: "HTML error page", input: []byte("<html><body><h1>503 Service Unavailable</h1></body></html>")},
+		{desc: "XML error", input: []byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)},
+		{desc: "plain text", input: []byte("Not found, sorry")},
+		{desc: "binary garbage", input: garbage},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := Process(bytes.NewReader(tc.input), ioutil.Discard, Options{Width: 100})
+			require.True(t, errors.Is(err, ErrNotAnImage), "expected %v, got %v", ErrNotAnImage, err)
+		})
+	}
+}
+
+const svgImage = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">
+<!-- an innocent looking icon -->
+<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><script>alert(1)</script></svg>`
+
+func TestProcessRejectsSVG(t *testing.T) {
+	// Reading byte by byte makes sure we sniff more than the first read
+	err := Process(iotest.OneByteReader(strings.NewReader(svgImage)), ioutil.Discard, Options{Width: 100})
+	require.True(t, errors.Is(err, ErrUnsupportedFormat), "unexpected error: %v", err)
+	require.Equal(t, "unsupported format: svg", err.Error())
+}
+
+func TestIsSVG(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		head  string
+		isSVG bool
+	}{
+		{desc: "full prolog", head: svgImage, isSVG: true},
+		{desc: "bare root element", head: `<svg xmlns="http://www.w3.org/2000/svg"/>`, isSVG: true},
+		{desc: "byte order mark and whitespace", head: "\xef\xbb\xbf\n  <svg>", isSVG: true},
+		{desc: "other XML", head: `<?xml version="1.0"?><Error><Code>NoSuchKey</Code></Error>`},
+		{desc: "HTML with inline SVG", head: `<html><body><svg></svg></body></html>`},
+		{desc: "similar element", head: `<svgfoo/>`},
+		{desc: "unterminated comment", head: `<!-- <svg>`},
+		{desc: "truncated", head: `<svg`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.isSVG, isSVG([]byte(tc.head)))
+		})
+	}
+}
+
+func TestProcessSniffingKeepsStreamIntact(t *testing.T) {
+	for _, fixture := range []string{pngFixture, "../../../testdata/image.jpg", "../../../testdata/image.tiff", "../../../testdata/image.bmp"} {
+		t.Run(fixture, func(t *testing.T) {
+			// Sending the image byte by byte makes sure the decoder sees the
+			// bytes we sniffed even if they arrived in separate reads
+			r := iotest.OneByteReader(openFixture(t, fixture))
+			require.NoError(t, Process(r, ioutil.Discard, Options{Width: 8}))
+		})
+	}
+}
+
+func openFixture(t *testing.T, path string) io.Reader {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return bytes.NewReader(data)
+}
+
+func BenchmarkResizeImageFilters(b *testing.B) {
+	src := hardEdgedImage(3000, 7)
+
+	for _, name := range []string{"box", "lanczos"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				resizeImage(src, 400, 0, filters[name])
+			}
+		})
+	}
+}
+
+func BenchmarkProcessAdaptiveFilter(b *testing.B) {
+	var data bytes.Buffer
+	require.NoError(b, png.Encode(&data, hardEdgedImage(1000, 7)))
+
+	for _, threshold := range []float64{0, 0.9} {
+		b.Run(fmt.Sprintf("threshold %v", threshold), func(b *testing.B) {
+			opts := Options{Width: 950, AdaptiveFilterThreshold: threshold}
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, Process(bytes.NewReader(data.Bytes()), ioutil.Discard, opts))
+			}
+		})
+	}
+}
+
+func TestAdaptiveFilter(t *testing.T) {
+	src := image.Rect(0, 0, 1000, 500)
+
+	tests := []struct {
+		desc     string
+		opts     Options
+		adaptive bool
+	}{
+		{desc: "disabled", opts: Options{Width: 950}, adaptive: false},
+		{desc: "slight downscale", opts: Options{Width: 950, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "at threshold", opts: Options{Width: 900, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "strong downscale", opts: Options{Width: 899, AdaptiveFilterThreshold: 0.9}, adaptive: false},
+		{desc: "same size", opts: Options{Width: 1000, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "upscale", opts: Options{Width: 1100, AdaptiveFilterThreshold: 0.9}, adaptive: false},
+		{desc: "height only", opts: Options{Height: 475, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "stretched", opts: Options{Width: 950, Height: 250, AdaptiveFilterThreshold: 0.9}, adaptive: false},
+		{desc: "contain", opts: Options{Width: 950, Height: 2000, Crop: CropContain, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "cover", opts: Options{Width: 100, Height: 475, Crop: CropCover, AdaptiveFilterThreshold: 0.9}, adaptive: true},
+		{desc: "explicit filter", opts: Options{Width: 950, Filter: "lanczos", AdaptiveFilterThreshold: 0.9}, adaptive: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.adaptive, adaptiveFilter(src, tc.opts))
+		})
+	}
+}
+
+func TestProcessRejectsInvalidAdaptiveFilterThreshold(t *testing.T) {
+	for _, threshold := range []float64{-0.1, 1.1} {
+		err := Process(bytes.NewReader(nil), ioutil.Discard, Options{Width: 10, AdaptiveFilterThreshold: threshold})
+		require.Error(t, err, "threshold %v", threshold)
+	}
+}
+
+// hardEdgedImage returns a size x size checkerboard of opaque white and
+// fully transparent black cells
+func hardEdgedImage(size, cellSize int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if (x/cellSize+y/cellSize)%2 == 0 {
+				img.SetNRGBA(x, y, opaqueWhite)
+			} else {
+				img.SetNRGBA(x, y, transparentBlack)
+			}
+		}
+	}
+	return img
+}
+
+// naiveDownscale halves the size of img by averaging non-premultiplied
+// colors, which blends the black of transparent pixels into opaque ones
+func naiveDownscale(img *image.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			var r, g, b, a int
+			for _, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				c := img.NRGBAAt(2*x+p.X, 2*y+p.Y)
+				r, g, b, a = r+int(c.R), g+int(c.G), b+int(c.B), a+int(c.A)
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / 4), G: uint8(g / 4), B: uint8(b / 4), A: uint8(a / 4)})
+		}
+	}
+	return dst
+}
+
+// countDarkFringes counts visible pixels that are darker than the only
+// visible color in the source image: white
+func countDarkFringes(img *image.NRGBA) int {
+	const tolerance = 2
+
+	n := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			if c.R < 0xff-tolerance || c.G < 0xff-tolerance || c.B < 0xff-tolerance {
+				n++
+			}
+		}
+	}
+	return n
+}
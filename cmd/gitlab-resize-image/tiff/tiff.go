@@ -0,0 +1,58 @@
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	leHeader = "II\x2a\x00" // Header for little-endian files
+	beHeader = "MM\x00\x2a" // Header for big-endian files
+
+	ifdEntryLen = 12
+)
+
+// HasHeader reports whether b starts like a TIFF file
+func HasHeader(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(leHeader)) || bytes.HasPrefix(b, []byte(beHeader))
+}
+
+// IsMultiPage reports whether a TIFF file contains more than one image
+// file directory (page). image.Decode only returns the first page.
+func IsMultiPage(r io.ReaderAt) (bool, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return false, fmt.Errorf("read header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case leHeader:
+		order = binary.LittleEndian
+	case beHeader:
+		order = binary.BigEndian
+	default:
+		return false, errors.New("not a TIFF file")
+	}
+
+	ifdOffset := int64(order.Uint32(header[4:]))
+
+	var entryCount [2]byte
+	if _, err := r.ReadAt(entryCount[:], ifdOffset); err != nil {
+		return false, fmt.Errorf("read first IFD: %w", err)
+	}
+
+	// The offset of the next IFD follows the entries of the current one. It
+	// is zero for the last IFD.
+	nextOffsetPos := ifdOffset + int64(len(entryCount)) + ifdEntryLen*int64(order.Uint16(entryCount[:]))
+
+	var nextOffset [4]byte
+	if _, err := r.ReadAt(nextOffset[:], nextOffsetPos); err != nil {
+		return false, fmt.Errorf("read next IFD offset: %w", err)
+	}
+
+	return order.Uint32(nextOffset[:]) != 0, nil
+}
@@ -0,0 +1,66 @@
+package tiff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	singlePageTIFF = "../../../testdata/image.tiff"
+	multiPageTIFF  = "../../../testdata/image_multipage.tiff"
+	png            = "../../../testdata/image.png"
+)
+
+func TestIsMultiPage(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		fixture   string
+		multiPage bool
+	}{
+		{desc: "single page", fixture: singlePageTIFF, multiPage: false},
+		{desc: "multiple pages", fixture: multiPageTIFF, multiPage: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			data, err := ioutil.ReadFile(tc.fixture)
+			require.NoError(t, err)
+
+			multiPage, err := IsMultiPage(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, tc.multiPage, multiPage)
+		})
+	}
+}
+
+func TestHasHeader(t *testing.T) {
+	for _, fixture := range []string{singlePageTIFF, multiPageTIFF} {
+		data, err := ioutil.ReadFile(fixture)
+		require.NoError(t, err)
+		require.True(t, HasHeader(data), fixture)
+	}
+
+	require.True(t, HasHeader([]byte("MM\x00\x2a\x00\x00\x00\x08")), "big-endian header")
+
+	data, err := ioutil.ReadFile(png)
+	require.NoError(t, err)
+	require.False(t, HasHeader(data))
+	require.False(t, HasHeader([]byte("II")), "truncated header")
+}
+
+func TestIsMultiPageErrors(t *testing.T) {
+	data, err := ioutil.ReadFile(png)
+	require.NoError(t, err)
+
+	_, err = IsMultiPage(bytes.NewReader(data))
+	require.Error(t, err, "not a TIFF file")
+
+	data, err = ioutil.ReadFile(singlePageTIFF)
+	require.NoError(t, err)
+
+	_, err = IsMultiPage(bytes.NewReader(data[:len(data)-2]))
+	require.Error(t, err, "truncated file")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"io"
 	"io/ioutil"
@@ -28,6 +29,8 @@ password = "redis password"
 provider = "test provider"
 [image_resizer]
 max_scaler_procs = 123
+[git]
+slow_request_threshold = "1m"
 `
 	_, err = io.WriteString(f, data)
 	require.NoError(t, err)
@@ -43,6 +46,7 @@ max_scaler_procs = 123
 	require.Equal(t, "redis password", cfg.Redis.Password)
 	require.Equal(t, "test provider", cfg.ObjectStorageCredentials.Provider)
 	require.Equal(t, uint32(123), cfg.ImageResizerConfig.MaxScalerProcs, "image resizer max_scaler_procs")
+	require.Equal(t, time.Minute, cfg.GitConfig.SlowRequestThreshold.Duration, "git slow_request_threshold")
 }
 
 func TestConfigErrorHelp(t *testing.T) {
@@ -71,7 +75,7 @@ func TestConfigDefaults(t *testing.T) {
 
 	expectedBoot := &bootConfig{
 		secretPath:    "./.gitlab_workhorse_secret",
-		listenAddr:    "localhost:8181",
+		listenAddrs:   []string{"localhost:8181"},
 		listenNetwork: "tcp",
 		logFormat:     "text",
 	}
@@ -87,6 +91,8 @@ func TestConfigDefaults(t *testing.T) {
 		APIQueueTimeout:          queueing.DefaultTimeout,
 		APICILongPollingDuration: 50 * time.Second,
 		ImageResizerConfig:       config.DefaultImageResizerConfig,
+		GitConfig:                config.DefaultGitConfig,
+		ShutdownTimeout:          config.DefaultShutdownTimeout,
 	}
 
 	require.Equal(t, expectedCfg, cfg)
@@ -102,10 +108,14 @@ func TestConfigFlagParsing(t *testing.T) {
 		"-version",
 		"-secretPath", "secret path",
 		"-listenAddr", "listen addr",
+		"-listenAddr", "unix:///listen/socket",
 		"-listenNetwork", "listen network",
 		"-listenUmask", "123",
 		"-pprofListenAddr", "pprof listen addr",
 		"-prometheusListenAddr", "prometheus listen addr",
+		"-tlsCert", "tls cert",
+		"-tlsKey", "tls key",
+		"-tlsClientCA", "tls client ca",
 		"-logFile", "log file",
 		"-logFormat", "log format",
 		"-documentRoot", "document root",
@@ -126,11 +136,14 @@ func TestConfigFlagParsing(t *testing.T) {
 
 	expectedBoot := &bootConfig{
 		secretPath:           "secret path",
-		listenAddr:           "listen addr",
+		listenAddrs:          []string{"listen addr", "unix:///listen/socket"},
 		listenNetwork:        "listen network",
 		listenUmask:          123,
 		pprofListenAddr:      "pprof listen addr",
 		prometheusListenAddr: "prometheus listen addr",
+		tlsCert:              "tls cert",
+		tlsKey:               "tls key",
+		tlsClientCA:          "tls client ca",
 		logFile:              "log file",
 		logFormat:            "log format",
 		printVersion:         true,
@@ -152,6 +165,73 @@ func TestConfigFlagParsing(t *testing.T) {
 		APICILongPollingDuration: 234 * time.Second,
 		PropagateCorrelationID:   true,
 		ImageResizerConfig:       config.DefaultImageResizerConfig,
+		GitConfig:                config.DefaultGitConfig,
+		ShutdownTimeout:          config.DefaultShutdownTimeout,
 	}
 	require.Equal(t, expectedCfg, cfg)
 }
+
+func TestBuildTLSConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "workhorse-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	cert, key := writeTestCertificate(t, tmp, "server")
+
+	testCases := []struct {
+		desc         string
+		cert         string
+		key          string
+		clientCA     string
+		expectedAuth tls.ClientAuthType
+		expectedErr  bool
+	}{
+		{desc: "no TLS"},
+		{desc: "certificate and key", cert: cert, key: key, expectedAuth: tls.NoClientCert},
+		{desc: "client CA", cert: cert, key: key, clientCA: cert, expectedAuth: tls.RequireAndVerifyClientCert},
+		{desc: "missing key", cert: cert, expectedErr: true},
+		{desc: "key without certificate", key: key, expectedErr: true},
+		{desc: "client CA without certificate", clientCA: cert, expectedErr: true},
+		{desc: "key is not a certificate", cert: key, key: key, expectedErr: true},
+		{desc: "client CA is not a certificate", cert: cert, key: key, clientCA: key, expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tlsConfig, err := buildTLSConfig(tc.cert, tc.key, tc.clientCA)
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.cert == "" {
+				require.Nil(t, tlsConfig)
+				return
+			}
+			require.Len(t, tlsConfig.Certificates, 1)
+			require.Equal(t, tc.expectedAuth, tlsConfig.ClientAuth)
+		})
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	testCases := []struct {
+		addr            string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{addr: "localhost:8181", expectedNetwork: "tcp", expectedAddress: "localhost:8181"},
+		{addr: "[::1]:8181", expectedNetwork: "tcp", expectedAddress: "[::1]:8181"},
+		{addr: "tcp6://[::1]:8181", expectedNetwork: "tcp6", expectedAddress: "[::1]:8181"},
+		{addr: "unix:///tmp/workhorse.socket", expectedNetwork: "unix", expectedAddress: "/tmp/workhorse.socket"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			network, address := parseListenAddr(tc.addr, "tcp")
+			require.Equal(t, tc.expectedNetwork, network)
+			require.Equal(t, tc.expectedAddress, address)
+		})
+	}
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -20,6 +24,7 @@ import (
 
 	"github.com/golang/protobuf/jsonpb" //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
 	"github.com/golang/protobuf/proto"  //lint:ignore SA1019 https://gitlab.com/gitlab-org/gitlab-workhorse/-/issues/274
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -30,6 +35,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
 )
 
 func TestFailedCloneNoGitaly(t *testing.T) {
@@ -140,6 +146,152 @@ func TestGetInfoRefsProxiedToGitalySuccessfully(t *testing.T) {
 	}
 }
 
+// The -logFormat flag decides where the fields that git handlers add to
+// the access log line of a request end up
+func TestGetInfoRefsLogFormats(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.GracefulStop()
+
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+	ts := testAuthServer(t, nil, nil, 200, apiResponse)
+	defer ts.Close()
+
+	logger := logrus.StandardLogger()
+	defer func(out io.Writer, formatter logrus.Formatter, level logrus.Level) {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+	}(logger.Out, logger.Formatter, logger.Level)
+
+	for _, format := range []string{jsonLogFormat, textLogFormat} {
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "workhorse-log")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			logFile := filepath.Join(dir, "workhorse.log")
+
+			closer, err := startLogging(logFile, format)
+			require.NoError(t, err)
+			defer closer.Close()
+
+			// In text format, the regular log always goes to stderr
+			var stderr bytes.Buffer
+			if format == textLogFormat {
+				logger.SetOutput(&stderr)
+			}
+
+			accessLogger, accessCloser, err := getAccessLogger(logFile, format)
+			require.NoError(t, err)
+			defer accessCloser.Close()
+
+			testhelper.ConfigureSecret()
+			cfg := newUpstreamConfig(ts.URL)
+			cfg.LogAccessLogFields = accessLogDropsFields(format)
+			ws := httptest.NewServer(upstream.NewUpstream(*cfg, accessLogger, git.Options{}))
+
+			resp, _ := httpGet(t, ws.URL+"/gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack", nil)
+			require.Equal(t, 200, resp.StatusCode)
+			// Close waits for the request to be logged
+			ws.Close()
+
+			fileLog, err := ioutil.ReadFile(logFile)
+			require.NoError(t, err)
+
+			switch format {
+			case jsonLogFormat:
+				var gitLines []map[string]interface{}
+				for _, line := range strings.Split(strings.TrimSpace(string(fileLog)), "\n") {
+					var entry map[string]interface{}
+					require.NoError(t, json.Unmarshal([]byte(line), &entry), "line: %s", line)
+					if _, ok := entry["service"]; ok {
+						gitLines = append(gitLines, entry)
+					}
+				}
+
+				require.Len(t, gitLines, 1, "the git fields must only be on the access log line: %s", fileLog)
+				require.Equal(t, "git-upload-pack", gitLines[0]["service"])
+				require.Equal(t, float64(0), gitLines[0]["bytes_in"])
+				require.Greater(t, gitLines[0]["bytes_out"], float64(0))
+				require.Equal(t, float64(200), gitLines[0]["status"])
+			case textLogFormat:
+				require.Contains(t, string(fileLog), `"GET /gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack HTTP/1.1" 200`)
+				require.NotContains(t, string(fileLog), "bytes_in")
+
+				var finished string
+				for _, line := range strings.Split(stderr.String(), "\n") {
+					if strings.Contains(line, "finished request") {
+						finished = line
+					}
+				}
+				require.NotEmpty(t, finished, "log: %s", stderr.String())
+				require.Contains(t, finished, "service=git-upload-pack")
+				require.Contains(t, finished, "bytes_in=0")
+				require.Contains(t, finished, "bytes_out=")
+				require.Contains(t, finished, "uri=\"/gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack\"")
+			}
+		})
+	}
+}
+
+func TestGetInfoRefsCompression(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.GracefulStop()
+
+	apiResponse := gitOkBody(t)
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+
+	ts := testAuthServer(t, nil, nil, 200, apiResponse)
+	defer ts.Close()
+
+	testCases := []struct {
+		desc            string
+		compress        bool
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{desc: "gzip accepted", compress: true, acceptEncoding: "gzip", contentEncoding: "gzip"},
+		{desc: "gzip not accepted", compress: true, acceptEncoding: "identity"},
+		{desc: "compression disabled", compress: false, acceptEncoding: "gzip"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := newUpstreamConfig(ts.URL)
+			cfg.GitConfig.CompressInfoRefs = tc.compress
+			ws := startWorkhorseServerWithConfig(cfg)
+			defer ws.Close()
+
+			req, err := http.NewRequest("GET", ws.URL+"/gitlab-org/gitlab-test.git/info/refs?service=git-upload-pack", nil)
+			require.NoError(t, err)
+			// Setting this ourselves stops the client from decompressing the response
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, 200, resp.StatusCode)
+			require.Equal(t, tc.contentEncoding, resp.Header.Get("Content-Encoding"))
+
+			body := io.Reader(resp.Body)
+			if tc.contentEncoding == "gzip" {
+				gzipReader, err := gzip.NewReader(resp.Body)
+				require.NoError(t, err)
+				body = gzipReader
+			}
+
+			advertisement, err := ioutil.ReadAll(body)
+			require.NoError(t, err)
+
+			bodySplit := strings.SplitN(string(advertisement), "\000", 3)
+			require.Len(t, bodySplit, 3)
+			require.Equal(t, "git-upload-pack", bodySplit[1])
+			require.Equal(t, string(testhelper.GitalyInfoRefsResponseMock), bodySplit[2])
+		})
+	}
+}
+
 func TestGetInfoRefsProxiedToGitalyInterruptedStream(t *testing.T) {
 	apiResponse := gitOkBody(t)
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
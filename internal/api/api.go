@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,7 +11,10 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
@@ -51,6 +55,12 @@ var (
 			Help: "How many bytes have been returned by upstream GitLab in API failure/rejection response bodies.",
 		},
 	)
+	preAuthorizeRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_internal_api_pre_authorize_retries",
+			Help: "How many pre-authorization requests have been retried because upstream GitLab was temporarily unavailable.",
+		},
+	)
 )
 
 func NewAPI(myURL *url.URL, version string, roundTripper http.RoundTripper) *API {
@@ -143,6 +153,15 @@ type Response struct {
 	Repository gitalypb.Repository
 	// For git-http, does the requestor have the right to view all refs?
 	ShowAllRefs bool
+	// For git-http, may the requestor make partial clones of the repository?
+	AllowFilter bool
+	// For git-http, may the requestor fetch objects that are not reachable
+	// from any ref? Partial clones need this to fetch missing objects.
+	AllowAnySHA1InWant bool
+	// For git-http, may the requestor fetch refs by name with want-ref?
+	// Protocol v2 clients only send want-ref if the server advertises
+	// ref-in-want, which Git does only when this is set.
+	AllowRefInWant bool
 	// Detects whether an artifact is used for code intelligence
 	ProcessLsif bool
 	// Detects whether LSIF artifact will be parsed with references
@@ -235,7 +254,7 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 
 	httpResponse, err = api.doRequestWithoutRedirects(authReq)
 	if err != nil {
-		return nil, nil, fmt.Errorf("preAuthorizeHandler: do request: %v", err)
+		return nil, nil, fmt.Errorf("preAuthorizeHandler: do request: %w", err)
 	}
 	defer func() {
 		if outErr != nil {
@@ -262,9 +281,64 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 	return httpResponse, authResponse, nil
 }
 
+// RetryOptions configures how often a pre-authorization request is retried
+// when the auth backend is temporarily unavailable
+type RetryOptions struct {
+	// Attempts is the maximum number of requests made. Values less than 2
+	// disable retries.
+	Attempts int
+	// Backoff is how long we wait before the first retry. The wait doubles
+	// with each subsequent retry.
+	Backoff time.Duration
+}
+
+// preAuthorizeWithRetry calls PreAuthorize until it succeeds, fails with a
+// non-retryable error, or we run out of attempts. Pre-authorization requests
+// have no body so they are safe to repeat.
+func (api *API) preAuthorizeWithRetry(suffix string, r *http.Request, retry RetryOptions) (*http.Response, *Response, error) {
+	b := &backoff.Backoff{Min: retry.Backoff, Factor: 2, Jitter: true}
+
+	for attempt := 1; ; attempt++ {
+		httpResponse, authResponse, err := api.PreAuthorize(suffix, r)
+		if attempt >= retry.Attempts || !isRetryable(httpResponse, err) {
+			return httpResponse, authResponse, err
+		}
+
+		if httpResponse != nil {
+			httpResponse.Body.Close()
+		}
+		preAuthorizeRetries.Inc()
+
+		select {
+		case <-time.After(b.Duration()):
+		case <-r.Context().Done():
+			return nil, nil, fmt.Errorf("preAuthorizeHandler: retry: %v", r.Context().Err())
+		}
+	}
+}
+
+func isRetryable(httpResponse *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+
+	switch httpResponse.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
 func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler {
+	return api.PreAuthorizeHandlerWithRetry(next, suffix, RetryOptions{})
+}
+
+// PreAuthorizeHandlerWithRetry is like PreAuthorizeHandler, but it retries
+// the pre-authorization request on connection errors and 502/503 responses.
+func (api *API) PreAuthorizeHandlerWithRetry(next HandleFunc, suffix string, retry RetryOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		httpResponse, authResponse, err := api.PreAuthorize(suffix, r)
+		httpResponse, authResponse, err := api.preAuthorizeWithRetry(suffix, r, retry)
 		if httpResponse != nil {
 			defer httpResponse.Body.Close()
 		}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func TestPreAuthorizeHandlerWithRetry(t *testing.T) {
+	retry := RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+
+	testCases := []struct {
+		desc             string
+		failures         []int
+		expectedCode     int
+		expectedRequests int32
+		expectedNext     bool
+	}{
+		{
+			desc:             "success on first attempt",
+			expectedCode:     http.StatusOK,
+			expectedRequests: 1,
+			expectedNext:     true,
+		},
+		{
+			desc:             "backend unavailable twice",
+			failures:         []int{http.StatusServiceUnavailable, http.StatusBadGateway},
+			expectedCode:     http.StatusOK,
+			expectedRequests: 3,
+			expectedNext:     true,
+		},
+		{
+			desc:             "backend unavailable too often",
+			failures:         []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			expectedCode:     http.StatusBadGateway,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "access denied",
+			failures:         []int{http.StatusForbidden},
+			expectedCode:     http.StatusForbidden,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				if int(n) <= len(tc.failures) {
+					w.WriteHeader(tc.failures[n-1])
+					return
+				}
+
+				w.Header().Set("Content-Type", ResponseContentType)
+				require.NoError(t, json.NewEncoder(w).Encode(Response{GL_ID: "user-123"}))
+			}))
+			defer ts.Close()
+
+			a := newTestAPI(t, ts.URL)
+
+			nextCalled := false
+			h := a.PreAuthorizeHandlerWithRetry(func(w http.ResponseWriter, r *http.Request, ar *Response) {
+				nextCalled = true
+				require.Equal(t, "user-123", ar.GL_ID)
+			}, "", retry)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/foo/bar.git/info/refs", nil))
+
+			require.Equal(t, tc.expectedCode, w.Code)
+			require.Equal(t, tc.expectedRequests, atomic.LoadInt32(&requests))
+			require.Equal(t, tc.expectedNext, nextCalled)
+		})
+	}
+}
+
+func TestPreAuthorizeHandlerWithRetryConnectionRefused(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close() // Nothing listens on ts.URL anymore
+
+	a := newTestAPI(t, ts.URL)
+	h := a.PreAuthorizeHandlerWithRetry(func(http.ResponseWriter, *http.Request, *Response) {
+		t.Fatal("next handler must not be called")
+	}, "", RetryOptions{Attempts: 2, Backoff: time.Millisecond})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/foo/bar.git/info/refs", nil))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func newTestAPI(t *testing.T, backend string) *API {
+	testhelper.ConfigureSecret()
+
+	u, err := url.Parse(backend)
+	require.NoError(t, err)
+
+	return NewAPI(u, "123", http.DefaultTransport)
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"math"
+	"net"
 	"net/url"
 	"runtime"
 	"strings"
@@ -28,7 +30,7 @@ type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
 	d.Duration = temp
 	return err
@@ -84,7 +86,65 @@ type RedisConfig struct {
 
 type ImageResizerConfig struct {
 	MaxScalerProcs uint32 `toml:"max_scaler_procs"`
-	MaxFilesize    uint64 `toml:"max_filesize"`
+	// MaxScalerQueue is how many requests may wait for one of the
+	// MaxScalerProcs scaler processes, for up to ScalerQueueTimeout
+	MaxScalerQueue     uint32       `toml:"max_scaler_queue"`
+	ScalerQueueTimeout TomlDuration `toml:"scaler_queue_timeout"`
+	MaxFilesize        uint64       `toml:"max_filesize"`
+	// InProcess makes us resize images of uploads that are requested with
+	// a width in-process, see imageresizer.Resizer.Middleware. The
+	// settings below only apply to those.
+	InProcess     bool   `toml:"in_process"`
+	SigningSecret string `toml:"signing_secret"`
+	CacheSize     uint64 `toml:"cache_size"`
+	// ServeOriginalOnError makes the resize middleware serve the original
+	// image if resizing it fails, instead of an error
+	ServeOriginalOnError bool `toml:"serve_original_on_error"`
+}
+
+// TimeoutConfig limits how long serving a single request may take. Zero
+// values disable the respective timeout.
+type TimeoutConfig struct {
+	// ReadTimeout is how long reading the request body may take
+	ReadTimeout TomlDuration `toml:"read_timeout"`
+	// WriteTimeout is how long serving the whole request may take
+	WriteTimeout TomlDuration `toml:"write_timeout"`
+	// IdleTimeout is how long a request may go without reading from the
+	// request body or writing to the response
+	IdleTimeout TomlDuration `toml:"idle_timeout"`
+}
+
+type GitConfig struct {
+	// SlowRequestThreshold is how long a git-upload-pack or git-receive-pack
+	// request may take before we log a warning. Zero disables the warning.
+	SlowRequestThreshold TomlDuration `toml:"slow_request_threshold"`
+	// PreAuthorizeAttempts is how many times we try to pre-authorize a git
+	// request while the auth backend is temporarily unavailable
+	PreAuthorizeAttempts int `toml:"pre_authorize_attempts"`
+	// PreAuthorizeBackoff is how long we wait before the first retry. The
+	// wait doubles with each subsequent retry.
+	PreAuthorizeBackoff TomlDuration `toml:"pre_authorize_backoff"`
+	// RejectDumbHTTP makes us answer 'dumb' Git HTTP protocol requests with
+	// an explanatory error instead of proxying them to gitlab-rails. It is
+	// off by default so that we keep proxying them like we always did.
+	RejectDumbHTTP bool `toml:"reject_dumb_http"`
+	// ReceivePackMaxBodySize is the largest git-receive-pack request body
+	// we accept, in bytes. Zero means no limit.
+	ReceivePackMaxBodySize int64 `toml:"receive_pack_max_body_size"`
+	// RequestBufferSize is the size of the pooled buffers we copy request
+	// bodies to Gitaly with, in bytes. Zero means the default of 128 KiB.
+	RequestBufferSize int `toml:"request_buffer_size"`
+	// CompressInfoRefs makes us gzip the ref advertisement for clients that
+	// accept it. Pack data is compressed already, so it is sent as is.
+	CompressInfoRefs bool `toml:"compress_info_refs"`
+	// MetadataHeaders are request headers that we copy into the metadata
+	// of Gitaly calls, for Gitaly middleware that needs them
+	MetadataHeaders []string `toml:"metadata_headers"`
+	// AllowedServices are the git services, git-upload-pack and
+	// git-receive-pack, that clients may use. Empty allows both.
+	AllowedServices []string `toml:"allowed_services"`
+	// Timeouts replace the global timeouts for Git smart HTTP requests
+	Timeouts TimeoutConfig `toml:"timeouts"`
 }
 
 type Config struct {
@@ -106,20 +166,82 @@ type Config struct {
 	PropagateCorrelationID   bool                     `toml:"-"`
 	ImageResizerConfig       ImageResizerConfig       `toml:"image_resizer"`
 	AltDocumentRoot          string                   `toml:"alt_document_root"`
+	GitConfig                GitConfig                `toml:"git"`
+	Timeouts                 TimeoutConfig            `toml:"timeouts"`
+	KeepAliveTimeout         TomlDuration             `toml:"keep_alive_timeout"`
+	TrustedCIDRsForXFF       []string                 `toml:"trusted_cidrs_for_x_forwarded_for"`
+	TrustedProxies           []*net.IPNet             `toml:"-"`
+	ShutdownTimeout          TomlDuration             `toml:"shutdown_timeout"`
+	LogAccessLogFields       bool                     `toml:"-"`
 }
 
 var DefaultImageResizerConfig = ImageResizerConfig{
-	MaxScalerProcs: uint32(math.Max(2, float64(runtime.NumCPU())/2)),
-	MaxFilesize:    250 * 1000, // 250kB,
+	MaxScalerProcs:       uint32(math.Max(2, float64(runtime.NumCPU())/2)),
+	ScalerQueueTimeout:   TomlDuration{Duration: time.Second},
+	MaxFilesize:          250 * 1000, // 250kB,
+	ServeOriginalOnError: true,
+}
+
+var DefaultGitConfig = GitConfig{
+	SlowRequestThreshold: TomlDuration{Duration: 30 * time.Second},
+	PreAuthorizeAttempts: 3,
+	PreAuthorizeBackoff:  TomlDuration{Duration: 100 * time.Millisecond},
+	CompressInfoRefs:     true,
+}
+
+// reservedMetadataKeys are the Gitaly call metadata keys that Workhorse
+// sets itself, see git.withRequestMetadata. Clients must not be able to add
+// values to them through git.metadata_headers.
+var reservedMetadataKeys = []string{"request_id", "remote_ip", "user_id", "username", "anonymous"}
+
+func isReservedMetadataKey(key string) bool {
+	if strings.HasPrefix(key, "grpc-") {
+		return true
+	}
+	for _, reserved := range reservedMetadataKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
 }
 
+// DefaultShutdownTimeout is how long we wait for in-flight requests, such
+// as clones, when shutting down. It is shorter than the 30 seconds that,
+// say, Kubernetes gives pods to stop before it kills them.
+var DefaultShutdownTimeout = TomlDuration{Duration: 10 * time.Second}
+
 func LoadConfig(data string) (*Config, error) {
-	cfg := &Config{ImageResizerConfig: DefaultImageResizerConfig}
+	cfg := &Config{
+		ImageResizerConfig: DefaultImageResizerConfig,
+		GitConfig:          DefaultGitConfig,
+		ShutdownTimeout:    DefaultShutdownTimeout,
+	}
 
 	if _, err := toml.Decode(data, cfg); err != nil {
 		return nil, err
 	}
 
+	for _, cidr := range cfg.TrustedCIDRsForXFF {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_cidrs_for_x_forwarded_for: %v", err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+
+	for _, service := range cfg.GitConfig.AllowedServices {
+		if service != "git-upload-pack" && service != "git-receive-pack" {
+			return nil, fmt.Errorf("git.allowed_services: unknown service %q", service)
+		}
+	}
+
+	for _, header := range cfg.GitConfig.MetadataHeaders {
+		if isReservedMetadataKey(strings.ToLower(header)) {
+			return nil, fmt.Errorf("git.metadata_headers: %q is a reserved metadata key", header)
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -24,6 +25,9 @@ func TestLoadEmptyConfig(t *testing.T) {
 	require.Empty(t, cfg.AltDocumentRoot)
 	require.Equal(t, cfg.ImageResizerConfig.MaxFilesize, uint64(250000))
 	require.GreaterOrEqual(t, cfg.ImageResizerConfig.MaxScalerProcs, uint32(2))
+	require.True(t, cfg.ImageResizerConfig.ServeOriginalOnError)
+	require.Equal(t, DefaultGitConfig, cfg.GitConfig)
+	require.Equal(t, 10*time.Second, cfg.ShutdownTimeout.Duration)
 
 	require.Equal(t, ObjectStorageCredentials{}, cfg.ObjectStorageCredentials)
 	require.NoError(t, cfg.RegisterGoCloudURLOpeners())
@@ -83,7 +87,13 @@ func TestLoadImageResizerConfig(t *testing.T) {
 	config := `
 [image_resizer]
 max_scaler_procs = 200
+max_scaler_queue = 50
+scaler_queue_timeout = "2s"
 max_filesize = 350000
+in_process = true
+signing_secret = "s3cr3t"
+cache_size = 10000000
+serve_original_on_error = false
 `
 
 	cfg, err := LoadConfig(config)
@@ -92,13 +102,143 @@ max_filesize = 350000
 	require.NotNil(t, cfg.ImageResizerConfig, "Expected image resizer config")
 
 	expected := ImageResizerConfig{
-		MaxScalerProcs: 200,
-		MaxFilesize:    350000,
+		MaxScalerProcs:     200,
+		MaxScalerQueue:     50,
+		ScalerQueueTimeout: TomlDuration{Duration: 2 * time.Second},
+		MaxFilesize:        350000,
+		InProcess:          true,
+		SigningSecret:      "s3cr3t",
+		CacheSize:          10000000,
 	}
 
 	require.Equal(t, expected, cfg.ImageResizerConfig)
 }
 
+func TestLoadGitConfig(t *testing.T) {
+	config := `
+[git]
+slow_request_threshold = "1m30s"
+pre_authorize_attempts = 5
+pre_authorize_backoff = "1s"
+reject_dumb_http = true
+receive_pack_max_body_size = 1073741824
+request_buffer_size = 65536
+compress_info_refs = false
+metadata_headers = ["X-Gitlab-Feature-Flags", "X-Tenant-Id"]
+allowed_services = ["git-upload-pack"]
+
+[git.timeouts]
+idle_timeout = "5m"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := GitConfig{
+		SlowRequestThreshold:   TomlDuration{Duration: 90 * time.Second},
+		PreAuthorizeAttempts:   5,
+		PreAuthorizeBackoff:    TomlDuration{Duration: time.Second},
+		RejectDumbHTTP:         true,
+		ReceivePackMaxBodySize: 1 << 30,
+		RequestBufferSize:      64 << 10,
+		CompressInfoRefs:       false,
+		MetadataHeaders:        []string{"X-Gitlab-Feature-Flags", "X-Tenant-Id"},
+		AllowedServices:        []string{"git-upload-pack"},
+		Timeouts:               TimeoutConfig{IdleTimeout: TomlDuration{Duration: 5 * time.Minute}},
+	}
+
+	require.Equal(t, expected, cfg.GitConfig)
+}
+
+func TestLoadGitConfigRejectsUnknownServices(t *testing.T) {
+	_, err := LoadConfig(`
+[git]
+allowed_services = ["git-upload-pack", "upload-archive"]
+`)
+	require.EqualError(t, err, `git.allowed_services: unknown service "upload-archive"`)
+}
+
+func TestLoadGitConfigRejectsReservedMetadataHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		header string
+	}{
+		{desc: "request ID", header: "request_id"},
+		{desc: "user ID in another case", header: "User_ID"},
+		{desc: "anonymous", header: "anonymous"},
+		{desc: "gRPC key", header: "Grpc-Timeout"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := LoadConfig(`
+[git]
+metadata_headers = ["X-Gitlab-Feature-Flags", "` + tc.header + `"]
+`)
+			require.EqualError(t, err, `git.metadata_headers: "`+tc.header+`" is a reserved metadata key`)
+		})
+	}
+}
+
+func TestLoadTimeoutsConfig(t *testing.T) {
+	config := `
+keep_alive_timeout = "2m"
+
+[timeouts]
+read_timeout = "1m"
+write_timeout = "10m"
+idle_timeout = "30s"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	expected := TimeoutConfig{
+		ReadTimeout:  TomlDuration{Duration: time.Minute},
+		WriteTimeout: TomlDuration{Duration: 10 * time.Minute},
+		IdleTimeout:  TomlDuration{Duration: 30 * time.Second},
+	}
+
+	require.Equal(t, expected, cfg.Timeouts)
+	require.Equal(t, 2*time.Minute, cfg.KeepAliveTimeout.Duration)
+	require.Equal(t, TimeoutConfig{}, cfg.GitConfig.Timeouts)
+}
+
+func TestLoadRedisConfig(t *testing.T) {
+	config := `
+[redis]
+URL = "unix:/home/git/gitlab/redis/redis.socket"
+ReadTimeout = "1s"
+WriteTimeout = "2s"
+KeepAlivePeriod = "5m"
+`
+
+	cfg, err := LoadConfig(config)
+	require.NoError(t, err)
+
+	require.Equal(t, "unix:/home/git/gitlab/redis/redis.socket", cfg.Redis.URL.String())
+	require.Equal(t, time.Second, cfg.Redis.ReadTimeout.Duration)
+	require.Equal(t, 2*time.Second, cfg.Redis.WriteTimeout.Duration)
+	require.Equal(t, 5*time.Minute, cfg.Redis.KeepAlivePeriod.Duration)
+}
+
+func TestLoadTrustedCIDRsConfig(t *testing.T) {
+	cfg, err := LoadConfig(`trusted_cidrs_for_x_forwarded_for = ["10.0.0.0/8", "2001:db8::/32"]`)
+	require.NoError(t, err)
+
+	require.Len(t, cfg.TrustedProxies, 2)
+	require.Equal(t, "10.0.0.0/8", cfg.TrustedProxies[0].String())
+	require.Equal(t, "2001:db8::/32", cfg.TrustedProxies[1].String())
+
+	_, err = LoadConfig(`trusted_cidrs_for_x_forwarded_for = ["10.0.0.1"]`)
+	require.Error(t, err)
+}
+
+func TestLoadShutdownTimeoutConfig(t *testing.T) {
+	cfg, err := LoadConfig(`shutdown_timeout = "1m"`)
+	require.NoError(t, err)
+
+	require.Equal(t, time.Minute, cfg.ShutdownTimeout.Duration)
+}
+
 func TestAltDocumentConfig(t *testing.T) {
 	config := `
 alt_document_root = "/path/to/documents"
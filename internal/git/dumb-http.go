@@ -0,0 +1,22 @@
+package git
+
+import (
+	"net/http"
+)
+
+const dumbHTTPMessage = "The 'dumb' Git HTTP protocol is not supported. Please upgrade your Git client (version 1.6.6 or later) or use a client that supports the 'smart' HTTP protocol."
+
+// DumbHTTPHandler rejects requests made with the 'dumb' Git HTTP protocol.
+// Without it such requests end up in gitlab-rails, which responds with
+// errors that do not tell the user what went wrong.
+func DumbHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, dumbHTTPMessage, http.StatusForbidden)
+	})
+}
+
+// IsDumbInfoRefsRequest tells smart and dumb protocol clients apart: only
+// smart protocol clients select a service when fetching info/refs.
+func IsDumbInfoRefsRequest(r *http.Request) bool {
+	return getService(r) == ""
+}
@@ -1,4 +1,27 @@
 package git
 
+import (
+	"net/http"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
 // For cosmetic purposes in Sentry
 type copyError struct{ error }
+
+// ErrorReporter sends errors of git handlers to an error tracking service,
+// like Sentry. fields describe the request: the handler, the service, the
+// repository and the user.
+type ErrorReporter interface {
+	ReportError(r *http.Request, err error, fields log.Fields)
+}
+
+// ErrorReporterFunc lets ordinary functions be ErrorReporters
+type ErrorReporterFunc func(r *http.Request, err error, fields log.Fields)
+
+func (f ErrorReporterFunc) ReportError(r *http.Request, err error, fields log.Fields) {
+	f(r, err, fields)
+}
+
+// discardErrors is the ErrorReporter of handlers that have none
+var discardErrors = ErrorReporterFunc(func(*http.Request, error, log.Fields) {})
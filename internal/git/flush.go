@@ -0,0 +1,89 @@
+package git
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progressFlushInterval is how long data we wrote to a flushingWriter may
+// wait in the buffers of the ResponseWriter
+var progressFlushInterval = 100 * time.Millisecond
+
+type writeFlusher interface {
+	io.Writer
+	http.Flusher
+}
+
+// flushingWriter sends what is written to it on to the client within
+// interval. During long fetches, Gitaly only sends sideband progress
+// messages now and then, and clients time out if these wait in a buffer.
+// Pack data comes in one write after another, and we flush it at most once
+// per interval instead of after every write.
+type flushingWriter struct {
+	mu        sync.Mutex
+	w         writeFlusher
+	interval  time.Duration
+	lastFlush time.Time
+	timer     *time.Timer
+	stopped   bool
+}
+
+func newFlushingWriter(w writeFlusher, interval time.Duration) *flushingWriter {
+	return &flushingWriter{w: w, interval: interval}
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.w.Write(p)
+	if err != nil || f.stopped {
+		return n, err
+	}
+
+	// A write after a pause is likely a progress message, which should not
+	// wait. Otherwise we flush once the interval is over, unless a later
+	// write does.
+	if wait := f.interval - time.Since(f.lastFlush); wait <= 0 {
+		f.flush()
+	} else if f.timer == nil {
+		f.timer = time.AfterFunc(wait, f.flushLater)
+	}
+
+	return n, nil
+}
+
+func (f *flushingWriter) flushLater() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.timer = nil
+	if !f.stopped {
+		f.flush()
+	}
+}
+
+// flush must be called with f.mu held
+func (f *flushingWriter) flush() {
+	f.w.Flush()
+	f.lastFlush = time.Now()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// stop makes sure that we no longer flush the ResponseWriter, which must
+// not be used once our handler returned
+func (f *flushingWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
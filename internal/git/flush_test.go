@@ -0,0 +1,100 @@
+package git
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushingWriterSendsProgress(t *testing.T) {
+	messages := []string{
+		"0016\x02Counting objects\n",
+		"0019\x02Compressing objects\n",
+		"0015\x02Writing objects\n",
+	}
+	received := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := newFlushingWriter(NewHttpResponseWriter(rw), 10*time.Millisecond)
+		defer w.stop()
+		for _, msg := range messages {
+			_, err := io.WriteString(w, msg)
+			require.NoError(t, err)
+
+			// Like a slow RPC, we send the next message only once the client
+			// got this one, which it only does if we flushed
+			select {
+			case <-received:
+			case <-time.After(10 * time.Second):
+				t.Error("client did not receive progress message")
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	for _, msg := range messages {
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(resp.Body, buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf))
+		received <- struct{}{}
+	}
+}
+
+// flushCounter is a writeFlusher that counts how often it was flushed
+type flushCounter struct {
+	flushes int64
+}
+
+func (f *flushCounter) Write(p []byte) (int, error) { return len(p), nil }
+func (f *flushCounter) Flush()                      { atomic.AddInt64(&f.flushes, 1) }
+func (f *flushCounter) count() int64                { return atomic.LoadInt64(&f.flushes) }
+
+func TestFlushingWriterLimitsFlushes(t *testing.T) {
+	fc := &flushCounter{}
+	w := newFlushingWriter(fc, time.Hour)
+	defer w.stop()
+
+	// Like pack data, which comes in one write after another
+	for i := 0; i < 100; i++ {
+		_, err := io.WriteString(w, "0032\x01PACK")
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int64(1), fc.count(), "only the first write comes after a pause")
+}
+
+func TestFlushingWriterFlushesLaterWrites(t *testing.T) {
+	fc := &flushCounter{}
+	w := newFlushingWriter(fc, 10*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		_, err := io.WriteString(w, "0015\x02Writing objects\n")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), fc.count())
+
+	// The second write must not wait for a third one
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.count() < 2 {
+		require.True(t, time.Now().Before(deadline), "the second write was not flushed")
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once our handler is done, we must leave the ResponseWriter alone
+	w.stop()
+	_, err := io.WriteString(w, "0000")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int64(2), fc.count())
+}
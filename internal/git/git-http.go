@@ -5,13 +5,26 @@ In this file we handle the Git 'smart HTTP' protocol
 package git
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"google.golang.org/grpc/metadata"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
@@ -19,14 +32,24 @@ const (
 	// We have to use a negative transfer.hideRefs since this is the only way
 	// to undo an already set parameter: https://www.spinics.net/lists/git/msg256772.html
 	GitConfigShowAllRefs = "transfer.hideRefs=!refs"
+	// These let clients make partial clones with 'git clone --filter'
+	GitConfigAllowFilter        = "uploadpack.allowFilter=true"
+	GitConfigAllowAnySHA1InWant = "uploadpack.allowAnySHA1InWant=true"
+	// This lets protocol v2 clients fetch refs by name with want-ref.
+	// Without it, git-upload-pack rejects want-ref lines with an error
+	// that Gitaly sends back to the client.
+	GitConfigAllowRefInWant = "uploadpack.allowRefInWant=true"
+
+	// maxPktLineLen is the longest pkt-line the git protocol allows
+	maxPktLineLen = 65520
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+func ReceivePack(a *api.API, cfg config.GitConfig, opts Options) http.Handler {
+	return postRPCHandler(a, "handleReceivePack", handleReceivePack, cfg.ReceivePackMaxBodySize, cfg, opts)
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, cfg config.GitConfig, opts Options) http.Handler {
+	return postRPCHandler(a, "handleUploadPack", handleUploadPack, 0, cfg, opts)
 }
 
 func gitConfigOptions(a *api.Response) []string {
@@ -36,33 +59,292 @@ func gitConfigOptions(a *api.Response) []string {
 		out = append(out, GitConfigShowAllRefs)
 	}
 
+	if a.AllowFilter {
+		out = append(out, GitConfigAllowFilter)
+	}
+
+	if a.AllowAnySHA1InWant {
+		out = append(out, GitConfigAllowAnySHA1InWant)
+	}
+
+	if a.AllowRefInWant {
+		out = append(out, GitConfigAllowRefInWant)
+	}
+
 	return out
 }
 
-func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error) http.Handler {
-	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
-		cr := &countReadCloser{ReadCloser: r.Body}
+// postRPCHandler rejects request bodies larger than maxBodySize with a 413
+// error. A maxBodySize of 0 or less means no limit.
+func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error, maxBodySize int64, cfg config.GitConfig, opts Options) http.Handler {
+	reporter := opts.errorReporter()
+
+	return repoPreAuthorizeHandler(a, cfg, opts, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
+		// The span is a child of the span of the request, if it has one, and
+		// the tracing interceptors of our Gitaly clients pass it on
+		span, ctx := opentracing.StartSpanFromContext(r.Context(), "git.rpc", opentracing.Tags{
+			"handler": name,
+			"service": getService(r),
+			"repo":    ar.GL_REPOSITORY,
+		})
+		r = r.WithContext(ctx)
+
+		// Like handleUploadPack, we keep a copy of the start of the body as
+		// it streams to the handler, instead of peeking at it before. That
+		// copy has the capabilities the client asks for.
+		requestHead := &prefixBuffer{limit: maxPktLineLen}
+		cr := &countReadCloser{ReadCloser: teeReadCloser(r.Body, requestHead)}
 		r.Body = cr
 
+		var lr *limitReadCloser
+		if maxBodySize > 0 {
+			lr = &limitReadCloser{ReadCloser: cr, remaining: maxBodySize}
+			r.Body = lr
+		}
+
 		w := NewHttpResponseWriter(rw)
 		defer func() {
+			if capabilities := parseCapabilities(requestHead.Bytes()); len(capabilities) > 0 {
+				w.addLogField("capabilities", capabilities)
+			}
+			w.addLogField("chunked", isChunked(r))
 			w.Log(r, cr.Count())
 		}()
 
-		if err := handler(w, r, ar); err != nil {
-			// If the handler already wrote a response this WriteHeader call is a
-			// no-op. It never reaches net/http because GitHttpResponseWriter calls
-			// WriteHeader on its underlying ResponseWriter at most once.
-			w.WriteHeader(500)
-			log.WithRequest(r).WithError(fmt.Errorf("%s: %v", name, err)).Error()
+		start := time.Now()
+		defer func() {
+			duration := time.Since(start)
+			logSlowRequest(r, name, cr.Count(), duration, cfg.SlowRequestThreshold.Duration)
+
+			method, code := getService(r), strconv.Itoa(w.Status())
+			gitRPCRequests.WithLabelValues(method, code).Inc()
+			gitRPCDuration.WithLabelValues(method, code).Observe(duration.Seconds())
+
+			span.SetTag("bytes_in", cr.Count())
+			span.SetTag("status", w.Status())
+			span.Finish()
+		}()
+
+		err := handler(w, r, ar)
+		if lr != nil && lr.Exceeded() {
+			if w.Status() == 0 {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			}
+			log.WithRequest(r).WithFields(log.Fields{
+				"handler":       name,
+				"service":       getService(r),
+				"max_body_size": maxBodySize,
+			}).Warn("git request body too large")
+			return
+		}
+
+		if err != nil {
+			// If the handler already wrote a response we cannot change the status
+			// code or send an error message anymore. Otherwise we send a plain
+			// text body so that git clients have something to show to the user.
+			if w.Status() == 0 {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			ext.Error.Set(span, true)
+			err = fmt.Errorf("%s: %v", name, err)
+			log.WithRequest(r).WithFields(log.Fields{"service": getService(r)}).WithError(err).Error()
+			reporter.ReportError(r, err, log.Fields{
+				"handler": name,
+				"service": getService(r),
+				"method":  r.Method,
+				"repo":    ar.GL_REPOSITORY,
+				"user":    ar.GL_USERNAME,
+				"user_id": ar.GL_ID,
+			})
+		}
+	})
+}
+
+// isChunked tells whether the client sent the request body with chunked
+// transfer encoding. net/http removes the chunk framing before we read the
+// body, so this only helps to debug proxies in between.
+func isChunked(r *http.Request) bool {
+	for _, encoding := range r.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func logSlowRequest(r *http.Request, name string, bytesIn int64, duration time.Duration, threshold time.Duration) {
+	if threshold <= 0 || duration <= threshold {
+		return
+	}
+
+	log.WithRequest(r).WithFields(log.Fields{
+		"handler":    name,
+		"service":    getService(r),
+		"bytes_in":   bytesIn,
+		"duration_s": duration.Seconds(),
+	}).Warn("slow git request")
+}
+
+func repoPreAuthorizeHandler(myAPI *api.API, cfg config.GitConfig, opts Options, handleFunc api.HandleFunc) http.Handler {
+	retry := api.RetryOptions{
+		Attempts: cfg.PreAuthorizeAttempts,
+		Backoff:  cfg.PreAuthorizeBackoff.Duration,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reject disallowed services before we ask the auth backend about
+		// them. Dumb HTTP requests have no service and are not affected.
+		if service := getService(r); !serviceAllowed(cfg.AllowedServices, service) {
+			http.Error(w, fmt.Sprintf("%s is disabled on this server", service), http.StatusForbidden)
+			return
+		}
+
+		// The auth backend and Gitaly get the repository from the path, so
+		// we do not pass on paths that could escape it. Path is decoded,
+		// which catches %2e%2e and %00 too.
+		if err := validateRepoPath(r.URL.Path); err != nil {
+			log.WithRequest(r).WithError(err).Info("rejecting git request")
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		if opts.PreAuthorizeHook != nil && !opts.PreAuthorizeHook(w, r, repoPath(r.URL.Path)) {
+			return
+		}
+
+		// The pre-authorization has a span of its own, which the API
+		// client passes on to the auth backend. The span ends when the
+		// backend answered, so that the RPCs are no children of it.
+		ctx := r.Context()
+		span, spanCtx := opentracing.StartSpanFromContext(ctx, "git.pre_authorize", opentracing.Tag{Key: "service", Value: getService(r)})
+
+		// The handler is created per request so that it can tell whether
+		// the request was allowed, and when the auth backend answered
+		start := time.Now()
+		allowed := false
+		preAuthorizeHandler := myAPI.PreAuthorizeHandlerWithRetry(func(_ http.ResponseWriter, r *http.Request, a *api.Response) {
+			allowed = true
+			observePreAuthorize("allowed", time.Since(start))
+			span.SetTag("repo", a.GL_REPOSITORY)
+			finishPreAuthorizeSpan(span, "allowed", http.StatusOK)
+
+			// The git handlers get the original ResponseWriter, which may
+			// implement interfaces like http.Flusher that crw does not.
+			// Both share their headers.
+			r = r.WithContext(withRequestMetadata(ctx, r, a, cfg.MetadataHeaders))
+			handleFunc(w, r, a)
+		}, "", retry)
+
+		crw := helper.NewCountingResponseWriter(w)
+		preAuthorizeHandler.ServeHTTP(crw, r.WithContext(spanCtx))
+
+		if !allowed {
+			outcome := "denied"
+			if crw.Status() == 0 || crw.Status() >= 500 {
+				outcome = "error"
+			}
+			observePreAuthorize(outcome, time.Since(start))
+			finishPreAuthorizeSpan(span, outcome, crw.Status())
 		}
 	})
 }
 
-func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Handler {
-	return myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
-		handleFunc(w, r, a)
-	}, "")
+// repoPath returns the part of a git request path that names the
+// repository, up to and including its .git suffix. GitLab project paths
+// cannot end in .git, so the first one ends the repository.
+func repoPath(path string) string {
+	if i := strings.Index(path, ".git/"); i >= 0 {
+		return path[:i+len(".git")]
+	}
+	return path
+}
+
+// validateRepoPath rejects request paths with ".." segments or null bytes.
+// Nested groups are fine: they are just more segments.
+func validateRepoPath(path string) error {
+	if strings.IndexByte(path, 0) >= 0 {
+		return errors.New("repository path contains a null byte")
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return fmt.Errorf("repository path %q contains \"..\"", path)
+		}
+	}
+
+	return nil
+}
+
+// finishPreAuthorizeSpan tags the span with the outcome of the
+// pre-authorization and the status code of the auth backend
+func finishPreAuthorizeSpan(span opentracing.Span, outcome string, status int) {
+	span.SetTag("outcome", outcome)
+	span.SetTag("status", status)
+	if outcome == "error" {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
+}
+
+// serviceAllowed tells whether service is in allowed. An empty list allows
+// all services.
+func serviceAllowed(allowed []string, service string) bool {
+	if len(allowed) == 0 || service == "" {
+		return true
+	}
+
+	for _, s := range allowed {
+		if s == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+func observePreAuthorize(outcome string, duration time.Duration) {
+	preAuthorizeRequests.WithLabelValues(outcome).Inc()
+	preAuthorizeDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+}
+
+// withRequestMetadata adds request-scoped values to the metadata of
+// outgoing Gitaly calls, so that they can be correlated with our logs.
+// Anonymous requests, such as clones of public projects, have no user, so
+// we tell Gitaly that instead of sending empty user values. The request
+// headers named in headers are copied as well, under their lowercased name
+// as gRPC requires. config.LoadConfig rejects headers that would add values
+// to the keys we set here.
+func withRequestMetadata(ctx context.Context, r *http.Request, a *api.Response, headers []string) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.New(nil)
+	}
+
+	if correlationID := correlation.ExtractFromContext(r.Context()); correlationID != "" {
+		md.Append("request_id", correlationID)
+	}
+	if remoteIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		md.Append("remote_ip", remoteIP)
+	}
+
+	if a.GL_ID != "" {
+		md.Append("user_id", a.GL_ID)
+	}
+	if a.GL_USERNAME != "" {
+		md.Append("username", a.GL_USERNAME)
+	}
+	md.Append("anonymous", strconv.FormatBool(a.GL_ID == ""))
+
+	for _, name := range headers {
+		if values := r.Header[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			md.Append(strings.ToLower(name), values...)
+		}
+	}
+
+	return metadata.NewOutgoingContext(ctx, md)
 }
 
 func writePostRPCHeader(w http.ResponseWriter, action string) {
@@ -70,6 +352,10 @@ func writePostRPCHeader(w http.ResponseWriter, action string) {
 	w.Header().Set("Cache-Control", "no-cache")
 }
 
+// getService returns the git service a request is for: git-upload-pack or
+// git-receive-pack. GET requests for info/refs name it in the service
+// query parameter, which dumb HTTP clients leave out. POST requests end
+// with it.
 func getService(r *http.Request) string {
 	if r.Method == "GET" {
 		return r.URL.Query().Get("service")
@@ -77,24 +363,64 @@ func getService(r *http.Request) string {
 	return filepath.Base(r.URL.Path)
 }
 
+// teeReadCloser is like io.TeeReader, but keeps the Close method of r
+func teeReadCloser(r io.ReadCloser, w io.Writer) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r, w), r}
+}
+
+// countReadCloser counts the bytes read from a request body. These are the
+// bytes after decoding any chunked transfer encoding.
 type countReadCloser struct {
-	n int64
+	n int64 // accessed atomically; keep first for 64-bit alignment on 32-bit platforms
 	io.ReadCloser
-	sync.Mutex
 }
 
 func (c *countReadCloser) Read(p []byte) (n int, err error) {
 	n, err = c.ReadCloser.Read(p)
-
-	c.Lock()
-	defer c.Unlock()
-	c.n += int64(n)
+	atomic.AddInt64(&c.n, int64(n))
 
 	return n, err
 }
 
 func (c *countReadCloser) Count() int64 {
-	c.Lock()
-	defer c.Unlock()
-	return c.n
+	return atomic.LoadInt64(&c.n)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitReadCloser works like io.LimitReader, except that it returns an
+// error rather than io.EOF once the client sends more than the limit.
+type limitReadCloser struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32 // accessed atomically
+}
+
+func (l *limitReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+
+	// Read one byte past the limit so we can tell whether the body is
+	// exactly as large as the limit or larger
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		atomic.StoreInt32(&l.exceeded, 1)
+		return n - 1, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// Exceeded tells whether the client sent more than the limit
+func (l *limitReadCloser) Exceeded() bool {
+	return atomic.LoadInt32(&l.exceeded) == 1
 }
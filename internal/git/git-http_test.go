@@ -0,0 +1,974 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	logkit "gitlab.com/gitlab-org/labkit/log"
+	"google.golang.org/grpc/metadata"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream/roundtripper"
+)
+
+func TestCorrelationIDIsPropagated(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []correlation.InboundHandlerOption
+		clientID bool
+	}{
+		{desc: "ID sent by the client", opts: []correlation.InboundHandlerOption{correlation.WithPropagation()}, clientID: true},
+		{desc: "ID generated by workhorse"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var outgoingMD metadata.MD
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			h := repoPreAuthorizeHandler(a, config.GitConfig{}, Options{}, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+				outgoingMD, _ = metadata.FromOutgoingContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// The middlewares that upstream wraps git handlers in
+			var accessLog bytes.Buffer
+			accessLogger := logrus.New()
+			accessLogger.SetOutput(&accessLog)
+			accessLogger.SetFormatter(&logrus.JSONFormatter{})
+			h = correlation.InjectCorrelationID(logkit.AccessLogger(h, logkit.WithAccessLogger(accessLogger)), tc.opts...)
+
+			r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil)
+			// Workhorse only reuses an ID from the client if it is
+			// configured to
+			r.Header.Set("X-Request-Id", "client-request-id")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal(accessLog.Bytes(), &entry), "log: %s", accessLog.String())
+			correlationID, _ := entry["correlation_id"].(string)
+			require.NotEmpty(t, correlationID)
+			require.Equal(t, []string{correlationID}, outgoingMD["request_id"])
+
+			if tc.clientID {
+				require.Equal(t, "client-request-id", correlationID)
+			} else {
+				require.NotEqual(t, "client-request-id", correlationID)
+			}
+		})
+	}
+}
+
+func TestRemoteIPIsPropagated(t *testing.T) {
+	r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil)
+	r.RemoteAddr = "18.245.0.1:1234"
+
+	md, ok := metadata.FromOutgoingContext(withRequestMetadata(r.Context(), r, &api.Response{}, nil))
+	require.True(t, ok)
+	require.Equal(t, []string{"18.245.0.1"}, md["remote_ip"])
+}
+
+func TestUserMetadata(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		response api.Response
+		userID   []string
+		username []string
+		anon     []string
+	}{
+		{
+			desc:     "authenticated",
+			response: api.Response{GL_ID: "user-123", GL_USERNAME: "jane"},
+			userID:   []string{"user-123"},
+			username: []string{"jane"},
+			anon:     []string{"false"},
+		},
+		{
+			desc: "anonymous",
+			anon: []string{"true"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil)
+
+			md, ok := metadata.FromOutgoingContext(withRequestMetadata(r.Context(), r, &tc.response, nil))
+			require.True(t, ok)
+			require.Equal(t, tc.userID, md["user_id"])
+			require.Equal(t, tc.username, md["username"])
+			require.Equal(t, tc.anon, md["anonymous"])
+		})
+	}
+}
+
+func TestHeaderMetadata(t *testing.T) {
+	r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil)
+	r.Header.Set("X-Tenant-Id", "tenant-1")
+	r.Header.Add("X-Gitlab-Feature-Flags", "foo")
+	r.Header.Add("X-Gitlab-Feature-Flags", "bar")
+	r.Header.Set("X-Secret", "s3cr3t")
+	r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	headers := []string{"x-tenant-id", "X-Gitlab-Feature-Flags", "X-Missing"}
+	md, ok := metadata.FromOutgoingContext(withRequestMetadata(r.Context(), r, &api.Response{}, headers))
+	require.True(t, ok)
+
+	require.Equal(t, []string{"tenant-1"}, md["x-tenant-id"])
+	require.Equal(t, []string{"foo", "bar"}, md["x-gitlab-feature-flags"])
+	require.NotContains(t, md, "x-missing")
+	require.NotContains(t, md, "x-secret")
+	require.NotContains(t, md, "authorization")
+}
+
+func TestRepoPreAuthorizeHandlerWithUnixSocketBackend(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	socket := filepath.Join(tmp, "gitlab.socket")
+	ln, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/foo/bar.git/info/refs", r.URL.Path)
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		require.NoError(t, json.NewEncoder(w).Encode(api.Response{GL_ID: "user-123"}))
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	// With a socket, the backend URL only determines the relative URL root
+	backend := helper.URLMustParse("http://localhost")
+	a := api.NewAPI(backend, "123", roundtripper.NewBackendRoundTripper(backend, socket, 0, true))
+
+	var glID string
+	h := repoPreAuthorizeHandler(a, config.GitConfig{}, Options{}, func(w http.ResponseWriter, r *http.Request, ar *api.Response) {
+		glID = ar.GL_ID
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/foo/bar.git/info/refs", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "user-123", glID)
+}
+
+func TestPostRPCHandlerLogsSlowRequests(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		sleep   time.Duration
+		warning bool
+	}{
+		{desc: "fast request", sleep: 0, warning: false},
+		{desc: "slow request", sleep: 20 * time.Millisecond, warning: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			cfg := config.GitConfig{SlowRequestThreshold: config.TomlDuration{Duration: 10 * time.Millisecond}}
+			h := postRPCHandler(a, "handleSleep", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				_, err := ioutil.ReadAll(r.Body)
+				time.Sleep(tc.sleep)
+				return err
+			}, 0, cfg, Options{})
+
+			hook := test.NewGlobal()
+			r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", strings.NewReader("hello"))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			var warnings []*logrus.Entry
+			for _, e := range hook.AllEntries() {
+				if e.Level == logrus.WarnLevel {
+					warnings = append(warnings, e)
+				}
+			}
+
+			if !tc.warning {
+				require.Empty(t, warnings)
+				return
+			}
+
+			require.Len(t, warnings, 1)
+			require.Equal(t, "slow git request", warnings[0].Message)
+			require.Equal(t, "handleSleep", warnings[0].Data["handler"])
+			require.Equal(t, "git-upload-pack", warnings[0].Data["service"])
+			require.Equal(t, int64(5), warnings[0].Data["bytes_in"])
+			require.GreaterOrEqual(t, warnings[0].Data["duration_s"], tc.sleep.Seconds())
+		})
+	}
+}
+
+func TestPostRPCHandlerErrors(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		written      string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			desc:         "nothing written",
+			written:      "",
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "Internal server error\n",
+		},
+		{
+			desc:         "partial write",
+			written:      "0008NAK\n",
+			expectedCode: http.StatusOK,
+			expectedBody: "0008NAK\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			h := postRPCHandler(a, "handleFail", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				writePostRPCHeader(w, "git-upload-pack")
+				if tc.written != "" {
+					if _, err := io.WriteString(w, tc.written); err != nil {
+						return err
+					}
+				}
+				return errors.New("something went wrong")
+			}, 0, config.GitConfig{}, Options{})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil))
+
+			require.Equal(t, tc.expectedCode, w.Code)
+			testhelper.RequireResponseBody(t, w, tc.expectedBody)
+		})
+	}
+}
+
+func TestPostRPCHandlerReportsErrors(t *testing.T) {
+	type report struct {
+		err    error
+		fields log.Fields
+	}
+	var reports []report
+	reporter := ErrorReporterFunc(func(r *http.Request, err error, fields log.Fields) {
+		reports = append(reports, report{err: err, fields: fields})
+	})
+
+	a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{GL_REPOSITORY: "project-1", GL_ID: "user-2", GL_USERNAME: "jane"})
+	defer cleanUp()
+
+	fail := true
+	h := postRPCHandler(a, "handleFail", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+		if !fail {
+			writePostRPCHeader(w, "git-upload-pack")
+			return nil
+		}
+		return errors.New("something went wrong")
+	}, 0, config.GitConfig{}, Options{ErrorReporter: reporter})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	require.Len(t, reports, 1)
+	require.EqualError(t, reports[0].err, "handleFail: something went wrong")
+	require.Equal(t, log.Fields{
+		"handler": "handleFail",
+		"service": "git-upload-pack",
+		"method":  "POST",
+		"repo":    "project-1",
+		"user":    "jane",
+		"user_id": "user-2",
+	}, reports[0].fields)
+
+	// Successful requests are not reported
+	fail = false
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil))
+	require.Len(t, reports, 1)
+}
+
+// The -logFormat flag of Workhorse sets the formatter of the standard
+// logger, which both the request log line and the error log line use
+func TestPostRPCHandlerLogFormats(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		formatter    logrus.Formatter
+		requireField func(t *testing.T, line string, key string, value string)
+	}{
+		{
+			desc:      "json",
+			formatter: &logrus.JSONFormatter{},
+			requireField: func(t *testing.T, line string, key string, value string) {
+				var entry map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(line), &entry), "line: %s", line)
+				require.Equal(t, value, entry[key])
+			},
+		},
+		{
+			desc:      "text",
+			formatter: &logrus.TextFormatter{DisableColors: true},
+			requireField: func(t *testing.T, line string, key string, value string) {
+				if strings.ContainsAny(value, " :") {
+					value = strconv.Quote(value)
+				}
+				require.Contains(t, line, key+"="+value)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			logger := logrus.StandardLogger()
+			defer func(out io.Writer, formatter logrus.Formatter) {
+				logger.SetOutput(out)
+				logger.SetFormatter(formatter)
+			}(logger.Out, logger.Formatter)
+
+			var out bytes.Buffer
+			logger.SetOutput(&out)
+			logger.SetFormatter(tc.formatter)
+
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			h := postRPCHandler(a, "handleFail", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				return errors.New("something went wrong")
+			}, 0, config.GitConfig{}, Options{})
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil))
+
+			var failed string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if strings.Contains(line, "something went wrong") {
+					failed = line
+				}
+			}
+
+			require.NotEmpty(t, failed, "log: %s", out.String())
+			tc.requireField(t, failed, "level", "error")
+			tc.requireField(t, failed, "error", "handleFail: something went wrong")
+			tc.requireField(t, failed, "service", "git-upload-pack")
+		})
+	}
+}
+
+func TestPostRPCHandlerLimitsBodySize(t *testing.T) {
+	const maxBodySize = 10
+
+	testCases := []struct {
+		desc         string
+		body         string
+		expectedCode int
+		expectedIn   int64
+	}{
+		{desc: "below limit", body: "012345678", expectedCode: http.StatusOK, expectedIn: 9},
+		{desc: "at limit", body: "0123456789", expectedCode: http.StatusOK, expectedIn: 10},
+		{desc: "above limit", body: strings.Repeat("0123456789", 100), expectedCode: http.StatusRequestEntityTooLarge, expectedIn: maxBodySize + 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			h := postRPCHandler(a, "handleReceivePack", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				writePostRPCHeader(w, "git-receive-pack")
+				if _, err := ioutil.ReadAll(r.Body); err != nil {
+					return err
+				}
+				w.WriteHeader(http.StatusOK)
+				return nil
+			}, maxBodySize, config.GitConfig{}, Options{})
+
+			w := httptest.NewRecorder()
+			fields := serveWithAccessLog(h, w, httptest.NewRequest("POST", "/foo/bar.git/git-receive-pack", strings.NewReader(tc.body)))
+
+			require.Equal(t, tc.expectedCode, w.Code)
+			require.Equal(t, tc.expectedIn, fields["bytes_in"], "the request must be logged even if its body is too large")
+		})
+	}
+}
+
+func TestPostRPCHandlerLogsCapabilities(t *testing.T) {
+	request, err := ioutil.ReadFile(filepath.Join(testhelper.RootDir(), "testdata/upload-pack-request.txt"))
+	require.NoError(t, err)
+
+	a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+	defer cleanUp()
+
+	var forwarded []byte
+	h := postRPCHandler(a, "handleUploadPack", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+		var err error
+		forwarded, err = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		return err
+	}, 0, config.GitConfig{}, Options{})
+
+	fields := serveWithAccessLog(h, httptest.NewRecorder(), httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", bytes.NewReader(request)))
+
+	require.Equal(t, request, forwarded, "the handler must get the entire request")
+	require.Equal(t, []string{
+		"multi_ack_detailed", "no-done", "side-band-64k", "thin-pack", "include-tag",
+		"ofs-delta", "deepen-since", "deepen-not", "agent=git/2.28.0",
+	}, fields["capabilities"])
+	require.Equal(t, int64(len(request)), fields["bytes_in"])
+}
+
+func TestPostRPCHandlerChunkedRequests(t *testing.T) {
+	body := strings.Repeat("0123456789", 1000)
+
+	testCases := []struct {
+		desc    string
+		chunked bool
+	}{
+		{desc: "Content-Length", chunked: false},
+		{desc: "chunked", chunked: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			forwarded := make(chan []byte, 1)
+			h := postRPCHandler(a, "handleReceivePack", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				data, err := ioutil.ReadAll(r.Body)
+				forwarded <- data
+				w.WriteHeader(http.StatusOK)
+				return err
+			}, 0, config.GitConfig{}, Options{})
+
+			logged := make(chan log.Fields, 1)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				logged <- serveWithAccessLog(h, w, r)
+			}))
+			defer ts.Close()
+
+			var reqBody io.Reader = strings.NewReader(body)
+			if tc.chunked {
+				// The client uses chunked encoding for bodies of unknown length
+				reqBody = ioutil.NopCloser(reqBody)
+			}
+			req, err := http.NewRequest("POST", ts.URL+"/foo/bar.git/git-receive-pack", reqBody)
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			require.Equal(t, body, string(<-forwarded))
+
+			fields := <-logged
+			require.Equal(t, tc.chunked, fields["chunked"])
+			require.Equal(t, int64(len(body)), fields["bytes_in"], "bytes_in must not include the chunk framing")
+		})
+	}
+}
+
+func TestPostRPCHandlerMetrics(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		path       string
+		status     int
+		handlerErr error
+	}{
+		{desc: "successful upload-pack", path: "/foo/bar.git/git-upload-pack", status: http.StatusOK},
+		{desc: "unavailable upload-pack", path: "/foo/bar.git/git-upload-pack", status: http.StatusServiceUnavailable},
+		{desc: "successful receive-pack", path: "/foo/bar.git/git-receive-pack", status: http.StatusOK},
+		{desc: "failed receive-pack", path: "/foo/bar.git/git-receive-pack", status: http.StatusInternalServerError, handlerErr: errors.New("something went wrong")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{})
+			defer cleanUp()
+
+			h := postRPCHandler(a, "handleMetrics", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+				if tc.handlerErr != nil {
+					return tc.handlerErr
+				}
+				w.WriteHeader(tc.status)
+				return nil
+			}, 0, config.GitConfig{}, Options{})
+
+			labels := fmt.Sprintf(`{code="%d",method="%s"}`, tc.status, filepath.Base(tc.path))
+			before := scrapeMetrics(t)
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", tc.path, strings.NewReader("0000")))
+
+			after := scrapeMetrics(t)
+			require.Equal(t, before["gitlab_workhorse_git_http_requests_total"+labels]+1, after["gitlab_workhorse_git_http_requests_total"+labels])
+			require.Equal(t, before["gitlab_workhorse_git_http_request_duration_seconds_count"+labels]+1, after["gitlab_workhorse_git_http_request_duration_seconds_count"+labels])
+		})
+	}
+}
+
+func TestRepoPreAuthorizeHandlerMetrics(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		code    int
+		outcome string
+	}{
+		{desc: "allowed", code: http.StatusOK, outcome: "allowed"},
+		{desc: "denied", code: http.StatusForbidden, outcome: "denied"},
+		{desc: "not found", code: http.StatusNotFound, outcome: "denied"},
+		{desc: "backend error", code: http.StatusInternalServerError, outcome: "error"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			a, cleanUp := newTestAPI(t, tc.code, api.Response{GL_ID: "user-123"})
+			defer cleanUp()
+
+			called := false
+			h := repoPreAuthorizeHandler(a, config.GitConfig{}, Options{}, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			labels := fmt.Sprintf(`{outcome="%s"}`, tc.outcome)
+			before := scrapeMetrics(t)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/foo/bar.git/info/refs", nil))
+			require.Equal(t, tc.code, w.Code)
+			require.Equal(t, tc.outcome == "allowed", called)
+
+			after := scrapeMetrics(t)
+			require.Equal(t, before["gitlab_workhorse_git_pre_authorize_requests_total"+labels]+1, after["gitlab_workhorse_git_pre_authorize_requests_total"+labels])
+			require.Equal(t, before["gitlab_workhorse_git_pre_authorize_duration_seconds_count"+labels]+1, after["gitlab_workhorse_git_pre_authorize_duration_seconds_count"+labels])
+		})
+	}
+}
+
+func TestPostRPCHandlerTracing(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	a, cleanUp := newTestAPI(t, http.StatusOK, api.Response{GL_REPOSITORY: "project-1"})
+	defer cleanUp()
+
+	h := postRPCHandler(a, "handleTracing", func(w *HttpResponseWriter, r *http.Request, _ *api.Response) error {
+		require.NotNil(t, opentracing.SpanFromContext(r.Context()), "Gitaly calls must see the span")
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return err
+	}, 0, config.GitConfig{}, Options{})
+
+	parent := tracer.StartSpan("request")
+	r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", strings.NewReader("0000"))
+	r = r.WithContext(opentracing.ContextWithSpan(r.Context(), parent))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	require.Len(t, spans, 2)
+
+	parentID := parent.Context().(mocktracer.MockSpanContext).SpanID
+	preAuthorize := spans["git.pre_authorize"]
+	require.NotNil(t, preAuthorize)
+	require.Equal(t, parentID, preAuthorize.ParentID)
+	require.Equal(t, map[string]interface{}{
+		"service": "git-upload-pack",
+		"repo":    "project-1",
+		"outcome": "allowed",
+		"status":  http.StatusOK,
+	}, preAuthorize.Tags())
+
+	rpc := spans["git.rpc"]
+	require.NotNil(t, rpc)
+	require.Equal(t, parentID, rpc.ParentID, "the RPC must not be a child of the pre-authorization")
+	require.Equal(t, map[string]interface{}{
+		"handler":  "handleTracing",
+		"service":  "git-upload-pack",
+		"repo":     "project-1",
+		"bytes_in": int64(4),
+		"status":   http.StatusOK,
+	}, rpc.Tags())
+}
+
+func TestRepoPreAuthorizeHandlerTracingDenied(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	a, cleanUp := newTestAPI(t, http.StatusForbidden, api.Response{})
+	defer cleanUp()
+
+	h := repoPreAuthorizeHandler(a, config.GitConfig{}, Options{}, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+		t.Fatal("denied requests must not be handled")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo/bar.git/info/refs?service=git-upload-pack", nil))
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "git.pre_authorize", spans[0].OperationName)
+	require.Equal(t, "denied", spans[0].Tag("outcome"))
+	require.Equal(t, http.StatusForbidden, spans[0].Tag("status"))
+}
+
+func TestRepoPreAuthorizeHandlerAllowedServices(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	backendCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		require.NoError(t, json.NewEncoder(w).Encode(api.Response{}))
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	a := api.NewAPI(u, "123", http.DefaultTransport)
+
+	testCases := []struct {
+		desc     string
+		allowed  []string
+		method   string
+		url      string
+		expected int
+	}{
+		{desc: "receive-pack when only upload-pack is allowed", allowed: []string{"git-upload-pack"}, method: "POST", url: "/foo/bar.git/git-receive-pack", expected: http.StatusForbidden},
+		{desc: "receive-pack refs when only upload-pack is allowed", allowed: []string{"git-upload-pack"}, method: "GET", url: "/foo/bar.git/info/refs?service=git-receive-pack", expected: http.StatusForbidden},
+		{desc: "upload-pack when only upload-pack is allowed", allowed: []string{"git-upload-pack"}, method: "POST", url: "/foo/bar.git/git-upload-pack", expected: http.StatusOK},
+		{desc: "upload-pack refs when only upload-pack is allowed", allowed: []string{"git-upload-pack"}, method: "GET", url: "/foo/bar.git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+		{desc: "dumb refs when only upload-pack is allowed", allowed: []string{"git-upload-pack"}, method: "GET", url: "/foo/bar.git/info/refs", expected: http.StatusOK},
+		{desc: "receive-pack by default", method: "POST", url: "/foo/bar.git/git-receive-pack", expected: http.StatusOK},
+		{desc: "upload-pack by default", method: "POST", url: "/foo/bar.git/git-upload-pack", expected: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			backendCalls = 0
+			called := false
+			h := repoPreAuthorizeHandler(a, config.GitConfig{AllowedServices: tc.allowed}, Options{}, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+			require.Equal(t, tc.expected, w.Code)
+
+			if tc.expected == http.StatusForbidden {
+				require.Equal(t, 0, backendCalls, "disallowed services must not reach the auth backend")
+				require.False(t, called)
+				require.Contains(t, w.Body.String(), "is disabled on this server")
+			} else {
+				require.Equal(t, 1, backendCalls)
+				require.True(t, called)
+			}
+		})
+	}
+}
+
+func TestRepoPreAuthorizeHandlerValidatesRepoPath(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	backendCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		require.NoError(t, json.NewEncoder(w).Encode(api.Response{}))
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	a := api.NewAPI(u, "123", http.DefaultTransport)
+
+	testCases := []struct {
+		desc     string
+		url      string
+		expected int
+	}{
+		{desc: "project", url: "/foo/bar.git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+		{desc: "nested groups", url: "/foo/bar/baz/qux.git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+		{desc: "dots in names", url: "/foo.bar/..baz/qux...git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+		{desc: "traversal", url: "/foo/../../bar.git/info/refs?service=git-upload-pack", expected: http.StatusBadRequest},
+		{desc: "traversal out of repository", url: "/foo/bar.git/../../baz.git/info/refs?service=git-upload-pack", expected: http.StatusBadRequest},
+		{desc: "encoded traversal", url: "/foo/%2e%2e/bar.git/info/refs?service=git-upload-pack", expected: http.StatusBadRequest},
+		{desc: "encoded slashes", url: "/foo%2F..%2Fbar.git/info/refs?service=git-upload-pack", expected: http.StatusBadRequest},
+		{desc: "null byte", url: "/foo/bar%00.git/info/refs?service=git-upload-pack", expected: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			backendCalls = 0
+			called := false
+			h := repoPreAuthorizeHandler(a, config.GitConfig{}, Options{}, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+			require.Equal(t, tc.expected, w.Code)
+
+			if tc.expected == http.StatusBadRequest {
+				require.Equal(t, 0, backendCalls, "invalid paths must not reach the auth backend")
+				require.False(t, called)
+			} else {
+				require.Equal(t, 1, backendCalls)
+				require.True(t, called)
+			}
+		})
+	}
+}
+
+func TestRepoPreAuthorizeHandlerCallsHook(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	backendCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		require.NoError(t, json.NewEncoder(w).Encode(api.Response{}))
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	a := api.NewAPI(u, "123", http.DefaultTransport)
+
+	var repoPaths []string
+	opts := Options{
+		PreAuthorizeHook: func(w http.ResponseWriter, r *http.Request, repoPath string) bool {
+			repoPaths = append(repoPaths, repoPath)
+			if repoPath == "/blocked/project.git" {
+				http.Error(w, "Unavailable For Legal Reasons", http.StatusUnavailableForLegalReasons)
+				return false
+			}
+			return true
+		},
+	}
+
+	testCases := []struct {
+		desc             string
+		url              string
+		expectedRepoPath string
+		expected         int
+	}{
+		{desc: "info refs", url: "/foo/bar.git/info/refs?service=git-upload-pack", expectedRepoPath: "/foo/bar.git", expected: http.StatusOK},
+		{desc: "upload pack", url: "/foo/bar/baz.git/git-upload-pack", expectedRepoPath: "/foo/bar/baz.git", expected: http.StatusOK},
+		{desc: "wiki", url: "/foo/bar.wiki.git/git-receive-pack", expectedRepoPath: "/foo/bar.wiki.git", expected: http.StatusOK},
+		{desc: "rejected", url: "/blocked/project.git/info/refs?service=git-upload-pack", expectedRepoPath: "/blocked/project.git", expected: http.StatusUnavailableForLegalReasons},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			backendCalls = 0
+			repoPaths = nil
+			called := false
+			h := repoPreAuthorizeHandler(a, config.GitConfig{}, opts, func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+			require.Equal(t, tc.expected, w.Code)
+			require.Equal(t, []string{tc.expectedRepoPath}, repoPaths)
+
+			if tc.expected == http.StatusOK {
+				require.Equal(t, 1, backendCalls)
+				require.True(t, called)
+			} else {
+				require.Equal(t, 0, backendCalls, "rejected requests must not reach the auth backend")
+				require.False(t, called)
+			}
+		})
+	}
+}
+
+// scrapeMetrics returns the samples of the default Prometheus registry,
+// keyed by metric name and labels
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		require.True(t, i > 0, "malformed sample %q", line)
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err)
+		samples[line[:i]] = value
+	}
+
+	return samples
+}
+
+func TestCountReadCloserConcurrentReads(t *testing.T) {
+	const (
+		readers     = 8
+		readsEach   = 1000
+		bytesToRead = 16
+	)
+
+	cr := &countReadCloser{ReadCloser: ioutil.NopCloser(zeroReader{})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bytesToRead)
+			for j := 0; j < readsEach; j++ {
+				_, err := cr.Read(buf)
+				require.NoError(t, err)
+				cr.Count()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(readers*readsEach*bytesToRead), cr.Count())
+}
+
+// mutexCountReadCloser is how countReadCloser used to be implemented. We
+// keep it around to compare its performance with the atomic version.
+type mutexCountReadCloser struct {
+	n int64
+	io.ReadCloser
+	sync.Mutex
+}
+
+func (c *mutexCountReadCloser) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+
+	c.Lock()
+	defer c.Unlock()
+	c.n += int64(n)
+
+	return n, err
+}
+
+func BenchmarkCountReadCloser(b *testing.B) {
+	benchmarks := []struct {
+		desc string
+		r    io.Reader
+	}{
+		{desc: "atomic", r: &countReadCloser{ReadCloser: ioutil.NopCloser(zeroReader{})}},
+		{desc: "mutex", r: &mutexCountReadCloser{ReadCloser: ioutil.NopCloser(zeroReader{})}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.desc, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 32)
+				for pb.Next() {
+					bm.r.Read(buf)
+				}
+			})
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestGitConfigOptions(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		response api.Response
+		expected []string
+	}{
+		{desc: "no options", response: api.Response{}, expected: nil},
+		{desc: "show all refs", response: api.Response{ShowAllRefs: true}, expected: []string{GitConfigShowAllRefs}},
+		{
+			desc:     "partial clone",
+			response: api.Response{AllowFilter: true, AllowAnySHA1InWant: true},
+			expected: []string{GitConfigAllowFilter, GitConfigAllowAnySHA1InWant},
+		},
+		{desc: "want-ref", response: api.Response{AllowRefInWant: true}, expected: []string{GitConfigAllowRefInWant}},
+		{
+			desc:     "all options",
+			response: api.Response{ShowAllRefs: true, AllowFilter: true, AllowAnySHA1InWant: true, AllowRefInWant: true},
+			expected: []string{GitConfigShowAllRefs, GitConfigAllowFilter, GitConfigAllowAnySHA1InWant, GitConfigAllowRefInWant},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, gitConfigOptions(&tc.response))
+		})
+	}
+}
+
+// serveWithAccessLog serves r with h, and returns the fields h added to
+// the access log line of r
+func serveWithAccessLog(h http.Handler, w http.ResponseWriter, r *http.Request) log.Fields {
+	r = log.WithAccessLogFields(r)
+	h.ServeHTTP(w, r)
+	return log.AccessLogFields(r)
+}
+
+// newTestAPI returns an API whose pre-authorization calls are answered with
+// the given status code and response
+func newTestAPI(t testing.TB, code int, response api.Response) (*api.API, func()) {
+	testhelper.ConfigureSecret()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		w.WriteHeader(code)
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	return api.NewAPI(u, "123", http.DefaultTransport), ts.Close
+}
@@ -0,0 +1,58 @@
+package git
+
+import (
+	"net/http"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// Options are the settings of git handlers that Workhorse sets in code
+// rather than in its config file
+type Options struct {
+	// ErrorReporter gets the errors that git handlers respond to with a
+	// 500, in addition to our log. If it is nil, we only log them.
+	ErrorReporter ErrorReporter
+	// PreAuthorizeHook, if set, is called with the repository path of each
+	// git request before we pre-authorize it, for deployments that need
+	// to, say, resolve a tenant first
+	PreAuthorizeHook RepoPathHook
+}
+
+// RepoPathHook gets a git request and the path of its repository, such as
+// /group/project.git. If it returns false, it has written a response and
+// the request is not handled any further.
+type RepoPathHook func(w http.ResponseWriter, r *http.Request, repoPath string) bool
+
+func (o Options) errorReporter() ErrorReporter {
+	if o.ErrorReporter == nil {
+		return discardErrors
+	}
+	return o.ErrorReporter
+}
+
+// NewHandler serves the smart HTTP protocol of all repositories:
+// info/refs, git-upload-pack and git-receive-pack. Upstream routes these
+// requests to the same handlers, but also decodes request bodies, checks
+// content types and applies timeouts. NewHandler does none of that, so
+// that tests and benchmarks can exercise the Git handlers against an
+// api.API and a Gitaly server without starting all of Workhorse.
+func NewHandler(a *api.API, cfg config.GitConfig, opts Options) http.Handler {
+	infoRefs := GetInfoRefsHandler(a, cfg, opts)
+	uploadPack := UploadPack(a, cfg, opts)
+	receivePack := ReceivePack(a, cfg, opts)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case r.Method == "GET" && strings.HasSuffix(path, ".git/info/refs"):
+			infoRefs.ServeHTTP(w, r)
+		case r.Method == "POST" && strings.HasSuffix(path, ".git/git-upload-pack"):
+			uploadPack.ServeHTTP(w, r)
+		case r.Method == "POST" && strings.HasSuffix(path, ".git/git-receive-pack"):
+			receivePack.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+const (
+	testPackRequest  = "0032want 0000000000000000000000000000000000000000\n00000009done\n"
+	testPackResponse = "0008NAK\n0000"
+)
+
+// echoSmartHTTPServer is a Gitaly stub that sends back what clients
+// sent it, prefixed with testPackResponse
+func echoSmartHTTPServer(t testing.TB) *smartHTTPServiceServer {
+	return &smartHTTPServiceServer{
+		PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+			data := []byte(testPackResponse)
+			for {
+				req, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				data = append(data, req.GetData()...)
+			}
+			return stream.Send(&gitalypb.PostUploadPackResponse{Data: data})
+		},
+		PostReceivePackFunc: func(stream gitalypb.SmartHTTPService_PostReceivePackServer) error {
+			data := []byte(testPackResponse)
+			for {
+				req, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				data = append(data, req.GetData()...)
+			}
+			return stream.Send(&gitalypb.PostReceivePackResponse{Data: data})
+		},
+	}
+}
+
+func newTestHandler(t testing.TB, code int) (http.Handler, func()) {
+	addr, stopGitaly := startSmartHTTPServer(t, echoSmartHTTPServer(t))
+	a, stopAPI := newTestAPI(t, code, api.Response{GitalyServer: gitaly.Server{Address: addr}})
+
+	return NewHandler(a, config.DefaultGitConfig, Options{}), func() {
+		stopAPI()
+		stopGitaly()
+	}
+}
+
+func TestHandlerRPCs(t *testing.T) {
+	h, cleanUp := newTestHandler(t, http.StatusOK)
+	defer cleanUp()
+
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		t.Run(service, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/group/subgroup/project.git/"+service, strings.NewReader(testPackRequest))
+			r.Header.Set("Content-Type", "application/x-"+service+"-request")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, "application/x-"+service+"-result", w.Header().Get("Content-Type"))
+			require.Equal(t, testPackResponse+testPackRequest, w.Body.String())
+		})
+	}
+}
+
+func TestHandlerDenied(t *testing.T) {
+	h, cleanUp := newTestHandler(t, http.StatusForbidden)
+	defer cleanUp()
+
+	testCases := []struct {
+		desc   string
+		method string
+		url    string
+	}{
+		{desc: "clone", method: "GET", url: "/group/project.git/info/refs?service=git-upload-pack"},
+		{desc: "fetch", method: "POST", url: "/group/project.git/git-upload-pack"},
+		{desc: "push", method: "POST", url: "/group/project.git/git-receive-pack"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, strings.NewReader(testPackRequest)))
+
+			require.Equal(t, http.StatusForbidden, w.Code)
+			require.NotContains(t, w.Body.String(), testPackResponse, "denied requests must not reach Gitaly")
+		})
+	}
+}
+
+func TestHandlerNotFound(t *testing.T) {
+	h, cleanUp := newTestHandler(t, http.StatusOK)
+	defer cleanUp()
+
+	for _, url := range []string{"/group/project.git/HEAD", "/group/project/git-upload-pack", "/group/project.git/info/refs/extra"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		require.Equal(t, http.StatusNotFound, w.Code, url)
+	}
+}
+
+func BenchmarkHandlerUploadPack(b *testing.B) {
+	h, cleanUp := newTestHandler(b, http.StatusOK)
+	defer cleanUp()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("POST", "/group/project.git/git-upload-pack", strings.NewReader(testPackRequest))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", w.Code)
+		}
+		if _, err := io.Copy(ioutil.Discard, w.Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -6,21 +6,25 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/golang/gddo/httputil"
 
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func GetInfoRefsHandler(a *api.API) http.Handler {
-	return repoPreAuthorizeHandler(a, handleGetInfoRefs)
+func GetInfoRefsHandler(a *api.API, cfg config.GitConfig, opts Options) http.Handler {
+	return repoPreAuthorizeHandler(a, cfg, opts, func(w http.ResponseWriter, r *http.Request, a *api.Response) {
+		handleGetInfoRefs(w, r, a, cfg.CompressInfoRefs)
+	})
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, compress bool) {
 	responseWriter := NewHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer responseWriter.Log(r, 0)
@@ -37,8 +41,11 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 
 	gitProtocol := r.Header.Get("Git-Protocol")
 
-	offers := []string{"gzip", "identity"}
-	encoding := httputil.NegotiateContentEncoding(r, offers)
+	encoding := "identity"
+	if compress {
+		responseWriter.Header().Set("Vary", "Accept-Encoding")
+		encoding = httputil.NegotiateContentEncoding(r, []string{"gzip", "identity"})
+	}
 
 	if err := handleGetInfoRefsWithGitaly(r.Context(), responseWriter, a, rpc, gitProtocol, encoding); err != nil {
 		helper.Fail500(responseWriter, r, fmt.Errorf("handleGetInfoRefs: %v", err))
@@ -68,9 +75,23 @@ func handleGetInfoRefsWithGitaly(ctx context.Context, responseWriter *HttpRespon
 		w = responseWriter
 	}
 
-	if _, err = io.Copy(w, infoRefsResponseReader); err != nil {
+	// The service line and the first ref line tell us whether the
+	// repository is empty
+	head := &prefixBuffer{limit: 2 * maxPktLineLen}
+	if _, err = io.Copy(w, io.TeeReader(infoRefsResponseReader, head)); err != nil {
 		log.WithError(err).Error("GetInfoRefsHandler: error copying gitaly response")
+		return nil
+	}
+
+	// We cannot tell whether a repository is empty from a protocol v2
+	// advertisement, so we do not count these
+	if isV2Advertisement(head.Bytes()) {
+		return nil
 	}
 
+	empty := isEmptyAdvertisement(head.Bytes())
+	infoRefsAdvertisements.WithLabelValues(rpc, strconv.FormatBool(empty)).Inc()
+	responseWriter.addLogField("empty_repository", empty)
+
 	return nil
 }
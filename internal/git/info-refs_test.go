@@ -0,0 +1,97 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+// What git-upload-pack advertises for an empty repository and for one with
+// a single branch, and with protocol v2 for either
+var (
+	emptyAdvertisement = pktLine("# service=git-upload-pack\n") + "0000" +
+		pktLine("0000000000000000000000000000000000000000 capabilities^{}\x00multi_ack thin-pack side-band side-band-64k ofs-delta shallow no-progress include-tag agent=git/2.28.0\n") +
+		"0000"
+	populatedAdvertisement = pktLine("# service=git-upload-pack\n") + "0000" +
+		pktLine("8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e HEAD\x00multi_ack thin-pack side-band side-band-64k ofs-delta shallow no-progress include-tag symref=HEAD:refs/heads/main agent=git/2.28.0\n") +
+		pktLine("8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e refs/heads/main\n") +
+		"0000"
+	v2Advertisement = pktLine("# service=git-upload-pack\n") + "0000" +
+		pktLine("version 2\n") +
+		pktLine("agent=git/2.28.0\n") +
+		pktLine("ls-refs\n") +
+		pktLine("fetch=shallow\n") +
+		"0000"
+)
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func TestGetInfoRefsCountsEmptyRepositories(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		advertisement string
+		empty         bool
+	}{
+		{desc: "empty repository", advertisement: emptyAdvertisement, empty: true},
+		{desc: "repository with refs", advertisement: populatedAdvertisement, empty: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+				InfoRefsUploadPackFunc: func(_ *gitalypb.InfoRefsRequest, s gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+					return s.Send(&gitalypb.InfoRefsResponse{Data: []byte(tc.advertisement)})
+				},
+			})
+			defer cleanUp()
+
+			labels := fmt.Sprintf(`{empty="%t",service="git-upload-pack"}`, tc.empty)
+			before := scrapeMetrics(t)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/foo/bar.git/info/refs?service=git-upload-pack", nil)
+			handleGetInfoRefs(w, r, &api.Response{GitalyServer: gitaly.Server{Address: addr}}, false)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tc.advertisement, w.Body.String(), "the advertisement must reach the client unaltered")
+
+			after := scrapeMetrics(t)
+			require.Equal(t, before["gitlab_workhorse_git_info_refs_advertisements_total"+labels]+1, after["gitlab_workhorse_git_info_refs_advertisements_total"+labels])
+		})
+	}
+}
+
+func TestGetInfoRefsDoesNotCountV2Advertisements(t *testing.T) {
+	addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+		InfoRefsUploadPackFunc: func(_ *gitalypb.InfoRefsRequest, s gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+			return s.Send(&gitalypb.InfoRefsResponse{Data: []byte(v2Advertisement)})
+		},
+	})
+	defer cleanUp()
+
+	before := scrapeMetrics(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	r.Header.Set("Git-Protocol", "version=2")
+	handleGetInfoRefs(w, r, &api.Response{GitalyServer: gitaly.Server{Address: addr}}, false)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, v2Advertisement, w.Body.String())
+
+	after := scrapeMetrics(t)
+	for _, empty := range []string{"true", "false"} {
+		name := fmt.Sprintf(`gitlab_workhorse_git_info_refs_advertisements_total{empty="%s",service="git-upload-pack"}`, empty)
+		require.Equal(t, before[name], after[name], name)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 func scanDeepen(body io.Reader) bool {
@@ -20,6 +21,71 @@ func scanDeepen(body io.Reader) bool {
 	return false
 }
 
+// parseCapabilities returns the capabilities a client asks for in the first
+// pkt-line of a git-upload-pack or git-receive-pack request. Upload-pack
+// clients list them after their first want, and receive-pack clients after
+// a NUL byte following their first ref update. Protocol v2 requests have no
+// such list, and neither do requests we cannot parse, so we return nil for
+// them.
+func parseCapabilities(head []byte) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	scanner.Split(pktLineSplitter)
+	if !scanner.Scan() {
+		return nil
+	}
+
+	line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		return strings.Fields(string(line[i+1:]))
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 2 && fields[0] == "want" {
+		return fields[2:]
+	}
+
+	return nil
+}
+
+// isEmptyAdvertisement tells whether head, the start of an info/refs
+// response, is the ref advertisement of an empty repository. Git advertises
+// no refs for those, and sends its capabilities on a "capabilities^{}" line
+// with a zero object ID instead of after the first ref. This only works for
+// protocol v0 and v1: see isV2Advertisement.
+func isEmptyAdvertisement(head []byte) bool {
+	line := firstAdvertisedLine(head)
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	return len(fields) == 2 && strings.Trim(fields[0], "0") == "" && fields[1] == "capabilities^{}"
+}
+
+// isV2Advertisement tells whether head, the start of an info/refs response,
+// is a protocol v2 capability advertisement. These list no refs, whether
+// the repository is empty or not: clients ask for refs with a later ls-refs
+// command.
+func isV2Advertisement(head []byte) bool {
+	return string(firstAdvertisedLine(head)) == "version 2"
+}
+
+// firstAdvertisedLine returns the first pkt-line of head, the start of an
+// info/refs response, after the "# service=" line of smart HTTP. It returns
+// nil if head has no such line.
+func firstAdvertisedLine(head []byte) []byte {
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("# service=")) {
+			continue
+		}
+		return line
+	}
+
+	return nil
+}
+
 func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if len(data) < 4 {
 		if atEOF && len(data) > 0 {
@@ -43,7 +109,13 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// Cast is safe because we requested an int-size number from strconv.ParseInt
 	pktLength := int(pktLength64)
 
-	if pktLength < 0 {
+	if pktLength == 1 || pktLength == 2 {
+		// special case: protocol v2 "0001" delimiter and "0002" response-end
+		// packets: return empty token
+		return 4, data[:0], nil
+	}
+
+	if pktLength < 4 {
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
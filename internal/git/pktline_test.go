@@ -3,6 +3,8 @@ package git
 import (
 	"bytes"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestSuccessfulScanDeepen(t *testing.T) {
@@ -13,6 +15,7 @@ func TestSuccessfulScanDeepen(t *testing.T) {
 		{"000dsomething000cdeepen 10000", true},
 		{"000dsomething0000000cdeepen 1", true},
 		{"000dsomething0000", false},
+		{"0012command=fetch\n0001000cdeepen 10000", true},
 	}
 
 	for _, example := range examples {
@@ -29,6 +32,7 @@ func TestFailedScanDeepen(t *testing.T) {
 		"invalid data",
 		"deepen",
 		"000cdeepen",
+		"0003deepen 1",
 	}
 
 	for _, example := range examples {
@@ -37,3 +41,87 @@ func TestFailedScanDeepen(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCapabilities(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		input    string
+		expected []string
+	}{
+		{
+			desc:     "upload-pack",
+			input:    "0050want 8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e multi_ack thin-pack ofs-delta\n0000",
+			expected: []string{"multi_ack", "thin-pack", "ofs-delta"},
+		},
+		{
+			desc:     "receive-pack",
+			input:    "00940000000000000000000000000000000000000000 8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e refs/heads/main\x00 report-status side-band-64k agent=git/2.28.0\n0000",
+			expected: []string{"report-status", "side-band-64k", "agent=git/2.28.0"},
+		},
+		{desc: "want without capabilities", input: "0032want 8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e\n0000"},
+		{desc: "protocol v2", input: "0012command=fetch\n0001000dthin-pack\n0000"},
+		{desc: "flush packet", input: "0000"},
+		{desc: "truncated pkt-line", input: "0050want 8a9c3e0c6d8f1e3f6e7f2d9b0a1c5e4d3b2a1f0e multi_ack"},
+		{desc: "not a pkt-line", input: "\x1f\x8b\x08\x00"},
+		{desc: "empty"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, parseCapabilities([]byte(tc.input)))
+		})
+	}
+}
+
+func TestIsEmptyAdvertisement(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		input    string
+		expected bool
+	}{
+		{desc: "empty repository", input: emptyAdvertisement, expected: true},
+		{desc: "repository with refs", input: populatedAdvertisement, expected: false},
+		{
+			desc:     "empty repository without service line",
+			input:    pktLine("0000000000000000000000000000000000000000 capabilities^{}\x00report-status delete-refs ofs-delta\n") + "0000",
+			expected: true,
+		},
+		{
+			desc:     "protocol v2",
+			input:    v2Advertisement,
+			expected: false,
+		},
+		{desc: "truncated", input: emptyAdvertisement[:40], expected: false},
+		{desc: "invalid", input: "invalid data", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, isEmptyAdvertisement([]byte(tc.input)))
+		})
+	}
+}
+
+func TestIsV2Advertisement(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		input    string
+		expected bool
+	}{
+		{desc: "protocol v2", input: v2Advertisement, expected: true},
+		{
+			desc:     "protocol v2 without service line",
+			input:    pktLine("version 2\n") + pktLine("ls-refs\n") + "0000",
+			expected: true,
+		},
+		{desc: "empty repository", input: emptyAdvertisement, expected: false},
+		{desc: "repository with refs", input: populatedAdvertisement, expected: false},
+		{desc: "invalid", input: "invalid data", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, isV2Advertisement([]byte(tc.input)))
+		})
+	}
+}
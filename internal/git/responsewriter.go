@@ -8,6 +8,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 )
 
 const (
@@ -36,19 +37,75 @@ var (
 		},
 		[]string{"method", "code", "service", "agent", "direction"},
 	)
+
+	gitRPCRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_http_requests_total",
+			Help: "How many git-upload-pack and git-receive-pack requests have been handled by gitlab-workhorse, partitioned by RPC method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+
+	gitRPCDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_http_request_duration_seconds",
+			Help:    "How long git-upload-pack and git-receive-pack requests took in gitlab-workhorse, partitioned by RPC method and status code.",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 600},
+		},
+		[]string{"method", "code"},
+	)
+
+	infoRefsAdvertisements = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_advertisements_total",
+			Help: "How many ref advertisements gitlab-workhorse has sent for info/refs requests, partitioned by service and whether the repository is empty. Protocol v2 advertisements list no refs and are not counted.",
+		},
+		[]string{"service", "empty"},
+	)
+
+	preAuthorizeRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_pre_authorize_requests_total",
+			Help: "How many git requests have been pre-authorized by the auth backend, partitioned by outcome (allowed, denied or error).",
+		},
+		[]string{"outcome"},
+	)
+
+	preAuthorizeDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_pre_authorize_duration_seconds",
+			Help:    "How long pre-authorizing git requests with the auth backend took, including retries, partitioned by outcome (allowed, denied or error).",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"outcome"},
+	)
 )
 
 type HttpResponseWriter struct {
 	helper.CountingResponseWriter
+	logFields log.Fields
+	// flusher is the ResponseWriter we wrap, if it can flush
+	flusher http.Flusher
 }
 
 func NewHttpResponseWriter(rw http.ResponseWriter) *HttpResponseWriter {
 	gitHTTPSessionsActive.Inc()
+	flusher, _ := rw.(http.Flusher)
 	return &HttpResponseWriter{
 		CountingResponseWriter: helper.NewCountingResponseWriter(rw),
+		flusher:                flusher,
 	}
 }
 
+// Flush implements http.Flusher, if the wrapped ResponseWriter does
+func (w *HttpResponseWriter) Flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
+
+// Log counts the request in our metrics, and adds its git details to its
+// access log line
 func (w *HttpResponseWriter) Log(r *http.Request, writtenIn int64) {
 	service := getService(r)
 	agent := getRequestAgent(r)
@@ -59,6 +116,22 @@ func (w *HttpResponseWriter) Log(r *http.Request, writtenIn int64) {
 		Add(float64(writtenIn))
 	gitHTTPBytes.WithLabelValues(r.Method, strconv.Itoa(w.Status()), service, agent, directionOut).
 		Add(float64(w.Count()))
+
+	log.AddAccessLogFields(r.Context(), log.Fields{
+		"service":   service,
+		"bytes_in":  writtenIn,
+		"bytes_out": w.Count(),
+	})
+	log.AddAccessLogFields(r.Context(), w.logFields)
+}
+
+// addLogField adds a field to the access log line of the request, once it
+// is logged with Log
+func (w *HttpResponseWriter) addLogField(key string, value interface{}) {
+	if w.logFields == nil {
+		w.logFields = log.Fields{}
+	}
+	w.logFields[key] = value
 }
 
 func getRequestAgent(r *http.Request) string {
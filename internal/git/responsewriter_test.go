@@ -0,0 +1,51 @@
+package git
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+func TestLogIncludesByteCounts(t *testing.T) {
+	w := NewHttpResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", nil)
+
+	_, err := io.WriteString(w, "0008NAK\n")
+	require.NoError(t, err)
+
+	r = log.WithAccessLogFields(r)
+	w.Log(r, 123)
+
+	fields := log.AccessLogFields(r)
+	require.Equal(t, int64(123), fields["bytes_in"])
+	require.Equal(t, int64(8), fields["bytes_out"])
+}
+
+func TestLogIncludesService(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		method   string
+		url      string
+		expected string
+	}{
+		{desc: "GET info/refs for fetching", method: "GET", url: "/foo/bar.git/info/refs?service=git-upload-pack", expected: "git-upload-pack"},
+		{desc: "GET info/refs for pushing", method: "GET", url: "/foo/bar.git/info/refs?service=git-receive-pack", expected: "git-receive-pack"},
+		{desc: "dumb GET info/refs", method: "GET", url: "/foo/bar.git/info/refs", expected: ""},
+		{desc: "POST upload-pack", method: "POST", url: "/foo/bar.git/git-upload-pack", expected: "git-upload-pack"},
+		{desc: "POST receive-pack", method: "POST", url: "/foo/bar.git/git-receive-pack", expected: "git-receive-pack"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := NewHttpResponseWriter(httptest.NewRecorder())
+			r := log.WithAccessLogFields(httptest.NewRequest(tc.method, tc.url, nil))
+			w.Log(r, 0)
+
+			require.Equal(t, tc.expected, log.AccessLogFields(r)["service"])
+		})
+	}
+}
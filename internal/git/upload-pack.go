@@ -1,12 +1,18 @@
 package git
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
@@ -14,8 +20,21 @@ import (
 
 var (
 	uploadPackTimeout = 10 * time.Minute
+
+	gitUploadPackRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_http_upload_pack_requests",
+			Help: "How many git-upload-pack requests have been processed by gitlab-workhorse, partitioned by whether the client asked for a shallow history.",
+		},
+		[]string{"shallow"},
+	)
 )
 
+// Clients send their deepen arguments right after their wants, so they show
+// up early in the request. We only keep this many bytes around to look for
+// them.
+const deepenScanLimit = 64 * 1024
+
 // Will not return a non-nil error after the response body has been
 // written to.
 func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
@@ -31,8 +50,23 @@ func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) e
 	readerCtx, cancel := context.WithTimeout(ctx, uploadPackTimeout)
 	defer cancel()
 
-	limited := helper.NewContextReader(readerCtx, r.Body)
-	cr, cw := helper.NewWriteAfterReader(limited, w)
+	// Rather than peeking at the request body before we forward it, we keep a
+	// copy of its first bytes while it streams to Gitaly. This way we never
+	// block on the client, and the body is read exactly once.
+	requestHead := &prefixBuffer{limit: deepenScanLimit}
+	defer func() {
+		shallow := scanDeepen(bytes.NewReader(requestHead.Bytes()))
+		w.addLogField("shallow", shallow)
+		gitUploadPackRequests.WithLabelValues(strconv.FormatBool(shallow)).Inc()
+	}()
+
+	// Sideband progress messages must reach the client while Gitaly is
+	// still busy, so we flush them
+	fw := newFlushingWriter(w, progressFlushInterval)
+	defer fw.stop()
+
+	limited := helper.NewContextReader(readerCtx, io.TeeReader(r.Body, requestHead))
+	cr, cw := helper.NewWriteAfterReader(limited, fw)
 	defer cw.Flush()
 
 	action := getService(r)
@@ -55,3 +89,34 @@ func handleUploadPackWithGitaly(ctx context.Context, a *api.Response, clientRequ
 
 	return nil
 }
+
+// prefixBuffer is an io.Writer that retains only the first limit bytes
+// written to it. It is safe for concurrent use because the Gitaly client may
+// still be reading the request body when an RPC returns early.
+type prefixBuffer struct {
+	sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if room := b.limit - len(b.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		b.buf = append(b.buf, p[:room]...)
+	}
+
+	return len(p), nil
+}
+
+// Bytes returns a copy of the retained bytes
+func (b *prefixBuffer) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+
+	return append([]byte(nil), b.buf...)
+}
@@ -2,11 +2,13 @@ package git
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,13 +36,23 @@ func (f *fakeReader) Read(b []byte) (int, error) {
 
 type smartHTTPServiceServer struct {
 	gitalypb.UnimplementedSmartHTTPServiceServer
-	PostUploadPackFunc func(gitalypb.SmartHTTPService_PostUploadPackServer) error
+	PostUploadPackFunc     func(gitalypb.SmartHTTPService_PostUploadPackServer) error
+	PostReceivePackFunc    func(gitalypb.SmartHTTPService_PostReceivePackServer) error
+	InfoRefsUploadPackFunc func(*gitalypb.InfoRefsRequest, gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error
 }
 
 func (srv *smartHTTPServiceServer) PostUploadPack(s gitalypb.SmartHTTPService_PostUploadPackServer) error {
 	return srv.PostUploadPackFunc(s)
 }
 
+func (srv *smartHTTPServiceServer) PostReceivePack(s gitalypb.SmartHTTPService_PostReceivePackServer) error {
+	return srv.PostReceivePackFunc(s)
+}
+
+func (srv *smartHTTPServiceServer) InfoRefsUploadPack(in *gitalypb.InfoRefsRequest, s gitalypb.SmartHTTPService_InfoRefsUploadPackServer) error {
+	return srv.InfoRefsUploadPackFunc(in, s)
+}
+
 func TestUploadPackTimesOut(t *testing.T) {
 	uploadPackTimeout = time.Millisecond
 	defer func() { uploadPackTimeout = originalUploadPackTimeout }()
@@ -64,6 +76,104 @@ func TestUploadPackTimesOut(t *testing.T) {
 	require.EqualError(t, err, "smarthttp.UploadPack: busyReader: context deadline exceeded")
 }
 
+func TestUploadPackDetectsShallowRequests(t *testing.T) {
+	want := "0032want " + strings.Repeat("a", 40) + "\n"
+
+	testCases := []struct {
+		desc    string
+		body    string
+		shallow bool
+	}{
+		{desc: "full clone", body: want + "0000" + "0009done\n", shallow: false},
+		{desc: "shallow clone", body: want + "000cdeepen 1" + "0000" + "0009done\n", shallow: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			receivedC := make(chan string, 1)
+			addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+				PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+					var received []byte
+					for {
+						req, err := stream.Recv()
+						if err == io.EOF {
+							break
+						}
+						require.NoError(t, err)
+						received = append(received, req.GetData()...)
+					}
+					receivedC <- string(received)
+					return nil
+				},
+			})
+			defer cleanUp()
+
+			w := NewHttpResponseWriter(httptest.NewRecorder())
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+			a := &api.Response{GitalyServer: gitaly.Server{Address: addr}}
+
+			require.NoError(t, handleUploadPack(w, r, a))
+			require.Equal(t, tc.body, <-receivedC, "request body must be forwarded unchanged")
+			require.Equal(t, tc.shallow, w.logFields["shallow"])
+		})
+	}
+}
+
+func TestUploadPackForwardsWantRef(t *testing.T) {
+	// A protocol v2 fetch of a branch by name
+	body := "0011command=fetch" + "0001" + "001fwant-ref refs/heads/master\n" + "0009done\n" + "0000"
+
+	testCases := []struct {
+		desc            string
+		response        api.Response
+		expectedOptions []string
+	}{
+		{desc: "want-ref allowed", response: api.Response{AllowRefInWant: true}, expectedOptions: []string{GitConfigAllowRefInWant}},
+		// Git then rejects want-ref itself
+		{desc: "want-ref not allowed", response: api.Response{}, expectedOptions: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			requestC := make(chan *gitalypb.PostUploadPackRequest, 1)
+			receivedC := make(chan string, 1)
+			addr, cleanUp := startSmartHTTPServer(t, &smartHTTPServiceServer{
+				PostUploadPackFunc: func(stream gitalypb.SmartHTTPService_PostUploadPackServer) error {
+					req, err := stream.Recv()
+					require.NoError(t, err)
+					requestC <- req
+
+					var received []byte
+					for {
+						req, err := stream.Recv()
+						if err == io.EOF {
+							break
+						}
+						require.NoError(t, err)
+						received = append(received, req.GetData()...)
+					}
+					receivedC <- string(received)
+					return nil
+				},
+			})
+			defer cleanUp()
+
+			w := NewHttpResponseWriter(httptest.NewRecorder())
+			r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+			r.Header.Set("Git-Protocol", "version=2")
+			a := tc.response
+			a.GitalyServer = gitaly.Server{Address: addr}
+
+			require.NoError(t, handleUploadPack(w, r, &a))
+
+			req := <-requestC
+			require.Equal(t, "version=2", req.GetGitProtocol())
+			require.Equal(t, tc.expectedOptions, req.GetGitConfigOptions())
+			require.Equal(t, body, <-receivedC, "want-ref must reach Gitaly unaltered")
+		})
+	}
+}
+
 func startSmartHTTPServer(t testing.TB, s gitalypb.SmartHTTPServiceServer) (string, func()) {
 	tmp, err := ioutil.TempDir("", "")
 	require.NoError(t, err)
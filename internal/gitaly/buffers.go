@@ -0,0 +1,56 @@
+package gitaly
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultRequestBufferSize is the size of the messages that streamio sends
+// data to Gitaly in
+const defaultRequestBufferSize = 128 * 1024
+
+// requestBuffers holds the *sync.Pool of buffers we copy request bodies to
+// Gitaly with. Busy servers forward many clones and pushes at once, and
+// io.Copy would allocate a buffer for each of them.
+var requestBuffers atomic.Value
+
+func init() {
+	requestBuffers.Store(newBufferPool(defaultRequestBufferSize))
+}
+
+// ConfigureRequestBuffers sets the size of the buffers we copy request
+// bodies to Gitaly with. A size of 0 or less means the default. Copies
+// that are running already keep using buffers of the old size.
+func ConfigureRequestBuffers(size int) {
+	if size <= 0 {
+		size = defaultRequestBufferSize
+	}
+
+	requestBuffers.Store(newBufferPool(size))
+}
+
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// copyRequest is like io.Copy, but it copies with a buffer from
+// requestBuffers. The buffer goes back to the pool when copying ends,
+// whether it failed or not.
+func copyRequest(dst io.Writer, src io.Reader) (int64, error) {
+	// The buffer must go back to the pool it came from, even if the pool
+	// is replaced in the meantime
+	pool := requestBuffers.Load().(*sync.Pool)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	// io.CopyBuffer ignores our buffer if dst is an io.ReaderFrom, like
+	// the writers of streamio, which allocate one of their own. We only
+	// let it see the Write method.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
@@ -0,0 +1,113 @@
+package gitaly
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requestBody is a request body that is neither an io.WriterTo nor too
+// short to need several reads, like the bodies of git requests
+type requestBody struct{ io.Reader }
+
+func TestCopyRequest(t *testing.T) {
+	defer ConfigureRequestBuffers(0)
+	ConfigureRequestBuffers(7)
+
+	var dst bytes.Buffer
+	n, err := copyRequest(&dst, requestBody{strings.NewReader("0032want 0a53e9ddeaddad63ad106860237bbf53411d11a7\n")})
+	require.NoError(t, err)
+	require.Equal(t, int64(50), n)
+	require.Equal(t, "0032want 0a53e9ddeaddad63ad106860237bbf53411d11a7\n", dst.String())
+}
+
+func TestCopyRequestConcurrently(t *testing.T) {
+	errBroken := errors.New("broken body")
+
+	defer ConfigureRequestBuffers(0)
+	ConfigureRequestBuffers(1000)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Copies that are running must not be affected when the
+			// buffer size changes
+			if i%10 == 0 {
+				ConfigureRequestBuffers(1000 + i)
+			}
+
+			body := bytes.Repeat([]byte(fmt.Sprintf("%03d", i)), 100000)
+			var src io.Reader = bytes.NewReader(body)
+			// Every other body fails halfway, whose buffer must still be
+			// reusable by the others
+			if i%2 == 1 {
+				src = io.MultiReader(io.LimitReader(src, int64(len(body)/2)), errReader{errBroken})
+			}
+
+			var dst bytes.Buffer
+			_, err := copyRequest(&dst, requestBody{src})
+			switch {
+			case i%2 == 1 && !errors.Is(err, errBroken):
+				errs <- fmt.Errorf("body %d: expected %v, got %v", i, errBroken, err)
+			case i%2 == 1 && !bytes.Equal(body[:len(body)/2], dst.Bytes()):
+				errs <- fmt.Errorf("body %d: unexpected data before the error", i)
+			case i%2 == 0 && err != nil:
+				errs <- fmt.Errorf("body %d: %v", i, err)
+			case i%2 == 0 && !bytes.Equal(body, dst.Bytes()):
+				errs <- fmt.Errorf("body %d: data mixed up with other bodies", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// errReader fails every read with err
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// discard is ioutil.Discard without its ReadFrom method, which has a pool
+// of its own
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkCopyRequest(b *testing.B) {
+	body := make([]byte, 1<<20)
+
+	for _, bc := range []struct {
+		desc string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{desc: "io.Copy", copy: io.Copy},
+		{desc: "pooled", copy: copyRequest},
+	} {
+		b.Run(bc.desc, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := bc.copy(discard{}, requestBody{bytes.NewReader(body)}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
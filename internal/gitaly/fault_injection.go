@@ -0,0 +1,171 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fault injection is meant for resilience testing in staging environments
+// only. It is never enabled unless FaultRateEnv is set explicitly.
+const (
+	FaultRateEnv  = "GITLAB_WORKHORSE_UNSAFE_GITALY_FAULT_RATE"
+	FaultDelayEnv = "GITLAB_WORKHORSE_UNSAFE_GITALY_FAULT_DELAY"
+
+	defaultFaultDelay = time.Second
+)
+
+type fault int
+
+const (
+	faultNone fault = iota
+	faultError
+	faultDelay
+	faultDisconnect
+)
+
+type faultInjector struct {
+	rate  float64
+	delay time.Duration
+
+	sync.Mutex
+	rand *rand.Rand
+}
+
+// faults is nil unless fault injection was enabled with ConfigureFaultInjection
+var faults *faultInjector
+
+// ConfigureFaultInjection enables fault injection for Gitaly connections
+// created after it is called, if FaultRateEnv is set. It returns the
+// configured fault rate, which is 0 if fault injection is disabled.
+func ConfigureFaultInjection() (float64, error) {
+	f, err := newFaultInjector(os.Getenv)
+	if err != nil {
+		return 0, err
+	}
+
+	faults = f
+	if f == nil {
+		return 0, nil
+	}
+
+	return f.rate, nil
+}
+
+func newFaultInjector(getenv func(string) string) (*faultInjector, error) {
+	rateParam := getenv(FaultRateEnv)
+	if rateParam == "" {
+		return nil, nil
+	}
+
+	rate, err := strconv.ParseFloat(rateParam, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", FaultRateEnv, err)
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("%s: rate must be between 0 and 1, got %v", FaultRateEnv, rate)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+
+	delay := defaultFaultDelay
+	if delayParam := getenv(FaultDelayEnv); delayParam != "" {
+		delay, err = time.ParseDuration(delayParam)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", FaultDelayEnv, err)
+		}
+	}
+
+	return &faultInjector{
+		rate:  rate,
+		delay: delay,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// pick decides which fault, if any, to inject into the next RPC
+func (f *faultInjector) pick() fault {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.rand.Float64() >= f.rate {
+		return faultNone
+	}
+
+	return fault(1 + f.rand.Intn(3))
+}
+
+func (f *faultInjector) sleep(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func injectedError(method string) error {
+	return status.Errorf(codes.Unavailable, "injected fault: %s", method)
+}
+
+func injectedDisconnect(method string) error {
+	return status.Errorf(codes.Unavailable, "injected disconnect: %s", method)
+}
+
+func (f *faultInjector) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	switch f.pick() {
+	case faultError:
+		return injectedError(method)
+	case faultDelay:
+		if err := f.sleep(ctx); err != nil {
+			return err
+		}
+	case faultDisconnect:
+		// Let the call reach Gitaly but pretend the response got lost
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		return injectedDisconnect(method)
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (f *faultInjector) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	switch f.pick() {
+	case faultError:
+		return nil, injectedError(method)
+	case faultDelay:
+		if err := f.sleep(ctx); err != nil {
+			return nil, err
+		}
+	case faultDisconnect:
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &disconnectedStream{ClientStream: stream, method: method}, nil
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// disconnectedStream behaves like a stream whose connection dropped right
+// after it was established
+type disconnectedStream struct {
+	grpc.ClientStream
+	method string
+}
+
+func (s *disconnectedStream) RecvMsg(m interface{}) error {
+	return injectedDisconnect(s.method)
+}
@@ -0,0 +1,98 @@
+package gitaly
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultInjectionDisabledByDefault(t *testing.T) {
+	require.Nil(t, faults, "fault injection must be disabled unless configured")
+
+	f, err := newFaultInjector(func(string) string { return "" })
+	require.NoError(t, err)
+	require.Nil(t, f)
+}
+
+func TestNewFaultInjector(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		env       map[string]string
+		enabled   bool
+		delay     time.Duration
+		expectErr bool
+	}{
+		{desc: "zero rate", env: map[string]string{FaultRateEnv: "0"}},
+		{desc: "default delay", env: map[string]string{FaultRateEnv: "0.5"}, enabled: true, delay: defaultFaultDelay},
+		{desc: "custom delay", env: map[string]string{FaultRateEnv: "0.5", FaultDelayEnv: "10ms"}, enabled: true, delay: 10 * time.Millisecond},
+		{desc: "invalid rate", env: map[string]string{FaultRateEnv: "lots"}, expectErr: true},
+		{desc: "rate out of range", env: map[string]string{FaultRateEnv: "1.5"}, expectErr: true},
+		{desc: "invalid delay", env: map[string]string{FaultRateEnv: "0.5", FaultDelayEnv: "soon"}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := newFaultInjector(func(k string) string { return tc.env[k] })
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			if !tc.enabled {
+				require.Nil(t, f)
+				return
+			}
+
+			require.NotNil(t, f)
+			require.Equal(t, tc.delay, f.delay)
+		})
+	}
+}
+
+func TestFaultInjectionRate(t *testing.T) {
+	const (
+		rate     = 0.25
+		attempts = 10000
+	)
+
+	f := &faultInjector{rate: rate, rand: rand.New(rand.NewSource(1))}
+
+	counts := make(map[fault]int)
+	for i := 0; i < attempts; i++ {
+		counts[f.pick()]++
+	}
+
+	injected := attempts - counts[faultNone]
+	require.InDelta(t, rate, float64(injected)/attempts, 0.02)
+
+	for _, kind := range []fault{faultError, faultDelay, faultDisconnect} {
+		require.NotZero(t, counts[kind], "fault kind %d never injected", kind)
+	}
+}
+
+func TestFaultInjectionUnaryClientInterceptor(t *testing.T) {
+	f := &faultInjector{rate: 1, delay: time.Millisecond, rand: rand.New(rand.NewSource(1))}
+
+	invoked := 0
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked++
+		return nil
+	}
+
+	for i := 0; i < 100; i++ {
+		err := f.unaryClientInterceptor(context.Background(), "/test/Method", nil, nil, nil, invoker)
+		if err != nil {
+			require.Equal(t, codes.Unavailable, status.Code(err))
+		}
+	}
+
+	require.NotZero(t, invoked, "delayed and disconnected calls still reach the server")
+	require.Less(t, invoked, 100, "injected errors never reach the server")
+}
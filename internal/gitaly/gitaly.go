@@ -15,6 +15,7 @@ import (
 	gitalyclient "gitlab.com/gitlab-org/gitaly/client"
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
 
 	grpccorrelation "gitlab.com/gitlab-org/labkit/correlation/grpc"
@@ -54,7 +55,14 @@ var (
 )
 
 func withOutgoingMetadata(ctx context.Context, features map[string]string) context.Context {
-	md := metadata.New(nil)
+	// Preserve metadata that callers already attached to ctx
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.New(nil)
+	}
+
 	for k, v := range features {
 		if !strings.HasPrefix(k, "gitaly-feature-") {
 			continue
@@ -111,6 +119,10 @@ func NewDiffClient(ctx context.Context, server Server) (context.Context, *DiffCl
 	return withOutgoingMetadata(ctx, server.Features), &DiffClient{grpcClient}, nil
 }
 
+// getOrCreateConnection returns the shared connection to server, so that
+// high request rates do not cause connection churn. gRPC reconnects these
+// connections by itself when they break; we only replace connections that
+// have been closed.
 func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	key := server.cacheKey()
 
@@ -118,14 +130,14 @@ func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	conn := cache.connections[key]
 	cache.RUnlock()
 
-	if conn != nil {
+	if usable(conn) {
 		return conn, nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
-	if conn := cache.connections[key]; conn != nil {
+	if conn := cache.connections[key]; usable(conn) {
 		return conn, nil
 	}
 
@@ -139,6 +151,10 @@ func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	return conn, nil
 }
 
+func usable(conn *grpc.ClientConn) bool {
+	return conn != nil && conn.GetState() != connectivity.Shutdown
+}
+
 func CloseConnections() {
 	cache.Lock()
 	defer cache.Unlock()
@@ -149,27 +165,33 @@ func CloseConnections() {
 }
 
 func newConnection(server Server) (*grpc.ClientConn, error) {
-	connOpts := append(gitalyclient.DefaultDialOpts,
-		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
-		grpc.WithStreamInterceptor(
-			grpc_middleware.ChainStreamClient(
-				grpctracing.StreamClientTracingInterceptor(),
-				grpc_prometheus.StreamClientInterceptor,
-				grpccorrelation.StreamClientCorrelationInterceptor(
-					grpccorrelation.WithClientName("gitlab-workhorse"),
-				),
-			),
+	streamInterceptors := []grpc.StreamClientInterceptor{
+		grpctracing.StreamClientTracingInterceptor(),
+		grpc_prometheus.StreamClientInterceptor,
+		grpccorrelation.StreamClientCorrelationInterceptor(
+			grpccorrelation.WithClientName("gitlab-workhorse"),
 		),
+	}
 
-		grpc.WithUnaryInterceptor(
-			grpc_middleware.ChainUnaryClient(
-				grpctracing.UnaryClientTracingInterceptor(),
-				grpc_prometheus.UnaryClientInterceptor,
-				grpccorrelation.UnaryClientCorrelationInterceptor(
-					grpccorrelation.WithClientName("gitlab-workhorse"),
-				),
-			),
+	unaryInterceptors := []grpc.UnaryClientInterceptor{
+		grpctracing.UnaryClientTracingInterceptor(),
+		grpc_prometheus.UnaryClientInterceptor,
+		grpccorrelation.UnaryClientCorrelationInterceptor(
+			grpccorrelation.WithClientName("gitlab-workhorse"),
 		),
+	}
+
+	// Injected faults go last so that they show up in our metrics and traces
+	// like real Gitaly failures would.
+	if faults != nil {
+		streamInterceptors = append(streamInterceptors, faults.streamClientInterceptor)
+		unaryInterceptors = append(unaryInterceptors, faults.unaryClientInterceptor)
+	}
+
+	connOpts := append(gitalyclient.DefaultDialOpts,
+		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
+		grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(streamInterceptors...)),
+		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(unaryInterceptors...)),
 	)
 
 	conn, connErr := gitalyclient.Dial(server.Address, connOpts)
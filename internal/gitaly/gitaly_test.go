@@ -38,6 +38,80 @@ func TestNewDiffClient(t *testing.T) {
 	testOutgoingMetadata(t, ctx)
 }
 
+func TestNewClientPreservesOutgoingMetadata(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "request_id", "abc123")
+
+	ctx, _, err := NewSmartHTTPClient(ctx, serverFixture())
+	require.NoError(t, err)
+	testOutgoingMetadata(t, ctx)
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	require.True(t, ok, "get metadata from context")
+	require.Equal(t, []string{"abc123"}, md["request_id"])
+}
+
+func TestConnectionsAreReused(t *testing.T) {
+	server := Server{Address: "tcp://localhost:124"}
+
+	conn1, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+	conn2, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+	require.True(t, conn1 == conn2, "expected the same connection for the same server")
+
+	other, err := getOrCreateConnection(Server{Address: server.Address, Token: "other-token"})
+	require.NoError(t, err)
+	require.False(t, conn1 == other, "expected a different connection for a different token")
+
+	require.NoError(t, conn1.Close())
+	conn3, err := getOrCreateConnection(server)
+	require.NoError(t, err)
+	require.False(t, conn1 == conn3, "expected a closed connection to be replaced")
+}
+
+func TestRequestMetadataLayersOnSharedConnection(t *testing.T) {
+	server := serverFixture()
+
+	ctx1, client1, err := NewSmartHTTPClient(metadata.AppendToOutgoingContext(context.Background(), "request_id", "1"), server)
+	require.NoError(t, err)
+	ctx2, client2, err := NewSmartHTTPClient(metadata.AppendToOutgoingContext(context.Background(), "request_id", "2"), server)
+	require.NoError(t, err)
+
+	require.Equal(t, client1, client2, "clients should share one connection")
+
+	for ctx, requestID := range map[context.Context]string{ctx1: "1", ctx2: "2"} {
+		md, ok := metadata.FromOutgoingContext(ctx)
+		require.True(t, ok)
+		require.Equal(t, []string{requestID}, md["request_id"])
+	}
+}
+
+func BenchmarkGetOrCreateConnection(b *testing.B) {
+	server := Server{Address: "tcp://localhost:125"}
+
+	b.Run("cached", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := getOrCreateConnection(server); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("uncached", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				conn, err := newConnection(server)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+		})
+	})
+}
+
 func testOutgoingMetadata(t *testing.T, ctx context.Context) {
 	md, ok := metadata.FromOutgoingContext(ctx)
 	require.True(t, ok, "get metadata from context")
@@ -78,7 +78,7 @@ func (client *SmartHTTPClient) ReceivePack(ctx context.Context, repo *gitalypb.R
 		sw := streamio.NewWriter(func(data []byte) error {
 			return stream.Send(&gitalypb.PostReceivePackRequest{Data: data})
 		})
-		_, err := io.Copy(sw, clientRequest)
+		_, err := copyRequest(sw, clientRequest)
 		stream.CloseSend()
 		errC <- err
 	}()
@@ -124,7 +124,7 @@ func (client *SmartHTTPClient) UploadPack(ctx context.Context, repo *gitalypb.Re
 		sw := streamio.NewWriter(func(data []byte) error {
 			return stream.Send(&gitalypb.PostUploadPackRequest{Data: data})
 		})
-		_, err := io.Copy(sw, clientRequest)
+		_, err := copyRequest(sw, clientRequest)
 		stream.CloseSend()
 		errC <- err
 	}()
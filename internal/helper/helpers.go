@@ -167,6 +167,66 @@ func FixRemoteAddr(r *http.Request) {
 	r.RemoteAddr = xff.GetRemoteAddr(r)
 }
 
+// FixRemoteAddrWithTrustedProxies is like FixRemoteAddr, but it only
+// looks at the X-Forwarded-For and X-Real-IP headers if the request comes
+// from one of trustedProxies. The client address is the right-most address
+// in X-Forwarded-For that is not a trusted proxy itself.
+func FixRemoteAddrWithTrustedProxies(r *http.Request, trustedProxies []*net.IPNet) {
+	if r.RemoteAddr == "@" {
+		r.RemoteAddr = "127.0.0.1:0"
+	}
+
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(net.ParseIP(host), trustedProxies) {
+		return
+	}
+
+	if clientIP := forwardedClientIP(r, trustedProxies); clientIP != nil {
+		r.RemoteAddr = net.JoinHostPort(clientIP.String(), port)
+	}
+}
+
+func forwardedClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	var clientIP net.IP
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// Anything left of a malformed address cannot be trusted
+			break
+		}
+
+		clientIP = ip
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+
+	if clientIP != nil {
+		return clientIP
+	}
+
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func SetForwardedFor(newHeaders *http.Header, originalRequest *http.Request) {
 	if clientIP, _, err := net.SplitHostPort(originalRequest.RemoteAddr); err == nil {
 		var header string
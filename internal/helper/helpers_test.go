@@ -3,6 +3,7 @@ package helper
 import (
 	"bytes"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -40,6 +41,54 @@ func TestFixRemoteAddr(t *testing.T) {
 	}
 }
 
+func TestFixRemoteAddrWithTrustedProxies(t *testing.T) {
+	var trustedProxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "127.0.0.1/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	testCases := []struct {
+		desc      string
+		initial   string
+		forwarded []string
+		realIP    string
+		expected  string
+	}{
+		{desc: "trusted peer without headers", initial: "10.0.0.1:1234", expected: "10.0.0.1:1234"},
+		{desc: "trusted peer", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1"}, expected: "18.245.0.1:1234"},
+		{desc: "trusted unix socket peer", initial: "@", forwarded: []string{"18.245.0.1"}, expected: "18.245.0.1:0"},
+		{desc: "untrusted peer", initial: "192.168.1.1:1234", forwarded: []string{"18.245.0.1"}, expected: "192.168.1.1:1234"},
+		{desc: "untrusted public peer", initial: "18.245.0.2:1234", forwarded: []string{"18.245.0.1"}, realIP: "18.245.0.3", expected: "18.245.0.2:1234"},
+		{desc: "chain of trusted proxies", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1, 10.0.0.3", "10.0.0.2"}, expected: "18.245.0.1:1234"},
+		{desc: "spoofed address left of client", initial: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 18.245.0.1"}, expected: "18.245.0.1:1234"},
+		{desc: "malformed address", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1, garbage, 10.0.0.2"}, expected: "10.0.0.2:1234"},
+		{desc: "only trusted proxies", initial: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3:1234"},
+		{desc: "X-Real-IP", initial: "10.0.0.1:1234", realIP: "18.245.0.1", expected: "18.245.0.1:1234"},
+		{desc: "IPv6 client", initial: "10.0.0.1:1234", forwarded: []string{"2001:db8::1"}, expected: "[2001:db8::1]:1234"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "unix:///tmp/test.socket/info/refs", nil)
+			require.NoError(t, err)
+
+			req.RemoteAddr = tc.initial
+			for _, forwarded := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			FixRemoteAddrWithTrustedProxies(req, trustedProxies)
+
+			require.Equal(t, tc.expected, req.RemoteAddr)
+		})
+	}
+}
+
 func TestSetForwardedForGeneratesHeader(t *testing.T) {
 	testCases := []struct {
 		remoteAddr           string
@@ -0,0 +1,107 @@
+package imageresizer
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// cacheKey identifies a resized image. validator is the ETag of the source
+// image, or its Last-Modified time if it has no ETag, so that entries go
+// stale as soon as the source image changes.
+type cacheKey struct {
+	path        string
+	validator   string
+	contentType string
+	width       int
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// resizeCache is an in-memory LRU cache of resized images, bounded by the
+// total size of the images it holds. A nil *resizeCache is a cache that
+// never hits.
+type resizeCache struct {
+	sync.Mutex
+	maxSize uint64
+	size    uint64
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+func newResizeCache(maxSize uint64) *resizeCache {
+	if maxSize == 0 {
+		return nil
+	}
+
+	return &resizeCache{
+		maxSize: maxSize,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// newCacheKey returns false if the response has no validator, in which
+// case we cannot tell whether a cached image is still fresh
+func newCacheKey(r *http.Request, header http.Header, width int) (cacheKey, bool) {
+	validator := header.Get("ETag")
+	if validator == "" {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return cacheKey{}, false
+	}
+
+	return cacheKey{
+		path:        r.URL.Path,
+		validator:   validator,
+		contentType: header.Get("Content-Type"),
+		width:       width,
+	}, true
+}
+
+func (c *resizeCache) get(key cacheKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *resizeCache) add(key cacheKey, data []byte) {
+	if c == nil || uint64(len(data)) > c.maxSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	c.size += uint64(len(data))
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resizeCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= uint64(len(entry.data))
+}
@@ -0,0 +1,108 @@
+package imageresizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestResizeCacheHitAndMiss(t *testing.T) {
+	c := newResizeCache(100)
+	key := cacheKey{path: "/image.png", validator: `"v1"`, contentType: "image/png", width: 64}
+
+	_, ok := c.get(key)
+	require.False(t, ok, "empty cache")
+
+	c.add(key, []byte("resized"))
+
+	data, ok := c.get(key)
+	require.True(t, ok)
+	require.Equal(t, []byte("resized"), data)
+
+	for _, other := range []cacheKey{
+		{path: "/other.png", validator: `"v1"`, contentType: "image/png", width: 64},
+		{path: "/image.png", validator: `"v2"`, contentType: "image/png", width: 64},
+		{path: "/image.png", validator: `"v1"`, contentType: "image/jpeg", width: 64},
+		{path: "/image.png", validator: `"v1"`, contentType: "image/png", width: 32},
+	} {
+		_, ok := c.get(other)
+		require.False(t, ok, "unexpected hit for %+v", other)
+	}
+}
+
+func TestResizeCacheEviction(t *testing.T) {
+	c := newResizeCache(10)
+	a, b, d := cacheKey{width: 1}, cacheKey{width: 2}, cacheKey{width: 3}
+
+	c.add(a, []byte("aaaa"))
+	c.add(b, []byte("bbbb"))
+
+	// Make b the least recently used entry
+	_, ok := c.get(a)
+	require.True(t, ok)
+
+	c.add(d, []byte("dddd"))
+
+	_, ok = c.get(b)
+	require.False(t, ok, "least recently used entry must be evicted")
+	_, ok = c.get(a)
+	require.True(t, ok)
+	_, ok = c.get(d)
+	require.True(t, ok)
+	require.Equal(t, uint64(8), c.size)
+
+	c.add(cacheKey{width: 4}, []byte("this is too large"))
+	require.Equal(t, 2, c.lru.Len(), "entries larger than the cache must not evict anything")
+
+	c.add(a, []byte("a"))
+	require.Equal(t, uint64(5), c.size, "replacing an entry must account for its old size")
+}
+
+func TestResizeCacheDisabled(t *testing.T) {
+	c := newResizeCache(0)
+	require.Nil(t, c)
+
+	c.add(cacheKey{}, []byte("resized"))
+	_, ok := c.get(cacheKey{})
+	require.False(t, ok)
+}
+
+func TestMiddlewareCachesResizedImages(t *testing.T) {
+	cfg := config.DefaultImageResizerConfig
+	cfg.CacheSize = 1000000
+
+	etag := `"v1"`
+	upstream := imageServer(t, "image/png", http.StatusOK)
+	h := NewResizer(config.Config{ImageResizerConfig: cfg}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		upstream.ServeHTTP(w, r)
+	}))
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/image.png?width=16", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, etag, w.Header().Get("ETag"))
+		return w
+	}
+
+	hits := func() float64 {
+		return testutil.ToFloat64(imageResizeRequests.WithLabelValues(statusServerCache))
+	}
+
+	before := hits()
+	resized := request().Body.Bytes()
+	require.Equal(t, before, hits(), "first request is a miss")
+
+	require.Equal(t, resized, request().Body.Bytes())
+	require.Equal(t, before+1, hits(), "second request is a hit")
+
+	etag = `"v2"`
+	require.Equal(t, resized, request().Body.Bytes())
+	require.Equal(t, before+1, hits(), "changed ETag is a miss")
+}
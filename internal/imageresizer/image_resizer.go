@@ -11,7 +11,6 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -30,7 +29,7 @@ import (
 type Resizer struct {
 	config.Config
 	senddata.Prefix
-	numScalerProcs processCounter
+	scalers *scalerLimiter
 }
 
 type resizeParams struct {
@@ -39,10 +38,6 @@ type resizeParams struct {
 	Width       uint
 }
 
-type processCounter struct {
-	n int32
-}
-
 type resizeStatus = string
 
 type imageFile struct {
@@ -62,6 +57,7 @@ type resizeOutcome struct {
 const (
 	statusSuccess        = "success"              // a rescaled image was served
 	statusClientCache    = "success-client-cache" // scaling was skipped because client cache was fresh
+	statusServerCache    = "success-server-cache" // scaling was skipped because the resized image was cached
 	statusServedOriginal = "served-original"      // scaling failed but the original image was served
 	statusRequestFailure = "request-failed"       // no image was served
 	statusUnknown        = "unknown"              // indicates an unhandled status case
@@ -154,9 +150,14 @@ const (
 )
 
 func NewResizer(cfg config.Config) *Resizer {
-	imageResizeMaxProcesses.Set(float64(cfg.ImageResizerConfig.MaxScalerProcs))
+	rc := cfg.ImageResizerConfig
+	imageResizeMaxProcesses.Set(float64(rc.MaxScalerProcs))
 
-	return &Resizer{Config: cfg, Prefix: "send-scaled-img:"}
+	return &Resizer{
+		Config:  cfg,
+		Prefix:  "send-scaled-img:",
+		scalers: newScalerLimiter(int64(rc.MaxScalerProcs), int(rc.MaxScalerQueue), rc.ScalerQueueTimeout.Duration),
+	}
 }
 
 // Inject forks into a dedicated scaler process to resize an image identified by path or URL
@@ -164,6 +165,7 @@ func NewResizer(cfg config.Config) *Resizer {
 func (r *Resizer) Inject(w http.ResponseWriter, req *http.Request, paramsData string) {
 	var outcome = resizeOutcome{status: statusUnknown, originalFileSize: 0, bytesWritten: 0}
 	start := time.Now()
+	skipInProcessResize(req)
 	params, err := r.unpackParameters(paramsData)
 
 	defer func() {
@@ -274,14 +276,15 @@ func (r *Resizer) tryResizeImage(req *http.Request, f *imageFile, params *resize
 		return f.reader, nil, fmt.Errorf("file is too small to resize: %d bytes", f.contentLength)
 	}
 
-	if !r.numScalerProcs.tryIncrement(int32(cfg.MaxScalerProcs)) {
-		return f.reader, nil, fmt.Errorf("too many running scaler processes (%d / %d)", r.numScalerProcs.n, cfg.MaxScalerProcs)
+	ctx := req.Context()
+	release, err := r.scalers.acquire(ctx, 1)
+	if err != nil {
+		return f.reader, nil, fmt.Errorf("start scaler process: %w", err)
 	}
 
-	ctx := req.Context()
 	go func() {
 		<-ctx.Done()
-		r.numScalerProcs.decrement()
+		release()
 	}()
 
 	// Creating buffered Reader is required for us to Peek into first bytes of the image file to detect the format
@@ -303,14 +306,18 @@ func (r *Resizer) tryResizeImage(req *http.Request, f *imageFile, params *resize
 		return buffered, nil, fmt.Errorf("unrecognized file signature: %v", headerBytes)
 	}
 
-	resizeCmd, resizedImageReader, err := startResizeImageCommand(ctx, buffered, params)
+	resizeCmd, resizedImageReader, err := startResizeImageCommand(ctx, buffered, params, f.contentLength)
 	if err != nil {
 		return buffered, nil, fmt.Errorf("fork into scaler process: %w", err)
 	}
 	return resizedImageReader, resizeCmd, nil
 }
 
-func startResizeImageCommand(ctx context.Context, imageReader io.Reader, params *resizeParams) (*exec.Cmd, io.ReadCloser, error) {
+// startResizeImageCommand passes contentLength to the scaler as a hint
+// about the size of its input, unless it is unknown (-1). If ctx has a
+// deadline, the scaler gives up when it passes, instead of resizing an
+// image that nobody waits for any more.
+func startResizeImageCommand(ctx context.Context, imageReader io.Reader, params *resizeParams, contentLength int64) (*exec.Cmd, io.ReadCloser, error) {
 	cmd := exec.CommandContext(ctx, "gitlab-resize-image")
 	cmd.Stdin = imageReader
 	cmd.Stderr = &strings.Builder{}
@@ -318,6 +325,12 @@ func startResizeImageCommand(ctx context.Context, imageReader io.Reader, params
 	cmd.Env = []string{
 		"GL_RESIZE_IMAGE_WIDTH=" + strconv.Itoa(int(params.Width)),
 	}
+	if contentLength > 0 {
+		cmd.Env = append(cmd.Env, "GL_RESIZE_IMAGE_EXPECTED_BYTES="+strconv.FormatInt(contentLength, 10))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		cmd.Env = append(cmd.Env, "GL_RESIZE_IMAGE_DEADLINE="+strconv.FormatInt(deadline.UnixNano(), 10))
+	}
 	cmd.Env = envInjector(ctx, cmd.Env)
 
 	stdout, err := cmd.StdoutPipe()
@@ -380,25 +393,6 @@ func openFromFile(location string) (*imageFile, error) {
 	return &imageFile{file, fi.Size(), fi.ModTime()}, nil
 }
 
-// Only allow more scaling requests if we haven't yet reached the maximum
-// allowed number of concurrent scaler processes
-func (c *processCounter) tryIncrement(maxScalerProcs int32) bool {
-	if p := atomic.AddInt32(&c.n, 1); p > maxScalerProcs {
-		c.decrement()
-		imageResizeConcurrencyLimitExceeds.Inc()
-
-		return false
-	}
-
-	imageResizeProcesses.Set(float64(c.n))
-	return true
-}
-
-func (c *processCounter) decrement() {
-	atomic.AddInt32(&c.n, -1)
-	imageResizeProcesses.Set(float64(c.n))
-}
-
 func (o *resizeOutcome) ok(status resizeStatus) {
 	o.status = status
 	o.err = nil
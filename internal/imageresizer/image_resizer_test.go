@@ -1,6 +1,7 @@
 package imageresizer
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"image"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -221,6 +224,35 @@ func TestServeOriginalImageWhenSourceImageIsTooSmall(t *testing.T) {
 	require.Equal(t, content, responseData, "expected original image")
 }
 
+func TestStartResizeImageCommandPassesDeadline(t *testing.T) {
+	for _, withDeadline := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		deadline := time.Now().Add(time.Minute)
+		if withDeadline {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+		defer cancel()
+
+		f, err := os.Open(imagePath)
+		require.NoError(t, err)
+		defer f.Close()
+
+		cmd, stdout, err := startResizeImageCommand(ctx, f, &resizeParams{Width: 64}, -1)
+		require.NoError(t, err)
+
+		_, err = ioutil.ReadAll(stdout)
+		require.NoError(t, err)
+		require.NoError(t, cmd.Wait())
+
+		env := "GL_RESIZE_IMAGE_DEADLINE=" + strconv.FormatInt(deadline.UnixNano(), 10)
+		if withDeadline {
+			require.Contains(t, cmd.Env, env)
+		} else {
+			require.NotContains(t, strings.Join(cmd.Env, "\n"), "GL_RESIZE_IMAGE_DEADLINE")
+		}
+	}
+}
+
 // The Rails applications sends a Base64 encoded JSON string carrying
 // these parameters in an HTTP response header
 func encodeParams(t *testing.T, p *resizeParams) string {
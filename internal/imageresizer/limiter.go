@@ -0,0 +1,164 @@
+package imageresizer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// errScalerQueueFull and errScalerQueueTimeout are why a scaler
+	// process could not be started. Resizers serve the original image
+	// instead.
+	errScalerQueueFull    = errors.New("too many scaler processes queued")
+	errScalerQueueTimeout = errors.New("timed out waiting for a scaler process")
+)
+
+var (
+	imageResizeQueued = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queued",
+			Help:      "Amount of image resizing requests waiting for a scaler process",
+		},
+	)
+	imageResizeRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rejections_total",
+			Help:      "Amount of image resizing requests that got no scaler process, partitioned by reason (queue_full, timeout or canceled)",
+		},
+		[]string{"reason"},
+	)
+)
+
+// scalerLimiter is a weighted semaphore that limits how many scaler
+// processes run at the same time. Requests beyond the limit wait in a FIFO
+// queue of bounded length, for at most the queue timeout. A timeout of 0
+// lets them wait until their request is canceled.
+type scalerLimiter struct {
+	mu       sync.Mutex
+	size     int64
+	used     int64
+	waiters  list.List // of *scalerWaiter
+	maxQueue int
+	timeout  time.Duration
+}
+
+type scalerWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+func newScalerLimiter(size int64, maxQueue int, timeout time.Duration) *scalerLimiter {
+	return &scalerLimiter{size: size, maxQueue: maxQueue, timeout: timeout}
+}
+
+// acquire takes weight of the capacity of l, waiting in the queue if it is
+// not available. The returned function gives it back. Errors say why we
+// gave up.
+func (l *scalerLimiter) acquire(ctx context.Context, weight int64) (func(), error) {
+	release := func() { l.release(weight) }
+
+	l.mu.Lock()
+	if l.used+weight <= l.size && l.waiters.Len() == 0 {
+		l.used += weight
+		imageResizeProcesses.Set(float64(l.used))
+		l.mu.Unlock()
+		return release, nil
+	}
+
+	if weight > l.size || l.waiters.Len() >= l.maxQueue {
+		used, queued := l.used, l.waiters.Len()
+		l.mu.Unlock()
+		return nil, l.reject("queue_full", fmt.Errorf("%w (%d / %d running, %d queued)", errScalerQueueFull, used, l.size, queued))
+	}
+
+	w := &scalerWaiter{weight: weight, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	imageResizeQueued.Inc()
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var reason string
+	var err error
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timeout:
+		reason, err = "timeout", fmt.Errorf("%w after %v", errScalerQueueTimeout, l.timeout)
+	case <-ctx.Done():
+		reason, err = "canceled", ctx.Err()
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		// We got our turn while giving up, so take it after all
+		l.mu.Unlock()
+		return release, nil
+	default:
+	}
+
+	front := l.waiters.Front() == elem
+	l.waiters.Remove(elem)
+	imageResizeQueued.Dec()
+	if front {
+		// Waiters behind us may fit where we did not
+		l.notifyWaiters()
+	}
+	l.mu.Unlock()
+
+	return nil, l.reject(reason, err)
+}
+
+func (l *scalerLimiter) release(weight int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.used -= weight
+	imageResizeProcesses.Set(float64(l.used))
+	l.notifyWaiters()
+}
+
+// notifyWaiters lets waiters run in the order they came, for as long as
+// there is capacity for the first one. l.mu must be held.
+func (l *scalerLimiter) notifyWaiters() {
+	for {
+		elem := l.waiters.Front()
+		if elem == nil {
+			return
+		}
+
+		w := elem.Value.(*scalerWaiter)
+		if l.used+w.weight > l.size {
+			return
+		}
+
+		l.used += w.weight
+		imageResizeProcesses.Set(float64(l.used))
+		l.waiters.Remove(elem)
+		imageResizeQueued.Dec()
+		close(w.ready)
+	}
+}
+
+func (l *scalerLimiter) reject(reason string, err error) error {
+	imageResizeConcurrencyLimitExceeds.Inc()
+	imageResizeRejections.WithLabelValues(reason).Inc()
+	return err
+}
@@ -0,0 +1,161 @@
+package imageresizer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScalerLimiterLimitsConcurrency(t *testing.T) {
+	const (
+		limit    = 3
+		resizers = 20
+	)
+
+	l := newScalerLimiter(limit, resizers, 0)
+
+	var running, maxRunning int64
+	var wg sync.WaitGroup
+	errs := make(chan error, resizers)
+	for i := 0; i < resizers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, err := l.acquire(context.Background(), 1)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer release()
+
+			n := atomic.AddInt64(&running, 1)
+			for {
+				max := atomic.LoadInt64(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.True(t, maxRunning > 0)
+	require.True(t, maxRunning <= limit, "%d resizers ran at the same time", maxRunning)
+	require.Equal(t, int64(0), l.used)
+	require.Equal(t, 0, queued(l))
+}
+
+func TestScalerLimiterRejectsWhenSaturated(t *testing.T) {
+	l := newScalerLimiter(1, 1, 20*time.Millisecond)
+	queueFull := testutil.ToFloat64(imageResizeRejections.WithLabelValues("queue_full"))
+	timedOut := testutil.ToFloat64(imageResizeRejections.WithLabelValues("timeout"))
+
+	release, err := l.acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer release()
+
+	waited := make(chan error)
+	go func() {
+		_, err := l.acquire(context.Background(), 1)
+		waited <- err
+	}()
+	waitForQueued(t, l, 1)
+
+	_, err = l.acquire(context.Background(), 1)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, errScalerQueueFull), "unexpected error: %v", err)
+	require.Equal(t, queueFull+1, testutil.ToFloat64(imageResizeRejections.WithLabelValues("queue_full")))
+
+	err = <-waited
+	require.Error(t, err)
+	require.True(t, errors.Is(err, errScalerQueueTimeout), "unexpected error: %v", err)
+	require.Equal(t, timedOut+1, testutil.ToFloat64(imageResizeRejections.WithLabelValues("timeout")))
+	require.Equal(t, 0, queued(l))
+}
+
+func TestScalerLimiterStopsWaitingWhenCanceled(t *testing.T) {
+	l := newScalerLimiter(1, 1, 0)
+
+	release, err := l.acquire(context.Background(), 1)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx, 1)
+		waited <- err
+	}()
+	waitForQueued(t, l, 1)
+
+	cancel()
+	require.Equal(t, context.Canceled, <-waited)
+	require.Equal(t, 0, queued(l))
+}
+
+func TestScalerLimiterWeights(t *testing.T) {
+	l := newScalerLimiter(3, 2, 0)
+
+	releaseHeavy, err := l.acquire(context.Background(), 2)
+	require.NoError(t, err)
+
+	ran := make(chan int64, 2)
+	for i, weight := range []int64{2, 1} {
+		weight := weight
+		go func() {
+			release, err := l.acquire(context.Background(), weight)
+			require.NoError(t, err)
+			ran <- weight
+			release()
+		}()
+		waitForQueued(t, l, i+1)
+	}
+
+	// There is room for the light request, but it came after the heavy
+	// one and must not overtake it
+	select {
+	case weight := <-ran:
+		t.Fatalf("request of weight %d ran before its turn", weight)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Both fit once the first heavy request is done
+	releaseHeavy()
+	require.ElementsMatch(t, []int64{2, 1}, []int64{<-ran, <-ran})
+}
+
+func TestScalerLimiterWithoutCapacity(t *testing.T) {
+	l := newScalerLimiter(0, 10, 0)
+
+	_, err := l.acquire(context.Background(), 1)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, errScalerQueueFull), "unexpected error: %v", err)
+}
+
+func queued(l *scalerLimiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.waiters.Len()
+}
+
+func waitForQueued(t *testing.T, l *scalerLimiter, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(l) != n {
+		require.True(t, time.Now().Before(deadline), "expected %d queued requests, got %d", n, queued(l))
+		time.Sleep(time.Millisecond)
+	}
+}
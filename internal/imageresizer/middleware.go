@@ -0,0 +1,296 @@
+package imageresizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/cmd/gitlab-resize-image/resize"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const (
+	// WidthParam is the query parameter the middleware reads the requested
+	// width from
+	WidthParam = "width"
+	// WidthHeader is used if the request has no WidthParam
+	WidthHeader = "Gitlab-Image-Width"
+
+	// Guards against requests that would make us allocate huge images
+	maxMiddlewareWidth  = 2048
+	maxMiddlewarePixels = 4096 * 4096
+)
+
+// Middleware resizes the image responses of next in-process, without
+// forking gitlab-resize-image. The width is taken from the WidthParam query
+// parameter, e.g. ?width=64, or the WidthHeader request header. Responses
+// that are not PNG or JPEG images, are larger than MaxFilesize, or that
+// fail to resize are served unchanged, unless ServeOriginalOnError is
+// false, in which case resize errors fail the request with 500 Internal
+// Server Error. Resizes share the MaxScalerProcs limit with the scaler
+// processes of r; requests that get no share are served originals too.
+// Images that the backend asks r to resize are not resized again.
+//
+// Only originals of up to MaxFilesize bytes are buffered. Larger ones are
+// streamed to the client as they come, without resizing them.
+//
+// If SigningSecret is set, resize requests must be signed, see Signature.
+// Requests that are not are rejected with 403 Forbidden.
+//
+// If CacheSize is set, up to that many bytes of resized images are kept in
+// memory, keyed by the path, ETag or Last-Modified header, content type and
+// width of the original.
+//
+// Range requests are answered from the resized image, which is why we ask
+// next for the entire original. Resized images larger than MaxFilesize are
+// not served; we serve the original instead.
+func (r *Resizer) Middleware(next http.Handler) http.Handler {
+	cfg := r.ImageResizerConfig
+	secret := []byte(cfg.SigningSecret)
+	cache := newResizeCache(cfg.CacheSize)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		width, ok := requestedWidth(req)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if len(secret) > 0 {
+			if err := verifySignature(req, secret, width, time.Now()); err != nil {
+				log.WithRequest(req).WithFields(log.Fields{"subsystem": logSystem}).WithError(fmt.Errorf("resize request: %v", err)).Info("rejected resize request")
+				helper.HTTPError(w, req, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		rw := &resizingResponseWriter{
+			rw:                   w,
+			width:                width,
+			maxSize:              int64(cfg.MaxFilesize),
+			serveOriginalOnError: cfg.ServeOriginalOnError,
+		}
+		next.ServeHTTP(rw, withoutRange(withResizingWriter(req, rw)))
+
+		if !rw.buffering {
+			return
+		}
+
+		key, cacheable := newCacheKey(req, w.Header(), width)
+		if cacheable {
+			if data, ok := cache.get(key); ok {
+				rw.writeResized(req, data)
+				imageResizeRequests.WithLabelValues(statusServerCache).Inc()
+				return
+			}
+		}
+
+		release, err := r.scalers.acquire(req.Context(), 1)
+		if err != nil {
+			log.WithRequest(req).WithFields(log.Fields{"subsystem": logSystem}).WithError(fmt.Errorf("resize image in-process: %w", err)).Error()
+			imageResizeRequests.WithLabelValues(statusServedOriginal).Inc()
+			rw.flushOriginal()
+			return
+		}
+		defer release()
+
+		if data, ok := rw.finish(req); ok && cacheable {
+			cache.add(key, data)
+		}
+	})
+}
+
+type resizingWriterKey struct{}
+
+// withResizingWriter returns req with rw in its context, so that Inject
+// can tell that the response goes through the middleware
+func withResizingWriter(req *http.Request, rw *resizingResponseWriter) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), resizingWriterKey{}, rw))
+}
+
+// skipInProcessResize makes the middleware, if req goes through it, pass
+// on the response to req unchanged
+func skipInProcessResize(req *http.Request) {
+	if rw, ok := req.Context().Value(resizingWriterKey{}).(*resizingResponseWriter); ok {
+		rw.passThrough = true
+	}
+}
+
+func requestedWidth(r *http.Request) (int, bool) {
+	param := r.URL.Query().Get(WidthParam)
+	if param == "" {
+		param = r.Header.Get(WidthHeader)
+	}
+	if param == "" {
+		return 0, false
+	}
+
+	width, err := strconv.Atoi(param)
+	if err != nil || width <= 0 || width > maxMiddlewareWidth {
+		return 0, false
+	}
+
+	return width, true
+}
+
+// withoutRange returns r without the headers of range requests. Ranges of
+// the original image are no use to us.
+func withoutRange(r *http.Request) *http.Request {
+	if r.Header.Get("Range") == "" && r.Header.Get("If-Range") == "" {
+		return r
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.Header.Del("Range")
+	r2.Header.Del("If-Range")
+	return r2
+}
+
+func isResizableContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "image/png" || mediaType == "image/jpeg"
+}
+
+// resizingResponseWriter holds back successful image responses so that
+// they can be resized once the handler is done. Everything else is passed
+// through as it is written.
+type resizingResponseWriter struct {
+	rw      http.ResponseWriter
+	width   int
+	maxSize int64
+	// serveOriginalOnError makes finish serve the buffered original if
+	// resizing fails, instead of failing the request
+	serveOriginalOnError bool
+	// passThrough makes us pass on the response unchanged, because it is
+	// resized already
+	passThrough bool
+	status      int
+	buffering   bool
+	buf         bytes.Buffer
+}
+
+func (w *resizingResponseWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *resizingResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+
+	w.status = status
+	if status == http.StatusOK && !w.passThrough && isResizableContentType(w.rw.Header().Get("Content-Type")) {
+		w.buffering = true
+		return
+	}
+
+	w.rw.WriteHeader(status)
+}
+
+func (w *resizingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.buffering {
+		return w.rw.Write(data)
+	}
+
+	if int64(w.buf.Len()+len(data)) > w.maxSize {
+		// Too large to resize; send what we have so far and stream the rest
+		imageResizeRequests.WithLabelValues(statusServedOriginal).Inc()
+		if err := w.flushOriginal(); err != nil {
+			return 0, err
+		}
+		return w.rw.Write(data)
+	}
+
+	return w.buf.Write(data)
+}
+
+// flushOriginal writes out the buffered response unchanged and stops
+// buffering
+func (w *resizingResponseWriter) flushOriginal() error {
+	w.buffering = false
+	w.rw.WriteHeader(w.status)
+
+	_, err := w.buf.WriteTo(w.rw)
+	return err
+}
+
+// writeResized serves data with http.ServeContent, which answers range and
+// conditional requests. The Content-Length of the original does not apply.
+func (w *resizingResponseWriter) writeResized(r *http.Request, data []byte) {
+	w.rw.Header().Del("Content-Length")
+	http.ServeContent(w.rw, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+var errResizedTooLarge = errors.New("resized image too large")
+
+// cappedBuffer is a bytes.Buffer that fails writes beyond max bytes
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.max {
+		return 0, fmt.Errorf("%w: more than %d bytes", errResizedTooLarge, b.max)
+	}
+
+	return b.buf.Write(p)
+}
+
+// finish resizes the buffered image and writes it out. If resizing fails,
+// it writes out the original image, or an error if w.serveOriginalOnError
+// is false. It returns the resized image if it was served.
+func (w *resizingResponseWriter) finish(r *http.Request) ([]byte, bool) {
+	start := time.Now()
+	contentType := w.rw.Header().Get("Content-Type")
+
+	out := &cappedBuffer{max: w.maxSize}
+	err := resize.Process(bytes.NewReader(w.buf.Bytes()), out, resize.Options{
+		Width:         w.width,
+		MaxPixels:     maxMiddlewarePixels,
+		ExpectedBytes: int64(w.buf.Len()),
+	})
+	if err != nil {
+		fields := log.Fields{
+			"subsystem":                 logSystem,
+			logSystem + ".target_width": w.width,
+			logSystem + ".content_type": contentType,
+		}
+		err = fmt.Errorf("resize image in-process: %v", err)
+
+		if !w.serveOriginalOnError {
+			imageResizeRequests.WithLabelValues(statusRequestFailure).Inc()
+			// The headers of the original do not describe the error
+			w.rw.Header().Del("Content-Length")
+			helper.Fail500WithFields(w.rw, r, err, fields)
+			return nil, false
+		}
+
+		log.WithRequest(r).WithFields(fields).WithError(err).Error()
+		imageResizeRequests.WithLabelValues(statusServedOriginal).Inc()
+		w.flushOriginal()
+		return nil, false
+	}
+
+	w.writeResized(r, out.buf.Bytes())
+
+	imageResizeDurations.WithLabelValues(contentType, strconv.Itoa(w.width)).Observe(time.Since(start).Seconds())
+	imageResizeRequests.WithLabelValues(statusSuccess).Inc()
+
+	return out.buf.Bytes(), true
+}
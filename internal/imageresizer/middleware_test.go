@@ -0,0 +1,300 @@
+package imageresizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func imageServer(t *testing.T, contentType string, status int) http.Handler {
+	data, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write(data)
+	})
+}
+
+func requestThroughMiddleware(t *testing.T, h http.Handler, url string, header http.Header, cfg config.ImageResizerConfig) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	NewResizer(config.Config{ImageResizerConfig: cfg}).Middleware(h).ServeHTTP(w, r)
+
+	return w
+}
+
+func TestMiddlewareResizesImages(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		url    string
+		header http.Header
+	}{
+		{desc: "query parameter", url: "/image.png?width=16"},
+		{desc: "header", url: "/image.png", header: http.Header{WidthHeader: {"16"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := requestThroughMiddleware(t, imageServer(t, "image/png", http.StatusOK), tc.url, tc.header, config.DefaultImageResizerConfig)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, "image/png", w.Header().Get("Content-Type"))
+
+			img, err := ioutil.ReadAll(w.Body)
+			require.NoError(t, err)
+			require.Equal(t, w.Header().Get("Content-Length"), strconv.Itoa(len(img)))
+
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(img))
+			require.NoError(t, err)
+			require.Equal(t, "png", format)
+			require.Equal(t, 16, cfg.Width)
+		})
+	}
+}
+
+func TestMiddlewarePassesThroughUnchanged(t *testing.T) {
+	original, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	smallFiles := config.DefaultImageResizerConfig
+	smallFiles.MaxFilesize = 16
+
+	noProcs := config.DefaultImageResizerConfig
+	noProcs.MaxScalerProcs = 0
+
+	testCases := []struct {
+		desc        string
+		url         string
+		contentType string
+		status      int
+		cfg         config.ImageResizerConfig
+	}{
+		{desc: "no width", url: "/image.png", contentType: "image/png", status: http.StatusOK},
+		{desc: "invalid width", url: "/image.png?width=wide", contentType: "image/png", status: http.StatusOK},
+		{desc: "negative width", url: "/image.png?width=-1", contentType: "image/png", status: http.StatusOK},
+		{desc: "width too large", url: "/image.png?width=1000000", contentType: "image/png", status: http.StatusOK},
+		{desc: "unsupported format", url: "/image.svg?width=16", contentType: "image/svg+xml", status: http.StatusOK},
+		{desc: "not an image", url: "/file?width=16", contentType: "application/octet-stream", status: http.StatusOK},
+		{desc: "error response", url: "/image.png?width=16", contentType: "image/png", status: http.StatusNotFound},
+		{desc: "file too large", url: "/image.png?width=16", contentType: "image/png", status: http.StatusOK, cfg: smallFiles},
+		{desc: "concurrency limit", url: "/image.png?width=16", contentType: "image/png", status: http.StatusOK, cfg: noProcs},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := tc.cfg
+			if cfg == (config.ImageResizerConfig{}) {
+				cfg = config.DefaultImageResizerConfig
+			}
+
+			w := requestThroughMiddleware(t, imageServer(t, tc.contentType, tc.status), tc.url, nil, cfg)
+
+			require.Equal(t, tc.status, w.Code)
+			require.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+			require.Equal(t, original, w.Body.Bytes())
+		})
+	}
+}
+
+func TestMiddlewareServesOriginalIfResizingFails(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("this is not a PNG"))
+	})
+
+	w := requestThroughMiddleware(t, h, "/image.png?width=16", nil, config.DefaultImageResizerConfig)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "this is not a PNG", w.Body.String())
+}
+
+func TestMiddlewareResizeErrors(t *testing.T) {
+	original, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+	broken := []byte("this is not a PNG")
+
+	testCases := []struct {
+		desc                 string
+		data                 []byte
+		maxFilesize          uint64
+		serveOriginalOnError bool
+		expectedCode         int
+		expectedBody         []byte
+		expectResized        bool
+	}{
+		{desc: "resized", data: original, serveOriginalOnError: true, expectedCode: http.StatusOK, expectResized: true},
+		{desc: "resized without fallback", data: original, serveOriginalOnError: false, expectedCode: http.StatusOK, expectResized: true},
+		{desc: "broken image", data: broken, serveOriginalOnError: true, expectedCode: http.StatusOK, expectedBody: broken},
+		{desc: "broken image without fallback", data: broken, serveOriginalOnError: false, expectedCode: http.StatusInternalServerError, expectedBody: []byte("Internal server error\n")},
+		{desc: "original too large", data: original, maxFilesize: 16, serveOriginalOnError: false, expectedCode: http.StatusOK, expectedBody: original},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Header().Set("Content-Length", strconv.Itoa(len(tc.data)))
+				w.Write(tc.data)
+			})
+
+			cfg := config.DefaultImageResizerConfig
+			cfg.ServeOriginalOnError = tc.serveOriginalOnError
+			if tc.maxFilesize > 0 {
+				cfg.MaxFilesize = tc.maxFilesize
+			}
+
+			w := requestThroughMiddleware(t, h, "/image.png?width=16", nil, cfg)
+			require.Equal(t, tc.expectedCode, w.Code)
+
+			if tc.expectResized {
+				img, _, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+				require.NoError(t, err)
+				require.Equal(t, 16, img.Width)
+				return
+			}
+
+			require.Equal(t, tc.expectedBody, w.Body.Bytes())
+			if tc.expectedCode == http.StatusOK {
+				require.Equal(t, "image/png", w.Header().Get("Content-Type"), "originals keep their Content-Type")
+				require.Equal(t, strconv.Itoa(len(tc.data)), w.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestResizingResponseWriterBuffersAtMostMaxSize(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "image/png")
+	w := &resizingResponseWriter{rw: rec, width: 16, maxSize: 16}
+
+	chunk := bytes.Repeat([]byte("x"), 8)
+	for i := 0; i < 10; i++ {
+		n, err := w.Write(chunk)
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+		require.LessOrEqual(t, w.buf.Len(), 16)
+	}
+
+	require.False(t, w.buffering, "originals larger than maxSize must be streamed")
+	require.Equal(t, bytes.Repeat(chunk, 10), rec.Body.Bytes())
+}
+
+func TestMiddlewareServesRangesOfResizedImages(t *testing.T) {
+	var upstreamRanges []string
+	upstream := imageServer(t, "image/png", http.StatusOK)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRanges = append(upstreamRanges, r.Header.Get("Range"))
+		upstream.ServeHTTP(w, r)
+	})
+
+	full := requestThroughMiddleware(t, h, "/image.png?width=16", nil, config.DefaultImageResizerConfig)
+	require.Equal(t, http.StatusOK, full.Code)
+	resized := full.Body.Bytes()
+	size := len(resized)
+
+	testCases := []struct {
+		desc         string
+		rangeHeader  string
+		expectedCode int
+		expectedBody []byte
+		contentRange string
+	}{
+		{desc: "first bytes", rangeHeader: "bytes=0-9", expectedCode: http.StatusPartialContent, expectedBody: resized[:10], contentRange: fmt.Sprintf("bytes 0-9/%d", size)},
+		{desc: "suffix", rangeHeader: "bytes=-5", expectedCode: http.StatusPartialContent, expectedBody: resized[size-5:], contentRange: fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size)},
+		{desc: "open ended", rangeHeader: "bytes=10-", expectedCode: http.StatusPartialContent, expectedBody: resized[10:], contentRange: fmt.Sprintf("bytes 10-%d/%d", size-1, size)},
+		{desc: "beyond the resized image", rangeHeader: fmt.Sprintf("bytes=%d-", size), expectedCode: http.StatusRequestedRangeNotSatisfiable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			upstreamRanges = nil
+			w := requestThroughMiddleware(t, h, "/image.png?width=16", http.Header{"Range": {tc.rangeHeader}}, config.DefaultImageResizerConfig)
+
+			require.Equal(t, []string{""}, upstreamRanges, "upstream must serve the entire original")
+			require.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode != http.StatusPartialContent {
+				return
+			}
+
+			require.Equal(t, tc.expectedBody, w.Body.Bytes())
+			require.Equal(t, tc.contentRange, w.Header().Get("Content-Range"))
+			require.Equal(t, strconv.Itoa(len(tc.expectedBody)), w.Header().Get("Content-Length"))
+		})
+	}
+}
+
+func TestMiddlewareServesOriginalIfResizedImageIsTooLarge(t *testing.T) {
+	original, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxFilesize = uint64(len(original))
+
+	// Enlarging the image makes it larger than the original
+	w := requestThroughMiddleware(t, imageServer(t, "image/png", http.StatusOK), "/image.png?width=1024", nil, cfg)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, original, w.Body.Bytes())
+}
+
+func TestMiddlewareSharesScalerLimit(t *testing.T) {
+	original, err := ioutil.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	cfg := config.DefaultImageResizerConfig
+	cfg.MaxScalerProcs = 1
+	r := NewResizer(config.Config{ImageResizerConfig: cfg})
+
+	// A scaler process of r takes the only share
+	release, err := r.scalers.acquire(context.Background(), 1)
+	require.NoError(t, err)
+
+	request := func() []byte {
+		w := httptest.NewRecorder()
+		r.Middleware(imageServer(t, "image/png", http.StatusOK)).ServeHTTP(w, httptest.NewRequest("GET", "/image.png?width=16", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.Bytes()
+	}
+
+	require.Equal(t, original, request())
+
+	release()
+	resized, _, err := image.DecodeConfig(bytes.NewReader(request()))
+	require.NoError(t, err)
+	require.Equal(t, 16, resized.Width)
+}
+
+func TestMiddlewareDoesNotResizeInjectedImages(t *testing.T) {
+	r := NewResizer(config.Config{ImageResizerConfig: config.DefaultImageResizerConfig})
+	params := encodeParams(t, &resizeParams{Location: imagePath, ContentType: "image/png", Width: 16})
+
+	// Like the backend asking us to send a scaled image
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		r.Inject(w, req, params)
+	})
+
+	w := httptest.NewRecorder()
+	r.Middleware(h).ServeHTTP(w, httptest.NewRequest("GET", "/image.png?width=8", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cfg, _, err := image.DecodeConfig(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, 16, cfg.Width, "the scaler process resized the image, and nobody after it")
+}
@@ -0,0 +1,63 @@
+package imageresizer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ExpiresParam is the query parameter holding the Unix time after which
+	// a signed resize request is no longer valid
+	ExpiresParam = "expires"
+	// SignatureParam is the query parameter holding the signature of a
+	// resize request
+	SignatureParam = "signature"
+)
+
+var (
+	errMissingSignature = errors.New("missing signature")
+	errSignatureExpired = errors.New("signature expired")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// Signature returns the hex encoded HMAC-SHA256 of path, width and expires,
+// separated by newlines, using secret as the key. path is the escaped URL
+// path of the request, without the query string.
+func Signature(secret []byte, path string, width int, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d\n%d", path, width, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifySignature(r *http.Request, secret []byte, width int, now time.Time) error {
+	query := r.URL.Query()
+
+	signature := query.Get(SignatureParam)
+	expiresParam := query.Get(ExpiresParam)
+	if signature == "" || expiresParam == "" {
+		return errMissingSignature
+	}
+
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	expected := Signature(secret, r.URL.EscapedPath(), width, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+
+	// Only check this once we know the expiry time has not been tampered with
+	if now.Unix() > expires {
+		return errSignatureExpired
+	}
+
+	return nil
+}
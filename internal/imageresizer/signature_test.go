@@ -0,0 +1,84 @@
+package imageresizer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var testSigningSecret = []byte("s3cr3t")
+
+func signedURL(path string, width int, expires int64) string {
+	return fmt.Sprintf("%s?width=%d&expires=%d&signature=%s", path, width, expires, Signature(testSigningSecret, path, width, expires))
+}
+
+func TestSignature(t *testing.T) {
+	// Generated with: printf '/image.png\n64\n1600000000' | openssl dgst -sha256 -hmac s3cr3t
+	expected := "fe42febb7147fa5a151fb58b541da6c3d59a16b3c202f1357bf13844efd9f107"
+
+	require.Equal(t, expected, Signature(testSigningSecret, "/image.png", 64, 1600000000))
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	future := now.Add(time.Hour).Unix()
+	past := now.Add(-time.Second).Unix()
+
+	testCases := []struct {
+		desc        string
+		url         string
+		width       int
+		expectedErr error
+	}{
+		{desc: "valid", url: signedURL("/image.png", 64, future), width: 64},
+		{desc: "expires right now", url: signedURL("/image.png", 64, now.Unix()), width: 64},
+		{desc: "expired", url: signedURL("/image.png", 64, past), width: 64, expectedErr: errSignatureExpired},
+		{desc: "unsigned", url: "/image.png?width=64", width: 64, expectedErr: errMissingSignature},
+		{desc: "no expiry", url: fmt.Sprintf("/image.png?width=64&signature=%s", Signature(testSigningSecret, "/image.png", 64, future)), width: 64, expectedErr: errMissingSignature},
+		{desc: "tampered width", url: fmt.Sprintf("/image.png?width=128&expires=%d&signature=%s", future, Signature(testSigningSecret, "/image.png", 64, future)), width: 128, expectedErr: errInvalidSignature},
+		{desc: "other path", url: "/other.png" + signedURL("/image.png", 64, future)[len("/image.png"):], width: 64, expectedErr: errInvalidSignature},
+		{desc: "tampered expiry", url: fmt.Sprintf("/image.png?width=64&expires=%d&signature=%s", future+1, Signature(testSigningSecret, "/image.png", 64, future)), width: 64, expectedErr: errInvalidSignature},
+		{desc: "tampered signature", url: fmt.Sprintf("/image.png?width=64&expires=%d&signature=%s", future, Signature([]byte("other"), "/image.png", 64, future)), width: 64, expectedErr: errInvalidSignature},
+		{desc: "malformed expiry", url: "/image.png?width=64&expires=soon&signature=abc", width: 64, expectedErr: errInvalidSignature},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.url, nil)
+
+			require.Equal(t, tc.expectedErr, verifySignature(r, testSigningSecret, tc.width, now))
+		})
+	}
+}
+
+func TestMiddlewareRequiresSignature(t *testing.T) {
+	cfg := config.DefaultImageResizerConfig
+	cfg.SigningSecret = string(testSigningSecret)
+
+	expires := time.Now().Add(time.Hour).Unix()
+
+	testCases := []struct {
+		desc         string
+		url          string
+		expectedCode int
+	}{
+		{desc: "signed", url: signedURL("/image.png", 16, expires), expectedCode: http.StatusOK},
+		{desc: "unsigned", url: "/image.png?width=16", expectedCode: http.StatusForbidden},
+		{desc: "expired", url: signedURL("/image.png", 16, time.Now().Add(-time.Hour).Unix()), expectedCode: http.StatusForbidden},
+		{desc: "no resizing", url: "/image.png", expectedCode: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			w := requestThroughMiddleware(t, imageServer(t, "image/png", http.StatusOK), tc.url, nil, cfg)
+
+			require.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
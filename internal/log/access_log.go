@@ -0,0 +1,59 @@
+package log
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type accessLogFieldsKey struct{}
+
+type accessLogFields struct {
+	mu     sync.Mutex
+	fields Fields
+}
+
+// WithAccessLogFields returns r with room for the fields that handlers add
+// to its access log line with AddAccessLogFields
+func WithAccessLogFields(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessLogFieldsKey{}, &accessLogFields{}))
+}
+
+// AddAccessLogFields adds fields to the access log line of the request ctx
+// belongs to. Requests that did not go through WithAccessLogFields have no
+// room for them, and the fields are dropped.
+func AddAccessLogFields(ctx context.Context, fields Fields) {
+	f, ok := ctx.Value(accessLogFieldsKey{}).(*accessLogFields)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fields == nil {
+		f.fields = Fields{}
+	}
+	for k, v := range fields {
+		f.fields[k] = v
+	}
+}
+
+// AccessLogFields returns the fields that handlers added to the access log
+// line of r
+func AccessLogFields(r *http.Request) Fields {
+	f, ok := r.Context().Value(accessLogFieldsKey{}).(*accessLogFields)
+	if !ok {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fields := make(Fields, len(f.fields))
+	for k, v := range f.fields {
+		fields[k] = v
+	}
+	return fields
+}
@@ -0,0 +1,27 @@
+package log
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogFields(t *testing.T) {
+	r := WithAccessLogFields(httptest.NewRequest("GET", "/", nil))
+
+	// Handlers further down get requests derived from r
+	r2 := r.WithContext(context.WithValue(r.Context(), struct{}{}, nil))
+	AddAccessLogFields(r2.Context(), Fields{"a": 1, "b": 2})
+	AddAccessLogFields(r2.Context(), Fields{"b": 3})
+
+	require.Equal(t, Fields{"a": 1, "b": 3}, AccessLogFields(r))
+}
+
+func TestAccessLogFieldsWithoutRoom(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	AddAccessLogFields(r.Context(), Fields{"a": 1})
+
+	require.Empty(t, AccessLogFields(r))
+}
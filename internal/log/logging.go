@@ -75,6 +75,14 @@ func (b *Builder) Info(args ...interface{}) {
 	b.entry.Info(args...)
 }
 
+func Warn(args ...interface{}) {
+	NewBuilder().Warn(args...)
+}
+
+func (b *Builder) Warn(args ...interface{}) {
+	b.entry.Warn(args...)
+}
+
 func Error(args ...interface{}) {
 	NewBuilder().Error(args...)
 }
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// livenessHandler reports that the Workhorse process is up. Unlike the
+// /-/liveness endpoint of gitlab-rails it does not depend on the backend.
+func livenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "OK\n")
+	})
+}
+
+// readinessHandler reports whether the auth backend can be reached
+func (u *upstream) readinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := u.pingBackend(r.Context()); err != nil {
+			// Probes run every few seconds, don't flood Sentry while the backend is down
+			log.WithRequest(r).WithError(err).Warn("readiness check failed")
+			http.Error(w, "Auth backend unreachable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "OK\n")
+	})
+}
+
+// pingBackend requests the gitlab-rails liveness endpoint. Any response
+// other than a gateway error means the backend is reachable.
+func (u *upstream) pingBackend(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", u.Backend.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.URL.Path = string(u.URLPrefix) + "-/liveness"
+
+	resp, err := u.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("backend responded with %s", resp.Status)
+	}
+
+	return nil
+}
@@ -8,7 +8,7 @@ import (
 
 	"github.com/gorilla/websocket"
 
-	"gitlab.com/gitlab-org/labkit/log"
+	logkit "gitlab.com/gitlab-org/labkit/log"
 	"gitlab.com/gitlab-org/labkit/tracing"
 
 	apipkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -20,6 +20,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/imageresizer"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/log"
 	proxypkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/proxy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
@@ -42,6 +43,7 @@ type routeEntry struct {
 
 type routeOptions struct {
 	tracing  bool
+	timeouts config.TimeoutConfig
 	matchers []matcherFunc
 }
 
@@ -57,6 +59,7 @@ const (
 	ciAPIPattern         = `^/ci/api/`
 	gitProjectPattern    = `^/.+\.git/`
 	projectPattern       = `^/([^/]+/){1,}[^/]+/`
+	uploadsPattern       = `^/uploads/`
 	snippetUploadPattern = `^/uploads/personal_snippet`
 	userUploadPattern    = `^/uploads/user`
 	importPattern        = `^/import/`
@@ -90,31 +93,59 @@ func withoutTracing() func(*routeOptions) {
 	}
 }
 
+func withTimeouts(timeouts config.TimeoutConfig) func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.timeouts = timeouts
+	}
+}
+
 func (u *upstream) observabilityMiddlewares(handler http.Handler, method string, regexpStr string) http.Handler {
-	handler = log.AccessLogger(
+	handler = logkit.AccessLogger(
 		handler,
-		log.WithAccessLogger(u.accessLogger),
-		log.WithExtraFields(func(r *http.Request) log.Fields {
-			return log.Fields{
+		logkit.WithAccessLogger(u.accessLogger),
+		logkit.WithExtraFields(func(r *http.Request) logkit.Fields {
+			fields := logkit.Fields{
 				"route": regexpStr, // This field matches the `route` label in Prometheus metrics
 			}
+			for k, v := range log.AccessLogFields(r) {
+				fields[k] = v
+			}
+			return fields
 		}),
 	)
+	handler = u.withAccessLogFields(handler)
 
 	handler = instrumentRoute(handler, method, regexpStr) // Add prometheus metrics
 	return handler
 }
 
+// withAccessLogFields gives handlers room to add fields to the access log
+// line of their request. If the access log cannot hold them, we log them
+// on a line of their own.
+func (u *upstream) withAccessLogFields(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = log.WithAccessLogFields(r)
+		next.ServeHTTP(w, r)
+
+		if fields := log.AccessLogFields(r); u.LogAccessLogFields && len(fields) > 0 {
+			log.WithRequest(r).WithFields(fields).Info("finished request")
+		}
+	})
+}
+
 func (u *upstream) route(method, regexpStr string, handler http.Handler, opts ...func(*routeOptions)) routeEntry {
 	// Instantiate a route with the defaults
 	options := routeOptions{
-		tracing: true,
+		tracing:  true,
+		timeouts: u.Timeouts,
 	}
 
 	for _, f := range opts {
 		f(&options)
 	}
 
+	handler = withRequestTimeouts(handler, options.timeouts)
+
 	handler = u.observabilityMiddlewares(handler, method, regexpStr)
 	handler = denyWebsocket(handler) // Disallow websockets
 	if options.tracing {
@@ -169,7 +200,7 @@ func (ro *routeEntry) isMatch(cleanedPath string, req *http.Request) bool {
 	return ok
 }
 
-func buildProxy(backend *url.URL, version string, rt http.RoundTripper, cfg config.Config) http.Handler {
+func buildProxy(backend *url.URL, version string, rt http.RoundTripper, resizer *imageresizer.Resizer) http.Handler {
 	proxier := proxypkg.NewProxy(backend, version, rt)
 
 	return senddata.SendData(
@@ -181,7 +212,7 @@ func buildProxy(backend *url.URL, version string, rt http.RoundTripper, cfg conf
 		git.SendSnapshot,
 		artifacts.SendEntry,
 		sendurl.SendURL,
-		imageresizer.NewResizer(cfg),
+		resizer,
 	)
 }
 
@@ -196,8 +227,12 @@ func configureRoutes(u *upstream) {
 		u.RoundTripper,
 	)
 
+	// Both proxies and the in-process resizer share one limit of scaler
+	// processes
+	resizer := imageresizer.NewResizer(u.Config)
+
 	static := &staticpages.Static{DocumentRoot: u.DocumentRoot, Exclude: staticExclude}
-	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper, u.Config)
+	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper, resizer)
 	cableProxy := proxypkg.NewProxy(u.CableBackend, u.Version, u.CableRoundTripper)
 
 	assetsNotFoundHandler := NotFoundUnless(u.DevelopmentMode, proxy)
@@ -211,7 +246,7 @@ func configureRoutes(u *upstream) {
 	}
 
 	signingTripper := secret.NewRoundTripper(u.RoundTripper, u.Version)
-	signingProxy := buildProxy(u.Backend, u.Version, signingTripper, u.Config)
+	signingProxy := buildProxy(u.Backend, u.Version, signingTripper, resizer)
 
 	preparers := createUploadPreparers(u.Config)
 	uploadPath := path.Join(u.DocumentRoot, "uploads/tmp")
@@ -225,14 +260,22 @@ func configureRoutes(u *upstream) {
 		staticpages.CacheDisabled,
 		static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatHTML, uploadAccelerateProxy)),
 	)
+	// Like defaultUpstream, but resizing images requested with a width
+	imageUpstream := static.ServeExisting(
+		u.URLPrefix,
+		staticpages.CacheDisabled,
+		static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatHTML, resizer.Middleware(proxy))),
+	)
 	probeUpstream := static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatJSON, proxy)
 	healthUpstream := static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatText, proxy)
 
 	u.Routes = []routeEntry{
 		// Git Clone
-		u.route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
-		u.route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), withMatcher(isContentType("application/x-git-upload-pack-request"))),
-		u.route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), withMatcher(isContentType("application/x-git-receive-pack-request"))),
+		u.route("GET", gitProjectPattern+`info/refs\z`, git.DumbHTTPHandler(), withMatcher(u.rejectDumbHTTP), withMatcher(git.IsDumbInfoRefsRequest)),
+		u.route("GET", gitProjectPattern+`(HEAD|objects/.+)\z`, git.DumbHTTPHandler(), withMatcher(u.rejectDumbHTTP)),
+		u.route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api, u.GitConfig, u.gitOptions), withTimeouts(u.GitConfig.Timeouts)),
+		u.route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api, u.GitConfig, u.gitOptions)), withMatcher(isContentType("application/x-git-upload-pack-request")), withTimeouts(u.GitConfig.Timeouts)),
+		u.route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api, u.GitConfig, u.gitOptions)), withMatcher(isContentType("application/x-git-receive-pack-request")), withTimeouts(u.GitConfig.Timeouts)),
 		u.route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, signingProxy, preparers.lfs), withMatcher(isContentType("application/octet-stream"))),
 
 		// CI Artifacts
@@ -310,10 +353,16 @@ func configureRoutes(u *upstream) {
 		),
 
 		// Uploads
+		u.route("GET", uploadsPattern, imageUpstream, withMatcher(u.resizeInProcess)),
+		u.route("GET", projectPattern+`uploads/`, imageUpstream, withMatcher(u.resizeInProcess)),
 		u.route("POST", projectPattern+`uploads\z`, upload.Accelerate(api, signingProxy, preparers.uploads)),
 		u.route("POST", snippetUploadPattern, upload.Accelerate(api, signingProxy, preparers.uploads)),
 		u.route("POST", userUploadPattern, upload.Accelerate(api, signingProxy, preparers.uploads)),
 
+		// Workhorse's own health checks, for orchestrators such as Kubernetes
+		u.route("GET", `^/-/workhorse/liveness\z`, livenessHandler(), withoutTracing()),
+		u.route("GET", `^/-/workhorse/readiness\z`, u.readinessHandler(), withoutTracing()),
+
 		// health checks don't intercept errors and go straight to rails
 		// TODO: We should probably not return a HTML deploy page?
 		//       https://gitlab.com/gitlab-org/gitlab-workhorse/issues/230
@@ -327,6 +376,14 @@ func configureRoutes(u *upstream) {
 	}
 }
 
+func (u *upstream) rejectDumbHTTP(*http.Request) bool {
+	return u.GitConfig.RejectDumbHTTP
+}
+
+func (u *upstream) resizeInProcess(*http.Request) bool {
+	return u.ImageResizerConfig.InProcess
+}
+
 func createUploadPreparers(cfg config.Config) uploadPreparers {
 	defaultPreparer := upload.NewObjectStoragePreparer(cfg)
 
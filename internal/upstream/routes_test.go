@@ -0,0 +1,102 @@
+package upstream
+
+import (
+	"bytes"
+	"image"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+)
+
+func TestImageUploadsAreResizedInProcess(t *testing.T) {
+	original, err := ioutil.ReadFile("../../testdata/image.png")
+	require.NoError(t, err)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(original)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc          string
+		inProcess     bool
+		path          string
+		expectedWidth int
+	}{
+		{desc: "disabled", path: "/uploads/-/system/user/avatar/1/avatar.png?width=16", expectedWidth: 0},
+		{desc: "user upload", inProcess: true, path: "/uploads/-/system/user/avatar/1/avatar.png?width=16", expectedWidth: 16},
+		{desc: "project upload", inProcess: true, path: "/group/project/uploads/0123456789abcdef/image.png?width=16", expectedWidth: 16},
+		{desc: "no width", inProcess: true, path: "/uploads/-/system/user/avatar/1/avatar.png", expectedWidth: 0},
+		{desc: "not an upload", inProcess: true, path: "/group/project/raw/master/image.png?width=16", expectedWidth: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := config.Config{Backend: backendURL, ImageResizerConfig: config.DefaultImageResizerConfig}
+			cfg.ImageResizerConfig.InProcess = tc.inProcess
+
+			ts := httptest.NewServer(newUpstream(cfg, logrus.StandardLogger(), git.Options{}, configureRoutes))
+			defer ts.Close()
+
+			resp, err := http.Get(ts.URL + tc.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			if tc.expectedWidth == 0 {
+				require.Equal(t, original, body)
+				return
+			}
+
+			resized, _, err := image.DecodeConfig(bytes.NewReader(body))
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedWidth, resized.Width)
+		})
+	}
+}
+
+func TestGitRoutesCallPreAuthorizeHook(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected backend request: %s", r.URL)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	var repoPaths []string
+	gitOpts := git.Options{
+		PreAuthorizeHook: func(w http.ResponseWriter, r *http.Request, repoPath string) bool {
+			repoPaths = append(repoPaths, repoPath)
+			http.Error(w, "Unavailable For Legal Reasons", http.StatusUnavailableForLegalReasons)
+			return false
+		},
+	}
+
+	cfg := config.Config{Backend: backendURL, GitConfig: config.DefaultGitConfig}
+	ts := httptest.NewServer(newUpstream(cfg, logrus.StandardLogger(), gitOpts, configureRoutes))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/group/project.git/info/refs?service=git-upload-pack")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusUnavailableForLegalReasons, resp.StatusCode)
+	require.Equal(t, []string{"/group/project.git"}, repoPaths)
+}
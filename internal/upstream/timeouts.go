@@ -0,0 +1,151 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// withRequestTimeouts cancels the request context when one of the
+// configured timeouts expires. Handlers that proxy to gitlab-rails or
+// Gitaly stop as soon as their context is canceled.
+func withRequestTimeouts(handler http.Handler, timeouts config.TimeoutConfig) http.Handler {
+	if timeouts.ReadTimeout.Duration <= 0 && timeouts.WriteTimeout.Duration <= 0 && timeouts.IdleTimeout.Duration <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		if d := timeouts.WriteTimeout.Duration; d > 0 {
+			timer := time.AfterFunc(d, cancel)
+			defer timer.Stop()
+		}
+
+		if d := timeouts.ReadTimeout.Duration; d > 0 && hasBody(r) {
+			timer := time.AfterFunc(d, cancel)
+			defer timer.Stop()
+			r.Body = &timedBody{ReadCloser: r.Body, timer: timer}
+			w = &timedResponseWriter{ResponseWriter: w, timer: timer}
+		}
+
+		if d := timeouts.IdleTimeout.Duration; d > 0 {
+			idle := &idleTimer{timeout: d, timer: time.AfterFunc(d, cancel)}
+			defer idle.stop()
+
+			if r.Body != nil {
+				r.Body = &idleBody{ReadCloser: r.Body, idle: idle}
+			}
+			w = &idleResponseWriter{ResponseWriter: w, idle: idle}
+		}
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// hasBody tells if the request has a body for the read timeout to apply
+// to. The server gives bodiless requests, such as GETs, http.NoBody.
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// timedBody stops the read timeout once the whole body has been read, or
+// the handler closed it
+type timedBody struct {
+	io.ReadCloser
+	timer *time.Timer
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.timer.Stop()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// timedResponseWriter stops the read timeout when the handler starts its
+// response: it has read as much of the body as it is going to by then.
+type timedResponseWriter struct {
+	http.ResponseWriter
+	timer *time.Timer
+}
+
+func (w *timedResponseWriter) WriteHeader(status int) {
+	w.timer.Stop()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timedResponseWriter) Write(data []byte) (int, error) {
+	w.timer.Stop()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *timedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// idleTimer fires when the request makes no progress for timeout. Reads and
+// writes may happen in different goroutines, hence the mutex.
+type idleTimer struct {
+	timeout time.Duration
+
+	sync.Mutex
+	timer *time.Timer
+}
+
+func (i *idleTimer) reset() {
+	i.Lock()
+	defer i.Unlock()
+	i.timer.Reset(i.timeout)
+}
+
+func (i *idleTimer) stop() {
+	i.Lock()
+	defer i.Unlock()
+	i.timer.Stop()
+}
+
+type idleBody struct {
+	io.ReadCloser
+	idle *idleTimer
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.idle.reset()
+	}
+	return n, err
+}
+
+type idleResponseWriter struct {
+	http.ResponseWriter
+	idle *idleTimer
+}
+
+func (w *idleResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if n > 0 {
+		w.idle.reset()
+	}
+	return n, err
+}
+
+func (w *idleResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,135 @@
+package upstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestRequestTimeoutsAllowPeriodicWrites(t *testing.T) {
+	timeouts := config.TimeoutConfig{IdleTimeout: config.TomlDuration{Duration: 50 * time.Millisecond}}
+
+	h := withRequestTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Take several idle timeouts in total, but never pause for an entire one
+		for i := 0; i < 10; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			io.WriteString(w, "0005\n")
+			w.(http.Flusher).Flush()
+		}
+	}), timeouts)
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("0005\n", 10), string(body))
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+
+	testCases := []struct {
+		desc     string
+		method   string
+		timeouts config.TimeoutConfig
+		handler  func(w http.ResponseWriter, r *http.Request)
+		canceled bool
+	}{
+		{
+			desc:     "no timeouts",
+			handler:  func(w http.ResponseWriter, r *http.Request) { time.Sleep(2 * timeout) },
+			canceled: false,
+		},
+		{
+			desc:     "idle timeout",
+			timeouts: config.TimeoutConfig{IdleTimeout: config.TomlDuration{Duration: timeout}},
+			handler:  func(w http.ResponseWriter, r *http.Request) { time.Sleep(2 * timeout) },
+			canceled: true,
+		},
+		{
+			desc:     "write timeout",
+			timeouts: config.TimeoutConfig{WriteTimeout: config.TomlDuration{Duration: timeout}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 4; i++ {
+					io.WriteString(w, "still busy")
+					time.Sleep(timeout / 2)
+				}
+			},
+			canceled: true,
+		},
+		{
+			desc:     "read timeout after body was read",
+			timeouts: config.TimeoutConfig{ReadTimeout: config.TomlDuration{Duration: timeout}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				time.Sleep(2 * timeout)
+			},
+			canceled: false,
+		},
+		{
+			desc:     "read timeout before body was read",
+			timeouts: config.TimeoutConfig{ReadTimeout: config.TomlDuration{Duration: timeout}},
+			handler:  func(w http.ResponseWriter, r *http.Request) { time.Sleep(2 * timeout) },
+			canceled: true,
+		},
+		{
+			desc:     "read timeout without body",
+			method:   "GET",
+			timeouts: config.TimeoutConfig{ReadTimeout: config.TomlDuration{Duration: timeout}},
+			handler:  func(w http.ResponseWriter, r *http.Request) { time.Sleep(2 * timeout) },
+			canceled: false,
+		},
+		{
+			desc:     "read timeout after response started",
+			timeouts: config.TimeoutConfig{ReadTimeout: config.TomlDuration{Duration: timeout}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Read(make([]byte, 1))
+				w.WriteHeader(http.StatusOK)
+				time.Sleep(2 * timeout)
+			},
+			canceled: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var ctxErr error
+			h := withRequestTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.handler(w, r)
+				ctxErr = r.Context().Err()
+			}), tc.timeouts)
+
+			var r *http.Request
+			if tc.method == "GET" {
+				r = httptest.NewRequest("GET", "/foo/bar.git/info/refs", nil)
+			} else {
+				r = httptest.NewRequest("POST", "/foo/bar.git/git-upload-pack", strings.NewReader("body"))
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if tc.canceled {
+				require.Error(t, ctxErr)
+			} else {
+				require.NoError(t, ctxErr)
+			}
+		})
+	}
+}
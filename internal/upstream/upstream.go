@@ -16,6 +16,7 @@ import (
 	"gitlab.com/gitlab-org/labkit/correlation"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/rejectmethods"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
@@ -37,16 +38,20 @@ type upstream struct {
 	RoundTripper      http.RoundTripper
 	CableRoundTripper http.RoundTripper
 	accessLogger      *logrus.Logger
+	gitOptions        git.Options
 }
 
-func NewUpstream(cfg config.Config, accessLogger *logrus.Logger) http.Handler {
-	return newUpstream(cfg, accessLogger, configureRoutes)
+// NewUpstream routes requests to their handlers. gitOpts are passed on to
+// the git handlers.
+func NewUpstream(cfg config.Config, accessLogger *logrus.Logger, gitOpts git.Options) http.Handler {
+	return newUpstream(cfg, accessLogger, gitOpts, configureRoutes)
 }
 
-func newUpstream(cfg config.Config, accessLogger *logrus.Logger, routesCallback func(*upstream)) http.Handler {
+func newUpstream(cfg config.Config, accessLogger *logrus.Logger, gitOpts git.Options, routesCallback func(*upstream)) http.Handler {
 	up := upstream{
 		Config:       cfg,
 		accessLogger: accessLogger,
+		gitOptions:   gitOpts,
 	}
 	if up.Backend == nil {
 		up.Backend = DefaultBackend
@@ -82,7 +87,11 @@ func (u *upstream) configureURLPrefix() {
 }
 
 func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	helper.FixRemoteAddr(r)
+	if len(u.TrustedProxies) > 0 {
+		helper.FixRemoteAddrWithTrustedProxies(r, u.TrustedProxies)
+	} else {
+		helper.FixRemoteAddr(r)
+	}
 
 	helper.DisableResponseBuffering(w)
 
@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 )
 
 func TestRouting(t *testing.T) {
@@ -27,7 +28,7 @@ func TestRouting(t *testing.T) {
 		main   = ""
 	)
 
-	u := newUpstream(config.Config{}, logrus.StandardLogger(), func(u *upstream) {
+	u := newUpstream(config.Config{}, logrus.StandardLogger(), git.Options{}, func(u *upstream) {
 		u.Routes = []routeEntry{
 			handle(u, foobar),
 			handle(u, quxbaz),
@@ -50,6 +50,13 @@ func startLogging(file string, format string) (io.Closer, error) {
 	return nil, fmt.Errorf("unknown logFormat: %v", format)
 }
 
+// accessLogDropsFields tells if the access logs of format have no room for
+// the fields that handlers add to access log lines. The combined format of
+// text access logs only has the standard fields.
+func accessLogDropsFields(format string) bool {
+	return format == textLogFormat
+}
+
 // In text format, we use a separate logger for access logs
 func getAccessLogger(file string, format string) (*log.Logger, io.Closer, error) {
 	if format != "text" {
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +11,8 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,6 +21,8 @@ import (
 	"gitlab.com/gitlab-org/labkit/tracing"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
@@ -30,11 +37,14 @@ var BuildTime = "19700101.000000" // Set at build time in the Makefile
 
 type bootConfig struct {
 	secretPath           string
-	listenAddr           string
+	listenAddrs          []string
 	listenNetwork        string
 	listenUmask          int
 	pprofListenAddr      string
 	prometheusListenAddr string
+	tlsCert              string
+	tlsKey               string
+	tlsClientCA          string
 	logFile              string
 	logFormat            string
 	printVersion         bool
@@ -57,11 +67,38 @@ func main() {
 		os.Exit(0)
 	}
 
-	log.WithError(run(*boot, *cfg)).Fatal("shutting down")
+	if err := run(*boot, *cfg); err != nil {
+		log.WithError(err).Fatal("shutting down")
+	}
+
+	log.Info("shutdown complete")
 }
 
 type alreadyPrintedError struct{ error }
 
+// stringsFlag is a flag that may be given several times. The first time
+// replaces the default values.
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *stringsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, value)
+	return nil
+}
+
 // buildConfig may print messages to os.Stderr if err != nil. If err is
 // of type alreadyPrintedError it has already been printed.
 func buildConfig(arg0 string, args []string) (*bootConfig, *config.Config, error) {
@@ -77,11 +114,15 @@ func buildConfig(arg0 string, args []string) (*bootConfig, *config.Config, error
 	configFile := fset.String("config", "", "TOML file to load config from")
 
 	fset.StringVar(&boot.secretPath, "secretPath", "./.gitlab_workhorse_secret", "File with secret key to authenticate with authBackend")
-	fset.StringVar(&boot.listenAddr, "listenAddr", "localhost:8181", "Listen address for HTTP server")
+	boot.listenAddrs = []string{"localhost:8181"}
+	fset.Var(&stringsFlag{values: &boot.listenAddrs}, "listenAddr", "Listen `address` for HTTP server. Repeat to listen on several addresses. Prefix an address with 'network://', e.g. 'unix:///tmp/workhorse.socket', to override -listenNetwork for it.")
 	fset.StringVar(&boot.listenNetwork, "listenNetwork", "tcp", "Listen 'network' (tcp, tcp4, tcp6, unix)")
 	fset.IntVar(&boot.listenUmask, "listenUmask", 0, "Umask for Unix socket")
 	fset.StringVar(&boot.pprofListenAddr, "pprofListenAddr", "", "pprof listening address, e.g. 'localhost:6060'")
 	fset.StringVar(&boot.prometheusListenAddr, "prometheusListenAddr", "", "Prometheus listening address, e.g. 'localhost:9229'")
+	fset.StringVar(&boot.tlsCert, "tlsCert", "", "Optional: PEM file with the TLS certificate to serve HTTPS with, instead of HTTP")
+	fset.StringVar(&boot.tlsKey, "tlsKey", "", "PEM file with the private key of -tlsCert")
+	fset.StringVar(&boot.tlsClientCA, "tlsClientCA", "", "Optional: PEM file with the CA certificates that HTTPS clients must present a certificate of")
 
 	fset.StringVar(&boot.logFile, "logFile", "", "Log file location")
 	fset.StringVar(&boot.logFormat, "logFormat", "text", "Log format to use defaults to text (text, json, structured, none)")
@@ -144,6 +185,12 @@ func buildConfig(arg0 string, args []string) (*bootConfig, *config.Config, error
 	cfg.ObjectStorageCredentials = cfgFromFile.ObjectStorageCredentials
 	cfg.ImageResizerConfig = cfgFromFile.ImageResizerConfig
 	cfg.AltDocumentRoot = cfgFromFile.AltDocumentRoot
+	cfg.GitConfig = cfgFromFile.GitConfig
+	cfg.Timeouts = cfgFromFile.Timeouts
+	cfg.KeepAliveTimeout = cfgFromFile.KeepAliveTimeout
+	cfg.TrustedCIDRsForXFF = cfgFromFile.TrustedCIDRsForXFF
+	cfg.TrustedProxies = cfgFromFile.TrustedProxies
+	cfg.ShutdownTimeout = cfgFromFile.ShutdownTimeout
 
 	return boot, cfg, nil
 }
@@ -159,19 +206,24 @@ func run(boot bootConfig, cfg config.Config) error {
 	tracing.Initialize(tracing.WithServiceName("gitlab-workhorse"))
 	log.WithField("version", Version).WithField("build_time", BuildTime).Print("Starting")
 
-	// Good housekeeping for Unix sockets: unlink before binding
-	if boot.listenNetwork == "unix" {
-		if err := os.Remove(boot.listenAddr); err != nil && !os.IsNotExist(err) {
-			return err
-		}
+	faultRate, err := gitaly.ConfigureFaultInjection()
+	if err != nil {
+		return fmt.Errorf("gitaly fault injection: %v", err)
+	}
+	if faultRate > 0 {
+		log.WithField("rate", faultRate).Warn("UNSAFE: Gitaly fault injection is enabled, DO NOT use this in production")
+	}
+
+	gitaly.ConfigureRequestBuffers(cfg.GitConfig.RequestBufferSize)
+
+	tlsConfig, err := buildTLSConfig(boot.tlsCert, boot.tlsKey, boot.tlsClientCA)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
 	}
 
-	// Change the umask only around net.Listen()
-	oldUmask := syscall.Umask(boot.listenUmask)
-	listener, err := net.Listen(boot.listenNetwork, boot.listenAddr)
-	syscall.Umask(oldUmask)
+	listeners, err := listen(boot)
 	if err != nil {
-		return fmt.Errorf("main listener: %v", err)
+		return err
 	}
 
 	finalErrors := make(chan error)
@@ -222,10 +274,129 @@ func run(boot bootConfig, cfg config.Config) error {
 		return fmt.Errorf("configure access logger: %v", err)
 	}
 	defer accessCloser.Close()
+	cfg.LogAccessLogFields = accessLogDropsFields(boot.logFormat)
+
+	up := wrapRaven(upstream.NewUpstream(cfg, accessLogger, git.Options{ErrorReporter: gitErrorReporter()}))
 
-	up := wrapRaven(upstream.NewUpstream(cfg, accessLogger))
+	conns := newActiveConns()
+	srv := &http.Server{
+		Handler:     up,
+		IdleTimeout: cfg.KeepAliveTimeout.Duration,
+		ConnState:   conns.track,
+	}
+	if tlsConfig != nil {
+		srv.TLSConfig = tlsConfig
+		// Do not upgrade to HTTP/2: websockets, e.g. of web terminals,
+		// hijack HTTP/1.1 connections
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	// Shutdown closes all listeners that the server serves
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if tlsConfig != nil {
+				// The certificate is in srv.TLSConfig already
+				finalErrors <- srv.ServeTLS(l, "", "")
+			} else {
+				finalErrors <- srv.Serve(l)
+			}
+		}(l)
+	}
 
-	go func() { finalErrors <- http.Serve(listener, up) }()
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-finalErrors:
+		return err
+	case sig := <-done:
+		log.WithFields(log.Fields{"shutdown_timeout_s": cfg.ShutdownTimeout.Duration.Seconds(), "signal": sig.String()}).Info("shutdown initiated")
+
+		return shutdown(srv, conns, cfg.ShutdownTimeout.Duration)
+	}
+}
+
+// listen opens the main listeners, one for each of boot.listenAddrs
+func listen(boot bootConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range boot.listenAddrs {
+		network, address := parseListenAddr(addr, boot.listenNetwork)
+
+		// Good housekeeping for Unix sockets: unlink before binding
+		if network == "unix" {
+			if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+				closeListeners(listeners)
+				return nil, err
+			}
+		}
+
+		// Change the umask only around net.Listen()
+		oldUmask := syscall.Umask(boot.listenUmask)
+		l, err := net.Listen(network, address)
+		syscall.Umask(oldUmask)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("main listener %s: %v", addr, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// parseListenAddr splits a -listenAddr value of the form network://address
+// into its parts. Addresses without a network use defaultNetwork.
+func parseListenAddr(addr string, defaultNetwork string) (network string, address string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+len("://"):]
+	}
+
+	return defaultNetwork, addr
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// buildTLSConfig returns the TLS configuration of the main listeners, or
+// nil if certFile is empty and we serve plain HTTP. If clientCAFile is set,
+// clients must present a certificate signed by one of its CAs.
+func buildTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		if keyFile != "" || clientCAFile != "" {
+			return nil, errors.New("-tlsKey and -tlsClientCA need -tlsCert")
+		}
+		return nil, nil
+	}
+	if keyFile == "" {
+		return nil, errors.New("-tlsCert needs -tlsKey")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
-	return <-finalErrors
+	return tlsConfig, nil
 }
@@ -3,21 +3,35 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -28,6 +42,7 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
@@ -62,36 +77,39 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func TestDeniedClone(t *testing.T) {
-	// Prepare clone directory
-	require.NoError(t, os.RemoveAll(scratchDir))
-
-	// Prepare test server and backend
-	ts := testAuthServer(t, nil, nil, 403, "Access denied")
-	defer ts.Close()
-	ws := startWorkhorseServer(ts.URL)
-	defer ws.Close()
-
-	// Do the git clone
-	cloneCmd := exec.Command("git", "clone", fmt.Sprintf("%s/%s", ws.URL, testRepo), checkoutDir)
-	out, err := cloneCmd.CombinedOutput()
-	t.Log(string(out))
-	require.Error(t, err, "git clone should have failed")
-}
+func TestDumbHTTPIsRejected(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		reject   bool
+		resource string
+		code     int
+	}{
+		{desc: "info/refs", reject: true, resource: "info/refs", code: http.StatusForbidden},
+		{desc: "HEAD", reject: true, resource: "HEAD", code: http.StatusForbidden},
+		{desc: "loose object", reject: true, resource: "objects/12/34567890abcdef", code: http.StatusForbidden},
+		{desc: "smart info/refs", reject: true, resource: "info/refs?service=git-upload-pack", code: http.StatusTeapot},
+		{desc: "guard disabled", reject: false, resource: "info/refs", code: http.StatusTeapot},
+	}
 
-func TestDeniedPush(t *testing.T) {
-	// Prepare the test server and backend
-	ts := testAuthServer(t, nil, nil, 403, "Access denied")
-	defer ts.Close()
-	ws := startWorkhorseServer(ts.URL)
-	defer ws.Close()
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})
+			defer ts.Close()
+
+			cfg := newUpstreamConfig(ts.URL)
+			cfg.GitConfig.RejectDumbHTTP = tc.reject
+			ws := startWorkhorseServerWithConfig(cfg)
+			defer ws.Close()
 
-	// Perform the git push
-	pushCmd := exec.Command("git", "push", "-v", fmt.Sprintf("%s/%s", ws.URL, testRepo), fmt.Sprintf("master:%s", newBranch()))
-	pushCmd.Dir = checkoutDir
-	out, err := pushCmd.CombinedOutput()
-	t.Log(string(out))
-	require.Error(t, err, "git push should have failed")
+			resp, body := httpGet(t, fmt.Sprintf("%s/%s/%s", ws.URL, testRepo, tc.resource), nil)
+			require.Equal(t, tc.code, resp.StatusCode)
+			if tc.code == http.StatusForbidden {
+				require.Contains(t, body, "'dumb' Git HTTP protocol is not supported")
+			}
+		})
+	}
 }
 
 func TestRegularProjectsAPI(t *testing.T) {
@@ -459,6 +477,101 @@ func TestImageResizing(t *testing.T) {
 	require.Equal(t, requestedWidth, bounds.Size().X, "wrong width after resizing")
 }
 
+func TestImageResizerCommandLine(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		args          []string
+		env           []string
+		expectedWidth int
+	}{
+		{desc: "environment only", env: []string{"GL_RESIZE_IMAGE_WIDTH=40"}, expectedWidth: 40},
+		{desc: "flags only", args: []string{"-width=32", "-quality=80"}, expectedWidth: 32},
+		{desc: "flags override environment", args: []string{"-width=24"}, env: []string{"GL_RESIZE_IMAGE_WIDTH=40"}, expectedWidth: 24},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			image, err := os.Open("testdata/image.png")
+			require.NoError(t, err)
+			defer image.Close()
+
+			cmd := exec.Command("gitlab-resize-image", tc.args...)
+			cmd.Env = append(os.Environ(), tc.env...)
+			cmd.Stdin = image
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+
+			out, err := cmd.Output()
+			require.NoError(t, err, "stderr: %s", stderr.String())
+
+			img, err := png.Decode(bytes.NewReader(out))
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedWidth, img.Bounds().Dx())
+		})
+	}
+}
+
+func TestImageResizerFileArguments(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "resized.jpg")
+
+	cmd := exec.Command("gitlab-resize-image", "-in=testdata/image.png", "-out="+out, "-width=30", "-format=jpg")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	require.NoError(t, err, "stderr: %s", stderr.String())
+	require.Empty(t, stdout)
+
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	require.NoError(t, err)
+	require.Equal(t, 30, cfg.Width)
+}
+
+func TestImageResizerExitCodes(t *testing.T) {
+	original, err := ioutil.ReadFile("testdata/image.png")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc         string
+		input        []byte
+		env          []string
+		expectedCode int
+	}{
+		{desc: "success", input: original},
+		{desc: "invalid options", input: original, env: []string{"GL_RESIZE_IMAGE_WIDTH=wide"}, expectedCode: 1},
+		{desc: "unsupported format", input: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), expectedCode: 3},
+		{desc: "broken image", input: original[:len(original)/2], expectedCode: 4},
+		{desc: "too large", input: original, env: []string{"GL_RESIZE_IMAGE_MAX_PIXELS=100"}, expectedCode: 5},
+		{desc: "timeout", input: original, env: []string{"GL_RESIZE_IMAGE_TIMEOUT=1ns"}, expectedCode: 6},
+		{desc: "not an image", input: []byte("<html><body>Not found</body></html>"), expectedCode: 7},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cmd := exec.Command("gitlab-resize-image")
+			cmd.Env = append(os.Environ(), append([]string{"GL_RESIZE_IMAGE_WIDTH=40"}, tc.env...)...)
+			cmd.Stdin = bytes.NewReader(tc.input)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+
+			err := cmd.Run()
+			if tc.expectedCode == 0 {
+				require.NoError(t, err, "stderr: %s", stderr.String())
+				return
+			}
+
+			var exitErr *exec.ExitError
+			require.True(t, errors.As(err, &exitErr), "unexpected error: %v", err)
+			require.Equal(t, tc.expectedCode, exitErr.ExitCode(), "stderr: %s", stderr.String())
+		})
+	}
+}
+
 func TestSendURLForArtifacts(t *testing.T) {
 	expectedBody := strings.Repeat("CONTENT!", 1024)
 
@@ -754,6 +867,7 @@ func newUpstreamConfig(authBackend string) *config.Config {
 		DocumentRoot:       testDocumentRoot,
 		Backend:            helper.URLMustParse(authBackend),
 		ImageResizerConfig: config.DefaultImageResizerConfig,
+		GitConfig:          config.DefaultGitConfig,
 	}
 }
 
@@ -763,7 +877,7 @@ func startWorkhorseServer(authBackend string) *httptest.Server {
 
 func startWorkhorseServerWithConfig(cfg *config.Config) *httptest.Server {
 	testhelper.ConfigureSecret()
-	u := upstream.NewUpstream(*cfg, logrus.StandardLogger())
+	u := upstream.NewUpstream(*cfg, logrus.StandardLogger(), git.Options{})
 
 	return httptest.NewServer(u)
 }
@@ -885,3 +999,309 @@ func TestHealthChecksUnreachable(t *testing.T) {
 		})
 	}
 }
+
+func TestWorkhorseLiveness(t *testing.T) {
+	ws := startWorkhorseServer("http://127.0.0.1:99999") // Liveness must not depend on the backend
+	defer ws.Close()
+
+	resp, body := httpGet(t, ws.URL+"/-/workhorse/liveness", nil)
+	require.Equal(t, 200, resp.StatusCode, "status code")
+	require.Equal(t, "OK\n", body, "response body")
+}
+
+func TestWorkhorseReadiness(t *testing.T) {
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/-/liveness", r.URL.Path)
+		w.WriteHeader(200)
+	})
+	defer ts.Close()
+
+	testCases := []struct {
+		desc    string
+		backend string
+		code    int
+	}{
+		{desc: "backend up", backend: ts.URL, code: 200},
+		{desc: "backend down", backend: "http://127.0.0.1:99999", code: 503},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ws := startWorkhorseServer(tc.backend)
+			defer ws.Close()
+
+			resp, _ := httpGet(t, ws.URL+"/-/workhorse/readiness", nil)
+			require.Equal(t, tc.code, resp.StatusCode, "status code")
+		})
+	}
+}
+
+func TestGracefulShutdownDrainsRequests(t *testing.T) {
+	requestReceived := make(chan struct{})
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		close(requestReceived)
+		time.Sleep(500 * time.Millisecond) // Still busy when the SIGTERM arrives
+		io.WriteString(w, "finished")
+	})
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "workhorse-shutdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	configFile := path.Join(tmp, "config.toml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`shutdown_timeout = "10s"`), 0644))
+
+	listenAddr := freeListenAddr(t)
+	cmd := exec.Command("gitlab-workhorse",
+		"-listenAddr", listenAddr,
+		"-authBackend", ts.URL,
+		"-secretPath", path.Join(testhelper.RootDir(), "testdata/test-secret"),
+		"-config", configFile,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	waitForListener(t, listenAddr)
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listenAddr + "/api/v4/projects/123")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		results <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+
+	<-requestReceived
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+
+	res := <-results
+	require.NoError(t, res.err)
+	require.Equal(t, 200, res.code)
+	require.Equal(t, "finished", res.body)
+
+	require.NoError(t, cmd.Wait(), "workhorse should exit cleanly")
+
+	_, err = http.Get("http://" + listenAddr + "/api/v4/projects/123")
+	require.Error(t, err, "workhorse should not accept new connections")
+}
+
+func TestGracefulShutdownTimeoutIsNoError(t *testing.T) {
+	requestReceived := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		close(requestReceived)
+		<-release // Still busy when the shutdown timeout expires
+	})
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "workhorse-shutdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	configFile := path.Join(tmp, "config.toml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`shutdown_timeout = "0s"`), 0644))
+
+	listenAddr := freeListenAddr(t)
+	cmd := exec.Command("gitlab-workhorse",
+		"-listenAddr", listenAddr,
+		"-authBackend", ts.URL,
+		"-secretPath", path.Join(testhelper.RootDir(), "testdata/test-secret"),
+		"-config", configFile,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	waitForListener(t, listenAddr)
+
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + listenAddr + "/api/v4/projects/123")
+		if err == nil {
+			resp.Body.Close()
+		}
+		errs <- err
+	}()
+
+	<-requestReceived
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+
+	require.Error(t, <-errs, "the request should be interrupted")
+	require.NoError(t, cmd.Wait(), "workhorse should exit cleanly")
+}
+
+func TestListenOnSeveralAddresses(t *testing.T) {
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "workhorse-listen")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	tcpAddr := freeListenAddr(t)
+	socket := path.Join(tmp, "workhorse.socket")
+	cmd := exec.Command("gitlab-workhorse",
+		"-listenAddr", tcpAddr,
+		"-listenAddr", "unix://"+socket,
+		"-authBackend", ts.URL,
+		"-secretPath", path.Join(testhelper.RootDir(), "testdata/test-secret"),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	waitForListener(t, tcpAddr)
+
+	tcpClient := &http.Client{}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	for desc, client := range map[string]*http.Client{"tcp": tcpClient, "unix": unixClient} {
+		resp, err := client.Get("http://" + tcpAddr + "/api/v4/projects/123")
+		require.NoError(t, err, desc)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err, desc)
+		require.Equal(t, 200, resp.StatusCode, desc)
+		require.Equal(t, "hello", string(body), desc)
+	}
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "workhorse should exit cleanly")
+
+	_, err = net.Dial("tcp", tcpAddr)
+	require.Error(t, err, "TCP listener should be closed")
+	_, err = net.Dial("unix", socket)
+	require.Error(t, err, "Unix socket listener should be closed")
+}
+
+func TestTLSListener(t *testing.T) {
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "workhorse-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	serverCert, serverKey := writeTestCertificate(t, tmp, "server")
+	clientCert, clientKey := writeTestCertificate(t, tmp, "client")
+
+	listenAddr := freeListenAddr(t)
+	cmd := exec.Command("gitlab-workhorse",
+		"-listenAddr", listenAddr,
+		"-authBackend", ts.URL,
+		"-secretPath", path.Join(testhelper.RootDir(), "testdata/test-secret"),
+		"-tlsCert", serverCert,
+		"-tlsKey", serverKey,
+		"-tlsClientCA", clientCert,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	waitForListener(t, listenAddr)
+
+	rootCAs := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile(serverCert)
+	require.NoError(t, err)
+	require.True(t, rootCAs.AppendCertsFromPEM(caPEM))
+	keyPair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+
+	httpsClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs, Certificates: certs},
+		}}
+	}
+	projectURL := "https://" + listenAddr + "/api/v4/projects/123"
+
+	resp, err := httpsClient(keyPair).Get(projectURL)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "HTTP/1.1", resp.Proto)
+	require.Equal(t, "hello", string(body))
+
+	_, err = httpsClient().Get(projectURL)
+	require.Error(t, err, "clients without a certificate should be rejected")
+
+	resp, err = http.Get("http://" + listenAddr + "/api/v4/projects/123")
+	if err == nil {
+		resp.Body.Close()
+		require.Equal(t, 400, resp.StatusCode, "plain HTTP should be rejected")
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// localhost, and its key, to dir. The certificate is its own CA.
+func writeTestCertificate(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = path.Join(dir, name+".crt")
+	keyFile = path.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func freeListenAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitForListener(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
@@ -6,13 +6,25 @@ import (
 
 	raven "github.com/getsentry/raven-go"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
+// Use a custom environment variable (not SENTRY_DSN) to prevent clashes
+// with gitlab-rails.
+const sentryDSNEnv = "GITLAB_WORKHORSE_SENTRY_DSN"
+
+// gitErrorReporter sends the errors of git handlers to Sentry, if
+// wrapRaven configures it
+func gitErrorReporter() git.ErrorReporter {
+	if os.Getenv(sentryDSNEnv) == "" {
+		return nil
+	}
+	return git.ErrorReporterFunc(helper.CaptureRavenError)
+}
+
 func wrapRaven(h http.Handler) http.Handler {
-	// Use a custom environment variable (not SENTRY_DSN) to prevent
-	// clashes with gitlab-rails.
-	sentryDSN := os.Getenv("GITLAB_WORKHORSE_SENTRY_DSN")
+	sentryDSN := os.Getenv(sentryDSNEnv)
 	sentryEnvironment := os.Getenv("GITLAB_WORKHORSE_SENTRY_ENVIRONMENT")
 	raven.SetDSN(sentryDSN) // sentryDSN may be empty
 
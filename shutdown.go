@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// activeConns tracks the connections of an http.Server that are serving a
+// request. These are the ones that Shutdown waits for.
+type activeConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newActiveConns() *activeConns {
+	return &activeConns{conns: make(map[net.Conn]struct{})}
+}
+
+// track is an http.Server ConnState hook
+func (a *activeConns) track(c net.Conn, state http.ConnState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if state == http.StateActive {
+		a.conns[c] = struct{}{}
+	} else {
+		delete(a.conns, c)
+	}
+}
+
+func (a *activeConns) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.conns)
+}
+
+// shutdown stops srv from accepting new connections and lets in-flight
+// requests, such as long clones, finish within timeout. Requests that are
+// still running then are interrupted. That is what the timeout is for, so
+// it is no error.
+func shutdown(srv *http.Server, conns *activeConns, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		return err
+	}
+
+	log.WithField("interrupted_requests", conns.count()).Warn("shutdown timeout expired, interrupting in-flight requests")
+	return srv.Close()
+}